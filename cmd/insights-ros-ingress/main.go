@@ -11,12 +11,14 @@ import (
 
 	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/features"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/outbox"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/retry"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/upload"
-	"github.com/go-chi/chi/v5"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,18 +32,41 @@ func main() {
 		log.WithError(err).Fatal("Failed to load configuration")
 	}
 
+	// Resolve the feature flags set for this environment
+	flags, err := features.New(features.Defaults, os.Environ(), log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load feature flags")
+	}
+
 	log.WithFields(logrus.Fields{
 		"service": "insights-ros-ingress",
 		"version": "1.0.0",
 		"port":    cfg.Server.Port,
 	}).Info("Starting Insights ROS Ingress service")
 
+	// Fail fast on a temp dir that would only break the first upload
+	if err := upload.CheckTempDir(cfg.Upload.TempDir); err != nil {
+		log.WithError(err).Fatal("Upload temp dir is not usable")
+	}
+
+	// Register Prometheus metrics
+	health.ConfigureMetricsNamespace(cfg.Metrics.Namespace, cfg.Metrics.Subsystem)
+	health.ConfigureUploadSizeBuckets(cfg.Upload.SizeBuckets)
+	health.InitMetrics()
+	health.PresignedURLExpirationSeconds.Set(float64(cfg.Storage.URLExpiration))
+
 	// Initialize storage client
 	storageClient, err := storage.NewMinIOClient(cfg.Storage)
 	if err != nil {
 		log.WithError(err).Fatal("Failed to initialize storage client")
 	}
 
+	// Budget storage retries so a storage outage can't turn into a retry storm
+	retryBudget := retry.NewBudget(cfg.Storage.RetryBudgetRate, cfg.Storage.RetryBudgetBurst)
+	if err := storageClient.SetRetryBudget(retryBudget); err != nil {
+		log.WithError(err).Fatal("Failed to apply retry budget to storage client")
+	}
+
 	// Initialize messaging client
 	messagingClient, err := messaging.NewKafkaProducer(cfg.Kafka)
 	if err != nil {
@@ -55,25 +80,87 @@ func main() {
 
 	// Initialize health checker
 	healthChecker := health.NewChecker(storageClient, messagingClient)
+	healthChecker.SetCacheTTL(time.Duration(cfg.Server.HealthCacheTTL) * time.Second)
+	healthChecker.SetTempDirCheck(func() error {
+		return upload.CheckTempDir(cfg.Upload.TempDir)
+	})
 
 	// Initialize upload handler
 	uploadHandler := upload.NewHandler(cfg, storageClient, messagingClient, log)
+	uploadHandler.SetFeatureFlags(flags)
+	healthChecker.SetOrgMetricsAuthorizer(uploadHandler.IsInternalRequest)
+
+	// Keep upload events durably and publish those left behind by a crash or a Kafka outage
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if cfg.Outbox.Dir != "" {
+		store, err := outbox.NewFileStore(cfg.Outbox.Dir)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to initialize outbox")
+		}
+		defer store.Close()
+		uploadHandler.SetOutbox(store)
+		// Entries outliving their presigned URLs would announce files consumers can't download
+		relay := outbox.NewRelay(store, messagingClient,
+			time.Duration(cfg.Outbox.RelayInterval)*time.Second,
+			time.Duration(cfg.Outbox.RelayDelay)*time.Second,
+			time.Duration(cfg.Storage.URLExpiration)*time.Second, log)
+		relay.SetIdentityEncoder(uploadHandler.RelayedEventIdentity)
+		go relay.Run(relayCtx)
+	}
 
-	// Setup HTTP routes
-	router := chi.NewRouter()
+	// Report temp files left behind by uploads to catch leaks
+	if cfg.Server.Debug {
+		health.RegisterDebugMetrics(uploadHandler.ExtractionDirs)
+	}
 
-	// For now we focus only on authentication, we will add authorization later
-	authMiddleware := auth.KubernetesAuthMiddleware(log)
-	// API routes
-	router.Route("/api/ingress/v1", func(r chi.Router) {
-		r.Use(authMiddleware)
-		r.Post("/upload", uploadHandler.HandleUpload)
-	})
+	// Reload live settings from the projected config directory
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	if cfg.Reload.Dir != "" {
+		reloader := config.NewReloader(cfg.Reload.Dir, time.Duration(cfg.Reload.Interval)*time.Second, log)
+		reloader.OnChange(config.SettingLogLevel, func(value string) error {
+			// An unset level falls back to the logger's default
+			level := logrus.InfoLevel
+			if value != "" {
+				var err error
+				if level, err = logrus.ParseLevel(value); err != nil {
+					return err
+				}
+			}
+			log.SetLevel(level)
+			return nil
+		})
+		reloader.OnChange(config.SettingAllowedOrgs, config.AllowedOrgsApplier(cfg.Auth.AllowedOrgs, uploadHandler.SetAllowedOrgs))
+		reloader.OnChange(config.SettingMaxConcurrentExtractions, config.LimitApplier(cfg.Upload.MaxConcurrentExtractions, uploadHandler.SetMaxConcurrentExtractions))
+		reloader.OnChange(config.SettingMaxConcurrentPresigns, config.LimitApplier(cfg.Storage.MaxConcurrentPresigns, storageClient.SetMaxConcurrentPresigns))
+		for _, flag := range flags.Known() {
+			reloader.OnChange(features.EnvPrefix+string(flag), func(value string) error {
+				return flags.Set(flag, value)
+			})
+		}
+		go reloader.Run(reloadCtx)
+	}
 
-	// Health and observability routes
-	router.Get("/health", healthChecker.Health)
-	router.Get("/ready", healthChecker.Ready)
-	router.With(authMiddleware).Get("/metrics", healthChecker.Metrics)
+	// For now we focus only on authentication, we will add authorization later
+	var authMiddleware func(http.Handler) http.Handler
+	switch cfg.Auth.Mode {
+	case config.AuthModeJWKS:
+		authMiddleware = auth.JWKSAuthMiddleware(cfg.Auth.JWKSURL, auth.JWKSOptions{
+			Issuer:          cfg.Auth.JWTIssuer,
+			Audience:        cfg.Auth.JWTAudience,
+			RefreshInterval: time.Duration(cfg.Auth.JWKSRefreshInterval) * time.Second,
+		}, log)
+	case config.AuthModeNoop:
+		authMiddleware = auth.NoopAuthMiddleware(log)
+	default:
+		authMiddleware = auth.KubernetesAuthMiddleware(log)
+	}
+	if cfg.Auth.TrustRHIdentity {
+		authMiddleware = auth.RHIdentityMiddleware(authMiddleware, log)
+	}
+	// Setup HTTP routes
+	router := newRouter(cfg, uploadHandler, healthChecker, flags, authMiddleware)
 
 	// Create HTTP server
 	server := &http.Server{
@@ -97,13 +184,21 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Info("Shutting down server...")
-
-	// Graceful shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	prestopDelay := time.Duration(cfg.Server.PrestopDelay) * time.Second
+	log.WithField("prestop_delay", prestopDelay).Info("Shutting down server...")
 
-	if err := server.Shutdown(ctx); err != nil {
+	// Fail readiness first and give the load balancer time to deregister the pod,
+	// then shut down gracefully with timeout
+	err = healthChecker.Drain(prestopDelay, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+		// Let uploads acknowledged in async mode finish publishing before the producer closes
+		return uploadHandler.WaitForBackground(ctx)
+	})
+	if err != nil {
 		log.WithError(err).Error("Server forced to shutdown")
 	}
 
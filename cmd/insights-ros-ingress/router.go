@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/features"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/middleware"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/upload"
+	"github.com/go-chi/chi/v5"
+)
+
+// newRouter sets up the HTTP routes, authenticating API and observability requests with authMiddleware
+func newRouter(cfg *config.Config, uploadHandler *upload.Handler, healthChecker *health.Checker, flags *features.Flags, authMiddleware func(http.Handler) http.Handler) http.Handler {
+	router := chi.NewRouter()
+
+	// API routes
+	router.Route("/api/ingress/v1", func(r chi.Router) {
+		r.Use(middleware.Compress(cfg.Server.CompressionLevel))
+		// CORS runs before authentication so browser preflight requests, which carry no token, succeed
+		r.Use(middleware.CORS(middleware.CORSOptions{
+			AllowedOrigins:   cfg.CORS.AllowedOrigins,
+			AllowedMethods:   append([]string{http.MethodGet}, cfg.Upload.AllowedMethods...),
+			AllowedHeaders:   cfg.CORS.AllowedHeaders,
+			AllowCredentials: cfg.CORS.AllowCredentials,
+		}))
+		// Uploads with a wrong method or encoding are refused before authentication, so clients
+		// get 405 or 415 rather than 401
+		r.With(
+			middleware.Timeouts(
+				time.Duration(cfg.Server.UploadReadTimeout)*time.Second,
+				time.Duration(cfg.Server.UploadWriteTimeout)*time.Second,
+			),
+			middleware.AllowMethods(cfg.Upload.AllowedMethods...),
+			middleware.AllowEncodings(cfg.Upload.AllowedEncodings...),
+			authMiddleware,
+		).HandleFunc("/upload", uploadHandler.HandleUpload)
+		r.Group(func(r chi.Router) {
+			r.Use(authMiddleware)
+			r.Post("/preflight", uploadHandler.HandlePreflight)
+			r.Get("/status/{requestID}", uploadHandler.HandleStatus)
+			if cfg.Upload.ReprocessEnabled {
+				r.Post("/internal/reprocess", uploadHandler.HandleReprocess)
+			}
+		})
+	})
+
+	// Health and observability routes
+	router.Get("/health", healthChecker.Health)
+	router.Get("/ready", healthChecker.Ready)
+	router.With(authMiddleware).Get("/metrics", healthChecker.Metrics)
+	router.With(authMiddleware).Get("/debug/flags", flags.Handler(uploadHandler.IsInternalRequest))
+
+	return router
+}
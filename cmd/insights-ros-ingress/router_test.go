@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/features"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	messagingmocks "github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	storagemocks "github.com/RedHatInsights/insights-ros-ingress/internal/storage/mocks"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/upload"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Router", func() {
+	var (
+		router        http.Handler
+		authenticated int
+	)
+
+	BeforeEach(func() {
+		log := logrus.New()
+		log.SetLevel(logrus.FatalLevel)
+		cfg := &config.Config{
+			Upload: config.UploadConfig{
+				TempDir:          GinkgoT().TempDir(),
+				AllowedMethods:   []string{http.MethodPost},
+				AllowedEncodings: []string{"identity", "gzip"},
+			},
+		}
+		storageClient := storagemocks.NewFakeClient()
+		producer := messagingmocks.NewFakeProducer()
+		flags, err := features.New(features.Defaults, nil, log)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Every request reaching authentication is refused, like one without a token
+		authenticated = 0
+		rejectAll := func(http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authenticated++
+				http.Error(w, "Unauthorized: Missing authorization header", http.StatusUnauthorized)
+			})
+		}
+
+		router = newRouter(cfg, upload.NewHandler(cfg, storageClient, producer, log),
+			health.NewChecker(storageClient, producer), flags, rejectAll)
+	})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should refuse an unauthenticated upload with a disallowed method with 405 before authenticating", func() {
+		recorder := serve(httptest.NewRequest(http.MethodGet, "/api/ingress/v1/upload", nil))
+
+		Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(recorder.Header().Get("Allow")).To(Equal("POST, OPTIONS"))
+		Expect(authenticated).To(BeZero())
+	})
+
+	It("should refuse an unauthenticated upload with a disallowed encoding with 415 before authenticating", func() {
+		req := httptest.NewRequest(http.MethodPost, "/api/ingress/v1/upload", strings.NewReader("payload"))
+		req.Header.Set("Content-Encoding", "br")
+
+		recorder := serve(req)
+
+		Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+		Expect(authenticated).To(BeZero())
+	})
+
+	It("should authenticate uploads with an allowed method", func() {
+		recorder := serve(httptest.NewRequest(http.MethodPost, "/api/ingress/v1/upload", strings.NewReader("payload")))
+
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(authenticated).To(Equal(1))
+	})
+
+	It("should authenticate the other API routes", func() {
+		Expect(serve(httptest.NewRequest(http.MethodPost, "/api/ingress/v1/preflight", nil)).Code).To(Equal(http.StatusUnauthorized))
+		Expect(serve(httptest.NewRequest(http.MethodGet, "/api/ingress/v1/status/abc", nil)).Code).To(Equal(http.StatusUnauthorized))
+		Expect(authenticated).To(Equal(2))
+	})
+})
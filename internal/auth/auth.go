@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -22,7 +23,30 @@ type ContextKey string
 const (
 	AuthenticatedUserKey ContextKey = "authenticated_user"
 	OauthTokenKey        ContextKey = "oauth_token"
+	IdentitySourceKey    ContextKey = "identity_source"
 	bearerPrefix                    = "Bearer "
+
+	// RHIdentityHeader carries the base64 encoded identity set by Red Hat platform proxies
+	RHIdentityHeader = "x-rh-identity"
+)
+
+// Identity sources, recording how the request's user was authenticated
+const (
+	SourceTokenReview = "token-review"
+	SourceJWT         = "jwt"
+	SourceRHIdentity  = "rh-identity"
+	SourceNoop        = "noop"
+	SourceUnknown     = "unknown"
+)
+
+// Authentication outcomes recorded in the auth_requests_total metric
+const (
+	OutcomeSuccess       = "success"
+	OutcomeMissingHeader = "missing_header"
+	OutcomeInvalidFormat = "invalid_format"
+	OutcomeEmptyToken    = "empty_token"
+	OutcomeInvalidToken  = "invalid_token"
+	OutcomeAPIError      = "api_error"
 )
 
 // KubernetesAuthMiddleware creates middleware that validates tokens using Kubernetes TokenReviewer API
@@ -68,27 +92,8 @@ func GetKubernetesConfig(log *logrus.Logger) (*rest.Config, error) {
 var AuthMiddleware = func(authClient authenticationv1client.AuthenticationV1Interface, log *logrus.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				log.Debug("Missing Authorization header")
-				http.Error(w, "Unauthorized: Missing Authorization header", http.StatusUnauthorized)
-				return
-			}
-
-			// Check Bearer token format
-
-			if !strings.HasPrefix(authHeader, bearerPrefix) {
-				log.Debug("Invalid Authorization header format - must be 'Bearer <token>'")
-				http.Error(w, "Unauthorized: Invalid Authorization header format", http.StatusUnauthorized)
-				return
-			}
-
-			// Extract token
-			token := strings.TrimPrefix(authHeader, bearerPrefix)
-			if token == "" {
-				log.Debug("Empty token in Authorization header")
-				http.Error(w, "Unauthorized: Empty token", http.StatusUnauthorized)
+			token, ok := bearerToken(w, r, log)
+			if !ok {
 				return
 			}
 
@@ -106,6 +111,7 @@ var AuthMiddleware = func(authClient authenticationv1client.AuthenticationV1Inte
 			result, err := authClient.TokenReviews().Create(ctx, tokenReview, metav1.CreateOptions{})
 			if err != nil {
 				log.WithError(err).Error("TokenReview API call failed")
+				health.AuthRequestsTotal.WithLabelValues(OutcomeAPIError).Inc()
 				http.Error(w, "Internal Server Error: Authentication failed", http.StatusInternalServerError)
 				return
 			}
@@ -115,11 +121,13 @@ var AuthMiddleware = func(authClient authenticationv1client.AuthenticationV1Inte
 				log.WithFields(logrus.Fields{
 					"error": result.Status.Error,
 				}).Info("Token authentication failed")
+				health.AuthRequestsTotal.WithLabelValues(OutcomeInvalidToken).Inc()
 				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 				return
 			}
 
 			// Log successful authentication
+			health.AuthRequestsTotal.WithLabelValues(OutcomeSuccess).Inc()
 			log.WithFields(logrus.Fields{
 				"user": result.Status.User.Username,
 				"uid":  result.Status.User.UID,
@@ -129,11 +137,81 @@ var AuthMiddleware = func(authClient authenticationv1client.AuthenticationV1Inte
 			userCtx := context.WithValue(r.Context(), AuthenticatedUserKey, result.Status.User)
 			// Add oauth token to request context for downstream handlers (used in kafka messages to ROS to authenticate the request)
 			oauthTokenCtx := context.WithValue(userCtx, OauthTokenKey, token)
-			r = r.WithContext(oauthTokenCtx)
+			r = r.WithContext(context.WithValue(oauthTokenCtx, IdentitySourceKey, SourceTokenReview))
 
 			// Continue to next handler
 			next.ServeHTTP(w, r)
 		})
 	}
+}
+
+// NoopAuthMiddleware creates middleware that passes every request through unauthenticated
+// Only meant for local development, uploads still need an authenticated user to derive their identity
+func NoopAuthMiddleware(log *logrus.Logger) func(http.Handler) http.Handler {
+	log.Warn("Authentication is disabled, requests are not authenticated")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), IdentitySourceKey, SourceNoop)))
+		})
+	}
+}
+
+// RHIdentityMiddleware passes requests carrying an x-rh-identity header through without a bearer token,
+// leaving the header to be decoded by the handler, and authenticates the others with fallback
+// Only meant behind a proxy that authenticates requests and sets or strips the header
+func RHIdentityMiddleware(fallback func(http.Handler) http.Handler, log *logrus.Logger) func(http.Handler) http.Handler {
+	log.Info("Trusting the identity in x-rh-identity headers")
+	return func(next http.Handler) http.Handler {
+		authenticated := fallback(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(RHIdentityHeader)
+			if header == "" {
+				authenticated.ServeHTTP(w, r)
+				return
+			}
 
+			// Events carry the header as the uploader's identity, as they carry the bearer token otherwise
+			ctx := context.WithValue(r.Context(), IdentitySourceKey, SourceRHIdentity)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, OauthTokenKey, header)))
+		})
+	}
+}
+
+// IdentitySource returns how the request's user was authenticated, SourceUnknown when no middleware recorded it
+func IdentitySource(ctx context.Context) string {
+	if source, ok := ctx.Value(IdentitySourceKey).(string); ok && source != "" {
+		return source
+	}
+	return SourceUnknown
+}
+
+// bearerToken extracts the bearer token from the Authorization header
+// When the header is missing or malformed it writes the 401 response and returns false
+func bearerToken(w http.ResponseWriter, r *http.Request, log *logrus.Logger) (string, bool) {
+	// Extract Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		log.Debug("Missing Authorization header")
+		health.AuthRequestsTotal.WithLabelValues(OutcomeMissingHeader).Inc()
+		http.Error(w, "Unauthorized: Missing Authorization header", http.StatusUnauthorized)
+		return "", false
+	}
+
+	// Check Bearer token format
+	if !strings.HasPrefix(authHeader, bearerPrefix) {
+		log.Debug("Invalid Authorization header format - must be 'Bearer <token>'")
+		health.AuthRequestsTotal.WithLabelValues(OutcomeInvalidFormat).Inc()
+		http.Error(w, "Unauthorized: Invalid Authorization header format", http.StatusUnauthorized)
+		return "", false
+	}
+
+	// Extract token
+	token := strings.TrimPrefix(authHeader, bearerPrefix)
+	if token == "" {
+		log.Debug("Empty token in Authorization header")
+		health.AuthRequestsTotal.WithLabelValues(OutcomeEmptyToken).Inc()
+		http.Error(w, "Unauthorized: Empty token", http.StatusUnauthorized)
+		return "", false
+	}
+	return token, true
 }
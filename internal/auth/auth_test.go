@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 
 	authenticationv1 "k8s.io/api/authentication/v1"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/auth/mocks"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
 )
 
 var _ = Describe("Kubernetes Auth Middleware", func() {
@@ -101,6 +103,7 @@ var _ = Describe("Kubernetes Auth Middleware", func() {
 		Context("When token is valid and user is authenticated", func() {
 			var capturedUser *authenticationv1.UserInfo
 			var capturedToken string
+			var capturedSource string
 
 			BeforeEach(func() {
 				// Setup mock expectations
@@ -131,6 +134,7 @@ var _ = Describe("Kubernetes Auth Middleware", func() {
 
 				capturedUser = nil
 				capturedToken = ""
+				capturedSource = ""
 
 				handler = middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					if user := r.Context().Value(auth.AuthenticatedUserKey); user != nil {
@@ -143,6 +147,7 @@ var _ = Describe("Kubernetes Auth Middleware", func() {
 							capturedToken = tokenStr
 						}
 					}
+					capturedSource = auth.IdentitySource(r.Context())
 					w.WriteHeader(http.StatusOK)
 				}))
 
@@ -158,6 +163,7 @@ var _ = Describe("Kubernetes Auth Middleware", func() {
 				Expect(capturedUser.Username).To(Equal("test-user"))
 				Expect(capturedUser.UID).To(Equal("test-uid"))
 				Expect(capturedToken).To(Equal("valid-token"))
+				Expect(capturedSource).To(Equal(auth.SourceTokenReview))
 			})
 		})
 
@@ -251,6 +257,61 @@ var _ = Describe("Context Keys", func() {
 
 		Expect(retrievedToken).To(Equal(token))
 	})
+
+	It("should report an unknown identity source when no middleware recorded one", func() {
+		Expect(auth.IdentitySource(context.Background())).To(Equal(auth.SourceUnknown))
+	})
+
+	Describe("RHIdentityMiddleware", func() {
+		var (
+			source   string
+			token    any
+			handler  http.Handler
+			fallback func(http.Handler) http.Handler
+		)
+
+		BeforeEach(func() {
+			source, token = "", nil
+			fallback = func(http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				})
+			}
+			handler = auth.RHIdentityMiddleware(fallback, logrus.New())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				source = auth.IdentitySource(r.Context())
+				token = r.Context().Value(auth.OauthTokenKey)
+			}))
+		})
+
+		It("should pass requests carrying the header through without a bearer token", func() {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.Header.Set(auth.RHIdentityHeader, "eyJpZGVudGl0eSI6e319")
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, req)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(source).To(Equal(auth.SourceRHIdentity))
+			Expect(token).To(Equal("eyJpZGVudGl0eSI6e319"))
+		})
+
+		It("should authenticate requests without the header with the fallback middleware", func() {
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/test", nil))
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(source).To(BeEmpty())
+		})
+	})
+
+	It("should record the noop identity source", func() {
+		var source string
+		handler := auth.NoopAuthMiddleware(logrus.New())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			source = auth.IdentitySource(r.Context())
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		Expect(source).To(Equal(auth.SourceNoop))
+	})
 })
 
 var _ = Describe("Kubernetes Config Loading", func() {
@@ -330,6 +391,101 @@ var _ = Describe("Middleware Performance", func() {
 	})
 })
 
+var _ = Describe("Authentication Outcome Metrics", func() {
+	var (
+		ctrl              *gomock.Controller
+		mockAuthClient    *mocks.MockAuthenticationV1Interface
+		mockTokenReviewer *mocks.MockTokenReviewInterface
+		handler           http.Handler
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+		mockAuthClient = mocks.NewMockAuthenticationV1Interface(ctrl)
+		mockTokenReviewer = mocks.NewMockTokenReviewInterface(ctrl)
+		log := logrus.New()
+		log.SetLevel(logrus.FatalLevel)
+
+		handler = auth.AuthMiddleware(mockAuthClient, log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	// expectOutcome sends a request with the given Authorization header and asserts
+	// that only the counter for the expected outcome was incremented
+	expectOutcome := func(authHeader, outcome string) {
+		outcomes := []string{
+			auth.OutcomeSuccess,
+			auth.OutcomeMissingHeader,
+			auth.OutcomeInvalidFormat,
+			auth.OutcomeEmptyToken,
+			auth.OutcomeInvalidToken,
+			auth.OutcomeAPIError,
+		}
+		before := make(map[string]float64)
+		for _, o := range outcomes {
+			before[o] = testutil.ToFloat64(health.AuthRequestsTotal.WithLabelValues(o))
+		}
+
+		req := httptest.NewRequest("GET", "/test", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, o := range outcomes {
+			expected := before[o]
+			if o == outcome {
+				expected++
+			}
+			Expect(testutil.ToFloat64(health.AuthRequestsTotal.WithLabelValues(o))).To(Equal(expected), "outcome %s", o)
+		}
+	}
+
+	expectTokenReview := func(status authenticationv1.TokenReviewStatus, err error) {
+		mockAuthClient.EXPECT().TokenReviews().Return(mockTokenReviewer)
+		if err != nil {
+			mockTokenReviewer.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, err)
+			return
+		}
+		mockTokenReviewer.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Return(&authenticationv1.TokenReview{Status: status}, nil)
+	}
+
+	It("should record a missing header", func() {
+		expectOutcome("", auth.OutcomeMissingHeader)
+	})
+
+	It("should record an invalid header format", func() {
+		expectOutcome("Basic dXNlcjpwYXNz", auth.OutcomeInvalidFormat)
+	})
+
+	It("should record an empty token", func() {
+		expectOutcome("Bearer ", auth.OutcomeEmptyToken)
+	})
+
+	It("should record an invalid token", func() {
+		expectTokenReview(authenticationv1.TokenReviewStatus{Authenticated: false, Error: "token not found"}, nil)
+		expectOutcome("Bearer invalid-token", auth.OutcomeInvalidToken)
+	})
+
+	It("should record a TokenReview API error", func() {
+		expectTokenReview(authenticationv1.TokenReviewStatus{}, &mockError{message: "TokenReview API error"})
+		expectOutcome("Bearer error-token", auth.OutcomeAPIError)
+	})
+
+	It("should record a successful authentication", func() {
+		expectTokenReview(authenticationv1.TokenReviewStatus{
+			Authenticated: true,
+			User:          authenticationv1.UserInfo{Username: "test-user"},
+		}, nil)
+		expectOutcome("Bearer valid-token", auth.OutcomeSuccess)
+	})
+})
+
 // mockError implements error interface for testing error scenarios
 type mockError struct {
 	message string
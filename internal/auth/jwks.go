@@ -0,0 +1,539 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// JWKSOptions configures local JWT validation against a JWKS
+type JWKSOptions struct {
+	// Issuer is the required iss claim, empty rejects every token
+	Issuer string
+	// Audience must be one of the aud claim's values, empty rejects every token
+	Audience string
+	// RefreshInterval is how long fetched keys are used before the JWKS is fetched again
+	RefreshInterval time.Duration
+}
+
+const (
+	// defaultJWKSRefreshInterval is used when no refresh interval is configured
+	defaultJWKSRefreshInterval = 5 * time.Minute
+	// minJWKSRefreshInterval rate limits the refreshes forced by unknown keys, so tokens with
+	// made up key IDs can't make every request fetch the JWKS
+	minJWKSRefreshInterval = 10 * time.Second
+	// jwtClockSkew is the leeway allowed on the exp and nbf claims
+	jwtClockSkew = 30 * time.Second
+	// jwksFetchTimeout bounds a single JWKS fetch
+	jwksFetchTimeout = 10 * time.Second
+	// minRSAKeyBits is the smallest RSA signing key accepted from the JWKS
+	minRSAKeyBits = 2048
+)
+
+// registeredClaims are the JWT claims validated here rather than passed on as extra user info
+var registeredClaims = []string{"iss", "aud", "exp", "nbf", "iat", "jti", "sub", "preferred_username", "groups"}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errJWKSFetch    = errors.New("failed to fetch JWKS")
+)
+
+// JWKSAuthMiddleware creates middleware that validates JWTs locally against the keys published at jwksURL
+// The token signature, expiry, issuer and audience are checked, and the user info is built from its claims
+func JWKSAuthMiddleware(jwksURL string, opts JWKSOptions, log *logrus.Logger) func(http.Handler) http.Handler {
+	return newJWKSAuthenticator(jwksURL, opts, log).middleware
+}
+
+// jwksAuthenticator validates JWTs with the keys of a JWKS, refreshing them when they are older than
+// the refresh interval, or when a token is signed with a key they don't hold, e.g. after a key rotation
+type jwksAuthenticator struct {
+	url        string
+	opts       JWKSOptions
+	client     *http.Client
+	minRefresh time.Duration
+	now        func() time.Time
+	logger     *logrus.Logger
+
+	// refreshMu serializes fetches, mu guards the fetched keys
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	keys      []jwk
+	fetchedAt time.Time
+}
+
+// jwk is a verification key of the JWKS
+type jwk struct {
+	kid string
+	// alg is the algorithm the key is restricted to, empty allows any algorithm of its type
+	alg string
+	key crypto.PublicKey
+}
+
+func newJWKSAuthenticator(jwksURL string, opts JWKSOptions, log *logrus.Logger) *jwksAuthenticator {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultJWKSRefreshInterval
+	}
+	return &jwksAuthenticator{
+		url:        jwksURL,
+		opts:       opts,
+		client:     &http.Client{Timeout: jwksFetchTimeout},
+		minRefresh: minJWKSRefreshInterval,
+		now:        time.Now,
+		logger:     log,
+	}
+}
+
+func (a *jwksAuthenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(w, r, a.logger)
+		if !ok {
+			return
+		}
+
+		user, err := a.authenticate(r.Context(), token)
+		if errors.Is(err, errJWKSFetch) {
+			a.logger.WithError(err).Error("JWKS fetch failed")
+			health.AuthRequestsTotal.WithLabelValues(OutcomeAPIError).Inc()
+			http.Error(w, "Internal Server Error: Authentication failed", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			a.logger.WithError(err).Info("Token authentication failed")
+			health.AuthRequestsTotal.WithLabelValues(OutcomeInvalidToken).Inc()
+			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		health.AuthRequestsTotal.WithLabelValues(OutcomeSuccess).Inc()
+		a.logger.WithFields(logrus.Fields{
+			"user": user.Username,
+			"uid":  user.UID,
+		}).Debug("Token authentication successful")
+
+		userCtx := context.WithValue(r.Context(), AuthenticatedUserKey, user)
+		oauthTokenCtx := context.WithValue(userCtx, OauthTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(oauthTokenCtx, IdentitySourceKey, SourceJWT)))
+	})
+}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// authenticate validates token and returns the user it was issued to
+func (a *jwksAuthenticator) authenticate(ctx context.Context, token string) (authenticationv1.UserInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: not a JWT", errInvalidToken)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: malformed header: %v", errInvalidToken, err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: malformed signature", errInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := a.verify(ctx, header, hash, signed, signature); err != nil {
+		return authenticationv1.UserInfo{}, err
+	}
+
+	var claims map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("%w: malformed claims: %v", errInvalidToken, err)
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return authenticationv1.UserInfo{}, err
+	}
+	return userFromClaims(claims), nil
+}
+
+// verify checks the signature with the keys matching the header, refreshing stale keys first,
+// and refreshing once more if no key verifies it in case the signing key was rotated
+func (a *jwksAuthenticator) verify(ctx context.Context, header jwtHeader, hash crypto.Hash, signed, signature []byte) error {
+	keys, fetchedAt, err := a.currentKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if verifyWithKeys(keys, header, hash, signed, signature) {
+		return nil
+	}
+
+	// The token picks the key ID, so a failed refresh here is reported as an invalid token rather than
+	// an outage: forged key IDs must not turn into server errors
+	if a.now().Sub(fetchedAt) >= a.minRefresh {
+		keys, err = a.refresh(ctx, fetchedAt)
+		if err != nil {
+			a.logger.WithError(err).WithField("kid", header.Kid).Warn("Failed to refresh JWKS for an unknown signing key")
+		} else if verifyWithKeys(keys, header, hash, signed, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature verification failed", errInvalidToken)
+}
+
+// currentKeys returns the fetched keys, fetching them when they are missing or older than the refresh interval
+// Stale keys are kept when a refresh fails, so a JWKS outage doesn't reject tokens signed with known keys
+func (a *jwksAuthenticator) currentKeys(ctx context.Context) ([]jwk, time.Time, error) {
+	a.mu.RLock()
+	keys, fetchedAt := a.keys, a.fetchedAt
+	a.mu.RUnlock()
+	if keys != nil && a.now().Sub(fetchedAt) < a.opts.RefreshInterval {
+		return keys, fetchedAt, nil
+	}
+
+	refreshed, err := a.refresh(ctx, fetchedAt)
+	if err != nil {
+		if keys == nil {
+			return nil, time.Time{}, err
+		}
+		a.logger.WithError(err).Warn("Failed to refresh JWKS, using the previously fetched keys")
+		return keys, fetchedAt, nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return refreshed, a.fetchedAt, nil
+}
+
+// refresh fetches the JWKS unless another request refreshed it since seen
+func (a *jwksAuthenticator) refresh(ctx context.Context, seen time.Time) ([]jwk, error) {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+
+	a.mu.RLock()
+	keys, fetchedAt := a.keys, a.fetchedAt
+	a.mu.RUnlock()
+	if keys != nil && fetchedAt.After(seen) {
+		return keys, nil
+	}
+
+	keys, err := a.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.fetchedAt = a.now()
+	return keys, nil
+}
+
+// jwksDocument is a JSON Web Key Set, keys with fields this service doesn't use are still decoded
+type jwksDocument struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// fetch downloads the JWKS and parses its signature verification keys
+// Keys of unsupported types are skipped so one unusual key doesn't disable the others
+func (a *jwksAuthenticator) fetch(ctx context.Context) ([]jwk, error) {
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodGet, a.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSFetch, err)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSFetch, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", errJWKSFetch, resp.StatusCode)
+	}
+
+	var doc jwksDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSFetch, err)
+	}
+
+	keys := []jwk{}
+	for _, key := range doc.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		var publicKey crypto.PublicKey
+		switch key.Kty {
+		case "RSA":
+			publicKey, err = rsaPublicKey(key.N, key.E)
+		case "EC":
+			publicKey, err = ecPublicKey(key.Crv, key.X, key.Y)
+		default:
+			err = fmt.Errorf("unsupported key type %q", key.Kty)
+		}
+		if err != nil {
+			a.logger.WithError(err).WithField("kid", key.Kid).Warn("Skipping unusable JWKS key")
+			continue
+		}
+		keys = append(keys, jwk{kid: key.Kid, alg: key.Alg, key: publicKey})
+	}
+	return keys, nil
+}
+
+// jwtHashes maps the supported signature algorithms to their hash, HMAC and "none" are never accepted
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// verifyWithKeys reports whether any key matching the header's key ID and algorithm verifies the signature
+func verifyWithKeys(keys []jwk, header jwtHeader, hash crypto.Hash, signed, signature []byte) bool {
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	for _, key := range keys {
+		if header.Kid != "" && key.kid != header.Kid {
+			continue
+		}
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		switch publicKey := key.key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "RS") && rsa.VerifyPKCS1v15(publicKey, hash, digest, signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "ES") && verifyECDSA(publicKey, digest, signature) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyECDSA verifies a JWS ECDSA signature, the fixed size concatenation of r and s
+func verifyECDSA(key *ecdsa.PublicKey, digest, signature []byte) bool {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	return ecdsa.Verify(key, digest, r, s)
+}
+
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+	}
+	if len(modulus) == 0 || len(exponent) == 0 || len(exponent) > 4 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+	if bits := key.N.BitLen(); bits < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA key has %d bits, at least %d are required", bits, minRSAKeyBits)
+	}
+	return key, nil
+}
+
+func ecPublicKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("EC key is not on curve %s", crv)
+	}
+	return key, nil
+}
+
+// validateClaims checks the token's expiry, not-before time, issuer and audience
+func (a *jwksAuthenticator) validateClaims(claims map[string]json.RawMessage) error {
+	now := a.now()
+
+	exp, ok, err := numericDateClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", errInvalidToken)
+	}
+	if now.After(exp.Add(jwtClockSkew)) {
+		return fmt.Errorf("%w: token expired at %s", errInvalidToken, exp.UTC().Format(time.RFC3339))
+	}
+
+	nbf, ok, err := numericDateClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(jwtClockSkew).Before(nbf) {
+		return fmt.Errorf("%w: token not valid before %s", errInvalidToken, nbf.UTC().Format(time.RFC3339))
+	}
+
+	// Without an expected issuer and audience a token issued to any client of the realm would be accepted
+	if a.opts.Issuer == "" || a.opts.Audience == "" {
+		return fmt.Errorf("%w: no issuer and audience configured", errInvalidToken)
+	}
+
+	var issuer string
+	if err := json.Unmarshal(claims["iss"], &issuer); err != nil || issuer != a.opts.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", errInvalidToken)
+	}
+
+	if !slices.Contains(stringsClaim(claims["aud"]), a.opts.Audience) {
+		return fmt.Errorf("%w: unexpected audience", errInvalidToken)
+	}
+	return nil
+}
+
+// numericDateClaim returns the time of a NumericDate claim, and whether the claim is present
+func numericDateClaim(claims map[string]json.RawMessage, name string) (time.Time, bool, error) {
+	raw, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: malformed %s claim", errInvalidToken, name)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// stringsClaim returns the values of a claim that is a string or an array of strings
+func stringsClaim(raw json.RawMessage) []string {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return []string{value}
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return values
+	}
+	return nil
+}
+
+// userFromClaims builds the user info from the token claims, the way TokenReview reports users:
+// the username is preferred_username (or sub), the UID is sub, the groups come from the groups
+// claim, and every other unregistered claim is passed on as extra user info. Nested claims are
+// kept as JSON documents, so claim paths into them still resolve
+func userFromClaims(claims map[string]json.RawMessage) authenticationv1.UserInfo {
+	var subject, username string
+	_ = json.Unmarshal(claims["sub"], &subject)
+	_ = json.Unmarshal(claims["preferred_username"], &username)
+	if username == "" {
+		username = subject
+	}
+
+	user := authenticationv1.UserInfo{
+		Username: username,
+		UID:      subject,
+		Groups:   stringsClaim(claims["groups"]),
+	}
+	for name, raw := range claims {
+		if slices.Contains(registeredClaims, name) {
+			continue
+		}
+		if values := extraValues(raw); len(values) > 0 {
+			if user.Extra == nil {
+				user.Extra = make(map[string]authenticationv1.ExtraValue)
+			}
+			user.Extra[name] = values
+		}
+	}
+	return user
+}
+
+// extraValues converts a claim to extra user info values: scalars become one value, arrays one
+// value per element, and objects their JSON document
+func extraValues(raw json.RawMessage) authenticationv1.ExtraValue {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(raw, &elements); err == nil {
+		var values authenticationv1.ExtraValue
+		for _, element := range elements {
+			values = append(values, scalarClaim(element))
+		}
+		return values
+	}
+	if string(raw) == "null" {
+		return nil
+	}
+	return authenticationv1.ExtraValue{scalarClaim(raw)}
+}
+
+// scalarClaim returns a string claim's value, or the JSON text of any other claim
+func scalarClaim(raw json.RawMessage) string {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value
+	}
+	var boolean bool
+	if err := json.Unmarshal(raw, &boolean); err == nil {
+		return strconv.FormatBool(boolean)
+	}
+	return string(raw)
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a JWT into v
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// signRS256 builds a JWT with the given claims signed by key
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	Expect(err).NotTo(HaveOccurred())
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwksFor returns the JWKS document publishing key under kid
+func jwksFor(key *rsa.PrivateKey, kid string) []byte {
+	doc, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	return doc
+}
+
+var _ = Describe("JWKS Auth Middleware", func() {
+	var (
+		key           *rsa.PrivateKey
+		jwks          atomic.Value
+		fetches       atomic.Int32
+		jwksServer    *httptest.Server
+		log           *logrus.Logger
+		authenticator *jwksAuthenticator
+		handler       http.Handler
+		captured      *authenticationv1.UserInfo
+		source        string
+		claims        map[string]any
+	)
+
+	BeforeEach(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		jwks.Store(jwksFor(key, "key-1"))
+		fetches.Store(0)
+		jwksServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			_, _ = w.Write(jwks.Load().([]byte))
+		}))
+
+		log = logrus.New()
+		log.SetLevel(logrus.ErrorLevel)
+		captured = nil
+		authenticator = newJWKSAuthenticator(jwksServer.URL, JWKSOptions{
+			Issuer:   "https://sso.example.com/realms/ros",
+			Audience: "ros-ingress",
+		}, log)
+		handler = authenticator.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := r.Context().Value(AuthenticatedUserKey).(authenticationv1.UserInfo)
+			captured = &user
+			source = IdentitySource(r.Context())
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		claims = map[string]any{
+			"iss":                "https://sso.example.com/realms/ros",
+			"aud":                []string{"account", "ros-ingress"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"sub":                "f0c6a1e2",
+			"preferred_username": "cost-operator",
+			"groups":             []string{"ros-uploaders"},
+			"org_id":             "12345",
+		}
+	})
+
+	AfterEach(func() {
+		jwksServer.Close()
+	})
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	It("should build the user from a valid token's claims", func() {
+		rr := serve(signRS256(key, "key-1", claims))
+
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(captured).NotTo(BeNil())
+		Expect(captured.Username).To(Equal("cost-operator"))
+		Expect(captured.UID).To(Equal("f0c6a1e2"))
+		Expect(captured.Groups).To(Equal([]string{"ros-uploaders"}))
+		Expect(captured.Extra).To(HaveKeyWithValue("org_id", authenticationv1.ExtraValue{"12345"}))
+		Expect(source).To(Equal(SourceJWT))
+	})
+
+	It("should reuse the fetched keys across requests", func() {
+		token := signRS256(key, "key-1", claims)
+		Expect(serve(token).Code).To(Equal(http.StatusOK))
+		Expect(serve(token).Code).To(Equal(http.StatusOK))
+		Expect(fetches.Load()).To(Equal(int32(1)))
+	})
+
+	It("should reject an expired token", func() {
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject a token from another issuer", func() {
+		claims["iss"] = "https://other.example.com"
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject a token for another audience", func() {
+		claims["aud"] = "account"
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject a token signed by an unknown key", func() {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serve(signRS256(other, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject every token when no audience is configured", func() {
+		authenticator.opts.Audience = ""
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject a token without an issuer", func() {
+		delete(claims, "iss")
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should ignore RSA keys shorter than 2048 bits", func() {
+		weak, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).NotTo(HaveOccurred())
+		jwks.Store(jwksFor(weak, "key-1"))
+
+		Expect(serve(signRS256(weak, "key-1", claims)).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject an unsigned token", func() {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		payload, _ := json.Marshal(claims)
+		token := header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		Expect(serve(token).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should pick up rotated keys without waiting for the refresh interval", func() {
+		authenticator.minRefresh = 0
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusOK))
+
+		rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		jwks.Store(jwksFor(rotated, "key-2"))
+
+		Expect(serve(signRS256(rotated, "key-2", claims)).Code).To(Equal(http.StatusOK))
+		Expect(fetches.Load()).To(Equal(int32(2)))
+	})
+
+	It("should not refetch the JWKS for unknown keys more often than the minimum refresh interval", func() {
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusOK))
+
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			Expect(serve(signRS256(other, "forged", claims)).Code).To(Equal(http.StatusUnauthorized))
+		}
+		Expect(fetches.Load()).To(Equal(int32(1)))
+	})
+
+	It("should reject unknown keys with 401 when the JWKS refetch fails", func() {
+		authenticator.minRefresh = 0
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusOK))
+		jwksServer.Close()
+
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serve(signRS256(other, "forged", claims)).Code).To(Equal(http.StatusUnauthorized))
+		// Tokens signed with the known keys are still accepted
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusOK))
+	})
+
+	It("should fail with 500 when the JWKS can't be fetched at all", func() {
+		jwksServer.Close()
+		Expect(serve(signRS256(key, "key-1", claims)).Code).To(Equal(http.StatusInternalServerError))
+	})
+})
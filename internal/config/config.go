@@ -1,10 +1,19 @@
 package config
 
 import (
+	"compress/gzip"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
 )
 
 // Config represents the application configuration
@@ -17,33 +26,74 @@ type Config struct {
 	Logging LoggingConfig `json:"logging"`
 	Metrics MetricsConfig `json:"metrics"`
 	Auth    AuthConfig    `json:"auth"`
+	CORS    CORSConfig    `json:"cors"`
+	Reload  ReloadConfig  `json:"reload"`
+	// Enrichment adds org metadata from an external lookup service to the ROS events
+	Enrichment EnrichmentConfig `json:"enrichment"`
+	// Outbox keeps upload events durably until they are published
+	Outbox OutboxConfig `json:"outbox"`
 }
 
 // ServerConfig holds HTTP server configuration
 type ServerConfig struct {
-	Port         int  `json:"port"`
-	ReadTimeout  int  `json:"readTimeout"`
-	WriteTimeout int  `json:"writeTimeout"`
-	IdleTimeout  int  `json:"idleTimeout"`
-	Debug        bool `json:"debug"`
+	Port            int  `json:"port"`
+	ReadTimeout     int  `json:"readTimeout"`
+	WriteTimeout    int  `json:"writeTimeout"`
+	IdleTimeout     int  `json:"idleTimeout"`
+	BodyReadTimeout int  `json:"bodyReadTimeout"`
+	PrestopDelay    int  `json:"prestopDelay"`
+	Debug           bool `json:"debug"`
+	// CompressionLevel is the gzip level (1-9) used to compress responses, trading CPU for size
+	CompressionLevel int `json:"compressionLevel"`
+	// HealthCacheTTL is how long (seconds) a health check result is reused, 0 checks on every probe
+	HealthCacheTTL int `json:"healthCacheTTL"`
+	// UploadReadTimeout and UploadWriteTimeout (seconds) override ReadTimeout and WriteTimeout
+	// on the upload route, 0 keeps the server defaults
+	UploadReadTimeout  int `json:"uploadReadTimeout"`
+	UploadWriteTimeout int `json:"uploadWriteTimeout"`
 }
 
 // StorageConfig holds MinIO/S3 storage configuration
 type StorageConfig struct {
-	Endpoint      string `json:"endpoint"`
-	Region        string `json:"region"`
-	Bucket        string `json:"bucket"`
-	AccessKey     string `json:"accessKey"`
-	SecretKey     string `json:"secretKey"`
-	UseSSL        bool   `json:"useSSL"`
-	URLExpiration int    `json:"urlExpiration"`
-	PathPrefix    string `json:"pathPrefix"`
+	Endpoint              string `json:"endpoint"`
+	Region                string `json:"region"`
+	Bucket                string `json:"bucket"`
+	AccessKey             string `json:"accessKey"`
+	SecretKey             string `json:"secretKey"`
+	UseSSL                bool   `json:"useSSL"`
+	URLExpiration         int    `json:"urlExpiration"`
+	PathPrefix            string `json:"pathPrefix"`
+	UsagePathPrefix       string `json:"usagePathPrefix"`
+	UncertifiedPathPrefix string `json:"uncertifiedPathPrefix"`
+	LowercaseKeys         bool   `json:"lowercaseKeys"`
+	OnConflict            string `json:"onConflict"`
+	// PartitionTimezone is the timezone manifest dates are converted to for date partitions, empty keeps the manifest's offset
+	PartitionTimezone string `json:"partitionTimezone"`
+	// MinPresignExpiry is the shortest presigned URL lifetime (seconds) consumers can work with, 0 sets no minimum
+	MinPresignExpiry int `json:"minPresignExpiry"`
+	// MetadataSanitization is how illegal characters in object metadata values are handled: encode or strip
+	MetadataSanitization string `json:"metadataSanitization"`
+	// WriteChecksumManifest stores a sidecar object listing the SHA-256 of each uploaded ROS file
+	WriteChecksumManifest bool `json:"writeChecksumManifest"`
+	// MaxConcurrentPresigns bounds concurrent presigned URL generations, 0 disables the limit
+	MaxConcurrentPresigns int `json:"maxConcurrentPresigns"`
+	// DateGranularity is the precision of the date partition in object keys: hour, day or month
+	DateGranularity string `json:"dateGranularity"`
+	// VerifyWrite stats each object after it is uploaded and fails the upload unless it has the uploaded size
+	VerifyWrite bool `json:"verifyWrite"`
+	// RetryBudgetRate is how many retries per second the storage retry budget refills, 0 disables the budget
+	RetryBudgetRate int `json:"retryBudgetRate"`
+	// RetryBudgetBurst is how many retries may be made back to back when the budget is full, 0 uses the rate
+	RetryBudgetBurst int `json:"retryBudgetBurst"`
 }
 
 // KafkaConfig holds Kafka configuration
 type KafkaConfig struct {
 	Brokers          []string `json:"brokers"`
 	Topic            string   `json:"topic"`
+	UsageTopic       string   `json:"usageTopic"`
+	UncertifiedTopic string   `json:"uncertifiedTopic"`
+	FallbackTopic    string   `json:"fallbackTopic"`
 	SecurityProtocol string   `json:"securityProtocol"`
 	SASLMechanism    string   `json:"saslMechanism"`
 	SASLUsername     string   `json:"saslUsername"`
@@ -52,6 +102,29 @@ type KafkaConfig struct {
 	ClientID         string   `json:"clientId"`
 	BatchSize        int      `json:"batchSize"`
 	Retries          int      `json:"retries"`
+	// QueueBufferingMaxMessages and QueueBufferingMaxKBytes bound the producer's local queue
+	QueueBufferingMaxMessages int `json:"queueBufferingMaxMessages"`
+	QueueBufferingMaxKBytes   int `json:"queueBufferingMaxKBytes"`
+	// ValueFormat is how upload events are serialized: "json" (plain JSON), or "avro" / "jsonschema"
+	// framed with the schema ID registered in the schema registry
+	ValueFormat string `json:"valueFormat"`
+	// The schema registry holding the event schemas, which are registered under SchemaRegistrySubject,
+	// or "<topic>-value" when it is empty
+	SchemaRegistryURL      string `json:"schemaRegistryUrl"`
+	SchemaRegistrySubject  string `json:"schemaRegistrySubject"`
+	SchemaRegistryUsername string `json:"schemaRegistryUsername"`
+	SchemaRegistryPassword string `json:"schemaRegistryPassword"`
+	// MaxHeaders and MaxHeaderBytes bound the number and total key and value size of a message's headers,
+	// messages beyond them are rejected. 0 disables a bound
+	MaxHeaders     int `json:"maxHeaders"`
+	MaxHeaderBytes int `json:"maxHeaderBytes"`
+	// SignMessages adds a "signature" header with the HMAC-SHA256 of each upload event's value,
+	// keyed with SigningKey, so consumers can detect tampered events
+	SignMessages bool   `json:"signMessages"`
+	SigningKey   string `json:"signingKey"`
+	// IdentityFormat is what upload events carry as the uploader's identity: "token" (the caller's OAuth
+	// token) or "rh-identity" (the resolved identity as a base64 encoded x-rh-identity header)
+	IdentityFormat string `json:"identityFormat"`
 }
 
 // UploadConfig holds upload processing configuration
@@ -60,8 +133,73 @@ type UploadConfig struct {
 	MaxMemory       int64    `json:"maxMemory"`
 	TempDir         string   `json:"tempDir"`
 	AllowedTypes    []string `json:"allowedTypes"`
+	AllowedMethods  []string `json:"allowedMethods"`
 	RequireAuth     bool     `json:"requireAuth"`
 	ValidationTopic string   `json:"validationTopic"`
+	// ForwardUsageFiles uploads the manifest "files" (usage CSVs) to a
+	// separate prefix and emits them on the usage topic
+	ForwardUsageFiles bool `json:"forwardUsageFiles"`
+	// MaxConcurrentExtractions bounds concurrent payload extractions, 0 disables the limit
+	MaxConcurrentExtractions int `json:"maxConcurrentExtractions"`
+	// ExtractionQueueTimeout is how long (seconds) to wait for an extraction slot before rejecting
+	ExtractionQueueTimeout int `json:"extractionQueueTimeout"`
+	// SizeBuckets overrides the upload size histogram buckets (bytes), empty keeps the defaults
+	SizeBuckets []float64 `json:"sizeBuckets"`
+	// RequireContentLength rejects uploads without a declared Content-Length (e.g. chunked) with 411
+	RequireContentLength bool `json:"requireContentLength"`
+	// ExtractionTimeout is the maximum time (seconds) to spend decompressing a payload, 0 disables it
+	ExtractionTimeout int `json:"extractionTimeout"`
+	// ValidateDateConsistency rejects manifests whose date falls outside their start/end range
+	ValidateDateConsistency bool `json:"validateDateConsistency"`
+	// MinOperatorVersion is the oldest operator semver accepted, empty disables the check
+	MinOperatorVersion string `json:"minOperatorVersion"`
+	// StatusTTL is how long (seconds) upload processing statuses are kept for polling
+	StatusTTL int `json:"statusTTL"`
+	// AckMode is "sync" to respond after the upload's events are delivered, or "async" to
+	// respond once its files are stored and publish the events in the background
+	AckMode string `json:"ackMode"`
+	// ForbiddenFilePatterns are path.Match patterns, a payload with any matching entry is rejected
+	ForbiddenFilePatterns []string `json:"forbiddenFilePatterns"`
+	// ReprocessEnabled exposes the internal endpoint that reruns a stored payload archive
+	// It is refused until raw payload archives are written with their upload metadata
+	ReprocessEnabled bool `json:"reprocessEnabled"`
+	// AllowedEncodings lists the request Content-Encoding values accepted on uploads
+	AllowedEncodings []string `json:"allowedEncodings"`
+	// EmptyOrgSchema selects the storage schema for identities without an org ID: "default" uses
+	// DefaultSchema, "account" derives it from the account number, and "reject" refuses the upload
+	EmptyOrgSchema string `json:"emptyOrgSchema"`
+	// DefaultSchema is the schema used for identities without an org ID in "default" mode
+	DefaultSchema string `json:"defaultSchema"`
+	// InferROSFromFiles picks the ROS files by name from the archive entries when the manifest lists none
+	InferROSFromFiles bool `json:"inferROSFromFiles"`
+	// ROSFilePatterns are path.Match patterns for entry base names treated as ROS files when inferring
+	ROSFilePatterns []string `json:"rosFilePatterns"`
+	// ClusterConcurrency is how concurrent uploads of the same cluster and date are handled:
+	// "last-writer-wins" stores them in parallel, "serialize" makes them wait for each other
+	ClusterConcurrency string `json:"clusterConcurrency"`
+	// MaxTotalROSBytes caps the combined size of the ROS files stored for one upload, 0 disables the cap
+	MaxTotalROSBytes int64 `json:"maxTotalROSBytes"`
+	// MaxSizeByType overrides MaxUploadSize for the listed file content types, matched without parameters
+	MaxSizeByType map[string]int64 `json:"maxSizeByType"`
+	// RequireManifestUUID rejects uploads without an X-Manifest-UUID header matching the manifest's uuid
+	RequireManifestUUID bool `json:"requireManifestUUID"`
+	// StrictManifestFields rejects manifests with fields the service doesn't know, such as misspelled keys
+	StrictManifestFields bool `json:"strictManifestFields"`
+	// AcceptRawBody accepts payloads sent as the whole request body instead of a multipart form,
+	// for requests whose Content-Type isn't multipart
+	AcceptRawBody bool `json:"acceptRawBody"`
+	// KeepFailedPayloads is how long (seconds) the extracted files of failed uploads are kept for
+	// debugging, 0 removes them immediately
+	KeepFailedPayloads int `json:"keepFailedPayloads"`
+	// MaxFailedPayloads caps how many failed payloads are kept, the oldest are removed first
+	MaxFailedPayloads int `json:"maxFailedPayloads"`
+	// RejectEmptyManifestEarly rejects a payload as soon as its manifest is extracted when the manifest
+	// lists no ROS files, instead of after the whole archive is extracted
+	RejectEmptyManifestEarly bool `json:"rejectEmptyManifestEarly"`
+	// RejectTrailingData rejects payloads with data other than zero padding after the end of the tar archive
+	RejectTrailingData bool `json:"rejectTrailingData"`
+	// RequireCertified rejects payloads whose manifest isn't marked as produced by a certified operator
+	RequireCertified bool `json:"requireCertified"`
 }
 
 // LoggingConfig holds logging configuration
@@ -69,6 +207,8 @@ type LoggingConfig struct {
 	Level  string `json:"level"`
 	Format string `json:"format"`
 	Output string `json:"output"`
+	// TimestampFormat is how logs and JSON responses write timestamps: default, rfc3339 or epoch_millis
+	TimestampFormat string `json:"timestampFormat"`
 }
 
 // MetricsConfig holds metrics configuration
@@ -76,13 +216,131 @@ type MetricsConfig struct {
 	Enabled bool   `json:"enabled"`
 	Path    string `json:"path"`
 	Port    int    `json:"port"`
+	// Namespace and Subsystem prefix every service metric name (e.g. "ros_ingress_http_requests_total"),
+	// empty keeps the bare names
+	Namespace string `json:"namespace"`
+	Subsystem string `json:"subsystem"`
+}
+
+// metricNamePart matches the characters Prometheus allows in a metric name
+var metricNamePart = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Auth modes selecting how bearer tokens are validated
+const (
+	AuthModeK8s  = "k8s"
+	AuthModeJWKS = "jwks"
+	AuthModeNoop = "noop"
+)
+
+// Identity formats selecting what upload events carry as the uploader's identity
+const (
+	IdentityFormatToken      = "token"
+	IdentityFormatRHIdentity = "rh-identity"
+)
+
+// Built-in group prefixes carrying a user's org ID and account number, used when none are configured
+const (
+	DefaultOrgGroupPrefix     = "org:"
+	DefaultAccountGroupPrefix = "account:"
+)
+
+// DefaultOrgClaimKeys returns the built-in extra claims checked for a user's org ID, in order
+func DefaultOrgClaimKeys() []string {
+	return []string{"org_id"}
+}
+
+// DefaultAccountClaimKeys returns the built-in extra claims checked for a user's account number, in order
+func DefaultAccountClaimKeys() []string {
+	return []string{"account_number", "customer_id", "client_id"}
 }
 
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	Enabled     bool     `json:"enabled"`
+	Enabled bool `json:"enabled"`
+	// Mode selects how bearer tokens are validated: "k8s" (TokenReview), "jwks" (locally against
+	// JWKSURL) or "noop" (no authentication, for local development)
+	Mode        string   `json:"mode"`
 	JWTSecret   string   `json:"jwtSecret"`
 	AllowedOrgs []string `json:"allowedOrgs"`
+	// RequireNumericIDs rejects uploads whose derived org/account IDs aren't numeric
+	RequireNumericIDs bool `json:"requireNumericIds"`
+	// IdentityCacheTTL is how long (seconds) identities derived from a token are reused, 0 disables caching
+	IdentityCacheTTL int `json:"identityCacheTTL"`
+	// SynthesizeEmail fills a missing email claim with a deterministic placeholder derived from the username and org
+	SynthesizeEmail bool `json:"synthesizeEmail"`
+	// RequireEmail rejects uploads whose identity has no email, after any synthesis
+	RequireEmail bool `json:"requireEmail"`
+	// AdminGroups and InternalGroups are path.Match patterns for the groups that flag a user as org admin
+	// or internal, empty keeps the default substring heuristics ("admin" and "redhat")
+	AdminGroups    []string `json:"adminGroups"`
+	InternalGroups []string `json:"internalGroups"`
+	// DeniedOrgs are refused even when AllowedOrgs would accept them
+	DeniedOrgs []string `json:"deniedOrgs"`
+	// AccountClaimPath is a dotted path (e.g. "realm_access.account") to the account number in the
+	// identity's extra claims, checked before the built-in account fields
+	AccountClaimPath string `json:"accountClaimPath"`
+	// DefaultOrgID and DefaultAccount are used when a user carries no org ID or account number
+	DefaultOrgID   string `json:"defaultOrgId"`
+	DefaultAccount string `json:"defaultAccount"`
+	// RequireOrgID rejects users carrying no org ID with 401 instead of falling back to DefaultOrgID
+	RequireOrgID bool `json:"requireOrgId"`
+	// RejectDefaultOrg rejects uploads whose org ID or account number is DefaultOrgID or DefaultAccount with 422
+	RejectDefaultOrg bool `json:"rejectDefaultOrg"`
+	// TrustRHIdentity accepts the identity in an x-rh-identity header set by an authenticating proxy,
+	// in place of a bearer token
+	TrustRHIdentity bool `json:"trustRhIdentity"`
+	// OrgGroupPrefix and AccountGroupPrefix mark the groups carrying the org ID and account number,
+	// OrgClaimKeys and AccountClaimKeys are the extra claims checked for them in order. Empty values
+	// keep the built-in mappings
+	OrgGroupPrefix     string   `json:"orgGroupPrefix"`
+	AccountGroupPrefix string   `json:"accountGroupPrefix"`
+	OrgClaimKeys       []string `json:"orgClaimKeys"`
+	AccountClaimKeys   []string `json:"accountClaimKeys"`
+	// JWKSURL is where the token signing keys are published in jwks mode
+	JWKSURL string `json:"jwksUrl"`
+	// JWTIssuer and JWTAudience are the iss and aud claims required in jwks mode
+	JWTIssuer   string `json:"jwtIssuer"`
+	JWTAudience string `json:"jwtAudience"`
+	// JWKSRefreshInterval is how often (seconds) the JWKS is fetched again in jwks mode
+	JWKSRefreshInterval int `json:"jwksRefreshInterval"`
+}
+
+// CORSConfig holds cross-origin configuration for browser-based clients
+// CORS is disabled when no origins are allowed
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+}
+
+// ReloadConfig holds the projected config directory watched for live setting changes
+// Reloading is disabled when no directory is set
+type ReloadConfig struct {
+	// Dir holds one file per setting, named after its environment variable (e.g. a mounted ConfigMap)
+	Dir string `json:"dir"`
+	// Interval is how often (seconds) Dir is checked for changes
+	Interval int `json:"interval"`
+}
+
+// EnrichmentConfig holds the org metadata lookup service, enrichment is disabled when URL is empty
+type EnrichmentConfig struct {
+	// URL is the lookup endpoint, the org ID is appended as the last path segment
+	URL string `json:"url"`
+	// CacheTTL is how long (seconds) an org's metadata is reused before it is looked up again
+	CacheTTL int `json:"cacheTTL"`
+	// Timeout bounds a single lookup (seconds)
+	Timeout int `json:"timeout"`
+}
+
+// OutboxConfig holds the upload event outbox, the outbox is disabled when Dir is empty
+type OutboxConfig struct {
+	// Dir keeps the pending events, it should be on a volume that outlives the pod
+	Dir string `json:"dir"`
+	// RelayInterval is how often (seconds) pending events are published
+	RelayInterval int `json:"relayInterval"`
+	// RelayDelay is how old (seconds) a pending event must be before the relay publishes it,
+	// so events of uploads still publishing aren't published twice
+	RelayDelay int `json:"relayDelay"`
 }
 
 // Load reads configuration from environment variables and files
@@ -90,58 +348,171 @@ type AuthConfig struct {
 func Load() (*Config, error) {
 	cfg := &Config{
 		Server: ServerConfig{
-			Port:         getEnvInt("SERVER_PORT", 8080),
-			ReadTimeout:  getEnvInt("SERVER_READ_TIMEOUT", 30),
-			WriteTimeout: getEnvInt("SERVER_WRITE_TIMEOUT", 30),
-			IdleTimeout:  getEnvInt("SERVER_IDLE_TIMEOUT", 120),
-			Debug:        getEnvBool("DEBUG", false),
+			Port:            getEnvInt("SERVER_PORT", 8080),
+			ReadTimeout:     getEnvInt("SERVER_READ_TIMEOUT", 30),
+			WriteTimeout:    getEnvInt("SERVER_WRITE_TIMEOUT", 30),
+			IdleTimeout:     getEnvInt("SERVER_IDLE_TIMEOUT", 120),
+			BodyReadTimeout: getEnvInt("SERVER_BODY_READ_TIMEOUT", 0),
+			PrestopDelay:    getEnvInt("SERVER_PRESTOP_DELAY", 0),
+			Debug:           getEnvBool("DEBUG", false),
+			// gzip's standard level
+			CompressionLevel: getEnvInt("COMPRESSION_LEVEL", 6),
+			HealthCacheTTL:   getEnvInt("HEALTH_CACHE_TTL", 5),
+			// Uploads of large archives over slow links need longer than the other routes
+			UploadReadTimeout:  getEnvInt("SERVER_UPLOAD_READ_TIMEOUT", 300),
+			UploadWriteTimeout: getEnvInt("SERVER_UPLOAD_WRITE_TIMEOUT", 300),
 		},
 		Storage: StorageConfig{
-			Endpoint:      getEnvString("STORAGE_ENDPOINT", ""),
-			Region:        getEnvString("STORAGE_REGION", "us-east-1"),
-			Bucket:        getEnvString("STORAGE_BUCKET", "insights-ros-data"),
-			AccessKey:     getEnvString("STORAGE_ACCESS_KEY", ""),
-			SecretKey:     getEnvString("STORAGE_SECRET_KEY", ""),
-			UseSSL:        getEnvBool("STORAGE_USE_SSL", false),
-			URLExpiration: getEnvInt("STORAGE_URL_EXPIRATION", 172800), // 48 hours
-			PathPrefix:    getEnvString("STORAGE_PATH_PREFIX", "ros"),
+			Endpoint:              getEnvString("STORAGE_ENDPOINT", ""),
+			Region:                getEnvString("STORAGE_REGION", "us-east-1"),
+			Bucket:                getEnvString("STORAGE_BUCKET", "insights-ros-data"),
+			AccessKey:             getEnvString("STORAGE_ACCESS_KEY", ""),
+			SecretKey:             getEnvString("STORAGE_SECRET_KEY", ""),
+			UseSSL:                getEnvBool("STORAGE_USE_SSL", false),
+			URLExpiration:         getEnvInt("STORAGE_URL_EXPIRATION", 172800), // 48 hours
+			PathPrefix:            getEnvString("STORAGE_PATH_PREFIX", "ros"),
+			UsagePathPrefix:       getEnvString("STORAGE_USAGE_PATH_PREFIX", "usage"),
+			UncertifiedPathPrefix: getEnvString("STORAGE_UNCERTIFIED_PATH_PREFIX", ""),
+			LowercaseKeys:         getEnvBool("STORAGE_LOWERCASE_KEYS", false),
+			OnConflict:            getEnvString("STORAGE_ON_CONFLICT", "overwrite"),
+			MetadataSanitization:  getEnvString("STORAGE_METADATA_SANITIZATION", "encode"),
+			MinPresignExpiry:      getEnvInt("STORAGE_MIN_PRESIGN_EXPIRY", 0),
+			PartitionTimezone:     getEnvString("STORAGE_PARTITION_TIMEZONE", ""),
+			DateGranularity:       getEnvString("STORAGE_DATE_GRANULARITY", "day"),
+			WriteChecksumManifest: getEnvBool("STORAGE_WRITE_CHECKSUM_MANIFEST", false),
+			VerifyWrite:           getEnvBool("STORAGE_VERIFY_WRITE", false),
+			MaxConcurrentPresigns: getEnvInt("STORAGE_MAX_CONCURRENT_PRESIGNS", 0),
+			RetryBudgetRate:       getEnvInt("STORAGE_RETRY_BUDGET_RATE", 0),
+			RetryBudgetBurst:      getEnvInt("STORAGE_RETRY_BUDGET_BURST", 0),
 		},
 		Kafka: KafkaConfig{
-			Brokers:          getEnvStringSlice("KAFKA_BROKERS", []string{"localhost:9092"}),
-			Topic:            getEnvString("KAFKA_ROS_TOPIC", "hccm.ros.events"),
-			SecurityProtocol: getEnvString("KAFKA_SECURITY_PROTOCOL", "PLAINTEXT"),
-			SASLMechanism:    getEnvString("KAFKA_SASL_MECHANISM", ""),
-			SASLUsername:     getEnvString("KAFKA_SASL_USERNAME", ""),
-			SASLPassword:     getEnvString("KAFKA_SASL_PASSWORD", ""),
-			SSLCALocation:    getEnvString("KAFKA_SSL_CA_LOCATION", ""),
-			ClientID:         getEnvString("KAFKA_CLIENT_ID", "insights-ros-ingress"),
-			BatchSize:        getEnvInt("KAFKA_BATCH_SIZE", 16384),
-			Retries:          getEnvInt("KAFKA_RETRIES", 3),
+			Brokers:                   getEnvStringSlice("KAFKA_BROKERS", []string{"localhost:9092"}),
+			Topic:                     getEnvString("KAFKA_ROS_TOPIC", "hccm.ros.events"),
+			UsageTopic:                getEnvString("KAFKA_USAGE_TOPIC", "hccm.usage.events"),
+			UncertifiedTopic:          getEnvString("KAFKA_UNCERTIFIED_TOPIC", ""),
+			FallbackTopic:             getEnvString("KAFKA_FALLBACK_TOPIC", ""),
+			SecurityProtocol:          getEnvString("KAFKA_SECURITY_PROTOCOL", "PLAINTEXT"),
+			SASLMechanism:             getEnvString("KAFKA_SASL_MECHANISM", ""),
+			SASLUsername:              getEnvString("KAFKA_SASL_USERNAME", ""),
+			SASLPassword:              getEnvString("KAFKA_SASL_PASSWORD", ""),
+			SSLCALocation:             getEnvString("KAFKA_SSL_CA_LOCATION", ""),
+			ClientID:                  getEnvString("KAFKA_CLIENT_ID", "insights-ros-ingress"),
+			BatchSize:                 getEnvInt("KAFKA_BATCH_SIZE", 16384),
+			Retries:                   getEnvInt("KAFKA_RETRIES", 3),
+			QueueBufferingMaxMessages: getEnvInt("KAFKA_QUEUE_BUFFERING_MAX_MESSAGES", 10000),
+			QueueBufferingMaxKBytes:   getEnvInt("KAFKA_QUEUE_BUFFERING_MAX_KBYTES", 16384), // 16MB
+			ValueFormat:               getEnvString("KAFKA_VALUE_FORMAT", "json"),
+			SchemaRegistryURL:         getEnvString("KAFKA_SCHEMA_REGISTRY_URL", ""),
+			SchemaRegistrySubject:     getEnvString("KAFKA_SCHEMA_REGISTRY_SUBJECT", ""),
+			SchemaRegistryUsername:    getEnvString("KAFKA_SCHEMA_REGISTRY_USERNAME", ""),
+			SchemaRegistryPassword:    getEnvString("KAFKA_SCHEMA_REGISTRY_PASSWORD", ""),
+			MaxHeaders:                getEnvInt("KAFKA_MAX_HEADERS", 0),
+			MaxHeaderBytes:            getEnvInt("KAFKA_MAX_HEADER_BYTES", 0),
+			SignMessages:              getEnvBool("KAFKA_SIGN_MESSAGES", false),
+			SigningKey:                getEnvString("KAFKA_SIGNING_KEY", ""),
+			IdentityFormat:            getEnvString("KAFKA_IDENTITY_FORMAT", IdentityFormatToken),
 		},
 		Upload: UploadConfig{
-			MaxUploadSize: getEnvInt64("UPLOAD_MAX_SIZE", 100*1024*1024),  // 100MB
-			MaxMemory:     getEnvInt64("UPLOAD_MAX_MEMORY", 32*1024*1024), // 32MB
-			TempDir:       getEnvString("UPLOAD_TEMP_DIR", "/tmp"),
-			AllowedTypes:  getEnvStringSlice("UPLOAD_ALLOWED_TYPES", []string{"application/vnd.redhat.hccm.upload"}),
-			RequireAuth:   getEnvBool("UPLOAD_REQUIRE_AUTH", true),
+			MaxUploadSize:  getEnvInt64("UPLOAD_MAX_SIZE", 100*1024*1024),  // 100MB
+			MaxMemory:      getEnvInt64("UPLOAD_MAX_MEMORY", 32*1024*1024), // 32MB
+			TempDir:        getEnvString("UPLOAD_TEMP_DIR", "/tmp"),
+			AllowedTypes:   getEnvStringSlice("UPLOAD_ALLOWED_TYPES", []string{"application/vnd.redhat.hccm.upload"}),
+			AllowedMethods: getEnvStringSlice("UPLOAD_ALLOWED_METHODS", []string{http.MethodPost}),
+			RequireAuth:    getEnvBool("UPLOAD_REQUIRE_AUTH", true),
 
 			// TODO: Remove the validation topic from the config
 			ValidationTopic: getEnvString("KAFKA_VALIDATION_TOPIC", "platform.upload.validation"),
+
+			ForwardUsageFiles:        getEnvBool("UPLOAD_FORWARD_USAGE_FILES", false),
+			MaxConcurrentExtractions: getEnvInt("UPLOAD_MAX_CONCURRENT_EXTRACTIONS", 0),
+			ExtractionQueueTimeout:   getEnvInt("UPLOAD_EXTRACTION_QUEUE_TIMEOUT", 5),
+			SizeBuckets:              getEnvFloatSlice("UPLOAD_SIZE_BUCKETS", nil),
+			RequireContentLength:     getEnvBool("UPLOAD_REQUIRE_CONTENT_LENGTH", false),
+			ExtractionTimeout:        getEnvInt("UPLOAD_EXTRACTION_TIMEOUT", 0),
+			ValidateDateConsistency:  getEnvBool("UPLOAD_VALIDATE_DATE_CONSISTENCY", false),
+			StatusTTL:                getEnvInt("UPLOAD_STATUS_TTL", 3600),
+			MinOperatorVersion:       getEnvString("UPLOAD_MIN_OPERATOR_VERSION", ""),
+			AckMode:                  getEnvString("UPLOAD_ACK_MODE", "sync"),
+			ForbiddenFilePatterns:    getEnvStringSlice("UPLOAD_FORBIDDEN_FILE_PATTERNS", []string{}),
+			ReprocessEnabled:         getEnvBool("UPLOAD_REPROCESS_ENABLED", false),
+			AllowedEncodings:         getEnvStringSlice("UPLOAD_ALLOWED_ENCODINGS", []string{"identity", "gzip"}),
+			EmptyOrgSchema:           getEnvString("UPLOAD_EMPTY_ORG_SCHEMA", "default"),
+			DefaultSchema:            getEnvString("UPLOAD_DEFAULT_SCHEMA", "default"),
+			InferROSFromFiles:        getEnvBool("UPLOAD_INFER_ROS_FROM_FILES", false),
+			ROSFilePatterns:          getEnvStringSlice("UPLOAD_ROS_FILE_PATTERNS", []string{"*ros-openshift*.csv"}),
+			ClusterConcurrency:       getEnvString("UPLOAD_CLUSTER_CONCURRENCY", "last-writer-wins"),
+			MaxTotalROSBytes:         getEnvInt64("UPLOAD_MAX_TOTAL_ROS_BYTES", 0),
+			MaxSizeByType:            getEnvInt64Map("UPLOAD_MAX_SIZE_BY_TYPE", nil),
+			RequireManifestUUID:      getEnvBool("UPLOAD_REQUIRE_MANIFEST_UUID_HEADER", false),
+			StrictManifestFields:     getEnvBool("UPLOAD_STRICT_MANIFEST_FIELDS", false),
+			AcceptRawBody:            getEnvBool("UPLOAD_ACCEPT_RAW_BODY", false),
+			KeepFailedPayloads:       getEnvInt("UPLOAD_KEEP_FAILED_PAYLOADS", 0),
+			MaxFailedPayloads:        getEnvInt("UPLOAD_MAX_FAILED_PAYLOADS", 20),
+			RejectEmptyManifestEarly: getEnvBool("UPLOAD_REJECT_EMPTY_MANIFEST_EARLY", false),
+			RejectTrailingData:       getEnvBool("UPLOAD_REJECT_TRAILING_DATA", false),
+			RequireCertified:         getEnvBool("UPLOAD_REQUIRE_CERTIFIED", false),
 		},
 		Logging: LoggingConfig{
-			Level:  getEnvString("LOG_LEVEL", "info"),
-			Format: getEnvString("LOG_FORMAT", "json"),
-			Output: getEnvString("LOG_OUTPUT", "stdout"),
+			Level:           getEnvString("LOG_LEVEL", "info"),
+			Format:          getEnvString("LOG_FORMAT", "json"),
+			Output:          getEnvString("LOG_OUTPUT", "stdout"),
+			TimestampFormat: getEnvString("LOG_TIMESTAMP_FORMAT", "default"),
 		},
 		Metrics: MetricsConfig{
 			Enabled: getEnvBool("METRICS_ENABLED", true),
 			Path:    getEnvString("METRICS_PATH", "/metrics"),
 			Port:    getEnvInt("METRICS_PORT", 8080),
+
+			Namespace: getEnvString("METRICS_NAMESPACE", ""),
+			Subsystem: getEnvString("METRICS_SUBSYSTEM", ""),
 		},
 		Auth: AuthConfig{
-			Enabled:     getEnvBool("AUTH_ENABLED", true),
-			JWTSecret:   getEnvString("JWT_SECRET", ""),
-			AllowedOrgs: getEnvStringSlice("AUTH_ALLOWED_ORGS", []string{}),
+			Enabled:           getEnvBool("AUTH_ENABLED", true),
+			Mode:              getEnvString("AUTH_MODE", AuthModeK8s),
+			JWTSecret:         getEnvString("JWT_SECRET", ""),
+			AllowedOrgs:       getEnvStringSlice("AUTH_ALLOWED_ORGS", []string{}),
+			RequireNumericIDs: getEnvBool("AUTH_REQUIRE_NUMERIC_IDS", false),
+			IdentityCacheTTL:  getEnvInt("AUTH_IDENTITY_CACHE_TTL", 0),
+			SynthesizeEmail:   getEnvBool("AUTH_SYNTHESIZE_EMAIL", false),
+			RequireEmail:      getEnvBool("AUTH_REQUIRE_EMAIL", false),
+			AdminGroups:       getEnvStringSlice("AUTH_ADMIN_GROUPS", []string{}),
+			InternalGroups:    getEnvStringSlice("AUTH_INTERNAL_GROUPS", []string{}),
+			DeniedOrgs:        getEnvStringSlice("AUTH_DENIED_ORGS", []string{}),
+			AccountClaimPath:  getEnvString("AUTH_ACCOUNT_CLAIM_PATH", ""),
+			DefaultOrgID:      getEnvString("AUTH_DEFAULT_ORG_ID", "1"),
+			DefaultAccount:    getEnvString("AUTH_DEFAULT_ACCOUNT", "1"),
+			RequireOrgID:      getEnvBool("AUTH_REQUIRE_ORG_ID", false),
+			RejectDefaultOrg:  getEnvBool("AUTH_REJECT_DEFAULT_ORG", false),
+			TrustRHIdentity:   getEnvBool("AUTH_TRUST_RH_IDENTITY", false),
+
+			OrgGroupPrefix:     getEnvString("AUTH_ORG_GROUP_PREFIX", DefaultOrgGroupPrefix),
+			AccountGroupPrefix: getEnvString("AUTH_ACCOUNT_GROUP_PREFIX", DefaultAccountGroupPrefix),
+			OrgClaimKeys:       getEnvStringSlice("AUTH_ORG_CLAIM_KEYS", DefaultOrgClaimKeys()),
+			AccountClaimKeys:   getEnvStringSlice("AUTH_ACCOUNT_CLAIM_KEYS", DefaultAccountClaimKeys()),
+
+			JWKSURL:             getEnvString("AUTH_JWKS_URL", ""),
+			JWTIssuer:           getEnvString("AUTH_JWT_ISSUER", ""),
+			JWTAudience:         getEnvString("AUTH_JWT_AUDIENCE", ""),
+			JWKSRefreshInterval: getEnvInt("AUTH_JWKS_REFRESH_INTERVAL", 300),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   getEnvStringSlice("CORS_ALLOWED_ORIGINS", []string{}),
+			AllowedHeaders:   getEnvStringSlice("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type"}),
+			AllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		},
+		Reload: ReloadConfig{
+			Dir:      getEnvString("CONFIG_DIR", ""),
+			Interval: getEnvInt("CONFIG_RELOAD_INTERVAL", 10),
+		},
+		Enrichment: EnrichmentConfig{
+			URL:      getEnvString("ENRICHMENT_URL", ""),
+			CacheTTL: getEnvInt("ENRICHMENT_CACHE_TTL", 300),
+			Timeout:  getEnvInt("ENRICHMENT_TIMEOUT", 2),
+		},
+		Outbox: OutboxConfig{
+			Dir:           getEnvString("OUTBOX_DIR", ""),
+			RelayInterval: getEnvInt("OUTBOX_RELAY_INTERVAL", 30),
+			RelayDelay:    getEnvInt("OUTBOX_RELAY_DELAY", 60),
 		},
 	}
 
@@ -155,6 +526,22 @@ func Load() (*Config, error) {
 
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
+	// Server validation
+	if c.Server.PrestopDelay < 0 {
+		return fmt.Errorf("server prestop delay must not be negative")
+	}
+	if c.Server.HealthCacheTTL < 0 {
+		return fmt.Errorf("health cache TTL must not be negative")
+	}
+	if c.Server.UploadReadTimeout < 0 || c.Server.UploadWriteTimeout < 0 {
+		return fmt.Errorf("server upload timeouts must not be negative")
+	}
+
+	// Compression level validation, zero leaves the standard level
+	if c.Server.CompressionLevel != 0 && (c.Server.CompressionLevel < gzip.BestSpeed || c.Server.CompressionLevel > gzip.BestCompression) {
+		return fmt.Errorf("compression level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+	}
+
 	// Storage validation
 	if c.Storage.Endpoint == "" {
 		return fmt.Errorf("storage endpoint is required")
@@ -163,6 +550,42 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("storage credentials are required")
 	}
 
+	switch c.Storage.OnConflict {
+	case "", "overwrite", "reject", "skip-identical":
+	default:
+		return fmt.Errorf("storage on-conflict policy must be one of overwrite, reject, skip-identical")
+	}
+
+	// Consumers fetching files after their URLs expire lose the upload
+	if c.Storage.MinPresignExpiry < 0 {
+		return fmt.Errorf("storage minimum presign expiry must not be negative")
+	}
+	if c.Storage.URLExpiration < c.Storage.MinPresignExpiry {
+		return fmt.Errorf("storage URL expiration (%ds) is below the minimum presign expiry (%ds)", c.Storage.URLExpiration, c.Storage.MinPresignExpiry)
+	}
+
+	if c.Storage.MaxConcurrentPresigns < 0 {
+		return fmt.Errorf("storage max concurrent presigns must not be negative")
+	}
+
+	if c.Storage.PartitionTimezone != "" {
+		if _, err := time.LoadLocation(c.Storage.PartitionTimezone); err != nil {
+			return fmt.Errorf("invalid storage partition timezone %q: %w", c.Storage.PartitionTimezone, err)
+		}
+	}
+
+	switch c.Storage.DateGranularity {
+	case "", "hour", "day", "month":
+	default:
+		return fmt.Errorf("storage date granularity must be one of hour, day, month")
+	}
+
+	switch c.Storage.MetadataSanitization {
+	case "", "encode", "strip":
+	default:
+		return fmt.Errorf("storage metadata sanitization must be one of encode, strip")
+	}
+
 	// Kafka validation
 	if len(c.Kafka.Brokers) == 0 {
 		return fmt.Errorf("kafka brokers are required")
@@ -170,11 +593,227 @@ func (c *Config) Validate() error {
 	if c.Kafka.Topic == "" {
 		return fmt.Errorf("kafka topic is required")
 	}
+	if c.Kafka.QueueBufferingMaxMessages < 0 || c.Kafka.QueueBufferingMaxKBytes < 0 {
+		return fmt.Errorf("kafka queue buffering limits must not be negative")
+	}
+	if c.Kafka.MaxHeaders < 0 || c.Kafka.MaxHeaderBytes < 0 {
+		return fmt.Errorf("kafka header limits must not be negative")
+	}
+	if c.Kafka.SignMessages && c.Kafka.SigningKey == "" {
+		return fmt.Errorf("kafka signing key is required when message signing is enabled")
+	}
+	switch c.Kafka.IdentityFormat {
+	case "", IdentityFormatToken, IdentityFormatRHIdentity:
+	default:
+		return fmt.Errorf("kafka identity format must be one of %s, %s", IdentityFormatToken, IdentityFormatRHIdentity)
+	}
+	switch c.Kafka.ValueFormat {
+	case "", "json":
+	case "avro", "jsonschema":
+		if c.Kafka.SchemaRegistryURL == "" {
+			return fmt.Errorf("kafka schema registry URL is required for the %s value format", c.Kafka.ValueFormat)
+		}
+	default:
+		return fmt.Errorf("kafka value format must be one of json, avro, jsonschema")
+	}
+
+	// Usage forwarding validation
+	if c.Upload.ForwardUsageFiles {
+		if c.Kafka.UsageTopic == "" {
+			return fmt.Errorf("kafka usage topic is required when usage forwarding is enabled")
+		}
+		if c.Storage.UsagePathPrefix == "" {
+			return fmt.Errorf("storage usage path prefix is required when usage forwarding is enabled")
+		}
+	}
+
+	// Upload method validation
+	for _, method := range c.Upload.AllowedMethods {
+		switch method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			return fmt.Errorf("upload allowed methods must be one of POST, PUT, PATCH")
+		}
+	}
+
+	// Upload encoding validation
+	for _, encoding := range c.Upload.AllowedEncodings {
+		switch encoding {
+		case "identity", "gzip":
+		default:
+			return fmt.Errorf("upload allowed encodings must be one of identity, gzip")
+		}
+	}
+
+	// Empty org schema validation
+	switch c.Upload.EmptyOrgSchema {
+	case "", "default", "account", "reject":
+	default:
+		return fmt.Errorf("upload empty org schema must be one of default, account, reject")
+	}
+
+	if c.Upload.MaxTotalROSBytes < 0 {
+		return fmt.Errorf("upload max total ROS bytes must not be negative")
+	}
+	for contentType, maxSize := range c.Upload.MaxSizeByType {
+		if maxSize <= 0 {
+			return fmt.Errorf("upload max size for content type %q must be positive", contentType)
+		}
+	}
+
+	// Cluster concurrency validation
+	switch c.Upload.ClusterConcurrency {
+	case "", "last-writer-wins", "serialize":
+	default:
+		return fmt.Errorf("upload cluster concurrency must be one of last-writer-wins, serialize")
+	}
+
+	// Ack mode validation
+	switch c.Upload.AckMode {
+	case "", "sync", "async":
+	default:
+		return fmt.Errorf("upload ack mode must be one of sync, async")
+	}
+
+	// Reprocessing reruns raw payload archives, which nothing writes yet
+	if c.Upload.ReprocessEnabled {
+		return fmt.Errorf("upload reprocessing can't be enabled until raw payload archiving is available")
+	}
+
+	// Forbidden file pattern validation
+	for _, pattern := range c.Upload.ForbiddenFilePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid forbidden file pattern %q: %w", pattern, err)
+		}
+	}
+
+	// ROS file pattern validation
+	for _, pattern := range c.Upload.ROSFilePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ROS file pattern %q: %w", pattern, err)
+		}
+	}
+	if c.Upload.InferROSFromFiles && len(c.Upload.ROSFilePatterns) == 0 {
+		return fmt.Errorf("ROS file patterns are required when inferring ROS files")
+	}
+
+	// Extraction limiter validation
+	if c.Upload.MaxConcurrentExtractions < 0 {
+		return fmt.Errorf("max concurrent extractions must not be negative")
+	}
+	if c.Upload.ExtractionQueueTimeout < 0 {
+		return fmt.Errorf("extraction queue timeout must not be negative")
+	}
+	if c.Upload.ExtractionTimeout < 0 {
+		return fmt.Errorf("extraction timeout must not be negative")
+	}
+	if c.Upload.KeepFailedPayloads < 0 || c.Upload.MaxFailedPayloads < 0 {
+		return fmt.Errorf("failed payload retention must not be negative")
+	}
+
+	switch strings.ToLower(c.Logging.TimestampFormat) {
+	case "", "default", "rfc3339", "epoch_millis":
+	default:
+		return fmt.Errorf("log timestamp format must be one of default, rfc3339, epoch_millis")
+	}
+
+	// Histogram bucket validation
+	for i, bucket := range c.Upload.SizeBuckets {
+		if bucket <= 0 || (i > 0 && bucket <= c.Upload.SizeBuckets[i-1]) {
+			return fmt.Errorf("upload size buckets must be positive and strictly increasing")
+		}
+	}
+
+	// Operator version gate validation
+	if c.Upload.MinOperatorVersion != "" {
+		if _, err := semver.NewVersion(c.Upload.MinOperatorVersion); err != nil {
+			return fmt.Errorf("minimum operator version must be a valid semver: %w", err)
+		}
+	}
+
+	// Metric name prefix validation
+	for _, part := range []string{c.Metrics.Namespace, c.Metrics.Subsystem} {
+		if part != "" && !metricNamePart.MatchString(part) {
+			return fmt.Errorf("metrics namespace and subsystem must be valid Prometheus metric name parts, got %q", part)
+		}
+	}
 
 	// Auth validation
 	if c.Auth.Enabled && c.Auth.JWTSecret == "" {
 		return fmt.Errorf("JWT secret is required when auth is enabled")
 	}
+	if c.Auth.IdentityCacheTTL < 0 {
+		return fmt.Errorf("identity cache TTL must not be negative")
+	}
+	for _, pattern := range c.Auth.AdminGroups {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid admin group pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range c.Auth.InternalGroups {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid internal group pattern %q: %w", pattern, err)
+		}
+	}
+	switch c.Auth.Mode {
+	case "", AuthModeK8s:
+	case AuthModeNoop:
+		// noop authenticates no user, so with auth enabled only trusted x-rh-identity headers can identify uploads
+		if c.Auth.Enabled && !c.Auth.TrustRHIdentity {
+			return fmt.Errorf("auth mode %s requires auth to be disabled or x-rh-identity headers to be trusted", AuthModeNoop)
+		}
+	case AuthModeJWKS:
+		u, err := url.Parse(c.Auth.JWKSURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("JWKS URL must be an absolute URL when auth mode is %s", AuthModeJWKS)
+		}
+		// Whoever can tamper with the key fetch can publish signing keys of their own
+		if u.Scheme != "https" {
+			return fmt.Errorf("JWKS URL must use https, got %s", u.Scheme)
+		}
+		if c.Auth.JWKSRefreshInterval <= 0 {
+			return fmt.Errorf("JWKS refresh interval must be positive")
+		}
+		// A realm signs tokens for all of its clients, only the issuer and audience tell ours apart
+		if c.Auth.JWTIssuer == "" || c.Auth.JWTAudience == "" {
+			return fmt.Errorf("JWT issuer and audience are required when auth mode is %s", AuthModeJWKS)
+		}
+	default:
+		return fmt.Errorf("auth mode must be one of %s, %s or %s, got %q", AuthModeK8s, AuthModeJWKS, AuthModeNoop, c.Auth.Mode)
+	}
+
+	// CORS validation
+	if c.CORS.AllowCredentials && slices.Contains(c.CORS.AllowedOrigins, "*") {
+		return fmt.Errorf("cors credentials cannot be allowed for a wildcard origin")
+	}
+
+	// Config reload validation
+	if c.Reload.Dir != "" && c.Reload.Interval <= 0 {
+		return fmt.Errorf("config reload interval must be positive")
+	}
+
+	// Storage retry budget validation
+	if c.Storage.RetryBudgetRate < 0 || c.Storage.RetryBudgetBurst < 0 {
+		return fmt.Errorf("storage retry budget rate and burst must not be negative")
+	}
+
+	// Enrichment validation
+	if c.Enrichment.CacheTTL < 0 || c.Enrichment.Timeout < 0 {
+		return fmt.Errorf("enrichment cache TTL and timeout must not be negative")
+	}
+	if c.Enrichment.URL != "" {
+		if u, err := url.Parse(c.Enrichment.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("enrichment URL must be an absolute URL")
+		}
+	}
+
+	// Outbox validation
+	if c.Outbox.Dir != "" && c.Outbox.RelayInterval <= 0 {
+		return fmt.Errorf("outbox relay interval must be positive")
+	}
+	if c.Outbox.RelayDelay < 0 {
+		return fmt.Errorf("outbox relay delay must not be negative")
+	}
 
 	return nil
 }
@@ -237,3 +876,40 @@ func getEnvStringSlice(key string, defaultValue []string) []string {
 	}
 	return defaultValue
 }
+
+func getEnvFloatSlice(key string, defaultValue []float64) []float64 {
+	if value := os.Getenv(key); value != "" {
+		var values []float64
+		for _, item := range strings.Split(value, ",") {
+			floatValue, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+			if err != nil {
+				return defaultValue
+			}
+			values = append(values, floatValue)
+		}
+		return values
+	}
+	return defaultValue
+}
+
+// getEnvInt64Map parses "key=value" pairs separated by commas, e.g. "text/csv=10485760,application/gzip=104857600"
+// Any malformed pair keeps the default
+func getEnvInt64Map(key string, defaultValue map[string]int64) map[string]int64 {
+	if value := os.Getenv(key); value != "" {
+		values := make(map[string]int64)
+		for _, item := range strings.Split(value, ",") {
+			name, number, ok := strings.Cut(item, "=")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				return defaultValue
+			}
+			intValue, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+			if err != nil {
+				return defaultValue
+			}
+			values[name] = intValue
+		}
+		return values
+	}
+	return defaultValue
+}
@@ -51,6 +51,245 @@ var _ = Describe("Configuration Loading", func() {
 			Expect(cfg.Storage.SecretKey).To(Equal("test-secret-key"))
 			Expect(cfg.Auth.Enabled).To(BeFalse())
 		})
+
+		It("should only allow POST uploads by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.AllowedMethods).To(Equal([]string{"POST"}))
+		})
+
+		It("should accept identity and gzip encoded uploads by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.AllowedEncodings).To(Equal([]string{"identity", "gzip"}))
+		})
+
+		It("should not bound payload extraction time by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.ExtractionTimeout).To(BeZero())
+		})
+
+		It("should give the upload route longer timeouts than the server defaults", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Server.UploadReadTimeout).To(BeNumerically(">", cfg.Server.ReadTimeout))
+			Expect(cfg.Server.UploadWriteTimeout).To(BeNumerically(">", cfg.Server.WriteTimeout))
+		})
+
+		It("should use the default schema for identities without an org by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.EmptyOrgSchema).To(Equal("default"))
+			Expect(cfg.Upload.DefaultSchema).To(Equal("default"))
+		})
+
+		It("should use the standard compression level by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Server.CompressionLevel).To(Equal(6))
+		})
+
+		It("should cache health check results for a few seconds by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Server.HealthCacheTTL).To(Equal(5))
+		})
+
+		It("should fall back to org and account 1 without requiring an org ID by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.DefaultOrgID).To(Equal("1"))
+			Expect(cfg.Auth.DefaultAccount).To(Equal("1"))
+			Expect(cfg.Auth.RequireOrgID).To(BeFalse())
+			Expect(cfg.Auth.RejectDefaultOrg).To(BeFalse())
+			Expect(cfg.Auth.TrustRHIdentity).To(BeFalse())
+		})
+
+		It("should use the built-in org and account mappings by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.OrgGroupPrefix).To(Equal("org:"))
+			Expect(cfg.Auth.AccountGroupPrefix).To(Equal("account:"))
+			Expect(cfg.Auth.OrgClaimKeys).To(Equal([]string{"org_id"}))
+			Expect(cfg.Auth.AccountClaimKeys).To(Equal([]string{"account_number", "customer_id", "client_id"}))
+		})
+
+		It("should read the org and account mappings from the environment", func() {
+			GinkgoT().Setenv("AUTH_ORG_GROUP_PREFIX", "tenant/")
+			GinkgoT().Setenv("AUTH_ACCOUNT_GROUP_PREFIX", "ebs=")
+			GinkgoT().Setenv("AUTH_ORG_CLAIM_KEYS", "tenant_id,organization")
+			GinkgoT().Setenv("AUTH_ACCOUNT_CLAIM_KEYS", "ebs_number")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.OrgGroupPrefix).To(Equal("tenant/"))
+			Expect(cfg.Auth.AccountGroupPrefix).To(Equal("ebs="))
+			Expect(cfg.Auth.OrgClaimKeys).To(Equal([]string{"tenant_id", "organization"}))
+			Expect(cfg.Auth.AccountClaimKeys).To(Equal([]string{"ebs_number"}))
+		})
+
+		It("should read the identity fallbacks from the environment", func() {
+			GinkgoT().Setenv("AUTH_DEFAULT_ORG_ID", "0")
+			GinkgoT().Setenv("AUTH_DEFAULT_ACCOUNT", "0")
+			GinkgoT().Setenv("AUTH_REQUIRE_ORG_ID", "true")
+			GinkgoT().Setenv("AUTH_REJECT_DEFAULT_ORG", "true")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.DefaultOrgID).To(Equal("0"))
+			Expect(cfg.Auth.DefaultAccount).To(Equal("0"))
+			Expect(cfg.Auth.RequireOrgID).To(BeTrue())
+			Expect(cfg.Auth.RejectDefaultOrg).To(BeTrue())
+		})
+
+		It("should encode illegal object metadata characters by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Storage.MetadataSanitization).To(Equal("encode"))
+		})
+
+		It("should fail to load when the presigned URL expiry is below the required minimum", func() {
+			GinkgoT().Setenv("STORAGE_URL_EXPIRATION", "3600")
+			GinkgoT().Setenv("STORAGE_MIN_PRESIGN_EXPIRY", "86400")
+
+			_, err := config.Load()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage URL expiration (3600s) is below the minimum presign expiry (86400s)"))
+		})
+
+		It("should load when the presigned URL expiry meets the required minimum", func() {
+			GinkgoT().Setenv("STORAGE_MIN_PRESIGN_EXPIRY", "172800")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Storage.MinPresignExpiry).To(Equal(172800))
+		})
+
+		It("should send the caller's token in events by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Kafka.IdentityFormat).To(Equal(config.IdentityFormatToken))
+		})
+
+		It("should load the rh-identity event identity format", func() {
+			GinkgoT().Setenv("KAFKA_IDENTITY_FORMAT", "rh-identity")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Kafka.IdentityFormat).To(Equal(config.IdentityFormatRHIdentity))
+		})
+
+		It("should validate tokens with TokenReview by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.Mode).To(Equal(config.AuthModeK8s))
+			Expect(cfg.Auth.JWKSRefreshInterval).To(Equal(300))
+		})
+
+		It("should load the JWKS settings in jwks auth mode", func() {
+			GinkgoT().Setenv("AUTH_MODE", "jwks")
+			GinkgoT().Setenv("AUTH_JWKS_URL", "https://sso.example.com/realms/ros/protocol/openid-connect/certs")
+			GinkgoT().Setenv("AUTH_JWKS_REFRESH_INTERVAL", "60")
+			GinkgoT().Setenv("AUTH_JWT_ISSUER", "https://sso.example.com/realms/ros")
+			GinkgoT().Setenv("AUTH_JWT_AUDIENCE", "ros-ingress")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.Mode).To(Equal(config.AuthModeJWKS))
+			Expect(cfg.Auth.JWKSURL).To(Equal("https://sso.example.com/realms/ros/protocol/openid-connect/certs"))
+			Expect(cfg.Auth.JWKSRefreshInterval).To(Equal(60))
+			Expect(cfg.Auth.JWTIssuer).To(Equal("https://sso.example.com/realms/ros"))
+			Expect(cfg.Auth.JWTAudience).To(Equal("ros-ingress"))
+		})
+
+		It("should fail to load an unknown auth mode", func() {
+			GinkgoT().Setenv("AUTH_MODE", "basic")
+
+			_, err := config.Load()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`auth mode must be one of k8s, jwks or noop, got "basic"`))
+		})
+
+		It("should load noop auth mode with auth disabled", func() {
+			GinkgoT().Setenv("AUTH_MODE", "noop")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Auth.Mode).To(Equal(config.AuthModeNoop))
+		})
+
+		It("should fail to load noop auth mode with auth enabled", func() {
+			GinkgoT().Setenv("AUTH_MODE", "noop")
+			GinkgoT().Setenv("AUTH_ENABLED", "true")
+			GinkgoT().Setenv("JWT_SECRET", "secret")
+
+			_, err := config.Load()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("auth mode noop requires auth to be disabled or x-rh-identity headers to be trusted"))
+		})
+
+		It("should load noop auth mode with auth enabled behind a trusted identity proxy", func() {
+			GinkgoT().Setenv("AUTH_MODE", "noop")
+			GinkgoT().Setenv("AUTH_ENABLED", "true")
+			GinkgoT().Setenv("JWT_SECRET", "secret")
+			GinkgoT().Setenv("AUTH_TRUST_RH_IDENTITY", "true")
+
+			_, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should acknowledge uploads synchronously by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.AckMode).To(Equal("sync"))
+		})
+
+		It("should disable CORS by default", func() {
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.CORS.AllowedOrigins).To(BeEmpty())
+			Expect(cfg.CORS.AllowCredentials).To(BeFalse())
+		})
+
+		It("should parse custom upload size buckets", func() {
+			Expect(os.Setenv("UPLOAD_SIZE_BUCKETS", "1048576, 5242880,52428800")).To(Succeed())
+			DeferCleanup(os.Unsetenv, "UPLOAD_SIZE_BUCKETS")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.SizeBuckets).To(Equal([]float64{1048576, 5242880, 52428800}))
+		})
+
+		It("should keep the default upload size buckets when the value is malformed", func() {
+			Expect(os.Setenv("UPLOAD_SIZE_BUCKETS", "1MB,5MB")).To(Succeed())
+			DeferCleanup(os.Unsetenv, "UPLOAD_SIZE_BUCKETS")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.SizeBuckets).To(BeEmpty())
+		})
+
+		It("should parse upload size limits by content type", func() {
+			Expect(os.Setenv("UPLOAD_MAX_SIZE_BY_TYPE", "application/gzip=52428800, text/csv = 1048576")).To(Succeed())
+			DeferCleanup(os.Unsetenv, "UPLOAD_MAX_SIZE_BY_TYPE")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.MaxSizeByType).To(Equal(map[string]int64{
+				"application/gzip": 52428800,
+				"text/csv":         1048576,
+			}))
+		})
+
+		It("should ignore upload size limits by content type when the value is malformed", func() {
+			Expect(os.Setenv("UPLOAD_MAX_SIZE_BY_TYPE", "application/gzip=50MB")).To(Succeed())
+			DeferCleanup(os.Unsetenv, "UPLOAD_MAX_SIZE_BY_TYPE")
+
+			cfg, err := config.Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Upload.MaxSizeByType).To(BeEmpty())
+		})
 	})
 })
 
@@ -176,7 +415,7 @@ var _ = Describe("Configuration Validation", func() {
 		})
 	})
 
-	Context("With auth enabled but missing JWT secret", func() {
+	Context("With an invalid minimum operator version", func() {
 		It("should return validation error", func() {
 			cfg := &config.Config{
 				Storage: config.StorageConfig{
@@ -188,15 +427,935 @@ var _ = Describe("Configuration Validation", func() {
 					Brokers: []string{"localhost:9092"},
 					Topic:   "test-topic",
 				},
-				Auth: config.AuthConfig{
-					Enabled:   true,
-					JWTSecret: "",
+				Upload: config.UploadConfig{
+					MinOperatorVersion: "not-a-version",
 				},
 			}
 
 			err := cfg.Validate()
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("JWT secret is required when auth is enabled"))
+			Expect(err.Error()).To(ContainSubstring("minimum operator version must be a valid semver"))
+		})
+	})
+
+	Context("With unordered upload size buckets", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					SizeBuckets: []float64{1048576, 1024},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload size buckets must be positive and strictly increasing"))
+		})
+	})
+
+	Context("With an unsupported upload method", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					AllowedMethods: []string{"POST", "GET"},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload allowed methods must be one of POST, PUT, PATCH"))
+		})
+	})
+
+	Context("With an unsupported upload encoding", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					AllowedEncodings: []string{"identity", "br"},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload allowed encodings must be one of identity, gzip"))
+		})
+	})
+
+	Context("With an invalid empty org schema mode", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					EmptyOrgSchema: "guess",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload empty org schema must be one of default, account, reject"))
+		})
+	})
+
+	Context("With an on-conflict policy", func() {
+		newConfig := func(policy string) *config.Config {
+			return &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:   "localhost:9000",
+					AccessKey:  "test-key",
+					SecretKey:  "test-secret",
+					OnConflict: policy,
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+		}
+
+		It("should accept skip-identical", func() {
+			Expect(newConfig("skip-identical").Validate()).To(Succeed())
+		})
+
+		It("should return validation error for an unknown policy", func() {
+			err := newConfig("merge").Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage on-conflict policy must be one of overwrite, reject, skip-identical"))
+		})
+	})
+
+	Context("With ROS file inference enabled but no ROS file patterns", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					InferROSFromFiles: true,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ROS file patterns are required when inferring ROS files"))
+		})
+	})
+
+	Context("With a negative upload read timeout", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Server: config.ServerConfig{
+					UploadReadTimeout: -1,
+				},
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("server upload timeouts must not be negative"))
+		})
+	})
+
+	Context("With a schema registry value format but no registry URL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers:     []string{"localhost:9092"},
+					Topic:       "test-topic",
+					ValueFormat: "avro",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("kafka schema registry URL is required for the avro value format"))
+		})
+	})
+
+	Context("With an unsupported value format", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers:           []string{"localhost:9092"},
+					Topic:             "test-topic",
+					ValueFormat:       "protobuf",
+					SchemaRegistryURL: "http://registry:8081",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("kafka value format must be one of json, avro, jsonschema"))
+		})
+	})
+
+	Context("With an unsupported identity format", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers:        []string{"localhost:9092"},
+					Topic:          "test-topic",
+					IdentityFormat: "jwt",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("kafka identity format must be one of token, rh-identity"))
+		})
+	})
+
+	Context("With an invalid cluster concurrency", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					ClusterConcurrency: "first-writer-wins",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload cluster concurrency must be one of last-writer-wins, serialize"))
+		})
+	})
+
+	Context("With a config directory and no reload interval", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Reload: config.ReloadConfig{
+					Dir: "/etc/insights-ros-ingress",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("config reload interval must be positive"))
+		})
+	})
+
+	Context("With a non-positive upload size limit for a content type", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					MaxSizeByType: map[string]int64{"application/gzip": 0},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`upload max size for content type "application/gzip" must be positive`))
+		})
+	})
+
+	Context("With an invalid admin group pattern", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					AdminGroups: []string{"org-[admin"},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`invalid admin group pattern "org-[admin"`))
+		})
+	})
+
+	Context("With a negative max total ROS bytes", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					MaxTotalROSBytes: -1,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload max total ROS bytes must not be negative"))
+		})
+	})
+
+	Context("With a negative failed payload retention", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					KeepFailedPayloads: -1,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("failed payload retention must not be negative"))
+		})
+	})
+
+	Context("With an invalid metrics namespace", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Metrics: config.MetricsConfig{
+					Namespace: "ros-ingress",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("metrics namespace and subsystem must be valid Prometheus metric name parts"))
+		})
+	})
+
+	Context("With an unknown storage date granularity", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:        "localhost:9000",
+					AccessKey:       "test-key",
+					SecretKey:       "test-secret",
+					DateGranularity: "week",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage date granularity must be one of hour, day, month"))
+		})
+	})
+
+	Context("With a negative retry budget", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:        "localhost:9000",
+					AccessKey:       "test-key",
+					SecretKey:       "test-secret",
+					RetryBudgetRate: -1,
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage retry budget rate and burst must not be negative"))
+		})
+	})
+
+	Context("With a relative enrichment URL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Enrichment: config.EnrichmentConfig{
+					URL: "orgs/metadata",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("enrichment URL must be an absolute URL"))
+		})
+	})
+
+	Context("With an outbox and no relay interval", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Outbox: config.OutboxConfig{
+					Dir: "/var/lib/ros-ingress/outbox",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("outbox relay interval must be positive"))
+		})
+	})
+
+	Context("With message signing and no signing key", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers:      []string{"localhost:9092"},
+					Topic:        "test-topic",
+					SignMessages: true,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("kafka signing key is required when message signing is enabled"))
+		})
+	})
+
+	Context("With a negative max concurrent presigns", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:              "localhost:9000",
+					AccessKey:             "test-key",
+					SecretKey:             "test-secret",
+					MaxConcurrentPresigns: -1,
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage max concurrent presigns must not be negative"))
+		})
+	})
+
+	Context("With an unknown log timestamp format", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Logging: config.LoggingConfig{
+					TimestampFormat: "unix",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("log timestamp format must be one of"))
+		})
+	})
+
+	Context("With an out of range compression level", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Server: config.ServerConfig{
+					CompressionLevel: 10,
+				},
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("compression level must be between 1 and 9"))
+		})
+	})
+
+	Context("With a negative health cache TTL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Server: config.ServerConfig{
+					HealthCacheTTL: -1,
+				},
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("health cache TTL must not be negative"))
+		})
+	})
+
+	Context("With a negative minimum presign expiry", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:         "localhost:9000",
+					AccessKey:        "test-key",
+					SecretKey:        "test-secret",
+					MinPresignExpiry: -1,
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage minimum presign expiry must not be negative"))
+		})
+	})
+
+	Context("With an unknown partition timezone", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:          "localhost:9000",
+					AccessKey:         "test-key",
+					SecretKey:         "test-secret",
+					PartitionTimezone: "Mars/Olympus_Mons",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid storage partition timezone"))
+		})
+	})
+
+	Context("With an unknown metadata sanitization mode", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:             "localhost:9000",
+					AccessKey:            "test-key",
+					SecretKey:            "test-secret",
+					MetadataSanitization: "drop",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("storage metadata sanitization must be one of encode, strip"))
+		})
+	})
+
+	Context("With an unknown upload ack mode", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					AckMode: "eventually",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload ack mode must be one of sync, async"))
+		})
+	})
+
+	Context("With upload reprocessing enabled", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					ReprocessEnabled: true,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upload reprocessing can't be enabled until raw payload archiving is available"))
+		})
+	})
+
+	Context("With a malformed forbidden file pattern", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Upload: config.UploadConfig{
+					ForbiddenFilePatterns: []string{"[.ssh"},
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid forbidden file pattern"))
+		})
+	})
+
+	Context("With CORS credentials allowed for a wildcard origin", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				CORS: config.CORSConfig{
+					AllowedOrigins:   []string{"*"},
+					AllowCredentials: true,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cors credentials cannot be allowed for a wildcard origin"))
+		})
+	})
+
+	Context("With auth enabled but missing JWT secret", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Enabled:   true,
+					JWTSecret: "",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWT secret is required when auth is enabled"))
+		})
+	})
+
+	Context("With jwks auth mode and no JWKS URL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:                config.AuthModeJWKS,
+					JWKSRefreshInterval: 300,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWKS URL must be an absolute URL when auth mode is jwks"))
+		})
+	})
+
+	Context("With jwks auth mode and a relative JWKS URL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:                config.AuthModeJWKS,
+					JWKSURL:             "protocol/openid-connect/certs",
+					JWKSRefreshInterval: 300,
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWKS URL must be an absolute URL when auth mode is jwks"))
+		})
+	})
+
+	Context("With jwks auth mode and no JWKS refresh interval", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:    config.AuthModeJWKS,
+					JWKSURL: "https://sso.example.com/realms/ros/protocol/openid-connect/certs",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWKS refresh interval must be positive"))
+		})
+	})
+
+	Context("With jwks auth mode and a plain HTTP JWKS URL", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:                config.AuthModeJWKS,
+					JWKSURL:             "http://sso.example.com/realms/ros/protocol/openid-connect/certs",
+					JWKSRefreshInterval: 300,
+					JWTIssuer:           "https://sso.example.com/realms/ros",
+					JWTAudience:         "ros-ingress",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWKS URL must use https, got http"))
+		})
+	})
+
+	Context("With jwks auth mode and no JWT audience", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:                config.AuthModeJWKS,
+					JWKSURL:             "https://sso.example.com/realms/ros/protocol/openid-connect/certs",
+					JWKSRefreshInterval: 300,
+					JWTIssuer:           "https://sso.example.com/realms/ros",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWT issuer and audience are required when auth mode is jwks"))
+		})
+	})
+
+	Context("With jwks auth mode and no JWT issuer", func() {
+		It("should return validation error", func() {
+			cfg := &config.Config{
+				Storage: config.StorageConfig{
+					Endpoint:  "localhost:9000",
+					AccessKey: "test-key",
+					SecretKey: "test-secret",
+				},
+				Kafka: config.KafkaConfig{
+					Brokers: []string{"localhost:9092"},
+					Topic:   "test-topic",
+				},
+				Auth: config.AuthConfig{
+					Mode:                config.AuthModeJWKS,
+					JWKSURL:             "https://sso.example.com/realms/ros/protocol/openid-connect/certs",
+					JWKSRefreshInterval: 300,
+					JWTAudience:         "ros-ingress",
+				},
+			}
+
+			err := cfg.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("JWT issuer and audience are required when auth mode is jwks"))
 		})
 	})
 })
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Settings that can be reloaded from the config directory without a restart
+const (
+	SettingLogLevel                 = "LOG_LEVEL"
+	SettingAllowedOrgs              = "AUTH_ALLOWED_ORGS"
+	SettingMaxConcurrentExtractions = "UPLOAD_MAX_CONCURRENT_EXTRACTIONS"
+	SettingMaxConcurrentPresigns    = "STORAGE_MAX_CONCURRENT_PRESIGNS"
+)
+
+// Reloader watches a projected config directory and applies changes to reloadable settings
+// The directory is polled rather than watched with inotify. Kubernetes updates ConfigMap and Secret
+// volumes by atomically swapping the ..data symlink, so a watch on a key's file keeps following the
+// old inode and misses the update, and inotify isn't delivered at all on some volume types. The
+// kubelet itself only syncs volumes every minute or so, which dwarfs the poll interval, and reading
+// a handful of small files per interval is cheap. Settings without a registered apply function are
+// structural: ports, brokers and credentials are bound once at startup into listeners and clients,
+// so they are only read from the environment and changes to them are logged as ignored
+type Reloader struct {
+	dir      string
+	interval time.Duration
+	logger   *logrus.Logger
+	appliers map[string]func(value string) error
+	values   map[string]string
+}
+
+// NewReloader creates a reloader checking dir for changes every interval
+func NewReloader(dir string, interval time.Duration, logger *logrus.Logger) *Reloader {
+	return &Reloader{
+		dir:      dir,
+		interval: interval,
+		logger:   logger,
+		appliers: make(map[string]func(value string) error),
+	}
+}
+
+// OnChange registers apply as the way to update setting while running
+// apply is called with the file's trimmed content when Run starts and after every change,
+// and with "" once the file is removed. An error leaves the previous value in effect
+func (r *Reloader) OnChange(setting string, apply func(value string) error) {
+	r.appliers[setting] = apply
+}
+
+// AllowedOrgsApplier returns the apply function for AUTH_ALLOWED_ORGS, calling set with the reloaded orgs
+// An empty or removed setting restores the orgs configured at startup instead of accepting every org
+func AllowedOrgsApplier(startup []string, set func(orgs []string)) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			set(startup)
+			return nil
+		}
+		set(strings.Split(value, ","))
+		return nil
+	}
+}
+
+// LimitApplier returns the apply function for a concurrency limit, calling set with the reloaded limit
+// An empty or removed setting restores the limit configured at startup, 0 removes the limit
+func LimitApplier(startup int, set func(limit int)) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			set(startup)
+			return nil
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q: %w", value, err)
+		}
+		if limit < 0 {
+			return fmt.Errorf("limit must not be negative, got %d", limit)
+		}
+		set(limit)
+		return nil
+	}
+}
+
+// Run applies the settings in the directory, then checks for changes every interval until ctx is done
+func (r *Reloader) Run(ctx context.Context) {
+	r.reload()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reload()
+		}
+	}
+}
+
+// reload reads the directory and applies the settings whose value changed since the last read
+func (r *Reloader) reload() {
+	values, err := readSettingsDir(r.dir)
+	if err != nil {
+		r.logger.WithError(err).WithField("dir", r.dir).Warn("Failed to read config directory")
+		return
+	}
+
+	initial := r.values == nil
+	for _, setting := range changedSettings(r.values, values) {
+		settingLogger := r.logger.WithField("setting", setting)
+
+		apply, ok := r.appliers[setting]
+		if !ok {
+			if initial {
+				settingLogger.Info("Config directory setting is not reloadable, using the environment")
+			} else {
+				settingLogger.Warn("Ignoring change to a setting that requires a restart")
+			}
+			continue
+		}
+
+		if err := apply(values[setting]); err != nil {
+			settingLogger.WithError(err).Warn("Ignoring invalid reloaded setting")
+			continue
+		}
+		settingLogger.Info("Reloaded setting")
+	}
+	r.values = values
+}
+
+// readSettingsDir returns the trimmed content of each file in dir keyed by file name
+// Hidden entries, like the ..data links of projected volumes, and directories are skipped
+func readSettingsDir(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		// Stat follows the symlinks projected volumes use for their keys
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		values[entry.Name()] = strings.TrimSpace(string(data))
+	}
+	return values, nil
+}
+
+// changedSettings returns the sorted names of settings added, removed or changed between previous and current
+func changedSettings(previous, current map[string]string) []string {
+	var changed []string
+	for setting, value := range current {
+		if old, ok := previous[setting]; !ok || old != value {
+			changed = append(changed, setting)
+		}
+	}
+	for setting := range previous {
+		if _, ok := current[setting]; !ok {
+			changed = append(changed, setting)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,206 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+)
+
+var _ = Describe("Reloader", func() {
+	var (
+		dir    string
+		logger *logrus.Logger
+		hook   *logtest.Hook
+		cancel context.CancelFunc
+
+		mu          sync.Mutex
+		allowedOrgs []string
+	)
+
+	writeSetting := func(setting, value string) {
+		Expect(os.WriteFile(filepath.Join(dir, setting), []byte(value+"\n"), 0o644)).To(Succeed())
+	}
+
+	liveAllowedOrgs := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return allowedOrgs
+	}
+
+	setAllowedOrgs := func(orgs []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		allowedOrgs = orgs
+	}
+
+	// startWith runs a reloader applying AUTH_ALLOWED_ORGS with apply
+	startWith := func(apply func(value string) error) {
+		reloader := config.NewReloader(dir, 10*time.Millisecond, logger)
+		reloader.OnChange(config.SettingAllowedOrgs, apply)
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			reloader.Run(ctx)
+		}()
+		DeferCleanup(func() {
+			cancel()
+			<-done
+		})
+	}
+
+	// start runs a reloader applying AUTH_ALLOWED_ORGS to allowedOrgs as a single value
+	start := func() {
+		startWith(func(value string) error {
+			if value == "invalid" {
+				return os.ErrInvalid
+			}
+			setAllowedOrgs([]string{value})
+			return nil
+		})
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		logger, hook = logtest.NewNullLogger()
+		allowedOrgs = nil
+	})
+
+	It("should apply the settings in the directory on start", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345")
+		start()
+
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+	})
+
+	It("should update the live setting when its file changes", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345")
+		start()
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+
+		writeSetting(config.SettingAllowedOrgs, "67890")
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"67890"}))
+	})
+
+	It("should apply an empty value when the file is removed", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345")
+		start()
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+
+		Expect(os.Remove(filepath.Join(dir, config.SettingAllowedOrgs))).To(Succeed())
+		Eventually(liveAllowedOrgs).Should(Equal([]string{""}))
+	})
+
+	It("should restore the startup allowed orgs when the file is removed", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345,67890")
+		startWith(config.AllowedOrgsApplier([]string{"11111"}, setAllowedOrgs))
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345", "67890"}))
+
+		Expect(os.Remove(filepath.Join(dir, config.SettingAllowedOrgs))).To(Succeed())
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"11111"}))
+	})
+
+	It("should restore the startup allowed orgs when the file is emptied", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345")
+		startWith(config.AllowedOrgsApplier([]string{"11111"}, setAllowedOrgs))
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+
+		writeSetting(config.SettingAllowedOrgs, "")
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"11111"}))
+	})
+
+	It("should follow the symlink swap of projected volumes", func() {
+		// Projected volumes link each key through ..data to a timestamped directory
+		first := filepath.Join(dir, "..first")
+		Expect(os.Mkdir(first, 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(first, config.SettingAllowedOrgs), []byte("12345"), 0o644)).To(Succeed())
+		Expect(os.Symlink("..first", filepath.Join(dir, "..data"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join("..data", config.SettingAllowedOrgs), filepath.Join(dir, config.SettingAllowedOrgs))).To(Succeed())
+		start()
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+
+		second := filepath.Join(dir, "..second")
+		Expect(os.Mkdir(second, 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(second, config.SettingAllowedOrgs), []byte("67890"), 0o644)).To(Succeed())
+		Expect(os.Symlink("..second", filepath.Join(dir, "..data_tmp"))).To(Succeed())
+		Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"67890"}))
+	})
+
+	It("should keep the previous value when the new one is invalid", func() {
+		writeSetting(config.SettingAllowedOrgs, "12345")
+		start()
+		Eventually(liveAllowedOrgs).Should(Equal([]string{"12345"}))
+
+		writeSetting(config.SettingAllowedOrgs, "invalid")
+		Eventually(func() string {
+			if entry := hook.LastEntry(); entry != nil {
+				return entry.Message
+			}
+			return ""
+		}).Should(Equal("Ignoring invalid reloaded setting"))
+		Expect(liveAllowedOrgs()).To(Equal([]string{"12345"}))
+	})
+
+	It("should log changes to structural settings as ignored", func() {
+		writeSetting("SERVER_PORT", "8080")
+		start()
+		Eventually(func() int { return len(hook.AllEntries()) }).Should(BeNumerically(">=", 1))
+		Expect(hook.LastEntry().Level).To(Equal(logrus.InfoLevel))
+
+		writeSetting("SERVER_PORT", "9090")
+		Eventually(func() bool {
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && entry.Message == "Ignoring change to a setting that requires a restart" {
+					return entry.Data["setting"] == "SERVER_PORT"
+				}
+			}
+			return false
+		}).Should(BeTrue())
+	})
+})
+
+var _ = Describe("LimitApplier", func() {
+	var limit int
+
+	apply := func(value string) error {
+		return config.LimitApplier(4, func(l int) { limit = l })(value)
+	}
+
+	BeforeEach(func() {
+		limit = -1
+	})
+
+	It("should set the reloaded limit", func() {
+		Expect(apply("8")).To(Succeed())
+		Expect(limit).To(Equal(8))
+	})
+
+	It("should allow removing the limit", func() {
+		Expect(apply("0")).To(Succeed())
+		Expect(limit).To(BeZero())
+	})
+
+	It("should restore the startup limit when the setting is removed", func() {
+		Expect(apply("")).To(Succeed())
+		Expect(limit).To(Equal(4))
+	})
+
+	It("should reject invalid limits", func() {
+		Expect(apply("many")).ToNot(Succeed())
+		Expect(apply("-1")).ToNot(Succeed())
+		Expect(limit).To(Equal(-1))
+	})
+})
@@ -0,0 +1,140 @@
+// Package features toggles features per environment with FEATURE_* settings, so one build can roll a
+// feature out gradually instead of shipping it everywhere at once
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EnvPrefix prefixes the environment variables, and config directory settings, that set flags
+const EnvPrefix = "FEATURE_"
+
+// Flag names a feature, set with the EnvPrefix variable of the same name, e.g. FEATURE_VERBOSE_RESPONSES
+type Flag string
+
+// Known flags
+const (
+	// VerboseResponses lets clients ask for the list of stored files in upload responses
+	VerboseResponses Flag = "VERBOSE_RESPONSES"
+)
+
+// Defaults are the flags the service knows, with the value they take when unset
+var Defaults = map[Flag]bool{
+	VerboseResponses: true,
+}
+
+// Flags holds the current value of each known flag, it is safe for concurrent use
+type Flags struct {
+	mu      sync.RWMutex
+	startup map[Flag]bool
+	values  map[Flag]bool
+}
+
+// New resolves the flags of defaults from environ, a list of KEY=value pairs as returned by os.Environ
+// Unknown FEATURE_ variables are logged and ignored, so the settings of a newer build don't keep an
+// older one from starting. A value that isn't a boolean is an error
+func New(defaults map[Flag]bool, environ []string, logger *logrus.Logger) (*Flags, error) {
+	values := make(map[Flag]bool, len(defaults))
+	for flag, value := range defaults {
+		values[flag] = value
+	}
+
+	for _, variable := range environ {
+		key, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(key, EnvPrefix) {
+			continue
+		}
+		flag := Flag(strings.TrimPrefix(key, EnvPrefix))
+		if _, ok := defaults[flag]; !ok {
+			logger.WithField("flag", key).Warn("Ignoring unknown feature flag")
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("feature flag %s must be a boolean, got %q", key, value)
+		}
+		values[flag] = enabled
+	}
+
+	startup := make(map[Flag]bool, len(values))
+	for flag, value := range values {
+		startup[flag] = value
+	}
+	return &Flags{startup: startup, values: values}, nil
+}
+
+// Enabled reports whether flag is on, unknown flags are off
+// A nil Flags has every flag off
+func (f *Flags) Enabled(flag Flag) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.values[flag]
+}
+
+// Set applies a reloaded value of flag, an empty value restores the value the service started with
+func (f *Flags) Set(flag Flag, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.startup[flag]; !ok {
+		return fmt.Errorf("unknown feature flag %s%s", EnvPrefix, flag)
+	}
+	if value == "" {
+		f.values[flag] = f.startup[flag]
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("feature flag %s%s must be a boolean, got %q", EnvPrefix, flag, value)
+	}
+	f.values[flag] = enabled
+	return nil
+}
+
+// Known returns the known flags in name order
+func (f *Flags) Known() []Flag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	flags := make([]Flag, 0, len(f.startup))
+	for flag := range f.startup {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i] < flags[j] })
+	return flags
+}
+
+// Handler serves the current value of every flag as a JSON object keyed by its variable name
+// Requests failing authorize are answered with 403
+func (f *Flags) Handler(authorize func(r *http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.Error(w, "Feature flags are restricted to internal users", http.StatusForbidden)
+			return
+		}
+
+		f.mu.RLock()
+		current := make(map[string]bool, len(f.values))
+		for flag, value := range f.values {
+			current[EnvPrefix+string(flag)] = value
+		}
+		f.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(current)
+	}
+}
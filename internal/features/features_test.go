@@ -0,0 +1,130 @@
+package features
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+var _ = Describe("Flags", func() {
+	const (
+		flagOn  Flag = "ON_BY_DEFAULT"
+		flagOff Flag = "OFF_BY_DEFAULT"
+	)
+
+	var (
+		defaults map[Flag]bool
+		logger   *logrus.Logger
+		hook     *logtest.Hook
+	)
+
+	BeforeEach(func() {
+		defaults = map[Flag]bool{flagOn: true, flagOff: false}
+		logger, hook = logtest.NewNullLogger()
+	})
+
+	load := func(environ ...string) *Flags {
+		flags, err := New(defaults, environ, logger)
+		Expect(err).ToNot(HaveOccurred())
+		return flags
+	}
+
+	Describe("New", func() {
+		It("should use the defaults of unset flags", func() {
+			flags := load("PATH=/usr/bin")
+
+			Expect(flags.Enabled(flagOn)).To(BeTrue())
+			Expect(flags.Enabled(flagOff)).To(BeFalse())
+		})
+
+		It("should parse boolean values from the environment", func() {
+			flags := load("FEATURE_ON_BY_DEFAULT=false", "FEATURE_OFF_BY_DEFAULT=1")
+
+			Expect(flags.Enabled(flagOn)).To(BeFalse())
+			Expect(flags.Enabled(flagOff)).To(BeTrue())
+		})
+
+		It("should keep the default of a flag set to an empty value", func() {
+			Expect(load("FEATURE_ON_BY_DEFAULT=").Enabled(flagOn)).To(BeTrue())
+		})
+
+		It("should reject a value that isn't a boolean", func() {
+			_, err := New(defaults, []string{"FEATURE_OFF_BY_DEFAULT=yes please"}, logger)
+			Expect(err).To(MatchError(ContainSubstring("FEATURE_OFF_BY_DEFAULT must be a boolean")))
+		})
+
+		It("should log and ignore unknown flags", func() {
+			flags := load("FEATURE_FROM_A_NEWER_BUILD=true")
+
+			Expect(flags.Enabled("FROM_A_NEWER_BUILD")).To(BeFalse())
+			Expect(flags.Known()).To(Equal([]Flag{flagOff, flagOn}))
+			Expect(hook.LastEntry().Message).To(Equal("Ignoring unknown feature flag"))
+			Expect(hook.LastEntry().Data).To(HaveKeyWithValue("flag", "FEATURE_FROM_A_NEWER_BUILD"))
+		})
+	})
+
+	Describe("Enabled", func() {
+		It("should report unknown flags and nil flags as off", func() {
+			Expect(load().Enabled("UNKNOWN")).To(BeFalse())
+
+			var flags *Flags
+			Expect(flags.Enabled(flagOn)).To(BeFalse())
+		})
+	})
+
+	Describe("Set", func() {
+		It("should apply reloaded values and restore the startup value when cleared", func() {
+			flags := load("FEATURE_OFF_BY_DEFAULT=true")
+
+			Expect(flags.Set(flagOff, "false")).To(Succeed())
+			Expect(flags.Enabled(flagOff)).To(BeFalse())
+
+			Expect(flags.Set(flagOff, "")).To(Succeed())
+			Expect(flags.Enabled(flagOff)).To(BeTrue())
+		})
+
+		It("should keep the current value when the reloaded one is invalid", func() {
+			flags := load()
+
+			Expect(flags.Set(flagOn, "maybe")).To(MatchError(ContainSubstring("must be a boolean")))
+			Expect(flags.Enabled(flagOn)).To(BeTrue())
+		})
+
+		It("should reject unknown flags", func() {
+			Expect(load().Set("UNKNOWN", "true")).To(MatchError(ContainSubstring("unknown feature flag FEATURE_UNKNOWN")))
+		})
+	})
+
+	Describe("Handler", func() {
+		get := func(flags *Flags, internal bool) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			flags.Handler(func(*http.Request) bool { return internal }).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/flags", nil))
+			return recorder
+		}
+
+		It("should serve the current flags to internal users", func() {
+			flags := load("FEATURE_OFF_BY_DEFAULT=true")
+			Expect(flags.Set(flagOn, "false")).To(Succeed())
+
+			recorder := get(flags, true)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var current map[string]bool
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &current)).To(Succeed())
+			Expect(current).To(Equal(map[string]bool{
+				"FEATURE_ON_BY_DEFAULT":  false,
+				"FEATURE_OFF_BY_DEFAULT": true,
+			}))
+		})
+
+		It("should refuse other users", func() {
+			Expect(get(load(), false).Code).To(Equal(http.StatusForbidden))
+		})
+	})
+})
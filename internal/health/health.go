@@ -3,8 +3,11 @@ package health
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -17,6 +20,15 @@ type HealthResponse struct {
 	Checks    map[string]Check `json:"checks"`
 }
 
+// MarshalJSON encodes the timestamp in the configured timestamp format
+func (h HealthResponse) MarshalJSON() ([]byte, error) {
+	type plain HealthResponse
+	return json.Marshal(struct {
+		plain
+		Timestamp logger.Timestamp `json:"timestamp"`
+	}{plain(h), logger.Timestamp(h.Timestamp)})
+}
+
 // Check represents an individual health check
 type Check struct {
 	Status  string        `json:"status"`
@@ -29,6 +41,20 @@ type Checker struct {
 	storageClient   StorageChecker
 	messagingClient MessagingChecker
 	version         string
+	draining        atomic.Bool
+
+	// tempDirCheck, when set, verifies the upload temp dir is usable
+	tempDirCheck func() error
+	// authorizeOrgMetrics decides who may read per-org metrics
+	authorizeOrgMetrics func(r *http.Request) bool
+
+	// cacheTTL is how long a health result is reused, zero checks on every request
+	cacheTTL time.Duration
+	// checkMu is held while checks run so concurrent probes wait for and share one result
+	checkMu  sync.Mutex
+	cached   HealthResponse
+	cachedAt time.Time
+	now      func() time.Time
 }
 
 // StorageChecker interface for storage health checks
@@ -47,11 +73,61 @@ func NewChecker(storageClient StorageChecker, messagingClient MessagingChecker)
 		storageClient:   storageClient,
 		messagingClient: messagingClient,
 		version:         "1.0.0",
+		now:             time.Now,
 	}
 }
 
+// SetCacheTTL makes Health reuse a result for ttl instead of checking dependencies on every probe
+func (c *Checker) SetCacheTTL(ttl time.Duration) {
+	c.checkMu.Lock()
+	defer c.checkMu.Unlock()
+	c.cacheTTL = ttl
+}
+
+// SetTempDirCheck adds a check of the upload temp dir to the health result
+func (c *Checker) SetTempDirCheck(check func() error) {
+	c.checkMu.Lock()
+	defer c.checkMu.Unlock()
+	c.tempDirCheck = check
+}
+
 // Health handles the health check endpoint
 func (c *Checker) Health(w http.ResponseWriter, r *http.Request) {
+	response := c.checkHealth()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Set appropriate HTTP status code
+	if response.Status == "unhealthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		// Log error but don't change HTTP status as headers are already written
+		// In a real application, you might want to use a logger here
+		_ = err
+	}
+}
+
+// checkHealth returns the cached health result while it is fresh, otherwise it checks the dependencies
+// Probes arriving while a check runs wait for it instead of starting their own
+func (c *Checker) checkHealth() HealthResponse {
+	c.checkMu.Lock()
+	defer c.checkMu.Unlock()
+
+	if c.cacheTTL > 0 && !c.cachedAt.IsZero() && c.now().Sub(c.cachedAt) < c.cacheTTL {
+		return c.cached
+	}
+
+	c.cached = c.runChecks()
+	c.cachedAt = c.now()
+	return c.cached
+}
+
+// runChecks checks storage and messaging connectivity, and the upload temp dir when configured
+func (c *Checker) runChecks() HealthResponse {
 	checks := make(map[string]Check)
 	overallStatus := "healthy"
 
@@ -87,36 +163,53 @@ func (c *Checker) Health(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	response := HealthResponse{
+	// Check the upload temp dir, which otherwise only fails on the first upload
+	if c.tempDirCheck != nil {
+		start = time.Now()
+		if err := c.tempDirCheck(); err != nil {
+			checks["temp_dir"] = Check{
+				Status:  "unhealthy",
+				Message: err.Error(),
+				Latency: time.Since(start),
+			}
+			overallStatus = "unhealthy"
+		} else {
+			checks["temp_dir"] = Check{
+				Status:  "healthy",
+				Latency: time.Since(start),
+			}
+		}
+	}
+
+	return HealthResponse{
 		Status:    overallStatus,
-		Timestamp: time.Now(),
+		Timestamp: c.now(),
 		Version:   c.version,
 		Checks:    checks,
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// Ready handles the readiness probe endpoint
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	// Report not ready while draining so load balancers stop routing new requests here
+	if c.draining.Load() {
+		response := map[string]interface{}{
+			"status":    "draining",
+			"timestamp": logger.Timestamp(time.Now()),
+			"version":   c.version,
+		}
 
-	// Set appropriate HTTP status code
-	if overallStatus == "unhealthy" {
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusServiceUnavailable)
-	} else {
-		w.WriteHeader(http.StatusOK)
-	}
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		// Log error but don't change HTTP status as headers are already written
-		// In a real application, you might want to use a logger here
-		_ = err
+		_ = json.NewEncoder(w).Encode(response)
+		return
 	}
-}
 
-// Ready handles the readiness probe endpoint
-func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
 	// For readiness, we just check if the service can start
 	// More basic than health check
 	response := map[string]interface{}{
 		"status":    "ready",
-		"timestamp": time.Now(),
+		"timestamp": logger.Timestamp(time.Now()),
 		"version":   c.version,
 	}
 
@@ -129,8 +222,24 @@ func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Drain flips readiness to not ready, waits for delay so the pod can be deregistered
+// while it keeps serving in-flight and late-arriving requests, then calls shutdown
+func (c *Checker) Drain(delay time.Duration, shutdown func() error) error {
+	c.draining.Store(true)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return shutdown()
+}
+
 // Metrics handles the metrics endpoint
+// With an org query parameter it serves only that org's per-org metrics instead
 func (c *Checker) Metrics(w http.ResponseWriter, r *http.Request) {
+	if org := r.URL.Query().Get("org"); org != "" {
+		c.serveOrgMetrics(w, r, org)
+		return
+	}
+
 	// Serve Prometheus metrics
 	promhttp.Handler().ServeHTTP(w, r)
 }
@@ -155,6 +264,23 @@ var (
 		[]string{"method", "endpoint"},
 	)
 
+	// Authentication metrics
+	AuthRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_requests_total",
+			Help: "Total number of authentication attempts by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	IdentityDerivationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "identity_derivations_total",
+			Help: "Total number of org IDs and account numbers derived for authenticated uploads, by identity source and derivation",
+		},
+		[]string{"source", "field", "derivation"},
+	)
+
 	// Upload metrics
 	UploadsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -164,13 +290,58 @@ var (
 		[]string{"status", "content_type"},
 	)
 
-	UploadSizeBytes = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "upload_size_bytes",
-			Help:    "Size of uploaded files in bytes",
-			Buckets: []float64{1024, 10240, 102400, 1048576, 10485760, 104857600, 1073741824},
+	UploadSizeBytes = newUploadSizeHistogram(DefaultUploadSizeBuckets)
+
+	UploadsByCertificationTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploads_by_certification_total",
+			Help: "Total number of processed uploads by manifest certified flag",
+		},
+		[]string{"certified"},
+	)
+
+	ActiveExtractions = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_extractions",
+			Help: "Number of payload extractions currently in progress",
+		},
+	)
+
+	UploadsRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "uploads_rejected_total",
+			Help: "Total number of uploads, preflight checks and reprocessing requests refused for their identity, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	ExtractionsRejectedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "extractions_rejected_total",
+			Help: "Total number of uploads rejected because the extraction limit was saturated",
+		},
+	)
+
+	ManifestParseFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "manifest_parse_failures_total",
+			Help: "Total number of payloads whose manifest could not be parsed, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	SuspiciousPayloadsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "suspicious_payloads_total",
+			Help: "Total number of payloads rejected for containing a forbidden file",
+		},
+	)
+
+	ClientDisconnectsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "client_disconnects_total",
+			Help: "Total number of uploads abandoned because the client disconnected mid-request",
 		},
-		[]string{"content_type"},
 	)
 
 	// Storage metrics
@@ -191,6 +362,28 @@ var (
 		[]string{"operation"},
 	)
 
+	StorageStoredBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "storage_stored_bytes_total",
+			Help: "Total number of bytes stored, as reported by the backend when writes are verified and as sent otherwise",
+		},
+	)
+
+	StoragePresignWaitDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "storage_presign_wait_seconds",
+			Help:    "Time spent waiting for a presign slot when concurrent presigns are limited, in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	PresignedURLExpirationSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "storage_presigned_url_expiration_seconds",
+			Help: "Configured lifetime of the presigned URLs sent to consumers, in seconds",
+		},
+	)
+
 	// Kafka metrics
 	KafkaMessagesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -208,18 +401,153 @@ var (
 		},
 		[]string{"topic"},
 	)
+
+	KafkaFailoversTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_failovers_total",
+			Help: "Total number of Kafka messages published to the fallback topic after the primary topic failed",
+		},
+		[]string{"topic", "fallback_topic"},
+	)
+
+	KafkaProducerRecreationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_producer_recreations_total",
+			Help: "Total number of attempts to recreate the Kafka producer after a fatal error, by status",
+		},
+		[]string{"status"},
+	)
+
+	// Retry metrics
+	RetryBudgetExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retry_budget_exhausted_total",
+			Help: "Total number of retries shed because the retry budget was exhausted, by subsystem",
+		},
+		[]string{"subsystem"},
+	)
+
+	// Outbox metrics
+	OutboxPendingEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_pending_entries",
+			Help: "Number of outbox entries whose events are not yet published, as of the last relay run",
+		},
+	)
+
+	OutboxRelayedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "outbox_relayed_total",
+			Help: "Total number of outbox entries published by the relay after their upload didn't publish them",
+		},
+	)
+
+	OutboxDeadLetteredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbox_dead_lettered_total",
+			Help: "Total number of outbox entries moved to the dead-letter directory instead of being published, by reason",
+		},
+		[]string{"reason"},
+	)
 )
 
+// newExtractionDirsGauge creates the gauge reporting the payload extraction directories on disk
+// count is called at scrape time. Directories are removed once their upload is processed,
+// so a count that keeps growing while uploads are idle points to leaked temp files
+func newExtractionDirsGauge(count func() int) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "upload_extraction_dirs",
+			Help: "Number of payload extraction directories currently in the upload temp dir",
+		},
+		func() float64 { return float64(count()) },
+	)
+}
+
+// DefaultUploadSizeBuckets are the upload size histogram buckets in bytes
+// They are finer between 1MB and 100MB where most payloads fall
+var DefaultUploadSizeBuckets = []float64{
+	1024, 10240, 102400, // 1KB, 10KB, 100KB
+	1048576, 2621440, 5242880, 10485760, // 1MB, 2.5MB, 5MB, 10MB
+	26214400, 52428800, 104857600, // 25MB, 50MB, 100MB
+	1073741824, // 1GB
+}
+
+func newUploadSizeHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upload_size_bytes",
+			Help:    "Size of uploaded files in bytes",
+			Buckets: buckets,
+		},
+		[]string{"content_type"},
+	)
+}
+
+// ConfigureUploadSizeBuckets replaces the upload size histogram buckets
+// It must be called before InitMetrics, empty buckets keep the defaults
+func ConfigureUploadSizeBuckets(buckets []float64) {
+	if len(buckets) == 0 {
+		return
+	}
+	UploadSizeBytes = newUploadSizeHistogram(buckets)
+}
+
+// metricsPrefix is prepended to the name of every service metric at registration
+var metricsPrefix string
+
+// ConfigureMetricsNamespace prefixes the service metric names with namespace and subsystem, joined
+// like prometheus.BuildFQName. The collectors are created at package init, so the prefix is applied
+// when they are registered. It must be called before InitMetrics, empty parts are skipped
+func ConfigureMetricsNamespace(namespace, subsystem string) {
+	metricsPrefix = ""
+	for _, part := range []string{namespace, subsystem} {
+		if part != "" {
+			metricsPrefix += part + "_"
+		}
+	}
+	orgRegistry = newOrgRegistry(metricsPrefix, OrgUploadsTotal, OrgUploadBytesTotal)
+}
+
 // InitMetrics initializes Prometheus metrics
 func InitMetrics() {
-	prometheus.MustRegister(
+	registerMetrics(prometheus.DefaultRegisterer)
+}
+
+// registerMetrics registers the service metrics with base under the configured prefix
+func registerMetrics(base prometheus.Registerer) {
+	prometheus.WrapRegistererWithPrefix(metricsPrefix, base).MustRegister(
 		HTTPRequestsTotal,
 		HTTPRequestDuration,
+		AuthRequestsTotal,
+		IdentityDerivationsTotal,
 		UploadsTotal,
 		UploadSizeBytes,
+		UploadsByCertificationTotal,
+		ActiveExtractions,
+		UploadsRejectedTotal,
+		ExtractionsRejectedTotal,
+		ManifestParseFailuresTotal,
+		SuspiciousPayloadsTotal,
+		ClientDisconnectsTotal,
 		StorageOperationsTotal,
 		StorageOperationDuration,
+		StorageStoredBytesTotal,
+		StoragePresignWaitDuration,
+		PresignedURLExpirationSeconds,
 		KafkaMessagesTotal,
 		KafkaMessageDuration,
+		KafkaFailoversTotal,
+		KafkaProducerRecreationsTotal,
+		RetryBudgetExhaustedTotal,
+		OutboxPendingEntries,
+		OutboxRelayedTotal,
+		OutboxDeadLetteredTotal,
 	)
 }
+
+// RegisterDebugMetrics registers the metrics used to catch resource leaks in debug deployments
+// Goroutines are already reported by the default registry's go_goroutines
+func RegisterDebugMetrics(extractionDirs func() int) {
+	prometheus.WrapRegistererWithPrefix(metricsPrefix, prometheus.DefaultRegisterer).MustRegister(newExtractionDirsGauge(extractionDirs))
+}
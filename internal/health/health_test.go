@@ -0,0 +1,341 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Checker", func() {
+	var checker *Checker
+
+	BeforeEach(func() {
+		checker = NewChecker(nil, nil)
+	})
+
+	readyStatus := func() int {
+		recorder := httptest.NewRecorder()
+		checker.Ready(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder.Code
+	}
+
+	Describe("Drain", func() {
+		It("should report ready before draining starts", func() {
+			Expect(readyStatus()).To(Equal(http.StatusOK))
+		})
+
+		It("should flip readiness for the prestop delay before shutdown begins", func() {
+			delay := 100 * time.Millisecond
+			var (
+				readyAtShutdown int
+				elapsed         time.Duration
+			)
+
+			start := time.Now()
+			err := checker.Drain(delay, func() error {
+				elapsed = time.Since(start)
+				readyAtShutdown = readyStatus()
+				return nil
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readyAtShutdown).To(Equal(http.StatusServiceUnavailable))
+			Expect(elapsed).To(BeNumerically(">=", delay))
+		})
+
+		It("should report not ready while waiting out the delay", func() {
+			shutdownCalled := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				_ = checker.Drain(time.Second, func() error {
+					close(shutdownCalled)
+					return nil
+				})
+			}()
+
+			Eventually(readyStatus).Should(Equal(http.StatusServiceUnavailable))
+			Expect(shutdownCalled).ToNot(BeClosed())
+			Eventually(shutdownCalled, 2*time.Second).Should(BeClosed())
+		})
+
+		It("should shut down immediately without a delay", func() {
+			called := false
+			Expect(checker.Drain(0, func() error {
+				called = true
+				return nil
+			})).To(Succeed())
+			Expect(called).To(BeTrue())
+		})
+	})
+})
+
+// countingChecker counts health checks, optionally blocking each until release is closed
+type countingChecker struct {
+	calls   atomic.Int32
+	err     error
+	release chan struct{}
+}
+
+func (c *countingChecker) HealthCheck() error {
+	c.calls.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	return c.err
+}
+
+var _ = Describe("Health check cache", func() {
+	var (
+		storage   *countingChecker
+		messaging *countingChecker
+		checker   *Checker
+		now       time.Time
+	)
+
+	BeforeEach(func() {
+		storage = &countingChecker{}
+		messaging = &countingChecker{}
+		checker = NewChecker(storage, messaging)
+		now = time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+		checker.now = func() time.Time { return now }
+	})
+
+	probe := func() int {
+		recorder := httptest.NewRecorder()
+		checker.Health(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return recorder.Code
+	}
+
+	It("should reuse the last result within the TTL", func() {
+		checker.SetCacheTTL(5 * time.Second)
+
+		Expect(probe()).To(Equal(http.StatusOK))
+		now = now.Add(4 * time.Second)
+		Expect(probe()).To(Equal(http.StatusOK))
+
+		Expect(storage.calls.Load()).To(BeNumerically("==", 1))
+		Expect(messaging.calls.Load()).To(BeNumerically("==", 1))
+	})
+
+	It("should check again once the TTL has passed", func() {
+		checker.SetCacheTTL(5 * time.Second)
+
+		Expect(probe()).To(Equal(http.StatusOK))
+		storage.err = errors.New("bucket unreachable")
+		now = now.Add(5 * time.Second)
+
+		Expect(probe()).To(Equal(http.StatusServiceUnavailable))
+		Expect(storage.calls.Load()).To(BeNumerically("==", 2))
+	})
+
+	It("should cache unhealthy results too", func() {
+		checker.SetCacheTTL(5 * time.Second)
+		messaging.err = errors.New("no brokers")
+
+		Expect(probe()).To(Equal(http.StatusServiceUnavailable))
+		Expect(probe()).To(Equal(http.StatusServiceUnavailable))
+		Expect(messaging.calls.Load()).To(BeNumerically("==", 1))
+	})
+
+	It("should check on every probe without a TTL", func() {
+		probe()
+		probe()
+
+		Expect(storage.calls.Load()).To(BeNumerically("==", 2))
+	})
+
+	It("should run a single check for concurrent probes", func() {
+		checker.SetCacheTTL(5 * time.Second)
+		storage.release = make(chan struct{})
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				codes <- probe()
+			}()
+		}
+
+		Eventually(storage.calls.Load).Should(BeNumerically("==", 1))
+		close(storage.release)
+		wg.Wait()
+		close(codes)
+
+		for code := range codes {
+			Expect(code).To(Equal(http.StatusOK))
+		}
+		Expect(storage.calls.Load()).To(BeNumerically("==", 1))
+		Expect(messaging.calls.Load()).To(BeNumerically("==", 1))
+	})
+})
+
+var _ = Describe("Upload size histogram", func() {
+	original := UploadSizeBytes
+
+	AfterEach(func() {
+		UploadSizeBytes = original
+	})
+
+	registeredBuckets := func() []float64 {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(UploadSizeBytes)
+		UploadSizeBytes.WithLabelValues("application/vnd.redhat.hccm.upload").Observe(3 * 1024 * 1024)
+
+		families, err := registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(families).To(HaveLen(1))
+		Expect(families[0].GetName()).To(Equal("upload_size_bytes"))
+
+		var bounds []float64
+		for _, bucket := range families[0].GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, bucket.GetUpperBound())
+		}
+		return bounds
+	}
+
+	It("should use the default buckets with finer resolution between 1MB and 100MB", func() {
+		Expect(registeredBuckets()).To(Equal(DefaultUploadSizeBuckets))
+	})
+
+	It("should apply custom buckets to the registered histogram", func() {
+		buckets := []float64{1048576, 2097152, 4194304}
+		ConfigureUploadSizeBuckets(buckets)
+
+		Expect(registeredBuckets()).To(Equal(buckets))
+	})
+
+	It("should keep the default buckets when none are configured", func() {
+		ConfigureUploadSizeBuckets(nil)
+
+		Expect(UploadSizeBytes).To(BeIdenticalTo(original))
+	})
+})
+
+var _ = Describe("Metrics namespace", func() {
+	AfterEach(func() {
+		ConfigureMetricsNamespace("", "")
+	})
+
+	registeredNames := func() []string {
+		registry := prometheus.NewRegistry()
+		registerMetrics(registry)
+
+		families, err := registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		return names
+	}
+
+	It("should keep the bare metric names by default", func() {
+		Expect(registeredNames()).To(ContainElements("extractions_rejected_total", "active_extractions"))
+	})
+
+	It("should prefix every metric name with the namespace and subsystem", func() {
+		ConfigureMetricsNamespace("ros", "ingress")
+
+		names := registeredNames()
+		Expect(names).To(ContainElements("ros_ingress_extractions_rejected_total", "ros_ingress_active_extractions"))
+		for _, name := range names {
+			Expect(name).To(HavePrefix("ros_ingress_"))
+		}
+	})
+
+	It("should skip an empty subsystem", func() {
+		ConfigureMetricsNamespace("ros_ingress", "")
+
+		Expect(registeredNames()).To(ContainElement("ros_ingress_extractions_rejected_total"))
+	})
+
+	It("should prefix the per-org metrics", func() {
+		ConfigureMetricsNamespace("ros_ingress", "")
+		OrgUploadsTotal.WithLabelValues("namespace-test-org", "success").Inc()
+
+		families, err := orgRegistry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(families).ToNot(BeEmpty())
+		for _, family := range families {
+			Expect(family.GetName()).To(HavePrefix("ros_ingress_org_"))
+		}
+	})
+})
+
+var _ = Describe("Extraction directories gauge", func() {
+	It("should report the count at scrape time", func() {
+		dirs := 0
+		gauge := newExtractionDirsGauge(func() int { return dirs })
+
+		dirs = 3
+		Expect(testutil.ToFloat64(gauge)).To(Equal(3.0))
+		dirs = 0
+		Expect(testutil.ToFloat64(gauge)).To(Equal(0.0))
+	})
+})
+
+var _ = Describe("Temp dir check", func() {
+	var checker *Checker
+
+	BeforeEach(func() {
+		checker = NewChecker(&countingChecker{}, &countingChecker{})
+	})
+
+	It("should not report the temp dir unless a check is set", func() {
+		response := checker.runChecks()
+		Expect(response.Status).To(Equal("healthy"))
+		Expect(response.Checks).ToNot(HaveKey("temp_dir"))
+	})
+
+	It("should report the service unhealthy when the temp dir is unusable", func() {
+		checker.SetTempDirCheck(func() error { return errors.New("upload temp dir /tmp/uploads is not writable") })
+
+		response := checker.runChecks()
+		Expect(response.Status).To(Equal("unhealthy"))
+		Expect(response.Checks["temp_dir"].Status).To(Equal("unhealthy"))
+		Expect(response.Checks["temp_dir"].Message).To(ContainSubstring("not writable"))
+		Expect(response.Checks["storage"].Status).To(Equal("healthy"))
+	})
+
+	It("should report a usable temp dir as healthy", func() {
+		checker.SetTempDirCheck(func() error { return nil })
+
+		response := checker.runChecks()
+		Expect(response.Status).To(Equal("healthy"))
+		Expect(response.Checks["temp_dir"].Status).To(Equal("healthy"))
+	})
+})
+
+var _ = Describe("Health response timestamps", func() {
+	AfterEach(func() {
+		logger.SetTimestampFormat("")
+	})
+
+	It("should encode the timestamp in the configured format", func() {
+		response := HealthResponse{Status: "healthy", Timestamp: time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)}
+
+		logger.SetTimestampFormat(logger.TimestampEpochMillis)
+		data, err := json.Marshal(response)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"timestamp":1709634600000`))
+		Expect(string(data)).To(ContainSubstring(`"status":"healthy"`))
+
+		logger.SetTimestampFormat(logger.TimestampDefault)
+		data, err = json.Marshal(response)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"timestamp":"2024-03-05T10:30:00Z"`))
+	})
+})
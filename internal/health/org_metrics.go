@@ -0,0 +1,94 @@
+package health
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// orgLabel is the label per-org metrics are filtered on
+const orgLabel = "org_id"
+
+// Per-org metrics are kept in their own registry rather than the default one, so the main
+// scrape doesn't grow with the number of tenants. They are only served filtered to one org
+var (
+	OrgUploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "org_uploads_total",
+			Help: "Total number of uploads per organization",
+		},
+		[]string{orgLabel, "status"},
+	)
+
+	OrgUploadBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "org_upload_bytes_total",
+			Help: "Total size of uploaded files per organization in bytes",
+		},
+		[]string{orgLabel},
+	)
+
+	orgRegistry = newOrgRegistry("", OrgUploadsTotal, OrgUploadBytesTotal)
+)
+
+// newOrgRegistry creates a registry of collectors whose metric names are prefixed with prefix
+func newOrgRegistry(prefix string, collectors ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWithPrefix(prefix, registry).MustRegister(collectors...)
+	return registry
+}
+
+// SetOrgMetricsAuthorizer sets the check a request must pass to read per-org metrics
+// Without one, /metrics?org= is always forbidden. It must be called before the server starts
+func (c *Checker) SetOrgMetricsAuthorizer(authorize func(r *http.Request) bool) {
+	c.authorizeOrgMetrics = authorize
+}
+
+// serveOrgMetrics serves the per-org metrics of org to authorized callers
+func (c *Checker) serveOrgMetrics(w http.ResponseWriter, r *http.Request, org string) {
+	if c.authorizeOrgMetrics == nil || !c.authorizeOrgMetrics(r) {
+		http.Error(w, "Per-org metrics are restricted to internal users", http.StatusForbidden)
+		return
+	}
+	promhttp.HandlerFor(orgGatherer(orgRegistry, org), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// orgGatherer returns a gatherer reporting only the series of gatherer labelled with org
+// Families left without series are dropped
+func orgGatherer(gatherer prometheus.Gatherer, org string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+
+		var filtered []*dto.MetricFamily
+		for _, family := range families {
+			var metrics []*dto.Metric
+			for _, metric := range family.GetMetric() {
+				if hasLabel(metric, orgLabel, org) {
+					metrics = append(metrics, metric)
+				}
+			}
+			if len(metrics) == 0 {
+				continue
+			}
+			filtered = append(filtered, &dto.MetricFamily{
+				Name:   family.Name,
+				Help:   family.Help,
+				Type:   family.Type,
+				Unit:   family.Unit,
+				Metric: metrics,
+			})
+		}
+		return filtered, err
+	})
+}
+
+func hasLabel(metric *dto.Metric, name, value string) bool {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue() == value
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Per-org metrics", func() {
+	Describe("orgGatherer", func() {
+		var registry *prometheus.Registry
+
+		BeforeEach(func() {
+			uploads := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_org_uploads_total", Help: "test"}, []string{orgLabel, "status"})
+			bytes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_org_upload_bytes_total", Help: "test"}, []string{orgLabel})
+			registry = newOrgRegistry("", uploads, bytes)
+
+			uploads.WithLabelValues("12345", "success").Inc()
+			uploads.WithLabelValues("12345", "error").Inc()
+			uploads.WithLabelValues("67890", "success").Inc()
+			bytes.WithLabelValues("67890").Add(1024)
+		})
+
+		It("should return only the requested org's series", func() {
+			families, err := orgGatherer(registry, "12345").Gather()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(families).To(HaveLen(1))
+			Expect(families[0].GetName()).To(Equal("test_org_uploads_total"))
+			Expect(families[0].GetMetric()).To(HaveLen(2))
+			for _, metric := range families[0].GetMetric() {
+				Expect(hasLabel(metric, orgLabel, "12345")).To(BeTrue())
+			}
+		})
+
+		It("should return nothing for an org without series", func() {
+			families, err := orgGatherer(registry, "99999").Gather()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(families).To(BeEmpty())
+		})
+
+		It("should leave the underlying registry unfiltered", func() {
+			_, err := orgGatherer(registry, "12345").Gather()
+			Expect(err).ToNot(HaveOccurred())
+
+			families, err := registry.Gather()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(families).To(HaveLen(2))
+			Expect(families[1].GetMetric()).To(HaveLen(3))
+		})
+	})
+
+	Describe("Metrics endpoint", func() {
+		var checker *Checker
+
+		BeforeEach(func() {
+			checker = NewChecker(nil, nil)
+			OrgUploadsTotal.WithLabelValues("org-metrics-a", "success").Inc()
+			OrgUploadsTotal.WithLabelValues("org-metrics-b", "success").Inc()
+		})
+
+		scrape := func(target string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			checker.Metrics(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			return recorder
+		}
+
+		It("should forbid per-org metrics without an authorizer", func() {
+			Expect(scrape("/metrics?org=org-metrics-a").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should forbid per-org metrics to callers the authorizer rejects", func() {
+			checker.SetOrgMetricsAuthorizer(func(*http.Request) bool { return false })
+			Expect(scrape("/metrics?org=org-metrics-a").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should serve only the requested org's series to authorized callers", func() {
+			checker.SetOrgMetricsAuthorizer(func(*http.Request) bool { return true })
+
+			recorder := scrape("/metrics?org=org-metrics-a")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring(`org_uploads_total{org_id="org-metrics-a",status="success"}`))
+			Expect(recorder.Body.String()).ToNot(ContainSubstring("org-metrics-b"))
+			Expect(recorder.Body.String()).ToNot(ContainSubstring("go_goroutines"))
+		})
+
+		It("should keep per-org series out of the unfiltered scrape", func() {
+			recorder := scrape("/metrics")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).ToNot(ContainSubstring("org_uploads_total"))
+		})
+	})
+})
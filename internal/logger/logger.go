@@ -26,18 +26,11 @@ func InitLogger() *logrus.Logger {
 		log.SetLevel(logrus.InfoLevel)
 	}
 
-	// Set log format
+	// Set log and timestamp format, the timestamp format also applies to JSON responses
 	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
-	if format == "json" {
-		log.SetFormatter(&logrus.JSONFormatter{
-			TimestampFormat: "2006-01-02T15:04:05.000Z",
-		})
-	} else {
-		log.SetFormatter(&logrus.TextFormatter{
-			FullTimestamp:   true,
-			TimestampFormat: "2006-01-02T15:04:05.000Z",
-		})
-	}
+	timestampFormat := strings.ToLower(os.Getenv("LOG_TIMESTAMP_FORMAT"))
+	SetTimestampFormat(timestampFormat)
+	log.SetFormatter(newFormatter(format, timestampFormat))
 
 	// Set output
 	output := strings.ToLower(os.Getenv("LOG_OUTPUT"))
@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Timestamp formats for logs and JSON responses, selected with LOG_TIMESTAMP_FORMAT
+const (
+	// TimestampDefault keeps the log layout below and Go's RFC 3339 encoding in JSON responses
+	TimestampDefault = "default"
+	// TimestampRFC3339 uses RFC 3339 with milliseconds and the zone offset everywhere
+	TimestampRFC3339 = "rfc3339"
+	// TimestampEpochMillis uses milliseconds since the Unix epoch everywhere
+	TimestampEpochMillis = "epoch_millis"
+)
+
+const (
+	defaultLogLayout = "2006-01-02T15:04:05.000Z"
+	rfc3339Layout    = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var timestampFormat atomic.Value
+
+// SetTimestampFormat sets the format used by Timestamp, unknown formats use the default
+func SetTimestampFormat(format string) {
+	timestampFormat.Store(format)
+}
+
+func currentTimestampFormat() string {
+	format, _ := timestampFormat.Load().(string)
+	return format
+}
+
+// Timestamp is a time encoded in JSON responses in the configured timestamp format
+type Timestamp time.Time
+
+// MarshalJSON implements json.Marshaler
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	switch currentTimestampFormat() {
+	case TimestampRFC3339:
+		return json.Marshal(time.Time(t).Format(rfc3339Layout))
+	case TimestampEpochMillis:
+		return strconv.AppendInt(nil, time.Time(t).UnixMilli(), 10), nil
+	default:
+		return time.Time(t).MarshalJSON()
+	}
+}
+
+// newFormatter creates the log formatter for the log and timestamp formats
+func newFormatter(logFormat, format string) logrus.Formatter {
+	isJSON := logFormat == "json"
+
+	if format == TimestampEpochMillis {
+		// Logrus only formats timestamps with layouts, so the inner formatter leaves them out
+		if isJSON {
+			return epochMillisFormatter{inner: &logrus.JSONFormatter{DisableTimestamp: true}, isJSON: true}
+		}
+		return epochMillisFormatter{inner: &logrus.TextFormatter{DisableTimestamp: true}}
+	}
+
+	layout := defaultLogLayout
+	if format == TimestampRFC3339 {
+		layout = rfc3339Layout
+	}
+	if isJSON {
+		return &logrus.JSONFormatter{TimestampFormat: layout}
+	}
+	return &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: layout}
+}
+
+// epochMillisFormatter adds the entry time in epoch milliseconds ahead of what inner formats
+type epochMillisFormatter struct {
+	inner  logrus.Formatter
+	isJSON bool
+}
+
+// Format implements logrus.Formatter
+func (f epochMillisFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.inner.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	millis := strconv.FormatInt(entry.Time.UnixMilli(), 10)
+	if f.isJSON {
+		// The inner formatter writes a single object, the time goes in as its first member
+		rest := bytes.TrimPrefix(formatted, []byte("{"))
+		separator := ","
+		if bytes.HasPrefix(rest, []byte("}")) {
+			separator = ""
+		}
+		return append([]byte(`{"time":`+millis+separator), rest...), nil
+	}
+	return append([]byte("time="+millis+" "), formatted...), nil
+}
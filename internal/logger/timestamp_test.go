@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Timestamp formats", func() {
+	// 2024-03-05T10:30:00.123Z
+	at := time.Date(2024, 3, 5, 10, 30, 0, 123000000, time.UTC)
+
+	AfterEach(func() {
+		SetTimestampFormat("")
+	})
+
+	// logLineAt formats a single entry logged at when with the given log and timestamp formats
+	logLineAt := func(when time.Time, logFormat, timestampFormat string) string {
+		log := logrus.New()
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		log.SetFormatter(newFormatter(logFormat, timestampFormat))
+		log.WithTime(when).WithField("request_id", "abc").Info("Upload processed")
+		return out.String()
+	}
+
+	logLine := func(logFormat, timestampFormat string) string {
+		return logLineAt(at, logFormat, timestampFormat)
+	}
+
+	marshal := func(format string) string {
+		SetTimestampFormat(format)
+		data, err := json.Marshal(struct {
+			Timestamp Timestamp `json:"timestamp"`
+		}{Timestamp(at)})
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	DescribeTable("JSON logs",
+		func(timestampFormat string, expected any) {
+			var entry map[string]any
+			Expect(json.Unmarshal([]byte(logLine("json", timestampFormat)), &entry)).To(Succeed())
+			Expect(entry["time"]).To(Equal(expected))
+			Expect(entry["msg"]).To(Equal("Upload processed"))
+			Expect(entry["request_id"]).To(Equal("abc"))
+		},
+		Entry("default", TimestampDefault, "2024-03-05T10:30:00.123Z"),
+		Entry("unset", "", "2024-03-05T10:30:00.123Z"),
+		Entry("rfc3339", TimestampRFC3339, "2024-03-05T10:30:00.123Z"),
+		Entry("epoch millis", TimestampEpochMillis, float64(at.UnixMilli())),
+	)
+
+	DescribeTable("text logs",
+		func(timestampFormat, expectedPrefix string) {
+			line := logLine("text", timestampFormat)
+			Expect(line).To(HavePrefix(expectedPrefix))
+			Expect(line).To(ContainSubstring(`msg="Upload processed"`))
+		},
+		Entry("default", TimestampDefault, `time="2024-03-05T10:30:00.123Z"`),
+		Entry("rfc3339", TimestampRFC3339, `time="2024-03-05T10:30:00.123Z"`),
+		Entry("epoch millis", TimestampEpochMillis, "time=1709634600123 level=info"),
+	)
+
+	It("should write the zone offset in RFC 3339 logs", func() {
+		cet := at.In(time.FixedZone("CET", 3600))
+		Expect(logLineAt(cet, "text", TimestampRFC3339)).To(HavePrefix(`time="2024-03-05T11:30:00.123+01:00"`))
+	})
+
+	DescribeTable("JSON responses",
+		func(format, expected string) {
+			Expect(marshal(format)).To(Equal(`{"timestamp":` + expected + `}`))
+		},
+		Entry("default", TimestampDefault, `"2024-03-05T10:30:00.123Z"`),
+		Entry("unset", "", `"2024-03-05T10:30:00.123Z"`),
+		Entry("rfc3339", TimestampRFC3339, `"2024-03-05T10:30:00.123Z"`),
+		Entry("epoch millis", TimestampEpochMillis, "1709634600123"),
+	)
+
+	It("should keep a JSON log with no other fields valid in epoch millis", func() {
+		formatter := epochMillisFormatter{inner: emptyObjectFormatter{}, isJSON: true}
+		line, err := formatter.Format(&logrus.Entry{Time: at})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(line)).To(Equal(`{"time":1709634600123}` + "\n"))
+	})
+})
+
+// emptyObjectFormatter formats every entry as an empty JSON object
+type emptyObjectFormatter struct{}
+
+func (emptyObjectFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return []byte("{}\n"), nil
+}
@@ -3,8 +3,11 @@ package messaging
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
@@ -13,11 +16,62 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrQueueFull is returned when the producer's local queue is full and the message could not be enqueued
+var ErrQueueFull = errors.New("kafka producer queue is full")
+
+// ErrMessageTooLarge is returned when an event exceeds the maximum message size accepted by the producer or broker
+var ErrMessageTooLarge = errors.New("kafka message is too large")
+
+// ErrHeadersTooLarge is returned when a message's headers exceed the configured count or size
+var ErrHeadersTooLarge = errors.New("kafka message headers exceed the configured limits")
+
+// Bounds of the wait between attempts to recreate a producer after a fatal error, doubling from the first
+const (
+	recreateBackoff    = time.Second
+	recreateMaxBackoff = time.Minute
+)
+
+// kafkaProducer is the subset of the confluent producer used by Producer
+type kafkaProducer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	Flush(timeoutMs int) int
+	Close()
+}
+
+// MessageProducer publishes upload events
+// Producer is the Kafka implementation, tests and alternative transports provide their own
+type MessageProducer interface {
+	SendROSEvent(ctx context.Context, msg *ROSMessage) error
+	SendUsageEvent(ctx context.Context, msg *ROSMessage) error
+	SendValidationMessage(ctx context.Context, requestID, status string) error
+	HealthCheck() error
+	Close() error
+}
+
+var _ MessageProducer = (*Producer)(nil)
+
 // Producer wraps Kafka producer with additional functionality
 type Producer struct {
-	producer *kafka.Producer
+	// mu guards producer, which is replaced after a fatal error, and the recovery state
+	mu       sync.RWMutex
+	producer kafkaProducer
 	config   config.KafkaConfig
 	logger   *logrus.Logger
+	// serializer frames events for the schema registry, nil sends plain JSON
+	serializer *schemaSerializer
+
+	// newProducer creates the producer replacing one that hit a fatal error
+	newProducer func() (kafkaProducer, error)
+	// fatalErr is the fatal error being recovered from, nil while the producer is usable
+	fatalErr error
+	// recreateBackoff and recreateMaxBackoff bound the wait between attempts to recreate the producer
+	recreateBackoff    time.Duration
+	recreateMaxBackoff time.Duration
+	// closed is closed by Close, stopping any recreation in progress
+	closed   chan struct{}
+	isClosed bool
 }
 
 // ROSMessage represents a ROS event message
@@ -28,17 +82,25 @@ type ROSMessage struct {
 	Metadata    ROSMetadata `json:"metadata"`
 	Files       []string    `json:"files"`
 	ObjectKeys  []string    `json:"object_keys"`
+	// ChecksumManifest and ChecksumManifestKey locate the sidecar listing the files' checksums, when written
+	ChecksumManifest    string `json:"checksum_manifest,omitempty"`
+	ChecksumManifestKey string `json:"checksum_manifest_key,omitempty"`
 }
 
 // ROSMetadata represents metadata for ROS events
+// IngestedAt is when the ingress processed the upload, as opposed to the manifest report date
 type ROSMetadata struct {
-	Account         string `json:"account"`
-	OrgID           string `json:"org_id"`
-	SourceID        string `json:"source_id"`
-	ProviderUUID    string `json:"provider_uuid"`
-	ClusterUUID     string `json:"cluster_uuid"`
-	ClusterAlias    string `json:"cluster_alias"`
-	OperatorVersion string `json:"operator_version"`
+	Account         string    `json:"account"`
+	OrgID           string    `json:"org_id"`
+	SourceID        string    `json:"source_id"`
+	ProviderUUID    string    `json:"provider_uuid"`
+	ClusterUUID     string    `json:"cluster_uuid"`
+	ClusterAlias    string    `json:"cluster_alias"`
+	OperatorVersion string    `json:"operator_version"`
+	Certified       bool      `json:"certified"`
+	IngestedAt      time.Time `json:"ingested_at"`
+	// OrgMetadata holds the org's metadata from the enrichment service, e.g. its tier and region
+	OrgMetadata map[string]string `json:"org_metadata,omitempty"`
 }
 
 // ValidationMessage represents a validation message for upload service
@@ -49,7 +111,48 @@ type ValidationMessage struct {
 
 // NewKafkaProducer creates a new Kafka producer
 func NewKafkaProducer(cfg config.KafkaConfig) (*Producer, error) {
-	// Configure Kafka producer
+	kafkaConfig := producerConfigMap(cfg)
+
+	serializer, err := newSchemaSerializer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create producer
+	newProducer := func() (kafkaProducer, error) {
+		return kafka.NewProducer(&kafkaConfig)
+	}
+	producer, err := newProducer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+
+	p := &Producer{
+		producer:           producer,
+		config:             cfg,
+		logger:             logrus.New(),
+		serializer:         serializer,
+		newProducer:        newProducer,
+		recreateBackoff:    recreateBackoff,
+		recreateMaxBackoff: recreateMaxBackoff,
+		closed:             make(chan struct{}),
+	}
+
+	// Start delivery report handler
+	go p.handleDeliveryReports(producer)
+
+	return p, nil
+}
+
+// current returns the producer in use
+func (p *Producer) current() kafkaProducer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.producer
+}
+
+// producerConfigMap builds the librdkafka configuration for the producer
+func producerConfigMap(cfg config.KafkaConfig) kafka.ConfigMap {
 	kafkaConfig := kafka.ConfigMap{
 		"bootstrap.servers":  strings.Join(cfg.Brokers, ","),
 		"client.id":          cfg.ClientID,
@@ -61,6 +164,14 @@ func NewKafkaProducer(cfg config.KafkaConfig) (*Producer, error) {
 		"enable.idempotence": true,
 	}
 
+	// Bound the local queue so a slow or unavailable broker can't grow memory unchecked
+	if cfg.QueueBufferingMaxMessages > 0 {
+		kafkaConfig["queue.buffering.max.messages"] = cfg.QueueBufferingMaxMessages
+	}
+	if cfg.QueueBufferingMaxKBytes > 0 {
+		kafkaConfig["queue.buffering.max.kbytes"] = cfg.QueueBufferingMaxKBytes
+	}
+
 	// Add security configuration if specified
 	if cfg.SecurityProtocol != "PLAINTEXT" {
 		kafkaConfig["security.protocol"] = cfg.SecurityProtocol
@@ -76,60 +187,124 @@ func NewKafkaProducer(cfg config.KafkaConfig) (*Producer, error) {
 		}
 	}
 
-	// Create producer
-	producer, err := kafka.NewProducer(&kafkaConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
-	}
-
-	p := &Producer{
-		producer: producer,
-		config:   cfg,
-		logger:   logrus.New(),
-	}
-
-	// Start delivery report handler
-	go p.handleDeliveryReports()
-
-	return p, nil
+	return kafkaConfig
 }
 
 // SendROSEvent sends a ROS event message to Kafka
 func (p *Producer) SendROSEvent(ctx context.Context, msg *ROSMessage) error {
-	start := time.Now()
-	defer func() {
-		health.KafkaMessageDuration.WithLabelValues(p.config.Topic).Observe(time.Since(start).Seconds())
-	}()
+	return p.sendEvent(ctx, p.rosTopic(msg), "ros", msg)
+}
 
-	// Marshal message to JSON
-	msgBytes, err := json.Marshal(msg)
+// rosTopic returns the topic for a ROS event
+// Payloads from non-certified operators go to the uncertified topic when one is configured
+func (p *Producer) rosTopic(msg *ROSMessage) string {
+	if !msg.Metadata.Certified && p.config.UncertifiedTopic != "" {
+		return p.config.UncertifiedTopic
+	}
+	return p.config.Topic
+}
+
+// SendUsageEvent sends a usage event message to the configured usage topic
+// The message shape matches the ROS event so consumers can share parsing logic
+func (p *Producer) SendUsageEvent(ctx context.Context, msg *ROSMessage) error {
+	return p.sendEvent(ctx, p.config.UsageTopic, "hccm", msg)
+}
+
+// sendEvent marshals and sends an upload event message to the given topic
+// Events that can't be delivered because the topic is unusable are published to the fallback topic when configured
+func (p *Producer) sendEvent(ctx context.Context, topic, service string, msg *ROSMessage) error {
+	// Marshal message in the configured format
+	msgBytes, err := p.marshal(topic, msg)
 	if err != nil {
-		health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "marshal_error").Inc()
-		return fmt.Errorf("failed to marshal ROS message: %w", err)
+		health.KafkaMessagesTotal.WithLabelValues(topic, "marshal_error").Inc()
+		return fmt.Errorf("failed to marshal %s message: %w", service, err)
 	}
 
 	// Create Kafka message
 	kafkaMsg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
-			Topic:     &p.config.Topic,
+			Topic:     &topic,
 			Partition: kafka.PartitionAny,
 		},
 		Key:   []byte(msg.RequestID),
 		Value: msgBytes,
 		Headers: []kafka.Header{
-			{Key: "service", Value: []byte("ros")},
+			{Key: "service", Value: []byte(service)},
 			{Key: "request_id", Value: []byte(msg.RequestID)},
 			{Key: "org_id", Value: []byte(msg.Metadata.OrgID)},
+			{Key: "certified", Value: []byte(strconv.FormatBool(msg.Metadata.Certified))},
 		},
 	}
+	p.sign(kafkaMsg)
+	if err := p.checkHeaders(kafkaMsg.Headers); err != nil {
+		health.KafkaMessagesTotal.WithLabelValues(topic, "headers_too_large").Inc()
+		return fmt.Errorf("failed to produce %s message: %w", service, err)
+	}
+
+	err = p.deliver(ctx, topic, service, kafkaMsg)
+	fallback := p.config.FallbackTopic
+	if err == nil || fallback == "" || fallback == topic || !isTopicError(err) {
+		return err
+	}
+
+	// The primary topic is unusable, publish to the fallback topic so the event isn't lost
+	health.KafkaFailoversTotal.WithLabelValues(topic, fallback).Inc()
+	p.logger.WithError(err).WithFields(logrus.Fields{
+		"topic":          topic,
+		"fallback_topic": fallback,
+		"request_id":     msg.RequestID,
+		"service":        service,
+	}).Warn("Failed to publish to primary topic, failing over to fallback topic")
+
+	kafkaMsg.TopicPartition = kafka.TopicPartition{
+		Topic:     &fallback,
+		Partition: kafka.PartitionAny,
+	}
+	// The fallback topic may map to a different schema registry subject
+	if p.serializer != nil {
+		if kafkaMsg.Value, err = p.marshal(fallback, msg); err != nil {
+			health.KafkaMessagesTotal.WithLabelValues(fallback, "marshal_error").Inc()
+			return fmt.Errorf("failed to marshal %s message for fallback topic: %w", service, err)
+		}
+		p.sign(kafkaMsg)
+	}
+	if err := p.deliver(ctx, fallback, service, kafkaMsg); err != nil {
+		return fmt.Errorf("failed to publish %s message to fallback topic after primary failure: %w", service, err)
+	}
+	return nil
+}
+
+// marshal serializes an event for topic, as plain JSON unless a schema registry format is configured
+func (p *Producer) marshal(topic string, msg *ROSMessage) ([]byte, error) {
+	if p.serializer == nil {
+		return json.Marshal(msg)
+	}
+	return p.serializer.Serialize(topic, msg)
+}
+
+// deliver produces a message to topic and waits for its delivery report
+func (p *Producer) deliver(ctx context.Context, topic, service string, kafkaMsg *kafka.Message) error {
+	start := time.Now()
+	defer func() {
+		health.KafkaMessageDuration.WithLabelValues(topic).Observe(time.Since(start).Seconds())
+	}()
 
 	// Send message
 	deliveryChan := make(chan kafka.Event)
-	err = p.producer.Produce(kafkaMsg, deliveryChan)
+	err := p.current().Produce(kafkaMsg, deliveryChan)
+	if isQueueFull(err) {
+		health.KafkaMessagesTotal.WithLabelValues(topic, "queue_full").Inc()
+		close(deliveryChan)
+		return fmt.Errorf("failed to produce %s message: %w: %v", service, ErrQueueFull, err)
+	}
+	if isMessageTooLarge(err) {
+		close(deliveryChan)
+		return p.messageTooLarge(topic, service, kafkaMsg, err)
+	}
 	if err != nil {
-		health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "produce_error").Inc()
+		health.KafkaMessagesTotal.WithLabelValues(topic, "produce_error").Inc()
 		close(deliveryChan)
-		return fmt.Errorf("failed to produce ROS message: %w", err)
+		return fmt.Errorf("failed to produce %s message: %w", service, err)
 	}
 
 	// Wait for delivery confirmation
@@ -137,25 +312,29 @@ func (p *Producer) SendROSEvent(ctx context.Context, msg *ROSMessage) error {
 	case e := <-deliveryChan:
 		close(deliveryChan)
 		if m, ok := e.(*kafka.Message); ok {
+			if isMessageTooLarge(m.TopicPartition.Error) {
+				return p.messageTooLarge(topic, service, kafkaMsg, m.TopicPartition.Error)
+			}
 			if m.TopicPartition.Error != nil {
-				health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "delivery_error").Inc()
+				health.KafkaMessagesTotal.WithLabelValues(topic, "delivery_error").Inc()
 				return fmt.Errorf("message delivery failed: %w", m.TopicPartition.Error)
 			}
-			health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "success").Inc()
+			health.KafkaMessagesTotal.WithLabelValues(topic, "success").Inc()
 			p.logger.WithFields(logrus.Fields{
 				"topic":      *m.TopicPartition.Topic,
 				"partition":  m.TopicPartition.Partition,
 				"offset":     m.TopicPartition.Offset,
-				"request_id": msg.RequestID,
-			}).Debug("ROS message delivered successfully")
+				"request_id": string(kafkaMsg.Key),
+				"service":    service,
+			}).Debug("Event message delivered successfully")
 		}
 	case <-ctx.Done():
 		close(deliveryChan)
-		health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "timeout").Inc()
+		health.KafkaMessagesTotal.WithLabelValues(topic, "timeout").Inc()
 		return fmt.Errorf("message delivery timeout: %w", ctx.Err())
 	case <-time.After(30 * time.Second):
 		close(deliveryChan)
-		health.KafkaMessagesTotal.WithLabelValues(p.config.Topic, "timeout").Inc()
+		health.KafkaMessagesTotal.WithLabelValues(topic, "timeout").Inc()
 		return fmt.Errorf("message delivery timeout after 30 seconds")
 	}
 
@@ -200,10 +379,19 @@ func (p *Producer) SendValidationMessage(ctx context.Context, requestID, status
 			{Key: "request_id", Value: []byte(requestID)},
 		},
 	}
+	if err := p.checkHeaders(kafkaMsg.Headers); err != nil {
+		health.KafkaMessagesTotal.WithLabelValues(validationTopic, "headers_too_large").Inc()
+		return fmt.Errorf("failed to produce validation message: %w", err)
+	}
 
 	// Send message
 	deliveryChan := make(chan kafka.Event)
-	err = p.producer.Produce(kafkaMsg, deliveryChan)
+	err = p.current().Produce(kafkaMsg, deliveryChan)
+	if isQueueFull(err) {
+		health.KafkaMessagesTotal.WithLabelValues(validationTopic, "queue_full").Inc()
+		close(deliveryChan)
+		return fmt.Errorf("failed to produce validation message: %w: %v", ErrQueueFull, err)
+	}
 	if err != nil {
 		health.KafkaMessagesTotal.WithLabelValues(validationTopic, "produce_error").Inc()
 		close(deliveryChan)
@@ -241,9 +429,70 @@ func (p *Producer) SendValidationMessage(ctx context.Context, requestID, status
 	return nil
 }
 
-// handleDeliveryReports handles delivery reports in the background
-func (p *Producer) handleDeliveryReports() {
-	for e := range p.producer.Events() {
+// isQueueFull reports whether a Produce error was caused by the local queue being full
+func isQueueFull(err error) bool {
+	var kafkaErr kafka.Error
+	return errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrQueueFull
+}
+
+// isMessageTooLarge reports whether err was caused by the message exceeding the producer's or broker's size limit
+func isMessageTooLarge(err error) bool {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return false
+	}
+	return kafkaErr.Code() == kafka.ErrMsgSizeTooLarge || kafkaErr.Code() == kafka.ErrInvalidMsgSize
+}
+
+// checkHeaders verifies that headers stay within the configured count and total size
+// Values such as the org ID come from the caller's identity, so they are rejected rather than
+// truncated, which would misattribute the event
+func (p *Producer) checkHeaders(headers []kafka.Header) error {
+	if limit := p.config.MaxHeaders; limit > 0 && len(headers) > limit {
+		return fmt.Errorf("%w: %d headers, the maximum is %d", ErrHeadersTooLarge, len(headers), limit)
+	}
+	if limit := p.config.MaxHeaderBytes; limit > 0 {
+		size := 0
+		for _, header := range headers {
+			size += len(header.Key) + len(header.Value)
+		}
+		if size > limit {
+			return fmt.Errorf("%w: %d header bytes, the maximum is %d", ErrHeadersTooLarge, size, limit)
+		}
+	}
+	return nil
+}
+
+// messageTooLarge records a message rejected for its size and returns an error wrapping ErrMessageTooLarge
+func (p *Producer) messageTooLarge(topic, service string, kafkaMsg *kafka.Message, err error) error {
+	health.KafkaMessagesTotal.WithLabelValues(topic, "message_too_large").Inc()
+	p.logger.WithError(err).WithFields(logrus.Fields{
+		"topic":         topic,
+		"request_id":    string(kafkaMsg.Key),
+		"service":       service,
+		"message_bytes": len(kafkaMsg.Value),
+	}).Error("Event message exceeds the maximum Kafka message size")
+	return fmt.Errorf("failed to produce %s message of %d bytes: %w: %v", service, len(kafkaMsg.Value), ErrMessageTooLarge, err)
+}
+
+// isTopicError reports whether err is an unrecoverable error with the topic itself
+// such as the topic being deleted or the producer not being authorized to write to it
+func isTopicError(err error) bool {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return false
+	}
+	switch kafkaErr.Code() {
+	case kafka.ErrUnknownTopic, kafka.ErrUnknownTopicOrPart, kafka.ErrTopicAuthorizationFailed, kafka.ErrTopicException:
+		return true
+	}
+	return false
+}
+
+// handleDeliveryReports handles the delivery reports and errors of producer in the background
+// A fatal error leaves the producer unusable, so it is replaced
+func (p *Producer) handleDeliveryReports(producer kafkaProducer) {
+	for e := range producer.Events() {
 		switch ev := e.(type) {
 		case *kafka.Message:
 			if ev.TopicPartition.Error != nil {
@@ -256,6 +505,11 @@ func (p *Producer) handleDeliveryReports() {
 				}).Debug("Message delivered")
 			}
 		case kafka.Error:
+			if ev.IsFatal() {
+				p.logger.WithError(ev).Error("Kafka producer hit a fatal error, recreating it")
+				p.recoverFrom(producer, ev)
+				continue
+			}
 			p.logger.WithError(ev).Error("Kafka error")
 		default:
 			p.logger.WithField("event", ev).Debug("Ignored Kafka event")
@@ -263,10 +517,72 @@ func (p *Producer) handleDeliveryReports() {
 	}
 }
 
+// recoverFrom starts replacing producer after it hit the fatal error err
+// The messaging health check fails until the replacement is in use
+func (p *Producer) recoverFrom(producer kafkaProducer, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A closed producer isn't replaced, and a replaced one is already being recovered from
+	if p.isClosed || p.producer != producer || p.fatalErr != nil {
+		return
+	}
+	p.fatalErr = err
+	go p.recreate()
+}
+
+// recreate creates a producer replacing the one that hit a fatal error, retrying with backoff until
+// it succeeds or the producer is closed
+func (p *Producer) recreate() {
+	backoff := p.recreateBackoff
+	for {
+		producer, err := p.newProducer()
+		if err == nil {
+			p.replace(producer)
+			return
+		}
+
+		health.KafkaProducerRecreationsTotal.WithLabelValues("failure").Inc()
+		p.logger.WithError(err).WithField("retry_in", backoff).Warn("Failed to recreate Kafka producer")
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, p.recreateMaxBackoff)
+	}
+}
+
+// replace puts producer in use in place of the one that hit a fatal error, and closes the latter
+func (p *Producer) replace(producer kafkaProducer) {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		producer.Close()
+		return
+	}
+	failed := p.producer
+	p.producer = producer
+	p.fatalErr = nil
+	p.mu.Unlock()
+
+	health.KafkaProducerRecreationsTotal.WithLabelValues("success").Inc()
+	p.logger.Info("Recreated Kafka producer after a fatal error")
+	go p.handleDeliveryReports(producer)
+	failed.Close()
+}
+
 // HealthCheck performs a health check on the Kafka connection
 func (p *Producer) HealthCheck() error {
+	p.mu.RLock()
+	producer, fatalErr := p.producer, p.fatalErr
+	p.mu.RUnlock()
+	if fatalErr != nil {
+		return fmt.Errorf("kafka producer is being recreated after a fatal error: %w", fatalErr)
+	}
+
 	// Get metadata to verify connection
-	metadata, err := p.producer.GetMetadata(nil, false, 5000)
+	metadata, err := producer.GetMetadata(nil, false, 5000)
 	if err != nil {
 		return fmt.Errorf("kafka health check failed: %w", err)
 	}
@@ -291,7 +607,7 @@ func (p *Producer) HealthCheck() error {
 
 // Flush flushes any outstanding messages
 func (p *Producer) Flush(timeout time.Duration) error {
-	remaining := p.producer.Flush(int(timeout.Milliseconds()))
+	remaining := p.current().Flush(int(timeout.Milliseconds()))
 	if remaining > 0 {
 		return fmt.Errorf("failed to flush %d messages within timeout", remaining)
 	}
@@ -300,10 +616,23 @@ func (p *Producer) Flush(timeout time.Duration) error {
 
 // Close closes the Kafka producer
 func (p *Producer) Close() error {
+	// Stop any recreation in progress
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.isClosed = true
+	if p.closed != nil {
+		close(p.closed)
+	}
+	producer := p.producer
+	p.mu.Unlock()
+
 	// Flush remaining messages
-	p.producer.Flush(5000) // 5 second timeout
+	producer.Flush(5000) // 5 second timeout
 
 	// Close producer
-	p.producer.Close()
+	producer.Close()
 	return nil
 }
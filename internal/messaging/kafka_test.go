@@ -0,0 +1,522 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// mockProducer records produced messages and fails topics configured as rejected
+type mockProducer struct {
+	mu sync.Mutex
+	// produceErrors fail Produce itself for a topic
+	produceErrors map[string]error
+	// deliveryErrors fail the delivery report for a topic
+	deliveryErrors map[string]error
+	produced       []string
+	values         [][]byte
+	headers        [][]kafka.Header
+	// events is returned by Events, closed by Close when set
+	events chan kafka.Event
+	closed bool
+}
+
+func newMockProducer() *mockProducer {
+	return &mockProducer{
+		produceErrors:  make(map[string]error),
+		deliveryErrors: make(map[string]error),
+	}
+}
+
+func (m *mockProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	topic := *msg.TopicPartition.Topic
+	m.produced = append(m.produced, topic)
+	m.values = append(m.values, msg.Value)
+	m.headers = append(m.headers, append([]kafka.Header(nil), msg.Headers...))
+	if err := m.produceErrors[topic]; err != nil {
+		return err
+	}
+
+	report := *msg
+	report.TopicPartition.Error = m.deliveryErrors[topic]
+	go func() { deliveryChan <- &report }()
+	return nil
+}
+
+func (m *mockProducer) producedValues() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.values...)
+}
+
+// producedHeader returns the value of header key on the i-th produced message
+func (m *mockProducer) producedHeader(i int, key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, header := range m.headers[i] {
+		if header.Key == key {
+			return string(header.Value), true
+		}
+	}
+	return "", false
+}
+
+func (m *mockProducer) Events() chan kafka.Event { return m.events }
+
+func (m *mockProducer) GetMetadata(*string, bool, int) (*kafka.Metadata, error) {
+	return &kafka.Metadata{Brokers: []kafka.BrokerMetadata{{ID: 1}}}, nil
+}
+
+func (m *mockProducer) Flush(int) int { return 0 }
+
+func (m *mockProducer) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if m.events != nil {
+		close(m.events)
+	}
+}
+
+func (m *mockProducer) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *mockProducer) producedTopics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.produced...)
+}
+
+var _ = Describe("Producer", func() {
+	Describe("rosTopic", func() {
+		var producer *Producer
+
+		BeforeEach(func() {
+			producer = &Producer{
+				config: config.KafkaConfig{
+					Topic: "hccm.ros.events",
+				},
+			}
+		})
+
+		It("should use the ROS topic for certified payloads", func() {
+			producer.config.UncertifiedTopic = "hccm.ros.uncertified"
+			msg := &ROSMessage{Metadata: ROSMetadata{Certified: true}}
+
+			Expect(producer.rosTopic(msg)).To(Equal("hccm.ros.events"))
+		})
+
+		It("should route non-certified payloads to the uncertified topic when configured", func() {
+			producer.config.UncertifiedTopic = "hccm.ros.uncertified"
+			msg := &ROSMessage{Metadata: ROSMetadata{Certified: false}}
+
+			Expect(producer.rosTopic(msg)).To(Equal("hccm.ros.uncertified"))
+		})
+
+		It("should keep non-certified payloads on the ROS topic when no uncertified topic is configured", func() {
+			msg := &ROSMessage{Metadata: ROSMetadata{Certified: false}}
+
+			Expect(producer.rosTopic(msg)).To(Equal("hccm.ros.events"))
+		})
+	})
+
+	Describe("producerConfigMap", func() {
+		It("should include the queue buffering limits", func() {
+			configMap := producerConfigMap(config.KafkaConfig{
+				Brokers:                   []string{"localhost:9092"},
+				SecurityProtocol:          "PLAINTEXT",
+				QueueBufferingMaxMessages: 10000,
+				QueueBufferingMaxKBytes:   16384,
+			})
+
+			Expect(configMap).To(HaveKeyWithValue("queue.buffering.max.messages", kafka.ConfigValue(10000)))
+			Expect(configMap).To(HaveKeyWithValue("queue.buffering.max.kbytes", kafka.ConfigValue(16384)))
+		})
+
+		It("should leave the librdkafka defaults when no limits are configured", func() {
+			configMap := producerConfigMap(config.KafkaConfig{
+				Brokers:          []string{"localhost:9092"},
+				SecurityProtocol: "PLAINTEXT",
+			})
+
+			Expect(configMap).ToNot(HaveKey("queue.buffering.max.messages"))
+			Expect(configMap).ToNot(HaveKey("queue.buffering.max.kbytes"))
+		})
+	})
+
+	Describe("isQueueFull", func() {
+		It("should detect queue full errors from the producer", func() {
+			err := kafka.NewError(kafka.ErrQueueFull, "Local: Queue full", false)
+			Expect(isQueueFull(err)).To(BeTrue())
+			Expect(isQueueFull(fmt.Errorf("produce: %w", err))).To(BeTrue())
+		})
+
+		It("should not treat other errors as queue full", func() {
+			Expect(isQueueFull(nil)).To(BeFalse())
+			Expect(isQueueFull(kafka.NewError(kafka.ErrMsgSizeTooLarge, "Broker: Message size too large", false))).To(BeFalse())
+			Expect(isQueueFull(fmt.Errorf("boom"))).To(BeFalse())
+		})
+	})
+
+	Describe("topic failover", func() {
+		var (
+			mock     *mockProducer
+			producer *Producer
+			msg      *ROSMessage
+		)
+
+		BeforeEach(func() {
+			mock = newMockProducer()
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+			producer = &Producer{
+				producer: mock,
+				config: config.KafkaConfig{
+					Topic:         "hccm.ros.events",
+					FallbackTopic: "hccm.ros.events.fallback",
+				},
+				logger: logger,
+			}
+			msg = &ROSMessage{RequestID: "req-1", Metadata: ROSMetadata{Certified: true}}
+		})
+
+		It("should publish only to the primary topic when it accepts the message", func() {
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events"}))
+		})
+
+		It("should fail over when the primary topic is rejected at produce time", func() {
+			mock.produceErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrUnknownTopic, "Local: Unknown topic", false)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events", "hccm.ros.events.fallback"}))
+		})
+
+		It("should fail over when the primary topic delivery fails with a topic error", func() {
+			mock.deliveryErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrUnknownTopicOrPart, "Broker: Unknown topic or partition", false)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events", "hccm.ros.events.fallback"}))
+		})
+
+		It("should not fail over on errors unrelated to the topic", func() {
+			mock.deliveryErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrMsgSizeTooLarge, "Broker: Message size too large", false)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).ToNot(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events"}))
+		})
+
+		It("should not fail over when no fallback topic is configured", func() {
+			producer.config.FallbackTopic = ""
+			mock.produceErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrUnknownTopic, "Local: Unknown topic", false)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).ToNot(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events"}))
+		})
+
+		It("should return an error when the fallback topic also fails", func() {
+			topicErr := kafka.NewError(kafka.ErrUnknownTopic, "Local: Unknown topic", false)
+			mock.produceErrors["hccm.ros.events"] = topicErr
+			mock.produceErrors["hccm.ros.events.fallback"] = topicErr
+
+			err := producer.SendROSEvent(context.Background(), msg)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fallback topic"))
+		})
+	})
+	Describe("message too large", func() {
+		var (
+			mock     *mockProducer
+			producer *Producer
+			msg      *ROSMessage
+		)
+
+		BeforeEach(func() {
+			mock = newMockProducer()
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+			producer = &Producer{
+				producer: mock,
+				config:   config.KafkaConfig{Topic: "hccm.ros.events"},
+				logger:   logger,
+			}
+			msg = &ROSMessage{RequestID: "req-1", Metadata: ROSMetadata{Certified: true}}
+		})
+
+		It("should return ErrMessageTooLarge when the broker rejects the message size", func() {
+			mock.deliveryErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrMsgSizeTooLarge, "Broker: Message size too large", false)
+			before := testutil.ToFloat64(health.KafkaMessagesTotal.WithLabelValues("hccm.ros.events", "message_too_large"))
+
+			err := producer.SendROSEvent(context.Background(), msg)
+			Expect(err).To(MatchError(ErrMessageTooLarge))
+			Expect(testutil.ToFloat64(health.KafkaMessagesTotal.WithLabelValues("hccm.ros.events", "message_too_large"))).To(Equal(before + 1))
+		})
+
+		It("should return ErrMessageTooLarge when the producer refuses to enqueue the message", func() {
+			mock.produceErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrMsgSizeTooLarge, "Broker: Message size too large", false)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(MatchError(ErrMessageTooLarge))
+		})
+
+		It("should not treat other delivery errors as too large", func() {
+			mock.deliveryErrors["hccm.ros.events"] = kafka.NewError(kafka.ErrAllBrokersDown, "Local: All broker connections are down", false)
+
+			err := producer.SendROSEvent(context.Background(), msg)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrMessageTooLarge)).To(BeFalse())
+		})
+	})
+
+	Describe("header limits", func() {
+		var (
+			mock     *mockProducer
+			producer *Producer
+			msg      *ROSMessage
+		)
+
+		newProducer := func(maxHeaders, maxHeaderBytes int) *Producer {
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+			return &Producer{
+				producer: mock,
+				config: config.KafkaConfig{
+					Topic:          "hccm.ros.events",
+					MaxHeaders:     maxHeaders,
+					MaxHeaderBytes: maxHeaderBytes,
+				},
+				logger: logger,
+			}
+		}
+
+		BeforeEach(func() {
+			mock = newMockProducer()
+			producer = newProducer(0, 0)
+			msg = &ROSMessage{RequestID: "req-1", Metadata: ROSMetadata{OrgID: "12345", Certified: true}}
+		})
+
+		It("should send headers within the limits", func() {
+			// service=ros, request_id=req-1, org_id=12345 and certified=true take 49 bytes
+			producer = newProducer(4, 49)
+
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+			Expect(mock.producedTopics()).To(Equal([]string{"hccm.ros.events"}))
+		})
+
+		It("should reject a message with more headers than allowed", func() {
+			producer = newProducer(3, 0)
+			before := testutil.ToFloat64(health.KafkaMessagesTotal.WithLabelValues("hccm.ros.events", "headers_too_large"))
+
+			err := producer.SendROSEvent(context.Background(), msg)
+			Expect(err).To(MatchError(ErrHeadersTooLarge))
+			Expect(err.Error()).To(ContainSubstring("4 headers, the maximum is 3"))
+			Expect(mock.producedTopics()).To(BeEmpty())
+			Expect(testutil.ToFloat64(health.KafkaMessagesTotal.WithLabelValues("hccm.ros.events", "headers_too_large"))).To(Equal(before + 1))
+		})
+
+		It("should reject a message whose headers are too large", func() {
+			producer = newProducer(0, 64)
+			msg.Metadata.OrgID = strings.Repeat("1", 64)
+
+			err := producer.SendROSEvent(context.Background(), msg)
+			Expect(err).To(MatchError(ErrHeadersTooLarge))
+			Expect(err.Error()).To(ContainSubstring("108 header bytes, the maximum is 64"))
+			Expect(mock.producedTopics()).To(BeEmpty())
+		})
+
+		It("should apply the limits to validation messages", func() {
+			producer = newProducer(1, 0)
+
+			err := producer.SendValidationMessage(context.Background(), "req-1", "success")
+			Expect(err).To(MatchError(ErrHeadersTooLarge))
+			Expect(mock.producedTopics()).To(BeEmpty())
+		})
+	})
+
+	Describe("message signing", func() {
+		var (
+			mock     *mockProducer
+			producer *Producer
+			msg      *ROSMessage
+		)
+
+		BeforeEach(func() {
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+			mock = newMockProducer()
+			producer = &Producer{
+				producer: mock,
+				config: config.KafkaConfig{
+					Topic:        "hccm.ros.events",
+					SignMessages: true,
+					SigningKey:   "shared-secret",
+				},
+				logger: logger,
+			}
+			msg = &ROSMessage{RequestID: "req-1", Metadata: ROSMetadata{OrgID: "12345", Certified: true}}
+		})
+
+		It("should sign known values with HMAC-SHA256", func() {
+			signature := signValue([]byte("key"), []byte("The quick brown fox jumps over the lazy dog"))
+			Expect(signature).To(Equal("f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"))
+			Expect(VerifySignature([]byte("key"), []byte("The quick brown fox jumps over the lazy dog"), signature)).To(BeTrue())
+		})
+
+		It("should attach a signature header that verifies against the value", func() {
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+
+			signature, ok := mock.producedHeader(0, "signature")
+			Expect(ok).To(BeTrue())
+			value := mock.producedValues()[0]
+			Expect(VerifySignature([]byte("shared-secret"), value, signature)).To(BeTrue())
+		})
+
+		It("should not verify a tampered value or another key", func() {
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+
+			signature, _ := mock.producedHeader(0, "signature")
+			value := mock.producedValues()[0]
+			tampered := bytes.Replace(value, []byte("12345"), []byte("54321"), 1)
+			Expect(VerifySignature([]byte("shared-secret"), tampered, signature)).To(BeFalse())
+			Expect(VerifySignature([]byte("other-secret"), value, signature)).To(BeFalse())
+			Expect(VerifySignature([]byte("shared-secret"), value, "not-hex")).To(BeFalse())
+		})
+
+		It("should sign usage events", func() {
+			producer.config.UsageTopic = "hccm.usage.events"
+			Expect(producer.SendUsageEvent(context.Background(), msg)).To(Succeed())
+
+			signature, ok := mock.producedHeader(0, "signature")
+			Expect(ok).To(BeTrue())
+			Expect(VerifySignature([]byte("shared-secret"), mock.producedValues()[0], signature)).To(BeTrue())
+		})
+
+		It("should not sign when signing is disabled", func() {
+			producer.config.SignMessages = false
+			Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+
+			_, ok := mock.producedHeader(0, "signature")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("fatal errors", func() {
+		var (
+			failed   *mockProducer
+			producer *Producer
+			// attempts counts calls to newProducer, which fail while failures is positive
+			mu       sync.Mutex
+			attempts int
+			failures int
+			release  chan struct{}
+		)
+
+		BeforeEach(func() {
+			failed = newMockProducer()
+			failed.events = make(chan kafka.Event)
+			attempts, failures = 0, 0
+			release = make(chan struct{})
+
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+			producer = &Producer{
+				producer:           failed,
+				config:             config.KafkaConfig{Topic: "hccm.ros.events"},
+				logger:             logger,
+				recreateBackoff:    time.Millisecond,
+				recreateMaxBackoff: 5 * time.Millisecond,
+				closed:             make(chan struct{}),
+			}
+			go producer.handleDeliveryReports(failed)
+		})
+
+		recreateWith := func(replacement *mockProducer) {
+			producer.newProducer = func() (kafkaProducer, error) {
+				<-release
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if failures > 0 {
+					failures--
+					return nil, errors.New("brokers unreachable")
+				}
+				return replacement, nil
+			}
+		}
+
+		attemptCount := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return attempts
+		}
+
+		It("should recreate the producer and report unhealthy until it is replaced", func() {
+			replacement := newMockProducer()
+			replacement.events = make(chan kafka.Event)
+			recreateWith(replacement)
+			failures = 2
+			failuresBefore := testutil.ToFloat64(health.KafkaProducerRecreationsTotal.WithLabelValues("failure"))
+			successesBefore := testutil.ToFloat64(health.KafkaProducerRecreationsTotal.WithLabelValues("success"))
+			Expect(producer.HealthCheck()).To(Succeed())
+
+			failed.events <- kafka.NewError(kafka.ErrFatal, "fatal idempotent producer error", true)
+			Eventually(producer.HealthCheck).Should(MatchError(ContainSubstring("kafka producer is being recreated after a fatal error")))
+
+			close(release)
+			Eventually(producer.HealthCheck).Should(Succeed())
+			Expect(attemptCount()).To(Equal(3))
+			Expect(failed.isClosed()).To(BeTrue())
+			Expect(testutil.ToFloat64(health.KafkaProducerRecreationsTotal.WithLabelValues("failure"))).To(Equal(failuresBefore + 2))
+			Expect(testutil.ToFloat64(health.KafkaProducerRecreationsTotal.WithLabelValues("success"))).To(Equal(successesBefore + 1))
+
+			Expect(producer.SendROSEvent(context.Background(), &ROSMessage{RequestID: "req-1", Metadata: ROSMetadata{Certified: true}})).To(Succeed())
+			Expect(replacement.producedTopics()).To(Equal([]string{"hccm.ros.events"}))
+			Expect(failed.producedTopics()).To(BeEmpty())
+
+			Expect(producer.Close()).To(Succeed())
+			Expect(replacement.isClosed()).To(BeTrue())
+		})
+
+		It("should keep the producer on errors that aren't fatal", func() {
+			recreateWith(newMockProducer())
+			close(release)
+
+			failed.events <- kafka.NewError(kafka.ErrAllBrokersDown, "all brokers down", false)
+			Consistently(producer.HealthCheck, 50*time.Millisecond).Should(Succeed())
+			Expect(attemptCount()).To(BeZero())
+			Expect(failed.isClosed()).To(BeFalse())
+		})
+
+		It("should stop recreating the producer once it is closed", func() {
+			recreateWith(newMockProducer())
+			failures = math.MaxInt
+			close(release)
+
+			failed.events <- kafka.NewError(kafka.ErrFatal, "fatal idempotent producer error", true)
+			Eventually(attemptCount).Should(BeNumerically(">", 1))
+
+			Expect(producer.Close()).To(Succeed())
+			Expect(failed.isClosed()).To(BeTrue())
+			stopped := attemptCount()
+			Consistently(attemptCount, 50*time.Millisecond).Should(BeNumerically("<=", stopped+1))
+		})
+	})
+})
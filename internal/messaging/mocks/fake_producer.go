@@ -0,0 +1,121 @@
+// Package mocks provides test doubles for the messaging package.
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+)
+
+// FakeProducer is an in-memory MessageProducer that records the messages it is asked to send
+// Set the error fields before use to make the corresponding calls fail
+type FakeProducer struct {
+	SendROSEventErr          error
+	SendUsageEventErr        error
+	SendValidationMessageErr error
+	HealthCheckErr           error
+
+	// Release, when set, makes SendROSEvent wait until it is closed or ctx is done
+	Release chan struct{}
+
+	mu                 sync.Mutex
+	calls              []string
+	rosEvents          []*messaging.ROSMessage
+	usageEvents        []*messaging.ROSMessage
+	validationMessages []messaging.ValidationMessage
+	closed             bool
+}
+
+var _ messaging.MessageProducer = (*FakeProducer)(nil)
+
+// NewFakeProducer creates a fake producer that accepts every message
+func NewFakeProducer() *FakeProducer {
+	return &FakeProducer{}
+}
+
+// SendROSEvent records msg and returns SendROSEventErr
+func (f *FakeProducer) SendROSEvent(ctx context.Context, msg *messaging.ROSMessage) error {
+	if f.Release != nil {
+		select {
+		case <-f.Release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "SendROSEvent")
+	f.rosEvents = append(f.rosEvents, msg)
+	return f.SendROSEventErr
+}
+
+// SendUsageEvent records msg and returns SendUsageEventErr
+func (f *FakeProducer) SendUsageEvent(_ context.Context, msg *messaging.ROSMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "SendUsageEvent")
+	f.usageEvents = append(f.usageEvents, msg)
+	return f.SendUsageEventErr
+}
+
+// SendValidationMessage records the validation message and returns SendValidationMessageErr
+func (f *FakeProducer) SendValidationMessage(_ context.Context, requestID, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "SendValidationMessage")
+	f.validationMessages = append(f.validationMessages, messaging.ValidationMessage{
+		RequestID:  requestID,
+		Validation: status,
+	})
+	return f.SendValidationMessageErr
+}
+
+// HealthCheck returns HealthCheckErr
+func (f *FakeProducer) HealthCheck() error {
+	return f.HealthCheckErr
+}
+
+// Close marks the producer closed
+func (f *FakeProducer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Calls returns the names of the send methods called so far, in order
+func (f *FakeProducer) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// ROSEvents returns the ROS events sent so far
+func (f *FakeProducer) ROSEvents() []*messaging.ROSMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*messaging.ROSMessage(nil), f.rosEvents...)
+}
+
+// UsageEvents returns the usage events sent so far
+func (f *FakeProducer) UsageEvents() []*messaging.ROSMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*messaging.ROSMessage(nil), f.usageEvents...)
+}
+
+// ValidationMessages returns the validation messages sent so far
+func (f *FakeProducer) ValidationMessages() []messaging.ValidationMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]messaging.ValidationMessage(nil), f.validationMessages...)
+}
+
+// Closed reports whether Close has been called
+func (f *FakeProducer) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
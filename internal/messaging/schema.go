@@ -0,0 +1,229 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/confluentinc/confluent-kafka-go/v2/schemaregistry"
+)
+
+// Event value formats
+const (
+	// valueFormatJSON is plain JSON without schema registry framing
+	valueFormatJSON = "json"
+	// valueFormatAvro is Avro binary framed with the registered schema ID
+	valueFormatAvro = "avro"
+	// valueFormatJSONSchema is JSON framed with the ID of its registered JSON schema
+	valueFormatJSONSchema = "jsonschema"
+)
+
+// schemaRegistryMagicByte starts every value framed for the schema registry, followed by the
+// 4 byte big-endian schema ID and the encoded message
+const schemaRegistryMagicByte byte = 0x0
+
+// rosMessageAvroSchema is the Avro schema of ROSMessage, field order is the binary encoding order
+const rosMessageAvroSchema = `{
+  "type": "record",
+  "name": "ROSMessage",
+  "namespace": "com.redhat.insights.ros",
+  "fields": [
+    {"name": "request_id", "type": "string"},
+    {"name": "b64_identity", "type": "string"},
+    {"name": "metadata", "type": {
+      "type": "record",
+      "name": "ROSMetadata",
+      "fields": [
+        {"name": "account", "type": "string"},
+        {"name": "org_id", "type": "string"},
+        {"name": "source_id", "type": "string"},
+        {"name": "provider_uuid", "type": "string"},
+        {"name": "cluster_uuid", "type": "string"},
+        {"name": "cluster_alias", "type": "string"},
+        {"name": "operator_version", "type": "string"},
+        {"name": "certified", "type": "boolean"},
+        {"name": "ingested_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+        {"name": "org_metadata", "type": {"type": "map", "values": "string"}, "default": {}}
+      ]
+    }},
+    {"name": "files", "type": {"type": "array", "items": "string"}},
+    {"name": "object_keys", "type": {"type": "array", "items": "string"}},
+    {"name": "checksum_manifest", "type": "string", "default": ""},
+    {"name": "checksum_manifest_key", "type": "string", "default": ""}
+  ]
+}`
+
+// rosMessageJSONSchema is the JSON schema of ROSMessage as produced by encoding/json
+const rosMessageJSONSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "ROSMessage",
+  "type": "object",
+  "properties": {
+    "request_id": {"type": "string"},
+    "b64_identity": {"type": "string"},
+    "metadata": {
+      "type": "object",
+      "properties": {
+        "account": {"type": "string"},
+        "org_id": {"type": "string"},
+        "source_id": {"type": "string"},
+        "provider_uuid": {"type": "string"},
+        "cluster_uuid": {"type": "string"},
+        "cluster_alias": {"type": "string"},
+        "operator_version": {"type": "string"},
+        "certified": {"type": "boolean"},
+        "ingested_at": {"type": "string", "format": "date-time"},
+        "org_metadata": {"type": "object", "additionalProperties": {"type": "string"}}
+      },
+      "required": ["account", "org_id", "source_id", "provider_uuid", "cluster_uuid", "cluster_alias", "operator_version", "certified", "ingested_at"]
+    },
+    "files": {"type": ["array", "null"], "items": {"type": "string"}},
+    "object_keys": {"type": ["array", "null"], "items": {"type": "string"}},
+    "checksum_manifest": {"type": "string"},
+    "checksum_manifest_key": {"type": "string"}
+  },
+  "required": ["request_id", "b64_identity", "metadata", "files", "object_keys"]
+}`
+
+// schemaSerializer serializes events in a schema registry format
+// Schemas are registered on first use of a subject, the registry client caches the IDs
+type schemaSerializer struct {
+	client  schemaregistry.Client
+	format  string
+	subject string
+}
+
+// newSchemaSerializer creates the serializer for the configured value format
+// It returns nil for plain JSON, which needs no registry
+func newSchemaSerializer(cfg config.KafkaConfig) (*schemaSerializer, error) {
+	if cfg.ValueFormat == "" || cfg.ValueFormat == valueFormatJSON {
+		return nil, nil
+	}
+
+	registryConfig := schemaregistry.NewConfig(cfg.SchemaRegistryURL)
+	if cfg.SchemaRegistryUsername != "" {
+		registryConfig = schemaregistry.NewConfigWithBasicAuthentication(cfg.SchemaRegistryURL, cfg.SchemaRegistryUsername, cfg.SchemaRegistryPassword)
+	}
+	client, err := schemaregistry.NewClient(registryConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema registry client: %w", err)
+	}
+
+	return &schemaSerializer{
+		client:  client,
+		format:  cfg.ValueFormat,
+		subject: cfg.SchemaRegistrySubject,
+	}, nil
+}
+
+// Serialize encodes msg for topic and frames it with the magic byte and schema ID
+func (s *schemaSerializer) Serialize(topic string, msg *ROSMessage) ([]byte, error) {
+	subject := s.subject
+	if subject == "" {
+		// The registry's default TopicNameStrategy
+		subject = topic + "-value"
+	}
+
+	var (
+		schema  schemaregistry.SchemaInfo
+		payload []byte
+		err     error
+	)
+	switch s.format {
+	case valueFormatAvro:
+		schema = schemaregistry.SchemaInfo{Schema: rosMessageAvroSchema, SchemaType: "AVRO"}
+		payload = encodeROSMessageAvro(msg)
+	case valueFormatJSONSchema:
+		schema = schemaregistry.SchemaInfo{Schema: rosMessageJSONSchema, SchemaType: "JSON"}
+		payload, err = json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value format %q", s.format)
+	}
+
+	id, err := s.client.Register(subject, schema, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register schema for subject %s: %w", subject, err)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(5 + len(payload))
+	buf.WriteByte(schemaRegistryMagicByte)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(id))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// encodeROSMessageAvro encodes msg in Avro binary following rosMessageAvroSchema
+func encodeROSMessageAvro(msg *ROSMessage) []byte {
+	var buf []byte
+	buf = appendAvroString(buf, msg.RequestID)
+	buf = appendAvroString(buf, msg.B64Identity)
+
+	metadata := msg.Metadata
+	buf = appendAvroString(buf, metadata.Account)
+	buf = appendAvroString(buf, metadata.OrgID)
+	buf = appendAvroString(buf, metadata.SourceID)
+	buf = appendAvroString(buf, metadata.ProviderUUID)
+	buf = appendAvroString(buf, metadata.ClusterUUID)
+	buf = appendAvroString(buf, metadata.ClusterAlias)
+	buf = appendAvroString(buf, metadata.OperatorVersion)
+	buf = appendAvroBoolean(buf, metadata.Certified)
+	buf = binary.AppendVarint(buf, metadata.IngestedAt.UnixMilli())
+	buf = appendAvroStringMap(buf, metadata.OrgMetadata)
+
+	buf = appendAvroStringArray(buf, msg.Files)
+	buf = appendAvroStringArray(buf, msg.ObjectKeys)
+	buf = appendAvroString(buf, msg.ChecksumManifest)
+	buf = appendAvroString(buf, msg.ChecksumManifestKey)
+	return buf
+}
+
+// Avro longs, string lengths and array block counts are zigzag varints, which is binary.AppendVarint's encoding
+
+func appendAvroString(buf []byte, value string) []byte {
+	buf = binary.AppendVarint(buf, int64(len(value)))
+	return append(buf, value...)
+}
+
+func appendAvroBoolean(buf []byte, value bool) []byte {
+	if value {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+// appendAvroStringArray writes values as a single block followed by the terminating empty block
+func appendAvroStringArray(buf []byte, values []string) []byte {
+	if len(values) > 0 {
+		buf = binary.AppendVarint(buf, int64(len(values)))
+		for _, value := range values {
+			buf = appendAvroString(buf, value)
+		}
+	}
+	return binary.AppendVarint(buf, 0)
+}
+
+// appendAvroStringMap writes values as a single block of key/value pairs, in key order so the
+// encoding is stable, followed by the terminating empty block
+func appendAvroStringMap(buf []byte, values map[string]string) []byte {
+	if len(values) > 0 {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		buf = binary.AppendVarint(buf, int64(len(keys)))
+		for _, key := range keys {
+			buf = appendAvroString(buf, key)
+			buf = appendAvroString(buf, values[key])
+		}
+	}
+	return binary.AppendVarint(buf, 0)
+}
@@ -0,0 +1,357 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSchemaRegistry assigns IDs to registered schemas and records the subjects used
+type fakeSchemaRegistry struct {
+	mu       sync.Mutex
+	ids      map[string]int
+	subjects []string
+	types    []string
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subject, ok := strings.CutPrefix(r.URL.Path, "/subjects/")
+	subject, ok2 := strings.CutSuffix(subject, "/versions")
+	if r.Method != http.MethodPost || !ok || !ok2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var schema struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	_ = json.Unmarshal(body, &schema)
+
+	id, ok := f.ids[schema.Schema]
+	if !ok {
+		id = 100 + len(f.ids)
+		f.ids[schema.Schema] = id
+	}
+	f.subjects = append(f.subjects, subject)
+	f.types = append(f.types, schema.SchemaType)
+
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+func (f *fakeSchemaRegistry) registeredSubjects() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.subjects...)
+}
+
+// avroReader decodes the Avro primitives used by the ROS message schema
+type avroReader struct {
+	data []byte
+}
+
+func (r *avroReader) long() int64 {
+	value, n := binary.Varint(r.data)
+	Expect(n).To(BeNumerically(">", 0))
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *avroReader) string() string {
+	length := int(r.long())
+	value := string(r.data[:length])
+	r.data = r.data[length:]
+	return value
+}
+
+func (r *avroReader) boolean() bool {
+	value := r.data[0] == 1
+	r.data = r.data[1:]
+	return value
+}
+
+func (r *avroReader) stringArray() []string {
+	var values []string
+	for count := r.long(); count != 0; count = r.long() {
+		for i := int64(0); i < count; i++ {
+			values = append(values, r.string())
+		}
+	}
+	return values
+}
+
+func (r *avroReader) stringMap() map[string]string {
+	values := map[string]string{}
+	for count := r.long(); count != 0; count = r.long() {
+		for i := int64(0); i < count; i++ {
+			key := r.string()
+			values[key] = r.string()
+		}
+	}
+	return values
+}
+
+var _ = Describe("Schema registry serialization", func() {
+	var (
+		registry *fakeSchemaRegistry
+		cfg      config.KafkaConfig
+		msg      *ROSMessage
+	)
+
+	BeforeEach(func() {
+		registry = &fakeSchemaRegistry{ids: make(map[string]int)}
+		server := httptest.NewServer(registry)
+		DeferCleanup(server.Close)
+
+		cfg = config.KafkaConfig{
+			Topic:             "hccm.ros.events",
+			SchemaRegistryURL: server.URL,
+		}
+		msg = &ROSMessage{
+			RequestID:   "req-1",
+			B64Identity: "eyJpZGVudGl0eSI6e319",
+			Metadata: ROSMetadata{
+				Account:         "67890",
+				OrgID:           "12345",
+				SourceID:        "source-1",
+				ProviderUUID:    "provider-1",
+				ClusterUUID:     "cluster-1",
+				ClusterAlias:    "my-cluster",
+				OperatorVersion: "3.0.0",
+				Certified:       true,
+				IngestedAt:      time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC),
+			},
+			Files:      []string{"https://storage.example.com/a.csv", "https://storage.example.com/b.csv"},
+			ObjectKeys: []string{"ros/a.csv", "ros/b.csv"},
+		}
+	})
+
+	newSerializer := func(format string) *schemaSerializer {
+		cfg.ValueFormat = format
+		serializer, err := newSchemaSerializer(cfg)
+		Expect(err).ToNot(HaveOccurred())
+		return serializer
+	}
+
+	// frame splits a serialized value into its magic byte, schema ID and payload
+	frame := func(value []byte) (byte, uint32, []byte) {
+		Expect(len(value)).To(BeNumerically(">=", 5))
+		return value[0], binary.BigEndian.Uint32(value[1:5]), value[5:]
+	}
+
+	It("should not create a serializer for plain JSON", func() {
+		Expect(newSerializer("")).To(BeNil())
+		Expect(newSerializer("json")).To(BeNil())
+	})
+
+	It("should frame Avro values with the magic byte and registered schema ID", func() {
+		value, err := newSerializer("avro").Serialize("hccm.ros.events", msg)
+		Expect(err).ToNot(HaveOccurred())
+
+		magic, id, payload := frame(value)
+		Expect(magic).To(Equal(byte(0)))
+		Expect(id).To(Equal(uint32(100)))
+		Expect(registry.registeredSubjects()).To(Equal([]string{"hccm.ros.events-value"}))
+		Expect(registry.types).To(Equal([]string{"AVRO"}))
+
+		reader := &avroReader{data: payload}
+		Expect(reader.string()).To(Equal("req-1"))
+		Expect(reader.string()).To(Equal("eyJpZGVudGl0eSI6e319"))
+		Expect([]string{reader.string(), reader.string(), reader.string(), reader.string(), reader.string(), reader.string(), reader.string()}).To(Equal([]string{
+			"67890", "12345", "source-1", "provider-1", "cluster-1", "my-cluster", "3.0.0",
+		}))
+		Expect(reader.boolean()).To(BeTrue())
+		Expect(reader.long()).To(Equal(msg.Metadata.IngestedAt.UnixMilli()))
+		Expect(reader.stringMap()).To(BeEmpty())
+		Expect(reader.stringArray()).To(Equal(msg.Files))
+		Expect(reader.stringArray()).To(Equal(msg.ObjectKeys))
+		Expect(reader.string()).To(BeEmpty())
+		Expect(reader.string()).To(BeEmpty())
+		Expect(reader.data).To(BeEmpty())
+	})
+
+	It("should encode empty file lists as empty Avro arrays", func() {
+		msg.Files, msg.ObjectKeys = nil, nil
+		value, err := newSerializer("avro").Serialize("hccm.ros.events", msg)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, _, payload := frame(value)
+		reader := &avroReader{data: payload}
+		for range 9 {
+			reader.string()
+		}
+		reader.boolean()
+		reader.long()
+		reader.stringMap()
+		Expect(reader.stringArray()).To(BeEmpty())
+		Expect(reader.stringArray()).To(BeEmpty())
+	})
+
+	It("should encode the org metadata as an Avro map", func() {
+		msg.Metadata.OrgMetadata = map[string]string{"tier": "premium", "region": "eu"}
+		value, err := newSerializer("avro").Serialize("hccm.ros.events", msg)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, _, payload := frame(value)
+		reader := &avroReader{data: payload}
+		for range 9 {
+			reader.string()
+		}
+		reader.boolean()
+		reader.long()
+		Expect(reader.stringMap()).To(Equal(msg.Metadata.OrgMetadata))
+		Expect(reader.stringArray()).To(Equal(msg.Files))
+	})
+
+	It("should frame JSON schema values around the JSON message", func() {
+		value, err := newSerializer("jsonschema").Serialize("hccm.ros.events", msg)
+		Expect(err).ToNot(HaveOccurred())
+
+		magic, id, payload := frame(value)
+		Expect(magic).To(Equal(byte(0)))
+		Expect(id).To(Equal(uint32(100)))
+		Expect(registry.types).To(Equal([]string{"JSON"}))
+
+		var decoded ROSMessage
+		Expect(json.Unmarshal(payload, &decoded)).To(Succeed())
+		Expect(decoded.RequestID).To(Equal("req-1"))
+		Expect(decoded.ObjectKeys).To(Equal(msg.ObjectKeys))
+	})
+
+	It("should register under the configured subject", func() {
+		cfg.SchemaRegistrySubject = "ros-events"
+		_, err := newSerializer("avro").Serialize("hccm.ros.events", msg)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(registry.registeredSubjects()).To(Equal([]string{"ros-events"}))
+	})
+
+	It("should fail when the registry rejects the schema", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		DeferCleanup(server.Close)
+		cfg.SchemaRegistryURL = server.URL
+		_, err := newSerializer("avro").Serialize("hccm.ros.events", msg)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to register schema for subject hccm.ros.events-value"))
+	})
+
+	It("should publish framed values through the producer", func() {
+		mock := newMockProducer()
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		producer := &Producer{
+			producer:   mock,
+			config:     cfg,
+			logger:     logger,
+			serializer: newSerializer("avro"),
+		}
+
+		Expect(producer.SendROSEvent(context.Background(), msg)).To(Succeed())
+		values := mock.producedValues()
+		Expect(values).To(HaveLen(1))
+		magic, id, _ := frame(values[0])
+		Expect(magic).To(Equal(byte(0)))
+		Expect(id).To(Equal(uint32(100)))
+	})
+})
+
+// jsonFields returns the JSON names of t's fields in declaration order, and those not omitted when empty
+func jsonFields(t reflect.Type) (names, required []string) {
+	for i := 0; i < t.NumField(); i++ {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		names = append(names, name)
+		if options != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	return names, required
+}
+
+// avroRecordFields returns the field names of an Avro record schema in order, and its fields' types
+func avroRecordFields(schema json.RawMessage) ([]string, map[string]json.RawMessage) {
+	var record struct {
+		Type   string `json:"type"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	Expect(json.Unmarshal(schema, &record)).To(Succeed())
+	Expect(record.Type).To(Equal("record"))
+
+	var names []string
+	types := map[string]json.RawMessage{}
+	for _, field := range record.Fields {
+		names = append(names, field.Name)
+		types[field.Name] = field.Type
+	}
+	return names, types
+}
+
+// jsonObjectProperties returns the property names of a JSON schema object in document order, its
+// properties' schemas and its required properties
+func jsonObjectProperties(schema json.RawMessage) ([]string, map[string]json.RawMessage, []string) {
+	var object struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+		Required   []string                   `json:"required"`
+	}
+	Expect(json.Unmarshal(schema, &object)).To(Succeed())
+
+	// A map loses the document order, so the properties' keys are read from the token stream
+	var document struct {
+		Properties json.RawMessage `json:"properties"`
+	}
+	Expect(json.Unmarshal(schema, &document)).To(Succeed())
+	decoder := json.NewDecoder(bytes.NewReader(document.Properties))
+	_, err := decoder.Token()
+	Expect(err).ToNot(HaveOccurred())
+	var names []string
+	for decoder.More() {
+		key, err := decoder.Token()
+		Expect(err).ToNot(HaveOccurred())
+		names = append(names, key.(string))
+		var value json.RawMessage
+		Expect(decoder.Decode(&value)).To(Succeed())
+	}
+	return names, object.Properties, object.Required
+}
+
+var _ = Describe("ROSMessage schemas", func() {
+	messageFields, messageRequired := jsonFields(reflect.TypeOf(ROSMessage{}))
+	metadataFields, metadataRequired := jsonFields(reflect.TypeOf(ROSMetadata{}))
+
+	It("should list the Avro fields in the order and under the names of the struct's JSON tags", func() {
+		names, types := avroRecordFields(json.RawMessage(rosMessageAvroSchema))
+		Expect(names).To(Equal(messageFields))
+
+		names, _ = avroRecordFields(types["metadata"])
+		Expect(names).To(Equal(metadataFields))
+	})
+
+	It("should list the JSON schema properties in the order and under the names of the struct's JSON tags", func() {
+		names, properties, required := jsonObjectProperties(json.RawMessage(rosMessageJSONSchema))
+		Expect(names).To(Equal(messageFields))
+		Expect(required).To(Equal(messageRequired))
+
+		names, _, required = jsonObjectProperties(properties["metadata"])
+		Expect(names).To(Equal(metadataFields))
+		Expect(required).To(Equal(metadataRequired))
+	})
+})
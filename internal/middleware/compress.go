@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+// compressibleTypes are the response content types worth compressing
+var compressibleTypes = []string{"application/json", "text/plain"}
+
+// Compress creates middleware that compresses JSON and text responses at the given
+// gzip level (1-9) for clients that send a matching Accept-Encoding
+// A level of zero uses the standard level
+func Compress(level int) func(http.Handler) http.Handler {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return chimiddleware.Compress(level, compressibleTypes...)
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compress", func() {
+	// A body repetitive enough that the fastest and best levels produce different output
+	body := []byte(`{"statuses":[` + strings.Repeat(`{"request_id":"abc","status":"succeeded"},`, 200) + `{}]}`)
+
+	serve := func(level int, acceptEncoding string) *httptest.ResponseRecorder {
+		handler := Compress(level)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/status/abc", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	gzipAt := func(level int) []byte {
+		var buf bytes.Buffer
+		writer, err := gzip.NewWriterLevel(&buf, level)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	DescribeTable("should compress with the configured level",
+		func(level int) {
+			recorder := serve(level, "gzip")
+			Expect(recorder.Header().Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(recorder.Body.Bytes()).To(Equal(gzipAt(level)))
+
+			reader, err := gzip.NewReader(recorder.Body)
+			Expect(err).ToNot(HaveOccurred())
+			decompressed, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decompressed).To(Equal(body))
+		},
+		Entry("fastest", gzip.BestSpeed),
+		Entry("standard", 6),
+		Entry("smallest", gzip.BestCompression),
+	)
+
+	It("should use the standard level when no level is set", func() {
+		Expect(serve(0, "gzip").Body.Bytes()).To(Equal(gzipAt(gzip.DefaultCompression)))
+	})
+
+	It("should produce different output at different levels", func() {
+		Expect(gzipAt(gzip.BestSpeed)).ToNot(Equal(gzipAt(gzip.BestCompression)))
+	})
+
+	It("should leave responses uncompressed for clients that don't accept gzip", func() {
+		recorder := serve(gzip.BestCompression, "")
+		Expect(recorder.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(recorder.Body.Bytes()).To(Equal(body))
+	})
+})
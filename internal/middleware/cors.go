@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	// AllowedOrigins lists the browser origins allowed to call the API, "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are advertised in preflight responses
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
+// CORS creates middleware that adds CORS headers for allowed origins and answers preflight requests
+// It must run before authentication, since browsers send preflight requests without credentials
+// With no allowed origins it passes every request through unchanged
+func CORS(opts CORSOptions) func(http.Handler) http.Handler {
+	allowMethods := strings.Join(opts.AllowedMethods, ", ")
+	allowHeaders := strings.Join(opts.AllowedHeaders, ", ")
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+
+	return func(next http.Handler) http.Handler {
+		if len(opts.AllowedOrigins) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			allowed := anyOrigin || slices.Contains(opts.AllowedOrigins, origin)
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !allowed {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				// Without CORS headers the browser blocks the response
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin && !opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				if allowHeaders != "" {
+					w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
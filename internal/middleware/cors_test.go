@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CORS", func() {
+	var handler http.Handler
+
+	newHandler := func(opts CORSOptions) {
+		handler = CORS(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	}
+
+	serve := func(method, origin string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/ingress/v1/upload", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	preflight := http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"authorization"},
+	}
+
+	BeforeEach(func() {
+		newHandler(CORSOptions{
+			AllowedOrigins: []string{"https://console.example.com"},
+			AllowedMethods: []string{http.MethodGet, http.MethodPost},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+		})
+	})
+
+	It("should add CORS headers for an allowed origin", func() {
+		recorder := serve(http.MethodPost, "https://console.example.com", nil)
+
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://console.example.com"))
+		Expect(recorder.Header().Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+		Expect(recorder.Header().Values("Vary")).To(ContainElement("Origin"))
+	})
+
+	It("should not add CORS headers for a disallowed origin", func() {
+		recorder := serve(http.MethodPost, "https://evil.example.com", nil)
+
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("should answer preflight requests from an allowed origin without calling the handler", func() {
+		recorder := serve(http.MethodOptions, "https://console.example.com", preflight)
+
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://console.example.com"))
+		Expect(recorder.Header().Get("Access-Control-Allow-Methods")).To(Equal("GET, POST"))
+		Expect(recorder.Header().Get("Access-Control-Allow-Headers")).To(Equal("Authorization, Content-Type"))
+	})
+
+	It("should reject preflight requests from a disallowed origin", func() {
+		recorder := serve(http.MethodOptions, "https://evil.example.com", preflight)
+
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("should echo the origin and allow credentials when configured", func() {
+		newHandler(CORSOptions{
+			AllowedOrigins:   []string{"https://console.example.com"},
+			AllowedMethods:   []string{http.MethodPost},
+			AllowCredentials: true,
+		})
+
+		recorder := serve(http.MethodPost, "https://console.example.com", nil)
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://console.example.com"))
+		Expect(recorder.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+	})
+
+	It("should allow any origin with a wildcard", func() {
+		newHandler(CORSOptions{AllowedOrigins: []string{"*"}, AllowedMethods: []string{http.MethodPost}})
+
+		recorder := serve(http.MethodPost, "https://anywhere.example.com", nil)
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(Equal("*"))
+	})
+
+	It("should pass requests through unchanged when no origins are allowed", func() {
+		newHandler(CORSOptions{})
+
+		recorder := serve(http.MethodOptions, "https://console.example.com", preflight)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+})
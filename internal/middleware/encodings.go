@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Content encodings the service knows how to decode
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+)
+
+// AllowEncodings creates middleware that restricts request bodies to the given content encodings
+// Requests without a Content-Encoding header are treated as identity. Other encodings get a 415
+// listing the allowed encodings in the Accept-Encoding header, and gzip bodies are decoded
+// before reaching the handler. The decoded body is unbounded, so the handler must limit what
+// it reads rather than trust the Content-Length, which is that of the encoded body
+func AllowEncodings(encodings ...string) func(http.Handler) http.Handler {
+	acceptEncoding := strings.Join(encodings, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested := requestEncodings(r)
+			for _, encoding := range requested {
+				if !slices.Contains(encodings, encoding) {
+					w.Header().Set("Accept-Encoding", acceptEncoding)
+					respondEncodingError(w, http.StatusUnsupportedMediaType, "Content encoding not supported")
+					return
+				}
+			}
+
+			if slices.Contains(requested, EncodingGzip) {
+				if len(requested) > 1 {
+					w.Header().Set("Accept-Encoding", acceptEncoding)
+					respondEncodingError(w, http.StatusUnsupportedMediaType, "Stacked content encodings are not supported")
+					return
+				}
+				body, err := gzip.NewReader(r.Body)
+				if err != nil {
+					respondEncodingError(w, http.StatusBadRequest, "Invalid gzip request body")
+					return
+				}
+				r.Body = gzipBody{Reader: body, body: r.Body}
+				r.Header.Del("Content-Encoding")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestEncodings returns the lowercased codings in the request's Content-Encoding header,
+// or identity when the header is absent
+func requestEncodings(r *http.Request) []string {
+	var encodings []string
+	for _, value := range r.Header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	if len(encodings) == 0 {
+		return []string{EncodingIdentity}
+	}
+	return encodings
+}
+
+func respondEncodingError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// gzipBody decodes a gzip request body and closes both the decoder and the underlying body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AllowEncodings", func() {
+	var (
+		handler  http.Handler
+		received []byte
+		encoding string
+	)
+
+	BeforeEach(func() {
+		received = nil
+		encoding = ""
+		handler = AllowEncodings(EncodingIdentity, EncodingGzip)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = io.ReadAll(r.Body)
+			encoding = r.Header.Get("Content-Encoding")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	})
+
+	serve := func(contentEncoding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	It("should pass requests without a Content-Encoding through unchanged", func() {
+		recorder := serve("", []byte("payload"))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(received).To(Equal([]byte("payload")))
+	})
+
+	It("should pass identity encoded requests through unchanged", func() {
+		recorder := serve("identity", []byte("payload"))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(received).To(Equal([]byte("payload")))
+	})
+
+	It("should decode gzip encoded requests", func() {
+		recorder := serve("GZIP", gzipped([]byte("payload")))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(received).To(Equal([]byte("payload")))
+		Expect(encoding).To(BeEmpty())
+	})
+
+	It("should reject a gzip body that is not valid gzip", func() {
+		recorder := serve("gzip", []byte("payload"))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(received).To(BeNil())
+	})
+
+	DescribeTable("should reject unsupported encodings with 415",
+		func(contentEncoding string) {
+			recorder := serve(contentEncoding, []byte("payload"))
+			Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+			Expect(recorder.Header().Get("Accept-Encoding")).To(Equal("identity, gzip"))
+			Expect(recorder.Body.String()).To(ContainSubstring("Content encoding not supported"))
+			Expect(received).To(BeNil())
+		},
+		Entry("brotli", "br"),
+		Entry("deflate", "deflate"),
+		Entry("a stack containing an unsupported coding", "gzip, br"),
+	)
+
+	It("should reject stacked gzip encodings", func() {
+		recorder := serve("gzip, gzip", gzipped(gzipped([]byte("payload"))))
+		Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+	})
+
+	It("should reject identity requests when only gzip is allowed", func() {
+		handler = AllowEncodings(EncodingGzip)(handler)
+		recorder := serve("", []byte("payload"))
+		Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+		Expect(recorder.Header().Get("Accept-Encoding")).To(Equal("gzip"))
+	})
+})
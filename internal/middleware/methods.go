@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AllowMethods creates middleware that restricts a route to the given HTTP methods
+// Other methods get a 405 listing the allowed methods in the Allow header, and
+// OPTIONS requests are answered directly with the same header
+func AllowMethods(methods ...string) func(http.Handler) http.Handler {
+	allow := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Allow", allow)
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/go-chi/chi/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AllowMethods", func() {
+	var router *chi.Mux
+
+	BeforeEach(func() {
+		router = chi.NewRouter()
+		router.With(AllowMethods(http.MethodPost)).HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+	})
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, "/upload", nil))
+		return recorder
+	}
+
+	It("should pass allowed methods through", func() {
+		recorder := serve(http.MethodPost)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("Allow")).To(BeEmpty())
+	})
+
+	It("should reject other methods with 405 and an Allow header", func() {
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			recorder := serve(method)
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed), "method %s", method)
+			Expect(recorder.Header().Get("Allow")).To(Equal("POST, OPTIONS"), "method %s", method)
+			Expect(recorder.Body.String()).To(ContainSubstring("Method not allowed"))
+		}
+	})
+
+	It("should answer OPTIONS with the allowed methods", func() {
+		recorder := serve(http.MethodOptions)
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(recorder.Header().Get("Allow")).To(Equal("POST, OPTIONS"))
+	})
+
+	It("should support multiple configured methods", func() {
+		router = chi.NewRouter()
+		router.With(AllowMethods(http.MethodPost, http.MethodPut)).HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		Expect(serve(http.MethodPut).Code).To(Equal(http.StatusAccepted))
+		Expect(serve(http.MethodGet).Header().Get("Allow")).To(Equal("POST, PUT, OPTIONS"))
+	})
+})
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// Timeouts creates middleware that overrides the server read and write timeouts for a route
+// The deadlines are measured from when the route starts handling the request, so a route can
+// allow longer (or shorter) than the server defaults. A zero timeout keeps the server default
+func Timeouts(read, write time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			now := time.Now()
+			// Writers that can't set deadlines (e.g. in tests) keep the server timeouts
+			if read > 0 {
+				_ = rc.SetReadDeadline(now.Add(read))
+			}
+			if write > 0 {
+				_ = rc.SetWriteDeadline(now.Add(write))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
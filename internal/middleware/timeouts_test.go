@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timeouts", func() {
+	var readErr chan error
+
+	BeforeEach(func() {
+		readErr = make(chan error, 1)
+	})
+
+	readBody := func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		readErr <- err
+		w.WriteHeader(http.StatusOK)
+	}
+
+	startServer := func(router http.Handler, readTimeout time.Duration) *httptest.Server {
+		server := httptest.NewUnstartedServer(router)
+		server.Config.ReadTimeout = readTimeout
+		server.Start()
+		DeferCleanup(server.Close)
+		return server
+	}
+
+	// sendSlowly posts a body that only completes after delay, returning the handler's read error
+	sendSlowly := func(url string, delay time.Duration) error {
+		body, writer := io.Pipe()
+		go func() {
+			_, _ = writer.Write([]byte("first part,"))
+			time.Sleep(delay)
+			_, _ = writer.Write([]byte("second part"))
+			_ = writer.Close()
+		}()
+
+		resp, err := http.Post(url, "text/plain", body)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+
+		var handlerErr error
+		Eventually(readErr).Should(Receive(&handlerErr))
+		return handlerErr
+	}
+
+	Context("with a short server read timeout", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			router := chi.NewRouter()
+			router.With(Timeouts(5*time.Second, 5*time.Second)).Post("/upload", readBody)
+			router.Post("/health", readBody)
+			server = startServer(router, 200*time.Millisecond)
+		})
+
+		It("should let a route with a longer read timeout read a slow body", func() {
+			Expect(sendSlowly(server.URL+"/upload", 500*time.Millisecond)).To(Succeed())
+		})
+
+		It("should keep the server read timeout on other routes", func() {
+			err := sendSlowly(server.URL+"/health", 500*time.Millisecond)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("timeout"))
+		})
+	})
+
+	It("should enforce a shorter read timeout than the server default", func() {
+		router := chi.NewRouter()
+		router.With(Timeouts(100*time.Millisecond, 0)).Post("/metrics", readBody)
+		server := startServer(router, 5*time.Second)
+
+		Expect(sendSlowly(server.URL+"/metrics", 500*time.Millisecond)).To(HaveOccurred())
+	})
+
+	It("should leave the server defaults alone when no timeouts are set", func() {
+		handler := Timeouts(0, 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+	})
+})
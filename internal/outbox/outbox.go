@@ -0,0 +1,228 @@
+// Package outbox keeps the events of stored uploads durably until they are published, so a crash
+// between storing an upload's files and announcing them can't lose the announcement
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+)
+
+// Record holds the events of one stored upload until they are published
+// The events are kept without their B64Identity, which may be the uploader's bearer token, so no
+// credential is written to the store. The relay rebuilds it from Identity
+type Record struct {
+	RequestID string                `json:"request_id"`
+	ROS       *messaging.ROSMessage `json:"ros"`
+	// Usage is only set when usage files were forwarded
+	Usage     *messaging.ROSMessage `json:"usage,omitempty"`
+	Identity  *identity.Identity    `json:"identity,omitempty"`
+	CreatedAt time.Time             `json:"created_at"`
+}
+
+// NewRecord creates the entry of an upload's events, dropping the B64Identity of its copies of them
+func NewRecord(requestID string, ros, usage *messaging.ROSMessage, id *identity.Identity, createdAt time.Time) *Record {
+	return &Record{
+		RequestID: requestID,
+		ROS:       withoutIdentity(ros),
+		Usage:     withoutIdentity(usage),
+		Identity:  id,
+		CreatedAt: createdAt,
+	}
+}
+
+// withoutIdentity returns a copy of msg without its B64Identity
+func withoutIdentity(msg *messaging.ROSMessage) *messaging.ROSMessage {
+	if msg == nil {
+		return nil
+	}
+	stripped := *msg
+	stripped.B64Identity = ""
+	return &stripped
+}
+
+// Store keeps outbox entries durably
+// Add must only return once the entry survives a crash
+type Store interface {
+	Add(entry *Record) error
+	// Pending returns the entries not marked done, oldest first
+	Pending() ([]*Record, error)
+	// Done removes the entry of requestID, removing an unknown entry is not an error
+	Done(requestID string) error
+	// DeadLetter sets the entry of requestID aside, so it is no longer pending but kept for inspection
+	DeadLetter(requestID string) error
+}
+
+// entryExt is the extension of entry files, partially written entries use a different one
+const entryExt = ".json"
+
+// lockFileName is the file a store holds an exclusive lock on while it uses its directory
+const lockFileName = ".lock"
+
+// deadLetterDir is the subdirectory entries that can't be relayed are moved to
+const deadLetterDir = "dead-letter"
+
+// ErrDirInUse is returned when another store, usually another replica, already uses the directory
+var ErrDirInUse = errors.New("outbox directory is in use by another process")
+
+// FileStore keeps each entry as a JSON file in a directory, typically on a persistent volume
+// A directory can only be used by one store at a time, since the relays of replicas sharing it
+// would publish each other's in-flight entries
+type FileStore struct {
+	dir  string
+	lock *os.File
+}
+
+var _ Store = (*FileStore)(nil)
+
+// NewFileStore creates a store in dir, creating the directory if needed
+// It returns ErrDirInUse if another store holds the directory, the lock is released by Close or
+// when the process exits
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox lock: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDirInUse
+		}
+		return nil, fmt.Errorf("failed to lock outbox directory: %w", err)
+	}
+	return &FileStore{dir: dir, lock: lock}, nil
+}
+
+// Close releases the directory for another store
+func (s *FileStore) Close() error {
+	return s.lock.Close()
+}
+
+// Add writes the entry to a temporary file and renames it into place once synced, so a crash
+// leaves either the whole entry or none of it
+func (s *FileStore) Add(entry *Record) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox entry: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".entry-")
+	if err != nil {
+		return fmt.Errorf("failed to create outbox entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync outbox entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.entryPath(entry.RequestID)); err != nil {
+		return fmt.Errorf("failed to commit outbox entry: %w", err)
+	}
+	return s.syncDir()
+}
+
+// Pending reads every committed entry
+func (s *FileStore) Pending() ([]*Record, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox directory: %w", err)
+	}
+
+	var entries []*Record
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasSuffix(name, entryExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Marked done while listing
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox entry %s: %w", name, err)
+		}
+		var entry Record
+		if err := json.Unmarshal(data, &entry); err != nil || entry.ROS == nil {
+			// A corrupt entry can never be relayed, set it aside so it doesn't block the others
+			if err := s.moveToDeadLetter(name); err != nil {
+				return nil, err
+			}
+			health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterCorrupt).Inc()
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	slices.SortFunc(entries, func(a, b *Record) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return entries, nil
+}
+
+// Done removes the entry file of requestID
+func (s *FileStore) Done(requestID string) error {
+	err := os.Remove(s.entryPath(requestID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove outbox entry: %w", err)
+	}
+	return nil
+}
+
+// DeadLetter moves the entry file of requestID to the dead-letter subdirectory
+func (s *FileStore) DeadLetter(requestID string) error {
+	return s.moveToDeadLetter(filepath.Base(s.entryPath(requestID)))
+}
+
+// moveToDeadLetter moves the entry file name to the dead-letter subdirectory
+func (s *FileStore) moveToDeadLetter(name string) error {
+	if err := os.MkdirAll(filepath.Join(s.dir, deadLetterDir), 0755); err != nil {
+		return fmt.Errorf("failed to create outbox dead-letter directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(s.dir, name), filepath.Join(s.dir, deadLetterDir, name)); err != nil {
+		return fmt.Errorf("failed to move outbox entry %s to the dead-letter directory: %w", name, err)
+	}
+	return s.syncDir()
+}
+
+// entryPath returns the file of requestID's entry, request IDs are generated UUIDs so they are
+// safe file names, but only the base name is used in case one isn't
+func (s *FileStore) entryPath(requestID string) string {
+	return filepath.Join(s.dir, filepath.Base(requestID)+entryExt)
+}
+
+// syncDir syncs the directory so a committed rename survives a crash
+func (s *FileStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox directory: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbox directory: %w", err)
+	}
+	return nil
+}
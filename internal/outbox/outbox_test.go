@@ -0,0 +1,251 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	"github.com/sirupsen/logrus"
+)
+
+func newRecord(requestID string, createdAt time.Time) *Record {
+	return &Record{
+		RequestID: requestID,
+		ROS: &messaging.ROSMessage{
+			RequestID:  requestID,
+			Metadata:   messaging.ROSMetadata{OrgID: "12345"},
+			ObjectKeys: []string{"org_12345/ros-data.csv"},
+		},
+		CreatedAt: createdAt,
+	}
+}
+
+var _ = Describe("FileStore", func() {
+	var (
+		dir   string
+		store *FileStore
+		now   time.Time
+	)
+
+	BeforeEach(func() {
+		dir = filepath.Join(GinkgoT().TempDir(), "outbox")
+		var err error
+		store, err = NewFileStore(dir)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(func() { _ = store.Close() })
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("should return the pending entries oldest first", func() {
+		Expect(store.Add(newRecord("req-2", now.Add(time.Minute)))).To(Succeed())
+		Expect(store.Add(newRecord("req-1", now))).To(Succeed())
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(2))
+		Expect(pending[0].RequestID).To(Equal("req-1"))
+		Expect(pending[0].ROS.ObjectKeys).To(Equal([]string{"org_12345/ros-data.csv"}))
+		Expect(pending[1].RequestID).To(Equal("req-2"))
+	})
+
+	It("should remove entries marked done", func() {
+		Expect(store.Add(newRecord("req-1", now))).To(Succeed())
+		Expect(store.Done("req-1")).To(Succeed())
+		Expect(store.Done("unknown")).To(Succeed())
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should ignore partially written entries", func() {
+		Expect(os.WriteFile(filepath.Join(dir, ".entry-123"), []byte(`{"request_id":`), 0644)).To(Succeed())
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should keep entries across store instances", func() {
+		Expect(store.Add(newRecord("req-1", now))).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		reopened, err := NewFileStore(dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer reopened.Close()
+		pending, err := reopened.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+	})
+
+	It("should not write the events' identity to disk", func() {
+		ros := &messaging.ROSMessage{RequestID: "req-1", B64Identity: "secret-token"}
+		entry := NewRecord("req-1", ros, &messaging.ROSMessage{RequestID: "req-1", B64Identity: "secret-token"}, &identity.Identity{OrgID: "12345"}, now)
+		Expect(store.Add(entry)).To(Succeed())
+
+		data, err := os.ReadFile(filepath.Join(dir, "req-1.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("secret-token"))
+		Expect(string(data)).To(ContainSubstring(`"org_id":"12345"`))
+		// The upload's own events are left untouched
+		Expect(ros.B64Identity).To(Equal("secret-token"))
+	})
+
+	It("should set dead-lettered entries aside", func() {
+		Expect(store.Add(newRecord("req-1", now))).To(Succeed())
+		Expect(store.DeadLetter("req-1")).To(Succeed())
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+		Expect(filepath.Join(dir, deadLetterDir, "req-1.json")).To(BeAnExistingFile())
+	})
+
+	It("should set corrupt entries aside without blocking the others", func() {
+		before := testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterCorrupt))
+		Expect(os.WriteFile(filepath.Join(dir, "req-bad.json"), []byte(`{"request_id":`), 0644)).To(Succeed())
+		Expect(store.Add(newRecord("req-1", now))).To(Succeed())
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].RequestID).To(Equal("req-1"))
+		Expect(filepath.Join(dir, deadLetterDir, "req-bad.json")).To(BeAnExistingFile())
+		Expect(testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterCorrupt))).To(Equal(before + 1))
+	})
+
+	It("should refuse a directory another store is using", func() {
+		_, err := NewFileStore(dir)
+		Expect(err).To(MatchError(ErrDirInUse))
+	})
+})
+
+var _ = Describe("Relay", func() {
+	var (
+		dir      string
+		store    *FileStore
+		producer *mocks.FakeProducer
+		relay    *Relay
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		var err error
+		store, err = NewFileStore(dir)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(func() { _ = store.Close() })
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		producer = mocks.NewFakeProducer()
+		relay = NewRelay(store, producer, time.Minute, time.Minute, 24*time.Hour, logger)
+		relay.now = func() time.Time { return now }
+	})
+
+	It("should publish the entries left unsent by a crashed process", func() {
+		entry := newRecord("req-1", now.Add(-time.Hour))
+		entry.Usage = &messaging.ROSMessage{RequestID: "req-1"}
+		Expect(store.Add(entry)).To(Succeed())
+
+		// A restarted process opens the same outbox directory once the crashed one released it
+		Expect(store.Close()).To(Succeed())
+		restarted, err := NewFileStore(dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer restarted.Close()
+		relay.store = restarted
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+		Expect(producer.Calls()).To(Equal([]string{"SendROSEvent", "SendUsageEvent", "SendValidationMessage"}))
+		Expect(producer.ROSEvents()[0].ObjectKeys).To(Equal([]string{"org_12345/ros-data.csv"}))
+
+		pending, err := restarted.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should rebuild the events' identity from the kept identity", func() {
+		entry := NewRecord("req-1", &messaging.ROSMessage{RequestID: "req-1", B64Identity: "secret-token"},
+			&messaging.ROSMessage{RequestID: "req-1"}, &identity.Identity{OrgID: "12345"}, now.Add(-time.Hour))
+		Expect(store.Add(entry)).To(Succeed())
+		relay.SetIdentityEncoder(func(id *identity.Identity) (string, error) {
+			return "encoded-" + id.OrgID, nil
+		})
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+		Expect(producer.ROSEvents()[0].B64Identity).To(Equal("encoded-12345"))
+		Expect(producer.UsageEvents()[0].B64Identity).To(Equal("encoded-12345"))
+	})
+
+	It("should leave entries that may still be publishing", func() {
+		Expect(store.Add(newRecord("req-1", now.Add(-time.Second)))).To(Succeed())
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(0))
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+
+	It("should keep entries that fail to publish for the next run", func() {
+		Expect(store.Add(newRecord("req-1", now.Add(-time.Hour)))).To(Succeed())
+		producer.SendROSEventErr = errors.New("broker unavailable")
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(0))
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+
+		producer.SendROSEventErr = nil
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+	})
+
+	It("should dead-letter entries whose presigned URLs have expired", func() {
+		before := testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterExpired))
+		Expect(store.Add(newRecord("req-1", now.Add(-25*time.Hour)))).To(Succeed())
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(0))
+		Expect(producer.Calls()).To(BeEmpty())
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+		Expect(filepath.Join(dir, deadLetterDir, "req-1.json")).To(BeAnExistingFile())
+		Expect(testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterExpired))).To(Equal(before + 1))
+		Expect(testutil.ToFloat64(health.OutboxPendingEntries)).To(BeZero())
+	})
+
+	It("should dead-letter entries too large to ever publish", func() {
+		before := testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterTooLarge))
+		Expect(store.Add(newRecord("req-1", now.Add(-time.Hour)))).To(Succeed())
+		producer.SendROSEventErr = fmt.Errorf("ros event: %w", messaging.ErrMessageTooLarge)
+
+		Expect(relay.RelayPending(context.Background())).To(Equal(0))
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+		Expect(filepath.Join(dir, deadLetterDir, "req-1.json")).To(BeAnExistingFile())
+		Expect(testutil.ToFloat64(health.OutboxDeadLetteredTotal.WithLabelValues(DeadLetterTooLarge))).To(Equal(before + 1))
+	})
+
+	It("should relay pending entries as soon as it runs", func() {
+		Expect(store.Add(newRecord("req-1", now.Add(-time.Hour)))).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			relay.Run(ctx)
+		}()
+		Eventually(producer.ROSEvents).Should(HaveLen(1))
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+})
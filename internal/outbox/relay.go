@@ -0,0 +1,168 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons entries are moved to the dead-letter directory, as reported by outbox_dead_lettered_total
+const (
+	// DeadLetterExpired is an entry older than the relay's max age, its presigned URLs have expired
+	DeadLetterExpired = "expired"
+	// DeadLetterTooLarge is an entry whose events exceed the Kafka message size limit
+	DeadLetterTooLarge = "too_large"
+	// DeadLetterCorrupt is an entry file that can't be decoded
+	DeadLetterCorrupt = "corrupt"
+)
+
+// IdentityEncoder returns the B64Identity of relayed events from the identity kept with their entry
+type IdentityEncoder func(id *identity.Identity) (string, error)
+
+// Relay publishes the outbox entries left behind by uploads whose events weren't published,
+// e.g. because the process crashed or Kafka was unavailable, and marks them done
+type Relay struct {
+	store    Store
+	producer messaging.MessageProducer
+	interval time.Duration
+	// minAge skips entries that the upload that added them may still be publishing
+	minAge time.Duration
+	// maxAge dead-letters entries the relay couldn't publish in time, 0 keeps them indefinitely
+	maxAge time.Duration
+	// encodeIdentity rebuilds the events' B64Identity, without one they are relayed without identity
+	encodeIdentity IdentityEncoder
+	now            func() time.Time
+	logger         *logrus.Logger
+}
+
+// NewRelay creates a relay checking store every interval for entries older than minAge
+// Entries older than maxAge are dead-lettered instead of published, 0 never ages them out
+func NewRelay(store Store, producer messaging.MessageProducer, interval, minAge, maxAge time.Duration, logger *logrus.Logger) *Relay {
+	return &Relay{
+		store:    store,
+		producer: producer,
+		interval: interval,
+		minAge:   minAge,
+		maxAge:   maxAge,
+		now:      time.Now,
+		logger:   logger,
+	}
+}
+
+// SetIdentityEncoder sets how relayed events get their B64Identity back
+// It must be called before the relay runs
+func (r *Relay) SetIdentityEncoder(encode IdentityEncoder) {
+	r.encodeIdentity = encode
+}
+
+// Run relays pending entries right away, to recover from a crash, and then every interval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	r.RelayPending(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.RelayPending(ctx)
+		}
+	}
+}
+
+// RelayPending publishes the pending entries old enough to relay and returns how many were published
+// An entry that fails to publish is kept for the next run, unless it is past maxAge or its events
+// are too large to ever publish, in which case it is dead-lettered
+func (r *Relay) RelayPending(ctx context.Context) int {
+	entries, err := r.store.Pending()
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to read outbox entries")
+		return 0
+	}
+
+	now := r.now()
+	relayed, deadLettered := 0, 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if now.Sub(entry.CreatedAt) < r.minAge {
+			continue
+		}
+
+		entryLogger := r.logger.WithField("request_id", entry.RequestID)
+		if r.maxAge > 0 && now.Sub(entry.CreatedAt) > r.maxAge {
+			if r.deadLetter(entry, DeadLetterExpired, entryLogger) {
+				deadLettered++
+			}
+			continue
+		}
+		if err := r.publish(ctx, entry); err != nil {
+			if errors.Is(err, messaging.ErrMessageTooLarge) {
+				if r.deadLetter(entry, DeadLetterTooLarge, entryLogger.WithError(err)) {
+					deadLettered++
+				}
+				continue
+			}
+			entryLogger.WithError(err).Warn("Failed to relay outbox entry")
+			continue
+		}
+		if err := r.store.Done(entry.RequestID); err != nil {
+			// The entry will be published again, events are delivered at least once
+			entryLogger.WithError(err).Warn("Failed to mark relayed outbox entry done")
+			continue
+		}
+		relayed++
+		health.OutboxRelayedTotal.Inc()
+		entryLogger.Info("Relayed outbox entry")
+	}
+
+	health.OutboxPendingEntries.Set(float64(len(entries) - relayed - deadLettered))
+	return relayed
+}
+
+// deadLetter sets the entry aside for reason and reports whether it was moved
+func (r *Relay) deadLetter(entry *Record, reason string, logger *logrus.Entry) bool {
+	if err := r.store.DeadLetter(entry.RequestID); err != nil {
+		logger.WithError(err).Warn("Failed to dead-letter outbox entry")
+		return false
+	}
+	health.OutboxDeadLetteredTotal.WithLabelValues(reason).Inc()
+	logger.WithField("reason", reason).Error("Dead-lettered outbox entry, its events won't be published")
+	return true
+}
+
+// publish sends the entry's events in the order an upload sends them
+func (r *Relay) publish(ctx context.Context, entry *Record) error {
+	var b64Identity string
+	if r.encodeIdentity != nil {
+		var err error
+		if b64Identity, err = r.encodeIdentity(entry.Identity); err != nil {
+			return fmt.Errorf("failed to encode identity: %w", err)
+		}
+	}
+
+	ros := *entry.ROS
+	ros.B64Identity = b64Identity
+	if err := r.producer.SendROSEvent(ctx, &ros); err != nil {
+		return fmt.Errorf("failed to send ROS event: %w", err)
+	}
+	if entry.Usage != nil {
+		usage := *entry.Usage
+		usage.B64Identity = b64Identity
+		if err := r.producer.SendUsageEvent(ctx, &usage); err != nil {
+			return fmt.Errorf("failed to send usage event: %w", err)
+		}
+	}
+	if err := r.producer.SendValidationMessage(ctx, entry.RequestID, "success"); err != nil {
+		r.logger.WithError(err).WithField("request_id", entry.RequestID).Warn("Failed to send validation message")
+	}
+	return nil
+}
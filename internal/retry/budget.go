@@ -0,0 +1,65 @@
+// Package retry provides a retry budget capping the retries made against a backend
+package retry
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+)
+
+// ErrBudgetExhausted is returned for retries shed because the retry budget is exhausted
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Budget is a token bucket capping the retries of the subsystems sharing it
+// Every retry takes a token and tokens refill at a fixed rate up to the burst, so when a
+// backend is down retries are shed instead of piling onto its recovery
+type Budget struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBudget creates a full budget refilling rate retries per second, up to burst
+// It returns nil, which allows every retry, when rate is not positive
+func NewBudget(rate, burst int) *Budget {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &Budget{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Allow takes a token for a retry by subsystem and reports whether the retry may proceed
+// Shed retries are counted per subsystem
+func (b *Budget) Allow(subsystem string) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		health.RetryBudgetExhaustedTotal.WithLabelValues(subsystem).Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,74 @@
+package retry
+
+import (
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Budget", func() {
+	var (
+		budget *Budget
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+		budget = NewBudget(2, 4)
+		budget.last = now
+		budget.now = func() time.Time { return now }
+	})
+
+	// allowed counts the retries of n attempts the budget lets through
+	allowed := func(subsystem string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if budget.Allow(subsystem) {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("should allow a burst of retries then shed the rest", func() {
+		Expect(allowed("storage", 100)).To(Equal(4))
+	})
+
+	It("should refill at the configured rate", func() {
+		Expect(allowed("storage", 100)).To(Equal(4))
+
+		now = now.Add(1500 * time.Millisecond)
+		Expect(allowed("storage", 100)).To(Equal(3))
+	})
+
+	It("should not refill beyond the burst", func() {
+		now = now.Add(time.Hour)
+		Expect(allowed("storage", 100)).To(Equal(4))
+	})
+
+	It("should share the budget across subsystems", func() {
+		Expect(allowed("storage", 3)).To(Equal(3))
+		Expect(allowed("kafka", 3)).To(Equal(1))
+	})
+
+	It("should count shed retries per subsystem", func() {
+		before := testutil.ToFloat64(health.RetryBudgetExhaustedTotal.WithLabelValues("budget-test"))
+
+		allowed("budget-test", 10)
+
+		Expect(testutil.ToFloat64(health.RetryBudgetExhaustedTotal.WithLabelValues("budget-test"))).To(Equal(before + 6))
+	})
+
+	It("should default the burst to the rate", func() {
+		Expect(NewBudget(3, 0).burst).To(Equal(3.0))
+	})
+
+	It("should allow every retry when disabled", func() {
+		var disabled *Budget
+		Expect(NewBudget(0, 10)).To(BeNil())
+		Expect(disabled.Allow("storage")).To(BeTrue())
+	})
+})
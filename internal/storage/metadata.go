@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// userMetadataPrefix is the lowercased header prefix S3 returns user metadata under
+const userMetadataPrefix = "x-amz-meta-"
+
+// Metadata sanitization modes for characters that can't be sent in a header value
+const (
+	// metadataEncode percent-encodes illegal bytes so the original value can be recovered
+	metadataEncode = "encode"
+	// metadataStrip drops illegal bytes
+	metadataStrip = "strip"
+)
+
+// sanitizeMetadata makes user metadata safe to send as HTTP headers
+// Keys are reduced to header token characters and values to printable ASCII, illegal
+// value bytes are encoded or stripped according to mode. It reports whether anything changed.
+func sanitizeMetadata(metadata map[string]string, mode string) (map[string]string, bool) {
+	if len(metadata) == 0 {
+		return metadata, false
+	}
+
+	// Visit keys in order so colliding sanitized keys resolve deterministically
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sanitized := make(map[string]string, len(metadata))
+	changed := false
+	for _, key := range keys {
+		cleanKey := sanitizeMetadataKey(key)
+		cleanValue := sanitizeMetadataValue(metadata[key], mode)
+		if cleanKey != key || cleanValue != metadata[key] {
+			changed = true
+		}
+		sanitized[cleanKey] = cleanValue
+	}
+	return sanitized, changed
+}
+
+// sanitizeMetadataKey replaces characters that aren't valid in a header name with '-'
+func sanitizeMetadataKey(key string) string {
+	if key == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if isTokenChar(key[i]) {
+			b.WriteByte(key[i])
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// sanitizeMetadataValue removes or percent-encodes bytes outside printable ASCII
+func sanitizeMetadataValue(value, mode string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= 0x20 && c <= 0x7e:
+			b.WriteByte(c)
+		case mode == metadataStrip:
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isTokenChar reports whether c may appear in an HTTP header name (RFC 9110 tchar)
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
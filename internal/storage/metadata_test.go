@@ -0,0 +1,40 @@
+package storage
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sanitizeMetadata", func() {
+	DescribeTable("should sanitize values",
+		func(mode, value, expected string) {
+			sanitized, changed := sanitizeMetadata(map[string]string{"Key": value}, mode)
+			Expect(sanitized).To(Equal(map[string]string{"Key": expected}))
+			Expect(changed).To(Equal(value != expected))
+		},
+		Entry("printable ASCII is kept", metadataEncode, "cluster-1 (prod)", "cluster-1 (prod)"),
+		Entry("control characters are encoded", metadataEncode, "a\r\nb\tc", "a%0D%0Ab%09c"),
+		Entry("non-ASCII characters are encoded byte by byte", metadataEncode, "café", "caf%C3%A9"),
+		Entry("encoding is the default", "", "café", "caf%C3%A9"),
+		Entry("control characters are stripped", metadataStrip, "a\r\nb\x7fc", "abc"),
+		Entry("non-ASCII characters are stripped", metadataStrip, "café", "caf"),
+	)
+
+	DescribeTable("should reduce keys to header token characters",
+		func(key, expected string) {
+			sanitized, changed := sanitizeMetadata(map[string]string{key: "value"}, metadataEncode)
+			Expect(sanitized).To(HaveKeyWithValue(expected, "value"))
+			Expect(changed).To(Equal(key != expected))
+		},
+		Entry("token characters are kept", "Manifest_Id.v1", "Manifest_Id.v1"),
+		Entry("spaces and separators are replaced", "Manifest Id:(v1)", "Manifest-Id--v1-"),
+		Entry("non-ASCII characters are replaced per byte", "Größe", "Gr----e"),
+		Entry("an empty key is replaced", "", "-"),
+	)
+
+	It("should return nil metadata unchanged", func() {
+		sanitized, changed := sanitizeMetadata(nil, metadataEncode)
+		Expect(sanitized).To(BeNil())
+		Expect(changed).To(BeFalse())
+	})
+})
@@ -2,9 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
@@ -13,11 +17,46 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrObjectExists is returned when an upload would overwrite an existing object
+// and the storage conflict policy is set to reject
+var ErrObjectExists = errors.New("object already exists")
+
+// ErrWriteNotVerified is returned when write verification finds an uploaded object missing or of
+// another size than was uploaded
+var ErrWriteNotVerified = errors.New("uploaded object failed verification")
+
+// ErrObjectNotFound is returned when a requested object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// OnConflictSkipIdentical is the conflict policy keeping an existing object whose checksum matches
+// the upload's, so retries of a partially stored upload don't send its files again
+const OnConflictSkipIdentical = "skip-identical"
+
+// checksumMetadataKey is the user metadata key the SHA-256 of an object is stored under
+const checksumMetadataKey = "sha256"
+
+// StorageClient stores extracted payload files
+// Client is the MinIO implementation, tests and alternative stores provide their own
+type StorageClient interface {
+	Upload(ctx context.Context, req *UploadRequest) (*UploadResult, error)
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	Metadata(ctx context.Context, key string) (map[string]string, error)
+	GeneratePresignedURL(ctx context.Context, key string) (string, error)
+	GenerateUploadPath(schema, sourceID, date, filename string) string
+	HealthCheck() error
+}
+
+var _ StorageClient = (*Client)(nil)
+
 // Client wraps MinIO client with additional functionality
 type Client struct {
 	client *minio.Client
 	config config.StorageConfig
 	logger *logrus.Logger
+	// presignSlots bounds concurrent presigns, nil when unlimited
+	presignSlots chan struct{}
+	// presignSlotsMu guards presignSlots, which is replaced when the limit is reloaded
+	presignSlotsMu sync.RWMutex
 }
 
 // UploadRequest represents a file upload request
@@ -27,15 +66,21 @@ type UploadRequest struct {
 	Size        int64
 	ContentType string
 	Metadata    map[string]string
+	// PathPrefix overrides the configured path prefix when set
+	PathPrefix string
+	// SHA256 is the hex digest of Data, stored with the object when set so identical uploads can be skipped
+	SHA256 string
 }
 
 // UploadResult represents the result of a file upload
 type UploadResult struct {
-	Key           string
-	URL           string
-	PresignedURL  string
-	Size          int64
-	ETag          string
+	Key          string
+	URL          string
+	PresignedURL string
+	Size         int64
+	ETag         string
+	// Reused is set when an identical object was already stored and nothing was sent
+	Reused bool
 }
 
 // NewMinIOClient creates a new MinIO client
@@ -47,9 +92,10 @@ func NewMinIOClient(cfg config.StorageConfig) (*Client, error) {
 	}
 
 	client := &Client{
-		client: minioClient,
-		config: cfg,
-		logger: logrus.New(),
+		client:       minioClient,
+		config:       cfg,
+		logger:       logrus.New(),
+		presignSlots: newPresignSlots(cfg.MaxConcurrentPresigns),
 	}
 
 	// Ensure bucket exists
@@ -78,24 +124,82 @@ func (c *Client) Upload(ctx context.Context, req *UploadRequest) (*UploadResult,
 	}()
 
 	// Add path prefix if configured
-	key := req.Key
-	if c.config.PathPrefix != "" {
-		key = filepath.Join(c.config.PathPrefix, key)
+	prefix := c.config.PathPrefix
+	if req.PathPrefix != "" {
+		prefix = req.PathPrefix
+	}
+	key := prefixedKey(prefix, req.Key)
+
+	// Detect collisions before overwriting an existing object
+	if c.config.OnConflict == "reject" {
+		exists, err := c.Exists(ctx, key)
+		if err != nil {
+			health.StorageOperationsTotal.WithLabelValues("upload", "error").Inc()
+			return nil, err
+		}
+		if exists {
+			health.StorageOperationsTotal.WithLabelValues("upload", "conflict").Inc()
+			return nil, fmt.Errorf("%w: %s", ErrObjectExists, key)
+		}
+	}
+
+	// Retries of a partially stored upload find the objects they already stored
+	if c.config.OnConflict == OnConflictSkipIdentical && req.SHA256 != "" {
+		result, err := c.identicalObject(ctx, key, req.SHA256)
+		if err != nil {
+			health.StorageOperationsTotal.WithLabelValues("upload", operationErrorStatus(ctx)).Inc()
+			return nil, err
+		}
+		if result != nil {
+			health.StorageOperationsTotal.WithLabelValues("upload", "reused").Inc()
+			return result, nil
+		}
+	}
+
+	// S3 rejects metadata that isn't valid in a header with an unhelpful error
+	metadata, sanitized := sanitizeMetadata(req.Metadata, c.config.MetadataSanitization)
+	if sanitized {
+		c.logger.WithField("key", key).Warn("Sanitized object metadata with characters not allowed in headers")
+	}
+	if req.SHA256 != "" {
+		// sanitizeMetadata hands back the caller's map when it has nothing to sanitize
+		withChecksum := make(map[string]string, len(metadata)+1)
+		for name, value := range metadata {
+			withChecksum[name] = value
+		}
+		withChecksum[checksumMetadataKey] = req.SHA256
+		metadata = withChecksum
 	}
 
 	// Prepare upload options
 	opts := minio.PutObjectOptions{
 		ContentType:  req.ContentType,
-		UserMetadata: req.Metadata,
+		UserMetadata: metadata,
 	}
 
-	// Upload to MinIO
-	n, err := c.client.PutObject(c.config.Bucket, key, req.Data, req.Size, opts)
+	// Upload to MinIO, aborting the transfer if ctx is done
+	uploadCtx, done := withAttempts(ctx)
+	n, err := c.client.PutObjectWithContext(uploadCtx, c.config.Bucket, key, req.Data, req.Size, opts)
+	err = budgetError(uploadCtx, err)
+	done()
 	if err != nil {
-		health.StorageOperationsTotal.WithLabelValues("upload", "error").Inc()
+		health.StorageOperationsTotal.WithLabelValues("upload", operationErrorStatus(ctx)).Inc()
 		return nil, fmt.Errorf("failed to upload to MinIO: %w", err)
 	}
 
+	// Some S3-compatible stores acknowledge writes they silently lose or truncate
+	// PutObject only reports the bytes sent, the verifying stat is what the object takes up in the bucket
+	if c.config.VerifyWrite {
+		stored, err := c.verifyWrite(ctx, key, n)
+		health.StorageStoredBytesTotal.Add(float64(stored))
+		if err != nil {
+			health.StorageOperationsTotal.WithLabelValues("upload", "unverified").Inc()
+			return nil, err
+		}
+	} else {
+		health.StorageStoredBytesTotal.Add(float64(n))
+	}
+
 	health.StorageOperationsTotal.WithLabelValues("upload", "success").Inc()
 
 	// Generate presigned URL for access
@@ -120,6 +224,160 @@ func (c *Client) Upload(ctx context.Context, req *UploadRequest) (*UploadResult,
 	return result, nil
 }
 
+// verifyWrite returns the size the backend reports for the object at key, and an error wrapping
+// ErrWriteNotVerified unless it exists with the given size. A missing object or failed stat reports 0
+func (c *Client) verifyWrite(ctx context.Context, key string, size int64) (int64, error) {
+	statCtx, done := withAttempts(ctx)
+	info, err := c.client.StatObjectWithContext(statCtx, c.config.Bucket, key, minio.StatObjectOptions{})
+	err = budgetError(statCtx, err)
+	done()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, fmt.Errorf("%w: %s is missing", ErrWriteNotVerified, key)
+		}
+		return 0, fmt.Errorf("failed to stat uploaded object: %w", err)
+	}
+	if info.Size != size {
+		return info.Size, fmt.Errorf("%w: %s has %d bytes, uploaded %d", ErrWriteNotVerified, key, info.Size, size)
+	}
+	return info.Size, nil
+}
+
+// identicalObject returns the upload result for the object at key if it exists with the given checksum,
+// or nil when the object is missing or its content differs and it has to be uploaded
+func (c *Client) identicalObject(ctx context.Context, key, sha256 string) (*UploadResult, error) {
+	statCtx, done := withAttempts(ctx)
+	info, err := c.client.StatObjectWithContext(statCtx, c.config.Bucket, key, minio.StatObjectOptions{})
+	err = budgetError(statCtx, err)
+	done()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+	if userMetadata(info)[checksumMetadataKey] != sha256 {
+		return nil, nil
+	}
+
+	// A fresh URL, since the one handed out when the object was stored may have expired
+	presignedURL, err := c.GeneratePresignedURL(ctx, key)
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to generate presigned URL")
+	}
+
+	c.logger.WithField("key", key).Debug("Reusing identical object already in MinIO")
+	return &UploadResult{
+		Key:          key,
+		URL:          fmt.Sprintf("%s/%s/%s", c.getEndpointURL(), c.config.Bucket, key),
+		PresignedURL: presignedURL,
+		Size:         info.Size,
+		Reused:       true,
+	}, nil
+}
+
+// operationErrorStatus returns the metric status of a failed operation, telling cancellations apart
+func operationErrorStatus(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return "error"
+}
+
+// Exists reports whether an object with the given (already prefixed) key exists
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	defer func() {
+		health.StorageOperationDuration.WithLabelValues("stat").Observe(time.Since(start).Seconds())
+	}()
+
+	statCtx, done := withAttempts(ctx)
+	_, err := c.client.StatObjectWithContext(statCtx, c.config.Bucket, key, minio.StatObjectOptions{})
+	err = budgetError(statCtx, err)
+	done()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			health.StorageOperationsTotal.WithLabelValues("stat", "success").Inc()
+			return false, nil
+		}
+		health.StorageOperationsTotal.WithLabelValues("stat", "error").Inc()
+		return false, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	health.StorageOperationsTotal.WithLabelValues("stat", "success").Inc()
+	return true, nil
+}
+
+// Download opens the object with the given (already prefixed) key for reading.
+// The caller is responsible for closing the returned reader.
+func (c *Client) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	start := time.Now()
+	defer func() {
+		health.StorageOperationDuration.WithLabelValues("download").Observe(time.Since(start).Seconds())
+	}()
+
+	// GetObject is lazy, so stat first to surface a missing object up front
+	// Only the stat is budgeted, the object's reads use ctx after Download returns
+	statCtx, done := withAttempts(ctx)
+	_, err := c.client.StatObjectWithContext(statCtx, c.config.Bucket, key, minio.StatObjectOptions{})
+	err = budgetError(statCtx, err)
+	done()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			health.StorageOperationsTotal.WithLabelValues("download", "not_found").Inc()
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		health.StorageOperationsTotal.WithLabelValues("download", "error").Inc()
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	object, err := c.client.GetObjectWithContext(ctx, c.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		health.StorageOperationsTotal.WithLabelValues("download", "error").Inc()
+		return nil, fmt.Errorf("failed to download from MinIO: %w", err)
+	}
+
+	health.StorageOperationsTotal.WithLabelValues("download", "success").Inc()
+	return object, nil
+}
+
+// Metadata returns the user metadata of the object with the given (already prefixed) key
+// Keys are lowercased since S3 doesn't preserve their case
+func (c *Client) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	start := time.Now()
+	defer func() {
+		health.StorageOperationDuration.WithLabelValues("stat").Observe(time.Since(start).Seconds())
+	}()
+
+	statCtx, done := withAttempts(ctx)
+	info, err := c.client.StatObjectWithContext(statCtx, c.config.Bucket, key, minio.StatObjectOptions{})
+	err = budgetError(statCtx, err)
+	done()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			health.StorageOperationsTotal.WithLabelValues("stat", "not_found").Inc()
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		health.StorageOperationsTotal.WithLabelValues("stat", "error").Inc()
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	health.StorageOperationsTotal.WithLabelValues("stat", "success").Inc()
+	return userMetadata(info), nil
+}
+
+// userMetadata returns the user metadata of info with lowercased keys
+func userMetadata(info minio.ObjectInfo) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range info.Metadata {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, userMetadataPrefix) && len(values) > 0 {
+			metadata[strings.TrimPrefix(name, userMetadataPrefix)] = values[0]
+		}
+	}
+	return metadata
+}
+
 // GeneratePresignedURL generates a presigned URL for file access
 func (c *Client) GeneratePresignedURL(ctx context.Context, key string) (string, error) {
 	start := time.Now()
@@ -127,15 +385,90 @@ func (c *Client) GeneratePresignedURL(ctx context.Context, key string) (string,
 		health.StorageOperationDuration.WithLabelValues("presign").Observe(time.Since(start).Seconds())
 	}()
 
-	expiry := time.Duration(c.config.URLExpiration) * time.Second
-	url, err := c.client.PresignedGetObject(c.config.Bucket, key, expiry, nil)
+	if err := ctx.Err(); err != nil {
+		health.StorageOperationsTotal.WithLabelValues("presign", "cancelled").Inc()
+		return "", err
+	}
+
+	// Signing is CPU bound, so a storm of many-file uploads waits for a slot instead of spiking CPU
+	release, err := c.acquirePresignSlot(ctx)
 	if err != nil {
-		health.StorageOperationsTotal.WithLabelValues("presign", "error").Inc()
-		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
+		health.StorageOperationsTotal.WithLabelValues("presign", "cancelled").Inc()
+		return "", err
+	}
+
+	// minio-go v6 takes no context for presigning, which may look up the bucket region first. The caller
+	// stops waiting once ctx is done, the signing goroutine keeps the slot until it returns
+	type presigned struct {
+		url string
+		err error
+	}
+	done := make(chan presigned, 1)
+	go func() {
+		defer release()
+		expiry := time.Duration(c.config.URLExpiration) * time.Second
+		url, err := c.client.PresignedGetObject(c.config.Bucket, key, expiry, nil)
+		if err != nil {
+			done <- presigned{err: err}
+			return
+		}
+		done <- presigned{url: url.String()}
+	}()
+
+	select {
+	case result := <-done:
+		if result.err != nil {
+			health.StorageOperationsTotal.WithLabelValues("presign", "error").Inc()
+			return "", fmt.Errorf("failed to generate presigned URL: %w", result.err)
+		}
+		health.StorageOperationsTotal.WithLabelValues("presign", "success").Inc()
+		return result.url, nil
+	case <-ctx.Done():
+		health.StorageOperationsTotal.WithLabelValues("presign", "cancelled").Inc()
+		return "", ctx.Err()
+	}
+}
+
+// newPresignSlots creates the semaphore allowing maxConcurrent presigns
+// Returns nil when maxConcurrent is not positive so that presigning stays unbounded
+func newPresignSlots(maxConcurrent int) chan struct{} {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return make(chan struct{}, maxConcurrent)
+}
+
+// SetMaxConcurrentPresigns replaces the limit on concurrent presigns, 0 removes the limit
+// It is safe to call while presigning. Presigns already holding a slot release it to the previous
+// semaphore, so until they do the total can briefly exceed a lowered limit
+func (c *Client) SetMaxConcurrentPresigns(maxConcurrent int) {
+	c.presignSlotsMu.Lock()
+	defer c.presignSlotsMu.Unlock()
+	c.config.MaxConcurrentPresigns = maxConcurrent
+	c.presignSlots = newPresignSlots(maxConcurrent)
+}
+
+// acquirePresignSlot waits for a presign slot until ctx is done
+// The returned function frees the slot in the semaphore it was taken from
+func (c *Client) acquirePresignSlot(ctx context.Context) (func(), error) {
+	c.presignSlotsMu.RLock()
+	slots := c.presignSlots
+	c.presignSlotsMu.RUnlock()
+	if slots == nil {
+		return func() {}, nil
 	}
 
-	health.StorageOperationsTotal.WithLabelValues("presign", "success").Inc()
-	return url.String(), nil
+	start := time.Now()
+	defer func() {
+		health.StoragePresignWaitDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Delete removes a file from MinIO storage
@@ -146,12 +479,28 @@ func (c *Client) Delete(ctx context.Context, key string) error {
 	}()
 
 	// Add path prefix if configured
-	if c.config.PathPrefix != "" {
-		key = filepath.Join(c.config.PathPrefix, key)
+	key = prefixedKey(c.config.PathPrefix, key)
+
+	if err := ctx.Err(); err != nil {
+		health.StorageOperationsTotal.WithLabelValues("delete", "cancelled").Inc()
+		return err
 	}
 
-	err := c.client.RemoveObject(c.config.Bucket, key)
+	// minio-go v6's RemoveObject takes no context, its multi-object delete does and aborts the request with ctx
+	objects := make(chan string, 1)
+	objects <- key
+	close(objects)
+	var err error
+	for removeErr := range c.client.RemoveObjectsWithContext(ctx, c.config.Bucket, objects) {
+		if err == nil {
+			err = removeErr.Err
+		}
+	}
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			health.StorageOperationsTotal.WithLabelValues("delete", "cancelled").Inc()
+			return ctxErr
+		}
 		health.StorageOperationsTotal.WithLabelValues("delete", "error").Inc()
 		return fmt.Errorf("failed to delete from MinIO: %w", err)
 	}
@@ -162,33 +511,79 @@ func (c *Client) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// defaultListPageSize is how many keys ListStream passes to its callback at once when maxKeys is 0
+const defaultListPageSize = 1000
+
 // List lists objects in the bucket with a given prefix
+// It holds every key in memory, use ListStream for prefixes that may hold many objects
 func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var objects []string
+	err := c.ListStream(ctx, prefix, 0, func(keys []string) error {
+		objects = append(objects, keys...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// ListStream lists objects in the bucket with a given prefix, calling fn with pages of at most
+// maxKeys keys as they are listed, so only one page is held in memory at a time
+// A maxKeys of 0 uses pages of defaultListPageSize keys. fn may keep the pages it is given.
+// Listing stops at the first error fn returns, which ListStream returns as is
+func (c *Client) ListStream(ctx context.Context, prefix string, maxKeys int, fn func(keys []string) error) error {
 	start := time.Now()
 	defer func() {
 		health.StorageOperationDuration.WithLabelValues("list").Observe(time.Since(start).Seconds())
 	}()
 
+	if maxKeys <= 0 {
+		maxKeys = defaultListPageSize
+	}
+
 	// Add path prefix if configured
-	if c.config.PathPrefix != "" {
-		prefix = filepath.Join(c.config.PathPrefix, prefix)
+	prefix = prefixedKey(c.config.PathPrefix, prefix)
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	var objects []string
+	// minio-go v6 lists without a context, closing doneCh is the only way to stop
+	// its listing goroutine, which otherwise blocks forever sending to objectCh
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 	objectCh := c.client.ListObjects(c.config.Bucket, prefix, true, doneCh)
 
-	for object := range objectCh {
-		if object.Err != nil {
-			health.StorageOperationsTotal.WithLabelValues("list", "error").Inc()
-			return nil, fmt.Errorf("failed to list objects: %w", object.Err)
+	page := make([]string, 0, maxKeys)
+	for {
+		select {
+		case <-ctx.Done():
+			health.StorageOperationsTotal.WithLabelValues("list", "cancelled").Inc()
+			return ctx.Err()
+		case object, ok := <-objectCh:
+			if !ok {
+				if len(page) > 0 {
+					if err := fn(page); err != nil {
+						return err
+					}
+				}
+				health.StorageOperationsTotal.WithLabelValues("list", "success").Inc()
+				return nil
+			}
+			if object.Err != nil {
+				health.StorageOperationsTotal.WithLabelValues("list", "error").Inc()
+				return fmt.Errorf("failed to list objects: %w", object.Err)
+			}
+			page = append(page, object.Key)
+			if len(page) == maxKeys {
+				if err := fn(page); err != nil {
+					return err
+				}
+				page = make([]string, 0, maxKeys)
+			}
 		}
-		objects = append(objects, object.Key)
 	}
-
-	health.StorageOperationsTotal.WithLabelValues("list", "success").Inc()
-	return objects, nil
 }
 
 // HealthCheck performs a health check on the storage connection
@@ -213,8 +608,38 @@ func (c *Client) HealthCheck() error {
 }
 
 // GenerateUploadPath generates a standardized upload path
+// Key components are lowercased when configured so mixed-case cluster IDs or filenames
+// don't produce near-duplicate keys on case-sensitive stores
 func (c *Client) GenerateUploadPath(schema, sourceID, date, filename string) string {
-	return filepath.Join(schema, fmt.Sprintf("source=%s", sourceID), fmt.Sprintf("date=%s", date), filename)
+	uploadPath := filepath.Join(schema, fmt.Sprintf("source=%s", sourceID), fmt.Sprintf("date=%s", date), filename)
+	if c.config.LowercaseKeys {
+		uploadPath = strings.ToLower(uploadPath)
+	}
+	return uploadPath
+}
+
+// normalizePrefix trims leading/trailing slashes and collapses repeated slashes
+// so prefixes like "/ros/" or "ros//data" map to the same keys as "ros" or "ros/data"
+func normalizePrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+// prefixedKey joins the normalized prefix with key using object-key separators
+// A trailing slash on key is preserved so list prefixes keep matching whole path segments
+func prefixedKey(prefix, key string) string {
+	prefix = normalizePrefix(prefix)
+	if prefix == "" {
+		return key
+	}
+	if key == "" {
+		return prefix + "/"
+	}
+
+	joined := path.Join(prefix, key)
+	if strings.HasSuffix(key, "/") {
+		joined += "/"
+	}
+	return joined
 }
 
 // getEndpointURL returns the full endpoint URL for MinIO
@@ -230,4 +655,4 @@ func (c *Client) getEndpointURL() string {
 func (c *Client) Close() error {
 	// MinIO client doesn't require explicit closing
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,1025 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/minio/minio-go/v6"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeS3 is a minimal in-memory S3 endpoint supporting the object calls the client makes
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+	heads   int
+	puts    int
+	// requests counts every request, unavailable answers them all with 503
+	requests    int
+	unavailable bool
+	// shortWrites stores that many bytes less of every upload, and lostWrites none, while still
+	// acknowledging it, like a store silently failing writes
+	shortWrites int
+	lostWrites  bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+	if f.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodHead:
+		f.heads++
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range f.headers[path] {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		f.puts++
+		data, err := readObjectBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !f.lostWrites {
+			f.objects[path] = data[:max(len(data)-f.shortWrites, 0)]
+			f.headers[path] = r.Header.Clone()
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		if !strings.Contains(strings.TrimSuffix(path, "/"), "/") {
+			f.list(w, r, strings.TrimSuffix(path, "/"))
+			return
+		}
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		if !r.URL.Query().Has("delete") {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		var request deleteObjectsRequest
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, object := range request.Objects {
+			delete(f.objects, strings.TrimSuffix(path, "/")+"/"+object.Key)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<DeleteResult></DeleteResult>`))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// readObjectBody returns the object a PUT uploads, decoding the aws-chunked framing minio-go
+// uses to stream signed bodies over plain HTTP
+func readObjectBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	decodedLength := r.Header.Get("X-Amz-Decoded-Content-Length")
+	if decodedLength == "" {
+		return data, nil
+	}
+	size, err := strconv.Atoi(decodedLength)
+	if err != nil {
+		return nil, err
+	}
+
+	object := make([]byte, 0, size)
+	for {
+		header, rest, ok := bytes.Cut(data, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("truncated aws-chunked body")
+		}
+		chunkSize, _, _ := strings.Cut(string(header), ";")
+		n, err := strconv.ParseInt(chunkSize, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if int64(len(rest)) < n+2 {
+			return nil, errors.New("truncated aws-chunked body")
+		}
+		object = append(object, rest[:n]...)
+		data = rest[n+2:]
+	}
+	if len(object) != size {
+		return nil, fmt.Errorf("decoded %d bytes, expected %d", len(object), size)
+	}
+	return object, nil
+}
+
+// deleteObjectsRequest is the subset of the S3 DeleteObjects request body the fake reads
+type deleteObjectsRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+// listBucketResult is the subset of the S3 ListObjects response the client parses
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	IsTruncated bool
+	Contents    []listBucketObject
+}
+
+type listBucketObject struct {
+	Key          string
+	Size         int
+	LastModified string
+	ETag         string
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	result := listBucketResult{Name: bucket, Prefix: prefix}
+
+	var keys []string
+	for objectPath := range f.objects {
+		key := strings.TrimPrefix(objectPath, bucket+"/")
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, listBucketObject{
+			Key:          key,
+			Size:         len(f.objects[bucket+"/"+key]),
+			LastModified: "2006-01-02T15:04:05.000Z",
+			ETag:         `"etag"`,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newTestClient(endpoint string, cfg config.StorageConfig) *Client {
+	cfg.Endpoint = endpoint
+	if cfg.Bucket == "" {
+		cfg.Bucket = "test-bucket"
+	}
+	minioClient, err := minio.NewWithRegion(endpoint, "access", "secret", false, "us-east-1")
+	Expect(err).ToNot(HaveOccurred())
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	return &Client{
+		client:       minioClient,
+		config:       cfg,
+		logger:       logger,
+		presignSlots: newPresignSlots(cfg.MaxConcurrentPresigns),
+	}
+}
+
+var _ = Describe("MinIO Client", func() {
+	var (
+		s3     *fakeS3
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		s3 = newFakeS3()
+		server = httptest.NewServer(s3)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	endpoint := func() string {
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+
+	upload := func(client *Client, key string) (*UploadResult, error) {
+		data := []byte("node,cpu\nnode1,100m\n")
+		return client.Upload(context.Background(), &UploadRequest{
+			Key:         key,
+			Data:        bytes.NewReader(data),
+			Size:        int64(len(data)),
+			ContentType: "text/csv",
+		})
+	}
+
+	Describe("GenerateUploadPath", func() {
+		It("should keep key components as-is by default", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			path := client.GenerateUploadPath("org_123", "Cluster-ABC", "2024-01-01", "ROS-Data.csv")
+			Expect(path).To(Equal("org_123/source=Cluster-ABC/date=2024-01-01/ROS-Data.csv"))
+		})
+
+		It("should lowercase key components when normalization is enabled", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{LowercaseKeys: true})
+
+			path := client.GenerateUploadPath("org_123", "Cluster-ABC", "2024-01-01", "ROS-Data.csv")
+			Expect(path).To(Equal("org_123/source=cluster-abc/date=2024-01-01/ros-data.csv"))
+		})
+
+		It("should map mixed-case variants to the same key when normalization is enabled", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{LowercaseKeys: true})
+
+			Expect(client.GenerateUploadPath("org_1", "CLUSTER", "2024-01-01", "a.csv")).
+				To(Equal(client.GenerateUploadPath("org_1", "cluster", "2024-01-01", "A.csv")))
+		})
+	})
+
+	Describe("Upload conflict handling", func() {
+		Context("with the reject policy", func() {
+			It("should upload when no object exists", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: "reject"})
+
+				result, err := upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Key).To(Equal("org_1/source=c/date=2024-01-01/ros.csv"))
+				Expect(s3.objects).To(HaveKey("test-bucket/org_1/source=c/date=2024-01-01/ros.csv"))
+			})
+
+			It("should return a conflict when the object already exists", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: "reject"})
+
+				_, err := upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).To(MatchError(ErrObjectExists))
+			})
+		})
+
+		Context("with the overwrite policy", func() {
+			It("should overwrite without checking for an existing object", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: "overwrite"})
+
+				_, err := upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(s3.heads).To(BeZero())
+			})
+		})
+
+		Context("with the skip-identical policy", func() {
+			const key = "org_1/source=c/date=2024-01-01/ros.csv"
+
+			uploadContent := func(client *Client, content string) (*UploadResult, error) {
+				digest := sha256.Sum256([]byte(content))
+				return client.Upload(context.Background(), &UploadRequest{
+					Key:         key,
+					Data:        strings.NewReader(content),
+					Size:        int64(len(content)),
+					ContentType: "text/csv",
+					SHA256:      hex.EncodeToString(digest[:]),
+				})
+			}
+
+			It("should reuse an object already stored with the same checksum", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: OnConflictSkipIdentical, URLExpiration: 3600})
+				reusedBefore := testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("upload", "reused"))
+
+				first, err := uploadContent(client, "node,cpu\nnode1,100m\n")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(first.Reused).To(BeFalse())
+
+				second, err := uploadContent(client, "node,cpu\nnode1,100m\n")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(second.Reused).To(BeTrue())
+				Expect(second.Key).To(Equal(first.Key))
+				Expect(second.Size).To(Equal(first.Size))
+				presigned, err := url.Parse(second.PresignedURL)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(presigned.Path).To(Equal("/test-bucket/" + key))
+
+				Expect(s3.puts).To(Equal(1))
+				Expect(testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("upload", "reused"))).To(Equal(reusedBefore + 1))
+			})
+
+			It("should re-upload an object whose content changed", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: OnConflictSkipIdentical})
+
+				_, err := uploadContent(client, "node,cpu\nnode1,100m\n")
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := uploadContent(client, "node,cpu\nnode1,250m\n")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Reused).To(BeFalse())
+
+				Expect(s3.puts).To(Equal(2))
+				Expect(string(s3.objects["test-bucket/"+key])).To(Equal("node,cpu\nnode1,250m\n"))
+			})
+
+			It("should store the checksum with the object", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: OnConflictSkipIdentical})
+
+				result, err := uploadContent(client, "node,cpu\n")
+				Expect(err).ToNot(HaveOccurred())
+
+				metadata, err := client.Metadata(context.Background(), result.Key)
+				Expect(err).ToNot(HaveOccurred())
+				digest := sha256.Sum256([]byte("node,cpu\n"))
+				Expect(metadata).To(HaveKeyWithValue("sha256", hex.EncodeToString(digest[:])))
+			})
+
+			It("should upload without checking when the request has no checksum", func() {
+				client := newTestClient(endpoint(), config.StorageConfig{OnConflict: OnConflictSkipIdentical})
+
+				_, err := upload(client, key)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = upload(client, key)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(s3.heads).To(BeZero())
+				Expect(s3.puts).To(Equal(2))
+			})
+		})
+	})
+
+	Describe("Upload write verification", func() {
+		const key = "org_1/source=c/date=2024-01-01/ros.csv"
+
+		unverified := func() float64 {
+			return testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("upload", "unverified"))
+		}
+
+		It("should accept an object stored with the uploaded size", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+
+			result, err := upload(client, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Size).To(Equal(int64(len("node,cpu\nnode1,100m\n"))))
+			Expect(s3.heads).To(Equal(1))
+			Expect(string(s3.objects["test-bucket/"+key])).To(Equal("node,cpu\nnode1,100m\n"))
+		})
+
+		It("should fail the upload when the stored object has another size", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+			s3.shortWrites = 5
+			before := unverified()
+
+			result, err := upload(client, key)
+			Expect(err).To(MatchError(ErrWriteNotVerified))
+			Expect(err.Error()).To(ContainSubstring("has 15 bytes, uploaded 20"))
+			Expect(result).To(BeNil())
+			Expect(string(s3.objects["test-bucket/"+key])).To(Equal("node,cpu\nnode1,"))
+			Expect(unverified()).To(Equal(before + 1))
+		})
+
+		It("should fail the upload when the stored object is missing", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+			s3.lostWrites = true
+
+			_, err := upload(client, key)
+			Expect(err).To(MatchError(ErrWriteNotVerified))
+			Expect(err.Error()).To(ContainSubstring("is missing"))
+		})
+
+		It("should not verify writes by default", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			s3.shortWrites = 5
+
+			_, err := upload(client, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s3.heads).To(BeZero())
+		})
+	})
+
+	Describe("Upload metadata sanitization", func() {
+		uploadWithMetadata := func(client *Client, metadata map[string]string) http.Header {
+			data := []byte("node,cpu\nnode1,100m\n")
+			_, err := client.Upload(context.Background(), &UploadRequest{
+				Key:         "org_1/ros.csv",
+				Data:        bytes.NewReader(data),
+				Size:        int64(len(data)),
+				ContentType: "text/csv",
+				Metadata:    metadata,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			s3.mu.Lock()
+			defer s3.mu.Unlock()
+			return s3.headers["test-bucket/org_1/ros.csv"]
+		}
+
+		It("should upload metadata with control and non-ASCII characters", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			header := uploadWithMetadata(client, map[string]string{
+				"ClusterAlias": "prod\ncluster ü",
+				"Manifest Id":  "uuid-1",
+			})
+
+			Expect(header.Get("X-Amz-Meta-Clusteralias")).To(Equal("prod%0Acluster %C3%BC"))
+			Expect(header.Get("X-Amz-Meta-Manifest-Id")).To(Equal("uuid-1"))
+		})
+
+		It("should strip illegal characters when configured to", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{MetadataSanitization: "strip"})
+
+			header := uploadWithMetadata(client, map[string]string{"ClusterAlias": "prod\nclüster"})
+
+			Expect(header.Get("X-Amz-Meta-Clusteralias")).To(Equal("prodclster"))
+		})
+
+		It("should send valid metadata unchanged", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			header := uploadWithMetadata(client, map[string]string{"ClusterAlias": "prod-cluster (east)"})
+
+			Expect(header.Get("X-Amz-Meta-Clusteralias")).To(Equal("prod-cluster (east)"))
+		})
+	})
+
+	Describe("Stored bytes metric", func() {
+		It("should count the bytes the backend reports as written", func() {
+			before := testutil.ToFloat64(health.StorageStoredBytesTotal)
+
+			result, err := upload(newTestClient(endpoint(), config.StorageConfig{}), "ros/report.csv")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(result.Size).To(Equal(int64(len("node,cpu\nnode1,100m\n"))))
+			Expect(testutil.ToFloat64(health.StorageStoredBytesTotal) - before).To(Equal(float64(result.Size)))
+		})
+
+		It("should count a verified write once", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+			before := testutil.ToFloat64(health.StorageStoredBytesTotal)
+
+			result, err := upload(client, "ros/report.csv")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(testutil.ToFloat64(health.StorageStoredBytesTotal) - before).To(Equal(float64(result.Size)))
+		})
+
+		It("should count the size the backend stored when it differs from what was sent", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+			s3.shortWrites = 5
+			before := testutil.ToFloat64(health.StorageStoredBytesTotal)
+
+			_, err := upload(client, "ros/report.csv")
+			Expect(err).To(MatchError(ErrWriteNotVerified))
+
+			// The truncated object still takes up space in the bucket
+			Expect(testutil.ToFloat64(health.StorageStoredBytesTotal) - before).To(Equal(float64(len("node,cpu\nnode1,100m\n") - 5)))
+		})
+
+		It("should not count lost writes", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{VerifyWrite: true})
+			s3.lostWrites = true
+			before := testutil.ToFloat64(health.StorageStoredBytesTotal)
+
+			_, err := upload(client, "ros/report.csv")
+			Expect(err).To(MatchError(ErrWriteNotVerified))
+			Expect(testutil.ToFloat64(health.StorageStoredBytesTotal)).To(Equal(before))
+		})
+	})
+
+	Describe("Exists", func() {
+		It("should report whether an object exists", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			s3.objects["test-bucket/present.csv"] = []byte("x")
+
+			exists, err := client.Exists(context.Background(), "present.csv")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			exists, err = client.Exists(context.Background(), "absent.csv")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Describe("Download", func() {
+		It("should return the object contents", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			s3.objects["test-bucket/raw/payload.tar.gz"] = []byte("payload")
+
+			reader, err := client.Download(context.Background(), "raw/payload.tar.gz")
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("payload"))
+		})
+
+		It("should return ErrObjectNotFound for a missing object", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			_, err := client.Download(context.Background(), "raw/missing.tar.gz")
+			Expect(err).To(MatchError(ErrObjectNotFound))
+		})
+	})
+
+	Describe("Metadata", func() {
+		It("should return the user metadata with lowercased keys", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			_, err := client.Upload(context.Background(), &UploadRequest{
+				Key:      "raw/payload.tar.gz",
+				Data:     strings.NewReader("payload"),
+				Size:     7,
+				Metadata: map[string]string{"OrgId": "12345"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			metadata, err := client.Metadata(context.Background(), "raw/payload.tar.gz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(HaveKeyWithValue("orgid", "12345"))
+		})
+
+		It("should return ErrObjectNotFound for a missing object", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			_, err := client.Metadata(context.Background(), "raw/missing.tar.gz")
+			Expect(err).To(MatchError(ErrObjectNotFound))
+		})
+	})
+
+	Describe("Path prefix normalization", func() {
+		messyPrefixes := []string{"ros", "/ros", "ros/", "/ros/", "ros//", "//ros//"}
+
+		It("should normalize messy prefixes to the same prefix", func() {
+			for _, prefix := range messyPrefixes {
+				Expect(normalizePrefix(prefix)).To(Equal("ros"), "prefix %q", prefix)
+			}
+			Expect(normalizePrefix("//ros//data/")).To(Equal("ros/data"))
+			Expect(normalizePrefix("/")).To(BeEmpty())
+			Expect(normalizePrefix("")).To(BeEmpty())
+		})
+
+		It("should keep uploaded keys consistent with list and delete", func() {
+			for _, prefix := range messyPrefixes {
+				s3.objects = make(map[string][]byte)
+				client := newTestClient(endpoint(), config.StorageConfig{PathPrefix: prefix})
+
+				result, err := upload(client, "org_1/source=c/date=2024-01-01/ros.csv")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Key).To(Equal("ros/org_1/source=c/date=2024-01-01/ros.csv"), "prefix %q", prefix)
+
+				keys, err := client.List(context.Background(), "org_1/")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(keys).To(ConsistOf(result.Key), "prefix %q", prefix)
+
+				Expect(client.Delete(context.Background(), "org_1/source=c/date=2024-01-01/ros.csv")).To(Succeed())
+				keys, err = client.List(context.Background(), "org_1/")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(keys).To(BeEmpty(), "prefix %q", prefix)
+			}
+		})
+
+		It("should not match sibling prefixes when listing a directory", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{PathPrefix: "/ros/"})
+			_, err := upload(client, "org_1/a.csv")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = upload(client, "org_10/b.csv")
+			Expect(err).ToNot(HaveOccurred())
+
+			keys, err := client.List(context.Background(), "org_1/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(ConsistOf("ros/org_1/a.csv"))
+		})
+	})
+
+	Describe("ListStream", func() {
+		BeforeEach(func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			for _, key := range []string{"org_1/a.csv", "org_1/b.csv", "org_1/c.csv", "org_1/d.csv", "org_1/e.csv", "org_2/f.csv"} {
+				_, err := upload(client, key)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("should pass the keys in pages of at most maxKeys", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			var pages [][]string
+			err := client.ListStream(context.Background(), "org_1/", 2, func(keys []string) error {
+				pages = append(pages, keys)
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pages).To(Equal([][]string{
+				{"org_1/a.csv", "org_1/b.csv"},
+				{"org_1/c.csv", "org_1/d.csv"},
+				{"org_1/e.csv"},
+			}))
+		})
+
+		It("should use a single page for small prefixes by default", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			calls := 0
+			err := client.ListStream(context.Background(), "org_", 0, func(keys []string) error {
+				calls++
+				Expect(keys).To(HaveLen(6))
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(calls).To(Equal(1))
+		})
+
+		It("should stop listing at the first callback error", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+			errStop := errors.New("stop")
+
+			calls := 0
+			err := client.ListStream(context.Background(), "org_1/", 2, func(keys []string) error {
+				calls++
+				return errStop
+			})
+			Expect(err).To(MatchError(errStop))
+			Expect(calls).To(Equal(1))
+		})
+
+		It("should not call back for an empty prefix", func() {
+			client := newTestClient(endpoint(), config.StorageConfig{})
+
+			err := client.ListStream(context.Background(), "org_3/", 2, func(keys []string) error {
+				Fail("unexpected page")
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("List cancellation", func() {
+	var (
+		server *httptest.Server
+		pages  atomic.Int32
+	)
+
+	BeforeEach(func() {
+		pages.Store(0)
+		// An endless, slow listing: every page holds one object and reports more to come
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			page := pages.Add(1)
+			time.Sleep(10 * time.Millisecond)
+
+			key := fmt.Sprintf("ros/object-%06d.csv", page)
+			result := listBucketResult{
+				Name:        "test-bucket",
+				Prefix:      r.URL.Query().Get("prefix"),
+				IsTruncated: true,
+				Contents: []listBucketObject{
+					{Key: key, Size: 1, LastModified: "2006-01-02T15:04:05.000Z", ETag: `"etag"`},
+				},
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			_ = xml.NewEncoder(w).Encode(result)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should stop listing promptly when the context is cancelled", func() {
+		client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.List(ctx, "ros/")
+			done <- err
+		}()
+
+		Eventually(pages.Load).Should(BeNumerically(">=", 3))
+		cancel()
+
+		var err error
+		Eventually(done, 500*time.Millisecond).Should(Receive(&err))
+		Expect(err).To(MatchError(context.Canceled))
+
+		// Closing the done channel also stops the listing goroutine from fetching more pages
+		stopped := pages.Load()
+		Consistently(pages.Load, 100*time.Millisecond).Should(BeNumerically("<=", stopped+1))
+	})
+
+	It("should stream the keys of a listing too large to buffer", func() {
+		client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+		errEnough := errors.New("enough keys")
+
+		// The listing never ends, so only incremental processing can see its keys
+		var seen []string
+		err := client.ListStream(context.Background(), "ros/", 2, func(keys []string) error {
+			Expect(keys).To(HaveLen(2))
+			seen = append(seen, keys...)
+			if len(seen) == 6 {
+				return errEnough
+			}
+			return nil
+		})
+		Expect(err).To(MatchError(errEnough))
+		Expect(seen).To(Equal([]string{
+			"ros/object-000001.csv", "ros/object-000002.csv", "ros/object-000003.csv",
+			"ros/object-000004.csv", "ros/object-000005.csv", "ros/object-000006.csv",
+		}))
+
+		// Stopping also stops the listing goroutine, which may have fetched a page ahead, from fetching more pages
+		stopped := pages.Load()
+		Consistently(pages.Load, 100*time.Millisecond).Should(BeNumerically("<=", stopped+2))
+	})
+
+	It("should not start listing with a context that is already done", func() {
+		client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := client.List(ctx, "ros/")
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(pages.Load()).To(BeZero())
+	})
+})
+
+var _ = Describe("Context cancellation", func() {
+	var (
+		s3      *fakeS3
+		server  *httptest.Server
+		puts    atomic.Int32
+		deletes atomic.Int32
+
+		lookupsReleased chan struct{}
+	)
+
+	BeforeEach(func() {
+		s3 = newFakeS3()
+		puts.Store(0)
+		deletes.Store(0)
+		lookupsReleased = make(chan struct{})
+		// Uploads hang until the client gives up, other calls go to the fake store
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/slow.csv") {
+				puts.Add(1)
+				// The server only notices the client went away once the body is consumed
+				_, _ = io.Copy(io.Discard, r.Body)
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			if r.URL.Query().Has("delete") {
+				body, _ := io.ReadAll(r.Body)
+				if bytes.Contains(body, []byte("slow.csv")) {
+					deletes.Add(1)
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			if r.URL.Query().Has("location") {
+				// Region lookups before presigning hang too, they take no context so the test releases them
+				select {
+				case <-lookupsReleased:
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			s3.ServeHTTP(w, r)
+		}))
+	})
+
+	AfterEach(func() {
+		close(lookupsReleased)
+		server.Close()
+	})
+
+	newClient := func() *Client {
+		return newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+	}
+
+	uploadWith := func(ctx context.Context, key string) error {
+		data := []byte("node,cpu\nnode1,100m\n")
+		_, err := newClient().Upload(ctx, &UploadRequest{
+			Key:         key,
+			Data:        bytes.NewReader(data),
+			Size:        int64(len(data)),
+			ContentType: "text/csv",
+		})
+		return err
+	}
+
+	It("should abort an upload when the context times out", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := uploadWith(ctx, "ros/slow.csv")
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(puts.Load()).To(BeNumerically(">=", 1))
+	})
+
+	It("should not start an upload with a context that is already done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(uploadWith(ctx, "ros/slow.csv")).To(MatchError(context.Canceled))
+		Expect(puts.Load()).To(BeZero())
+	})
+
+	It("should not delete with a context that is already done", func() {
+		Expect(uploadWith(context.Background(), "ros/kept.csv")).To(Succeed())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(newClient().Delete(ctx, "ros/kept.csv")).To(MatchError(context.Canceled))
+		exists, err := newClient().Exists(context.Background(), "ros/kept.csv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeTrue())
+	})
+
+	It("should delete with a live context", func() {
+		Expect(uploadWith(context.Background(), "ros/kept.csv")).To(Succeed())
+
+		Expect(newClient().Delete(context.Background(), "ros/kept.csv")).To(Succeed())
+		exists, err := newClient().Exists(context.Background(), "ros/kept.csv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+
+	It("should abort a delete when the context times out", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		cancelledBefore := testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("delete", "cancelled"))
+
+		start := time.Now()
+		Expect(newClient().Delete(ctx, "ros/slow.csv")).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(deletes.Load()).To(BeNumerically("==", 1))
+		Expect(testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("delete", "cancelled"))).To(Equal(cancelledBefore + 1))
+	})
+
+	It("should stop waiting for a presign when the context times out", func() {
+		// Without a configured region the bucket region is looked up before signing
+		minioClient, err := minio.New(strings.TrimPrefix(server.URL, "http://"), "access", "secret", false)
+		Expect(err).ToNot(HaveOccurred())
+		client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{URLExpiration: 3600})
+		client.client = minioClient
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = client.GeneratePresignedURL(ctx, "ros/kept.csv")
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+
+	It("should not presign with a context that is already done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := newClient().GeneratePresignedURL(ctx, "ros/kept.csv")
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
+
+var _ = Describe("Presign limiter", func() {
+	var client *Client
+
+	presignWaits := func() uint64 {
+		metric := &dto.Metric{}
+		Expect(health.StoragePresignWaitDuration.Write(metric)).To(Succeed())
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	BeforeEach(func() {
+		client = newTestClient("localhost:9000", config.StorageConfig{URLExpiration: 3600, MaxConcurrentPresigns: 2})
+	})
+
+	It("should presign while slots are free", func() {
+		url, err := client.GeneratePresignedURL(context.Background(), "ros/file.csv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(url).To(ContainSubstring("ros/file.csv"))
+		Expect(client.presignSlots).To(BeEmpty())
+	})
+
+	It("should wait for a slot when saturated", func() {
+		release, err := client.acquirePresignSlot(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.acquirePresignSlot(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		waitsBefore := presignWaits()
+		done := make(chan error, 1)
+		go func() {
+			_, err := client.GeneratePresignedURL(context.Background(), "ros/file.csv")
+			done <- err
+		}()
+		Consistently(done, "100ms").ShouldNot(Receive())
+
+		release()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(presignWaits()).To(BeNumerically(">", waitsBefore))
+	})
+
+	It("should give up waiting when the context is done", func() {
+		for range 2 {
+			_, err := client.acquirePresignSlot(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+		}
+		cancelledBefore := testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("presign", "cancelled"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := client.GeneratePresignedURL(ctx, "ros/file.csv")
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(testutil.ToFloat64(health.StorageOperationsTotal.WithLabelValues("presign", "cancelled"))).To(Equal(cancelledBefore + 1))
+	})
+
+	It("should apply a reloaded limit to new presigns", func() {
+		release, err := client.acquirePresignSlot(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.acquirePresignSlot(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		client.SetMaxConcurrentPresigns(3)
+		_, err = client.GeneratePresignedURL(context.Background(), "ros/file.csv")
+		Expect(err).ToNot(HaveOccurred())
+
+		// Slots taken before the reload go back to the previous semaphore
+		release()
+		client.SetMaxConcurrentPresigns(0)
+		Expect(client.presignSlots).To(BeNil())
+		_, err = client.GeneratePresignedURL(context.Background(), "ros/file.csv")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should not limit presigns when unconfigured", func() {
+		client = newTestClient("localhost:9000", config.StorageConfig{URLExpiration: 3600})
+		Expect(client.presignSlots).To(BeNil())
+
+		for range 10 {
+			_, err := client.GeneratePresignedURL(context.Background(), "ros/file.csv")
+			Expect(err).ToNot(HaveOccurred())
+		}
+	})
+})
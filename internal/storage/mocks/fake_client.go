@@ -0,0 +1,168 @@
+// Package mocks provides test doubles for the storage package.
+package mocks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+)
+
+// FakeClient is an in-memory StorageClient
+// Set the error fields before use to make the corresponding calls fail
+type FakeClient struct {
+	UploadErr       error
+	DownloadErr     error
+	PresignErr      error
+	HealthCheckErr  error
+	uploadFailAfter int
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	uploads  []*storage.UploadRequest
+}
+
+var _ storage.StorageClient = (*FakeClient)(nil)
+
+// NewFakeClient creates an empty fake store
+func NewFakeClient() *FakeClient {
+	return &FakeClient{objects: make(map[string][]byte), metadata: make(map[string]map[string]string)}
+}
+
+// FailUploadsAfter makes uploads fail with UploadErr once n uploads have succeeded
+func (f *FakeClient) FailUploadsAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadFailAfter = n
+}
+
+// Upload stores the request data under its key, prefixed with the request's path prefix
+func (f *FakeClient) Upload(ctx context.Context, req *storage.UploadRequest) (*storage.UploadResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.UploadErr != nil && len(f.uploads) >= f.uploadFailAfter {
+		return nil, f.UploadErr
+	}
+
+	data, err := io.ReadAll(req.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	key := path.Join(req.PathPrefix, req.Key)
+	f.objects[key] = data
+	f.uploads = append(f.uploads, req)
+
+	presignedURL, err := f.presign(key)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.UploadResult{
+		Key:          key,
+		URL:          "https://storage.example.com/" + key,
+		PresignedURL: presignedURL,
+		Size:         int64(len(data)),
+	}, nil
+}
+
+// Download returns the object stored under key, or storage.ErrObjectNotFound
+func (f *FakeClient) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.DownloadErr != nil {
+		return nil, f.DownloadErr
+	}
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", storage.ErrObjectNotFound, key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Metadata returns the metadata stored with key by PutWithMetadata, or storage.ErrObjectNotFound
+func (f *FakeClient) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.objects[key]; !ok {
+		return nil, fmt.Errorf("%w: %s", storage.ErrObjectNotFound, key)
+	}
+	metadata := make(map[string]string, len(f.metadata[key]))
+	for name, value := range f.metadata[key] {
+		metadata[name] = value
+	}
+	return metadata, nil
+}
+
+// GeneratePresignedURL returns a deterministic URL for key
+func (f *FakeClient) GeneratePresignedURL(ctx context.Context, key string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.presign(key)
+}
+
+// presign builds the presigned URL for key, callers must hold the lock
+func (f *FakeClient) presign(key string) (string, error) {
+	if f.PresignErr != nil {
+		return "", f.PresignErr
+	}
+	return "https://storage.example.com/" + key + "?signed=true", nil
+}
+
+// GenerateUploadPath mirrors the layout of storage.Client without lowercasing
+func (f *FakeClient) GenerateUploadPath(schema, sourceID, date, filename string) string {
+	return path.Join(schema, "source="+sourceID, "date="+date, filename)
+}
+
+// HealthCheck returns HealthCheckErr
+func (f *FakeClient) HealthCheck() error {
+	return f.HealthCheckErr
+}
+
+// Put stores an object directly, bypassing Upload
+func (f *FakeClient) Put(key string, data []byte) {
+	f.PutWithMetadata(key, data, nil)
+}
+
+// PutWithMetadata stores an object with user metadata, whose keys must be lowercase, bypassing Upload
+func (f *FakeClient) PutWithMetadata(key string, data []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = data
+	f.metadata[key] = metadata
+}
+
+// Object returns the data stored under key
+func (f *FakeClient) Object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// Keys returns the keys of all stored objects in sorted order
+func (f *FakeClient) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns the upload requests that succeeded, in order
+func (f *FakeClient) Uploads() []*storage.UploadRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*storage.UploadRequest(nil), f.uploads...)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/retry"
+	"github.com/minio/minio-go/v6"
+)
+
+// retrySubsystem labels the storage retries counted against the retry budget
+const retrySubsystem = "storage"
+
+// attemptsKey is the context key of a storage operation's attempt counter
+type attemptsKey struct{}
+
+// operationAttempts counts the requests minio-go sends for one storage operation
+type operationAttempts struct {
+	count  atomic.Int32
+	cancel context.CancelCauseFunc
+}
+
+// withAttempts tags ctx so the transport can tell an operation's retries from its first request
+// minio-go retries internally, sending every attempt with the context the operation was given.
+// The returned function releases the context once the operation is done
+func withAttempts(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	attempts := &operationAttempts{cancel: cancel}
+	return context.WithValue(ctx, attemptsKey{}, attempts), func() { cancel(nil) }
+}
+
+// budgetError reports an operation whose retry was shed with the retry budget error,
+// rather than the cancellation the transport used to stop it
+func budgetError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), retry.ErrBudgetExhausted) {
+		return retry.ErrBudgetExhausted
+	}
+	return err
+}
+
+// budgetedTransport sheds the retries of tagged storage operations once the retry budget is exhausted
+type budgetedTransport struct {
+	base   http.RoundTripper
+	budget *retry.Budget
+}
+
+func (t *budgetedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts, ok := req.Context().Value(attemptsKey{}).(*operationAttempts)
+	if ok && attempts.count.Add(1) > 1 && !t.budget.Allow(retrySubsystem) {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		// Cancelling the operation's context ends minio-go's retry loop instead of backing off again
+		attempts.cancel(retry.ErrBudgetExhausted)
+		return nil, retry.ErrBudgetExhausted
+	}
+	return t.base.RoundTrip(req)
+}
+
+// SetRetryBudget makes the client's retries of uploads and object stats count against budget
+// It must be called before the client is used, a nil budget leaves retries unbounded
+func (c *Client) SetRetryBudget(budget *retry.Budget) error {
+	if budget == nil {
+		return nil
+	}
+	base, err := minio.DefaultTransport(c.config.UseSSL)
+	if err != nil {
+		return fmt.Errorf("failed to create storage transport: %w", err)
+	}
+	c.client.SetCustomTransport(&budgetedTransport{base: base, budget: budget})
+	return nil
+}
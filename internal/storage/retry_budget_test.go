@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/retry"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingTransport answers every request with 503, counting those that reach it
+type failingTransport struct {
+	requests int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+}
+
+var _ = Describe("Retry budget", func() {
+	Describe("budgetedTransport", func() {
+		var (
+			backend   *failingTransport
+			transport *budgetedTransport
+		)
+
+		BeforeEach(func() {
+			backend = &failingTransport{}
+			transport = &budgetedTransport{base: backend, budget: retry.NewBudget(1, 10)}
+		})
+
+		// attempt sends one request of the operation tagged in ctx
+		attempt := func(ctx context.Context) error {
+			req := httptest.NewRequest(http.MethodHead, "http://storage/bucket/key", nil).WithContext(ctx)
+			_, err := transport.RoundTrip(req)
+			return err
+		}
+
+		It("should cap the retries of many failing operations at the budget", func() {
+			shed := 0
+			for i := 0; i < 50; i++ {
+				ctx, done := withAttempts(context.Background())
+				for n := 0; n < 3; n++ {
+					if err := attempt(ctx); errors.Is(err, retry.ErrBudgetExhausted) {
+						shed++
+						break
+					}
+				}
+				done()
+			}
+
+			// Every operation's first request goes through, only the burst of retries follows
+			Expect(backend.requests).To(Equal(50 + 10))
+			Expect(shed).To(Equal(50 - 5))
+		})
+
+		It("should cancel the operation whose retry is shed", func() {
+			transport.budget = retry.NewBudget(1, 1)
+			Expect(transport.budget.Allow("test")).To(BeTrue())
+
+			ctx, done := withAttempts(context.Background())
+			defer done()
+			Expect(attempt(ctx)).To(Succeed())
+			Expect(attempt(ctx)).To(MatchError(retry.ErrBudgetExhausted))
+
+			Expect(ctx.Err()).To(HaveOccurred())
+			Expect(context.Cause(ctx)).To(MatchError(retry.ErrBudgetExhausted))
+		})
+
+		It("should not budget requests of untagged operations", func() {
+			for i := 0; i < 20; i++ {
+				Expect(attempt(context.Background())).To(Succeed())
+			}
+			Expect(backend.requests).To(Equal(20))
+		})
+	})
+
+	Describe("Client", func() {
+		var (
+			s3     *fakeS3
+			server *httptest.Server
+		)
+
+		BeforeEach(func() {
+			s3 = newFakeS3()
+			s3.unavailable = true
+			server = httptest.NewServer(s3)
+			DeferCleanup(server.Close)
+		})
+
+		It("should stop minio-go's retries once the budget is exhausted", func() {
+			client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+			budget := retry.NewBudget(1, 1)
+			Expect(budget.Allow("test")).To(BeTrue())
+			Expect(client.SetRetryBudget(budget)).To(Succeed())
+			shedBefore := testutil.ToFloat64(health.RetryBudgetExhaustedTotal.WithLabelValues(retrySubsystem))
+
+			_, err := client.Exists(context.Background(), "org_123/ros-data.csv")
+
+			Expect(err).To(MatchError(retry.ErrBudgetExhausted))
+			Expect(s3.requests).To(Equal(1))
+			Expect(testutil.ToFloat64(health.RetryBudgetExhaustedTotal.WithLabelValues(retrySubsystem))).To(Equal(shedBefore + 1))
+		})
+
+		It("should leave retries unbounded without a budget", func() {
+			client := newTestClient(strings.TrimPrefix(server.URL, "http://"), config.StorageConfig{})
+			Expect(client.SetRetryBudget(nil)).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				defer GinkgoRecover()
+				Eventually(func() int {
+					s3.mu.Lock()
+					defer s3.mu.Unlock()
+					return s3.requests
+				}, "5s").Should(BeNumerically(">=", 2))
+				cancel()
+			}()
+
+			_, err := client.Exists(ctx, "org_123/ros-data.csv")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,126 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("HandleUpload acknowledgment mode", func() {
+	var (
+		store    *fakeObjectStore
+		producer *mocks.FakeProducer
+	)
+
+	newHandler := func(ackMode string) *Handler {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		storageClient, objectStore := newFakeStorage()
+		store = objectStore
+		producer = mocks.NewFakeProducer()
+		producer.Release = make(chan struct{})
+
+		cfg := newTestConfig()
+		cfg.Storage.Bucket = "test-bucket"
+		cfg.Storage.PathPrefix = "ros"
+		cfg.Storage.URLExpiration = 3600
+		cfg.Upload.AckMode = ackMode
+		return NewHandler(cfg, storageClient, producer, logger)
+	}
+
+	// serve runs the handler in the background and returns the channel its response arrives on
+	serve := func(handler *Handler) <-chan *httptest.ResponseRecorder {
+		responses := make(chan *httptest.ResponseRecorder, 1)
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		go func() {
+			defer GinkgoRecover()
+			recorder := httptest.NewRecorder()
+			handler.HandleUpload(recorder, req)
+			responses <- recorder
+		}()
+		return responses
+	}
+
+	requestStatus := func(handler *Handler, recorder *httptest.ResponseRecorder) func() string {
+		var response UploadResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		return func() string {
+			status, found := handler.statuses.Get(response.RequestID)
+			Expect(found).To(BeTrue())
+			return status.Status
+		}
+	}
+
+	Context("in sync mode", func() {
+		It("should respond only after the events are published", func() {
+			handler := newHandler(ackModeSync)
+			responses := serve(handler)
+
+			Consistently(responses, "100ms").ShouldNot(Receive())
+			close(producer.Release)
+
+			var recorder *httptest.ResponseRecorder
+			Eventually(responses, "5s").Should(Receive(&recorder))
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(producer.Calls()).To(Equal([]string{"SendROSEvent", "SendValidationMessage"}))
+			Expect(requestStatus(handler, recorder)()).To(Equal(StatusSucceeded))
+		})
+	})
+
+	Context("in async mode", func() {
+		It("should respond once the files are stored and publish in the background", func() {
+			handler := newHandler(ackModeAsync)
+			responses := serve(handler)
+
+			var recorder *httptest.ResponseRecorder
+			Eventually(responses, "5s").Should(Receive(&recorder))
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(store.Keys()).ToNot(BeEmpty())
+			Expect(producer.Calls()).To(BeEmpty())
+			status := requestStatus(handler, recorder)
+			Expect(status()).To(Equal(StatusProcessing))
+
+			close(producer.Release)
+			Eventually(status).Should(Equal(StatusSucceeded))
+			Expect(handler.WaitForBackground(context.Background())).To(Succeed())
+			Expect(producer.Calls()).To(Equal([]string{"SendROSEvent", "SendValidationMessage"}))
+		})
+
+		It("should mark the upload failed when background publishing fails", func() {
+			handler := newHandler(ackModeAsync)
+			producer.SendROSEventErr = errors.New("broker unavailable")
+			responses := serve(handler)
+
+			var recorder *httptest.ResponseRecorder
+			Eventually(responses, "5s").Should(Receive(&recorder))
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+			close(producer.Release)
+			Eventually(requestStatus(handler, recorder)).Should(Equal(StatusFailed))
+			Expect(producer.Calls()).To(Equal([]string{"SendROSEvent"}))
+		})
+
+		It("should stop waiting for background publishing when the context is done", func() {
+			handler := newHandler(ackModeAsync)
+			var recorder *httptest.ResponseRecorder
+			Eventually(serve(handler), "5s").Should(Receive(&recorder))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(handler.WaitForBackground(ctx)).To(MatchError(context.Canceled))
+
+			close(producer.Release)
+			Expect(handler.WaitForBackground(context.Background())).To(Succeed())
+		})
+	})
+})
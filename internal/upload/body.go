@@ -0,0 +1,77 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// errBodyReadTimeout is returned when the request body is not fully read before its deadline
+var errBodyReadTimeout = errors.New("request body read timeout")
+
+// deadlineReader enforces an overall deadline on reading a request body
+// The connection read deadline interrupts blocked reads, this wrapper records that the
+// deadline was hit so callers can tell a slow client apart from a malformed body
+type deadlineReader struct {
+	io.ReadCloser
+	deadline time.Time
+	expired  bool
+}
+
+// newDeadlineReader wraps body so reads fail once deadline has passed
+func newDeadlineReader(body io.ReadCloser, deadline time.Time) *deadlineReader {
+	return &deadlineReader{
+		ReadCloser: body,
+		deadline:   deadline,
+	}
+}
+
+// Read implements io.Reader
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.expired || time.Now().After(d.deadline) {
+		d.expired = true
+		return 0, errBodyReadTimeout
+	}
+
+	n, err := d.ReadCloser.Read(p)
+	if err != nil && isTimeoutError(err) {
+		d.expired = true
+	}
+	return n, err
+}
+
+// isTimeoutError reports whether err was caused by an I/O deadline
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errBodyTooLarge is returned when a spooled body exceeds its size limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// spoolBody copies body to a temp file in dir and returns it rewound, so that extraction reads
+// from disk rather than waiting on the client. Bodies over limit bytes, which a decoded
+// Content-Encoding can produce, fail with errBodyTooLarge. The caller closes and removes the file
+func spoolBody(body io.Reader, dir string, limit int64) (*os.File, error) {
+	spool, err := os.CreateTemp(dir, ".raw-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	n, err := io.Copy(spool, io.LimitReader(body, limit+1))
+	if err == nil && n > limit {
+		err = errBodyTooLarge
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+		return nil, err
+	}
+	return spool, nil
+}
@@ -0,0 +1,48 @@
+package upload
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// throttledReader returns one byte per read after sleeping, simulating a slow-loris client
+type throttledReader struct {
+	data  *strings.Reader
+	delay time.Duration
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	time.Sleep(t.delay)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return t.data.Read(p)
+}
+
+var _ = Describe("deadlineReader", func() {
+	It("should read the whole body when it arrives before the deadline", func() {
+		body := io.NopCloser(strings.NewReader("payload"))
+		reader := newDeadlineReader(body, time.Now().Add(time.Minute))
+
+		data, err := io.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("payload"))
+		Expect(reader.expired).To(BeFalse())
+	})
+
+	It("should fail with a timeout when the body is trickled past the deadline", func() {
+		body := io.NopCloser(&throttledReader{
+			data:  strings.NewReader(strings.Repeat("x", 100)),
+			delay: 10 * time.Millisecond,
+		})
+		reader := newDeadlineReader(body, time.Now().Add(50*time.Millisecond))
+
+		_, err := io.ReadAll(reader)
+		Expect(err).To(MatchError(errBodyReadTimeout))
+		Expect(reader.expired).To(BeTrue())
+	})
+})
@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	"github.com/sirupsen/logrus"
+)
+
+// checksumAlgorithm is the digest recorded in checksum manifests
+const checksumAlgorithm = "sha256"
+
+// checksumManifest is the sidecar object listing the checksums of an upload's ROS files
+type checksumManifest struct {
+	RequestID string         `json:"request_id"`
+	Algorithm string         `json:"algorithm"`
+	Files     []fileChecksum `json:"files"`
+}
+
+// fileChecksum is the checksum of a single stored object
+type fileChecksum struct {
+	ObjectKey string `json:"object_key"`
+	Checksum  string `json:"checksum"`
+}
+
+// fileSHA256 returns the hex SHA-256 of file and rewinds it so it can still be uploaded
+func fileSHA256(file io.ReadSeeker) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// checksumManifestName returns the file name of the checksum sidecar for an upload
+// It carries the request ID so uploads sharing a date partition don't overwrite each other's sidecar
+func checksumManifestName(requestID string) string {
+	return fmt.Sprintf("checksums-%s.json", requestID)
+}
+
+// writeChecksumManifest stores the checksum sidecar next to the ROS files and references it in the ROS message
+// checksums maps each stored object key to its hex SHA-256
+func (h *Handler) writeChecksumManifest(ctx context.Context, rosMessage *messaging.ROSMessage, checksums map[string]string, extractedPayload *ExtractedPayload, identity *identity.Identity, logger *logrus.Entry) error {
+	manifest := checksumManifest{
+		RequestID: rosMessage.RequestID,
+		Algorithm: checksumAlgorithm,
+		Files:     make([]fileChecksum, 0, len(checksums)),
+	}
+	for key, checksum := range checksums {
+		manifest.Files = append(manifest.Files, fileChecksum{ObjectKey: key, Checksum: checksum})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].ObjectKey < manifest.Files[j].ObjectKey
+	})
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checksum manifest: %w", err)
+	}
+
+	schema, err := h.getSchemaName(identity)
+	if err != nil {
+		return err
+	}
+	date := h.partitionDate(extractedPayload.Manifest.Date)
+	key := h.storageClient.GenerateUploadPath(schema, extractedPayload.Manifest.ClusterID, date, checksumManifestName(rosMessage.RequestID))
+
+	result, err := h.storageClient.Upload(ctx, &storage.UploadRequest{
+		Key:         key,
+		Data:        bytes.NewReader(data),
+		Size:        int64(len(data)),
+		ContentType: "application/json",
+		Metadata:    objectMetadata(extractedPayload.Manifest, rosMessage.RequestID, rosMessage.Metadata.IngestedAt),
+		PathPrefix:  h.rosPathPrefix(rosMessage.Metadata.Certified),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload checksum manifest: %w", err)
+	}
+
+	rosMessage.ChecksumManifest = result.PresignedURL
+	rosMessage.ChecksumManifestKey = result.Key
+
+	logger.WithFields(logrus.Fields{
+		"key":   result.Key,
+		"files": len(manifest.Files),
+	}).Info("Successfully uploaded checksum manifest")
+	return nil
+}
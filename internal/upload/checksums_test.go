@@ -0,0 +1,199 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	storagemocks "github.com/RedHatInsights/insights-ros-ingress/internal/storage/mocks"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("HandleUpload checksum manifest", func() {
+	var (
+		handler  *Handler
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	newHandler := func(writeChecksumManifest bool) {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Storage.UsagePathPrefix = "usage"
+		cfg.Storage.WriteChecksumManifest = writeChecksumManifest
+		cfg.Upload.ForwardUsageFiles = true
+		handler = NewHandler(cfg, store, producer, logger)
+	}
+
+	upload := func() *httptest.ResponseRecorder {
+		payload, err := DefaultTestPayloadFactory().
+			WithDate(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)).
+			WithROSFiles("ros-data.csv", "ros-namespace.csv").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		return recorder
+	}
+
+	sha256Hex := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	It("should write a sidecar with the checksum of each stored ROS file", func() {
+		newHandler(true)
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+
+		rosEvent := producer.ROSEvents()[0]
+		Expect(rosEvent.ChecksumManifestKey).To(MatchRegexp(`^org_12345/source=test-cluster-456/date=2024-03-05/checksums-.+\.json$`))
+		Expect(rosEvent.ChecksumManifest).To(Equal("https://storage.example.com/" + rosEvent.ChecksumManifestKey + "?signed=true"))
+
+		data, ok := store.Object(rosEvent.ChecksumManifestKey)
+		Expect(ok).To(BeTrue())
+		var manifest checksumManifest
+		Expect(json.Unmarshal(data, &manifest)).To(Succeed())
+		Expect(manifest.RequestID).To(Equal(rosEvent.RequestID))
+		Expect(manifest.Algorithm).To(Equal("sha256"))
+
+		Expect(manifest.Files).To(HaveLen(2))
+		for _, file := range manifest.Files {
+			Expect(rosEvent.ObjectKeys).To(ContainElement(file.ObjectKey))
+			stored, ok := store.Object(file.ObjectKey)
+			Expect(ok).To(BeTrue())
+			Expect(file.Checksum).To(Equal(sha256Hex(stored)), "object %s", file.ObjectKey)
+		}
+		Expect(manifest.Files[0].ObjectKey < manifest.Files[1].ObjectKey).To(BeTrue(), "files are sorted by object key")
+	})
+
+	It("should not list usage files in the sidecar", func() {
+		newHandler(true)
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+
+		usageEvent := producer.UsageEvents()[0]
+		Expect(usageEvent.ChecksumManifestKey).To(BeEmpty())
+
+		data, _ := store.Object(producer.ROSEvents()[0].ChecksumManifestKey)
+		Expect(string(data)).ToNot(ContainSubstring("usage.csv"))
+	})
+
+	It("should not write a sidecar unless enabled", func() {
+		newHandler(false)
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+
+		Expect(producer.ROSEvents()[0].ChecksumManifest).To(BeEmpty())
+		Expect(store.Keys()).ToNot(ContainElement(ContainSubstring("checksums-")))
+	})
+
+	It("should fail the upload without publishing when the sidecar can't be stored", func() {
+		newHandler(true)
+		store.UploadErr = errors.New("connection reset")
+		store.FailUploadsAfter(2)
+
+		Expect(upload().Code).To(Equal(http.StatusInternalServerError))
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("uploadFiles checksums", func() {
+	var (
+		handler  *Handler
+		objects  *storagemocks.FakeClient
+		filePath string
+		data     []byte
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		objects = storagemocks.NewFakeClient()
+		handler = NewHandler(&config.Config{}, objects, mocks.NewFakeProducer(), logger)
+
+		data = []byte("node,cpu_request,memory_request\nnode1,100m,256Mi\n")
+		filePath = filepath.Join(GinkgoT().TempDir(), "ros-data.csv")
+		Expect(os.WriteFile(filePath, data, 0644)).To(Succeed())
+	})
+
+	store := func() (map[string]string, []string) {
+		payload := &ExtractedPayload{
+			Manifest: &Manifest{UUID: "test-uuid-123", ClusterID: "test-cluster-456", Date: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)},
+		}
+		checksums := make(map[string]string)
+		_, keys, err := handler.uploadFiles(context.Background(), map[string]string{"ros-data.csv": filePath}, "", payload, "request-1", time.Now(), nil, checksums, logrus.NewEntry(logrus.StandardLogger()))
+		Expect(err).ToNot(HaveOccurred())
+		return checksums, keys
+	}
+
+	It("should hash the file while storing it", func() {
+		checksums, keys := store()
+
+		sum := sha256.Sum256(data)
+		Expect(checksums).To(Equal(map[string]string{keys[0]: hex.EncodeToString(sum[:])}))
+	})
+
+	It("should hash the file before storing it when identical objects are skipped", func() {
+		handler.config.Storage.OnConflict = "skip-identical"
+		checksums, keys := store()
+
+		sum := sha256.Sum256(data)
+		Expect(checksums).To(Equal(map[string]string{keys[0]: hex.EncodeToString(sum[:])}))
+		Expect(objects.Uploads()).To(ConsistOf(HaveField("SHA256", hex.EncodeToString(sum[:]))))
+		stored, ok := objects.Object(keys[0])
+		Expect(ok).To(BeTrue())
+		Expect(stored).To(Equal(data))
+	})
+})
+
+// BenchmarkStoreUpload measures extracting, checksumming and storing a payload of several 1MB ROS files
+func BenchmarkStoreUpload(b *testing.B) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	handler := NewHandler(&config.Config{
+		Storage: config.StorageConfig{WriteChecksumManifest: true},
+		Upload:  config.UploadConfig{TempDir: b.TempDir()},
+	}, storagemocks.NewFakeClient(), mocks.NewFakeProducer(), logger)
+
+	names := []string{"ros-1.csv", "ros-2.csv", "ros-3.csv", "ros-4.csv"}
+	rows := strings.Repeat("node1,100m,256Mi\n", 64*1024)
+	factory := DefaultTestPayloadFactory().WithROSFiles(names...)
+	for _, name := range names {
+		// Extra entries come last and replace the factory's ROS file contents
+		factory.WithExtraFile(name, rows)
+	}
+	payload, err := factory.Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), auth.OauthTokenKey, "test-token")
+	entry := logrus.NewEntry(logger)
+
+	b.SetBytes(int64(len(names) * len(rows)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.storeUpload(ctx, bytes.NewReader(payload), uuid.New().String(), "", nil, entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
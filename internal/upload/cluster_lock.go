@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"context"
+	"sync"
+)
+
+// Behaviors for uploads of the same cluster and date partition arriving concurrently
+const (
+	// clusterConcurrencyLastWriterWins stores concurrent uploads in parallel, later writes replace earlier ones
+	clusterConcurrencyLastWriterWins = "last-writer-wins"
+	// clusterConcurrencySerialize makes concurrent uploads wait for each other
+	clusterConcurrencySerialize = "serialize"
+)
+
+// clusterUploads tracks the uploads in flight for each cluster partition
+// When serializing, uploads for the same partition hold a per-partition lock while storing their files,
+// so the objects of one upload are never interleaved with another's
+type clusterUploads struct {
+	serialize bool
+
+	mu      sync.Mutex
+	entries map[string]*clusterUploadEntry
+}
+
+// clusterUploadEntry is the lock and in-flight count of a single partition
+type clusterUploadEntry struct {
+	lock     chan struct{}
+	inFlight int
+}
+
+func newClusterUploads(serialize bool) *clusterUploads {
+	return &clusterUploads{
+		serialize: serialize,
+		entries:   make(map[string]*clusterUploadEntry),
+	}
+}
+
+// acquire registers an upload for key, waiting for the partition lock when serializing
+// It reports whether another upload for key was already in flight. The returned release
+// must be called once the upload's files are stored, unless an error is returned
+func (c *clusterUploads) acquire(ctx context.Context, key string) (func(), bool, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &clusterUploadEntry{lock: make(chan struct{}, 1)}
+		c.entries[key] = entry
+	}
+	entry.inFlight++
+	contended := entry.inFlight > 1
+	c.mu.Unlock()
+
+	if c.serialize {
+		select {
+		case entry.lock <- struct{}{}:
+		case <-ctx.Done():
+			c.done(key, entry)
+			return nil, contended, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if c.serialize {
+				<-entry.lock
+			}
+			c.done(key, entry)
+		})
+	}
+	return release, contended, nil
+}
+
+// done removes an upload from the in-flight count, dropping the entry once the partition is idle
+func (c *clusterUploads) done(key string, entry *clusterUploadEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.inFlight--
+	if entry.inFlight == 0 {
+		delete(c.entries, key)
+	}
+}
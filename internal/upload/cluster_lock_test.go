@@ -0,0 +1,188 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	storagemocks "github.com/RedHatInsights/insights-ros-ingress/internal/storage/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+var _ = Describe("clusterUploads", func() {
+	It("should let uploads of the same partition run together unless serializing", func() {
+		uploads := newClusterUploads(false)
+
+		releaseFirst, contended, err := uploads.acquire(context.Background(), "org_1/cluster/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contended).To(BeFalse())
+
+		releaseSecond, contended, err := uploads.acquire(context.Background(), "org_1/cluster/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contended).To(BeTrue())
+
+		releaseFirst()
+		releaseSecond()
+		Expect(uploads.entries).To(BeEmpty())
+	})
+
+	It("should make uploads of the same partition wait when serializing", func() {
+		uploads := newClusterUploads(true)
+		release, _, err := uploads.acquire(context.Background(), "org_1/cluster/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+
+		acquired := make(chan bool)
+		go func() {
+			defer GinkgoRecover()
+			releaseSecond, contended, err := uploads.acquire(context.Background(), "org_1/cluster/2024-03-05")
+			Expect(err).ToNot(HaveOccurred())
+			acquired <- contended
+			releaseSecond()
+		}()
+
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+		release()
+		Eventually(acquired).Should(Receive(BeTrue()))
+	})
+
+	It("should not make other partitions wait", func() {
+		uploads := newClusterUploads(true)
+		release, _, err := uploads.acquire(context.Background(), "org_1/cluster-a/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+		defer release()
+
+		releaseOther, contended, err := uploads.acquire(context.Background(), "org_1/cluster-b/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contended).To(BeFalse())
+		releaseOther()
+	})
+
+	It("should stop waiting when the context is done", func() {
+		uploads := newClusterUploads(true)
+		release, _, err := uploads.acquire(context.Background(), "org_1/cluster/2024-03-05")
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, _, err = uploads.acquire(ctx, "org_1/cluster/2024-03-05")
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		release()
+		Expect(uploads.entries).To(BeEmpty())
+	})
+})
+
+// blockingStore holds every upload until released, announcing the keys as uploads start
+type blockingStore struct {
+	*storagemocks.FakeClient
+	started chan string
+	release chan struct{}
+}
+
+func (s *blockingStore) Upload(ctx context.Context, req *storage.UploadRequest) (*storage.UploadResult, error) {
+	s.started <- req.Key
+	<-s.release
+	return s.FakeClient.Upload(ctx, req)
+}
+
+var _ = Describe("HandleUpload concurrent uploads of a cluster", func() {
+	var (
+		store   *blockingStore
+		handler *Handler
+		hook    *logtest.Hook
+	)
+
+	newHandler := func(clusterConcurrency string) {
+		logger, logHook := logtest.NewNullLogger()
+		logger.SetLevel(logrus.InfoLevel)
+		hook = logHook
+
+		store = &blockingStore{
+			FakeClient: storagemocks.NewFakeClient(),
+			started:    make(chan string, 4),
+			release:    make(chan struct{}),
+		}
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.MaxConcurrentExtractions = 2
+		cfg.Upload.ClusterConcurrency = clusterConcurrency
+		handler = NewHandler(cfg, store, mocks.NewFakeProducer(), logger)
+	}
+
+	// serve starts an upload of clusterID in the background and returns the channel its status code arrives on
+	serve := func(clusterID string) <-chan int {
+		codes := make(chan int, 1)
+		payload, err := DefaultTestPayloadFactory().
+			WithClusterID(clusterID).
+			WithDate(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		go func() {
+			defer GinkgoRecover()
+			recorder := httptest.NewRecorder()
+			handler.HandleUpload(recorder, req)
+			codes <- recorder.Code
+		}()
+		return codes
+	}
+
+	lastWriterWinsWarnings := func() int {
+		count := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && entry.Message == "Concurrent upload of the same cluster and date, the last writer wins" {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("should store concurrent uploads in parallel and warn that the last writer wins", func() {
+		newHandler("last-writer-wins")
+
+		first := serve("cluster-1")
+		Eventually(store.started).Should(Receive())
+		second := serve("cluster-1")
+		Eventually(store.started).Should(Receive())
+
+		close(store.release)
+		Eventually(first).Should(Receive(Equal(http.StatusAccepted)))
+		Eventually(second).Should(Receive(Equal(http.StatusAccepted)))
+		Expect(store.Uploads()).To(HaveLen(2))
+		Expect(lastWriterWinsWarnings()).To(Equal(1))
+	})
+
+	It("should make a concurrent upload wait until the first has stored its files when serializing", func() {
+		newHandler("serialize")
+
+		first := serve("cluster-1")
+		Eventually(store.started).Should(Receive())
+		second := serve("cluster-1")
+		Consistently(store.started, 200*time.Millisecond).ShouldNot(Receive())
+
+		close(store.release)
+		Eventually(first).Should(Receive(Equal(http.StatusAccepted)))
+		Eventually(second).Should(Receive(Equal(http.StatusAccepted)))
+		Expect(store.Uploads()).To(HaveLen(2))
+		Expect(lastWriterWinsWarnings()).To(BeZero())
+	})
+
+	It("should not serialize uploads of different clusters", func() {
+		newHandler("serialize")
+
+		first := serve("cluster-1")
+		Eventually(store.started).Should(Receive())
+		second := serve("cluster-2")
+		Eventually(store.started).Should(Receive())
+
+		close(store.release)
+		Eventually(first).Should(Receive(Equal(http.StatusAccepted)))
+		Eventually(second).Should(Receive(Equal(http.StatusAccepted)))
+	})
+})
@@ -0,0 +1,112 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// maxEnrichmentResponseBytes bounds the lookup response read into memory
+const maxEnrichmentResponseBytes = 64 << 10
+
+// orgEnricher looks up org metadata, such as the tier and region, from an external service
+// Lookups are cached per org. A failed lookup falls back to the org's last known metadata, or
+// to none, so enrichment never fails an upload. A nil enricher is valid and adds no metadata
+type orgEnricher struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu sync.Mutex
+	// entries keeps expired metadata too, as the fallback for failed lookups
+	entries map[string]orgMetadataEntry
+	now     func() time.Time
+}
+
+type orgMetadataEntry struct {
+	metadata  map[string]string
+	expiresAt time.Time
+}
+
+// newOrgEnricher creates the enricher for cfg, returning nil when no lookup URL is configured
+func newOrgEnricher(cfg config.EnrichmentConfig) *orgEnricher {
+	if cfg.URL == "" {
+		return nil
+	}
+	return &orgEnricher{
+		url:     strings.TrimSuffix(cfg.URL, "/"),
+		ttl:     time.Duration(cfg.CacheTTL) * time.Second,
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		entries: make(map[string]orgMetadataEntry),
+		now:     time.Now,
+	}
+}
+
+// lookup returns the metadata of orgID, from the cache until it expires
+// Callers get their own copy so the cached metadata can't be modified
+func (e *orgEnricher) lookup(ctx context.Context, orgID string, logger *logrus.Entry) map[string]string {
+	if e == nil || orgID == "" {
+		return nil
+	}
+
+	e.mu.Lock()
+	now := e.now()
+	entry, cached := e.entries[orgID]
+	e.mu.Unlock()
+	if cached && now.Before(entry.expiresAt) {
+		return maps.Clone(entry.metadata)
+	}
+
+	metadata, err := e.fetch(ctx, orgID)
+	if err != nil {
+		logger.WithError(err).WithField("org_id", orgID).Warn("Failed to look up org metadata")
+		if cached {
+			return maps.Clone(entry.metadata)
+		}
+		return nil
+	}
+
+	e.mu.Lock()
+	e.entries[orgID] = orgMetadataEntry{metadata: metadata, expiresAt: now.Add(e.ttl)}
+	e.mu.Unlock()
+	return maps.Clone(metadata)
+}
+
+// fetch asks the lookup service for the metadata of orgID, an unknown org has no metadata
+func (e *orgEnricher) fetch(ctx context.Context, orgID string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+"/"+url.PathEscape(orgID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return map[string]string{}, nil
+	default:
+		return nil, fmt.Errorf("lookup returned status %d", resp.StatusCode)
+	}
+
+	metadata := map[string]string{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxEnrichmentResponseBytes)).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode lookup response: %w", err)
+	}
+	return metadata, nil
+}
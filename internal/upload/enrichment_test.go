@@ -0,0 +1,158 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	storagemocks "github.com/RedHatInsights/insights-ros-ingress/internal/storage/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeEnrichmentServer serves org metadata lookups, failing them while unavailable is set
+type fakeEnrichmentServer struct {
+	requests    atomic.Int32
+	unavailable atomic.Bool
+	lastPath    atomic.Value
+}
+
+func (s *fakeEnrichmentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	s.lastPath.Store(r.URL.EscapedPath())
+	switch {
+	case s.unavailable.Load():
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.URL.Path == "/orgs/unknown":
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"tier":"premium","region":"eu-west"}`))
+	}
+}
+
+var _ = Describe("orgEnricher", func() {
+	var (
+		lookups  *fakeEnrichmentServer
+		enricher *orgEnricher
+		now      time.Time
+		logger   *logrus.Entry
+	)
+
+	BeforeEach(func() {
+		lookups = &fakeEnrichmentServer{}
+		server := httptest.NewServer(lookups)
+		DeferCleanup(server.Close)
+
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		enricher = newOrgEnricher(config.EnrichmentConfig{URL: server.URL + "/orgs/", CacheTTL: 60, Timeout: 2})
+		enricher.now = func() time.Time { return now }
+
+		log := logrus.New()
+		log.SetLevel(logrus.FatalLevel)
+		logger = logrus.NewEntry(log)
+	})
+
+	It("should look up the metadata of the org", func() {
+		Expect(enricher.lookup(context.Background(), "12345", logger)).To(Equal(map[string]string{
+			"tier":   "premium",
+			"region": "eu-west",
+		}))
+		Expect(lookups.lastPath.Load()).To(Equal("/orgs/12345"))
+	})
+
+	It("should serve repeated lookups from the cache within the TTL", func() {
+		for range 3 {
+			Expect(enricher.lookup(context.Background(), "12345", logger)).To(HaveKeyWithValue("tier", "premium"))
+		}
+		Expect(lookups.requests.Load()).To(Equal(int32(1)))
+
+		now = now.Add(time.Minute)
+		enricher.lookup(context.Background(), "12345", logger)
+		Expect(lookups.requests.Load()).To(Equal(int32(2)))
+	})
+
+	It("should hand out copies that can't modify the cached metadata", func() {
+		enricher.lookup(context.Background(), "12345", logger)["tier"] = "tampered"
+		Expect(enricher.lookup(context.Background(), "12345", logger)).To(HaveKeyWithValue("tier", "premium"))
+	})
+
+	It("should fall back to the last known metadata when the lookup fails", func() {
+		enricher.lookup(context.Background(), "12345", logger)
+		now = now.Add(time.Hour)
+		lookups.unavailable.Store(true)
+
+		Expect(enricher.lookup(context.Background(), "12345", logger)).To(HaveKeyWithValue("region", "eu-west"))
+		Expect(lookups.requests.Load()).To(Equal(int32(2)))
+	})
+
+	It("should skip the metadata when the lookup fails for an org never looked up", func() {
+		lookups.unavailable.Store(true)
+		Expect(enricher.lookup(context.Background(), "12345", logger)).To(BeNil())
+	})
+
+	It("should cache an unknown org as having no metadata", func() {
+		Expect(enricher.lookup(context.Background(), "unknown", logger)).To(BeEmpty())
+		enricher.lookup(context.Background(), "unknown", logger)
+		Expect(lookups.requests.Load()).To(Equal(int32(1)))
+	})
+
+	It("should add no metadata when enrichment is disabled", func() {
+		disabled := newOrgEnricher(config.EnrichmentConfig{})
+		Expect(disabled).To(BeNil())
+		Expect(disabled.lookup(context.Background(), "12345", logger)).To(BeNil())
+	})
+})
+
+var _ = Describe("HandleUpload org metadata enrichment", func() {
+	var (
+		lookups  *fakeEnrichmentServer
+		producer *mocks.FakeProducer
+		handler  *Handler
+	)
+
+	BeforeEach(func() {
+		lookups = &fakeEnrichmentServer{}
+		server := httptest.NewServer(lookups)
+		DeferCleanup(server.Close)
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Enrichment = config.EnrichmentConfig{URL: server.URL + "/orgs", CacheTTL: 60, Timeout: 2}
+		handler = NewHandler(cfg, storagemocks.NewFakeClient(), producer, logger)
+	})
+
+	upload := func() *messaging.ROSMessage {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		Eventually(producer.ROSEvents).ShouldNot(BeEmpty())
+		events := producer.ROSEvents()
+		return events[len(events)-1]
+	}
+
+	It("should add the org metadata to the ROS event", func() {
+		Expect(upload().Metadata.OrgMetadata).To(Equal(map[string]string{
+			"tier":   "premium",
+			"region": "eu-west",
+		}))
+		Expect(lookups.lastPath.Load()).To(Equal("/orgs/12345"))
+	})
+
+	It("should accept the upload without metadata when the lookup fails", func() {
+		lookups.unavailable.Store(true)
+		Expect(upload().Metadata.OrgMetadata).To(BeNil())
+	})
+})
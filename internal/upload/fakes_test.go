@@ -0,0 +1,178 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// fakeObjectStore is a minimal in-memory S3 endpoint for a single existing bucket
+type fakeObjectStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+}
+
+func (f *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	isBucket := !strings.Contains(path, "/")
+	switch {
+	case r.URL.Query().Has("location"):
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`))
+	case isBucket && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[path] = data
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, value := range f.metadata[path] {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Put stores an object under key, which includes the bucket
+func (f *fakeObjectStore) Put(key string, data []byte) {
+	f.PutWithMetadata(key, data, nil)
+}
+
+// PutWithMetadata stores an object under key, which includes the bucket, with user metadata
+func (f *fakeObjectStore) PutWithMetadata(key string, data []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = data
+	f.metadata[key] = metadata
+}
+
+// Keys returns the stored object paths, including the bucket
+func (f *fakeObjectStore) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// newFakeStorage starts a fake object store and returns a storage client backed by it
+// The server is closed when the calling spec ends
+func newFakeStorage() (*storage.Client, *fakeObjectStore) {
+	store := &fakeObjectStore{objects: make(map[string][]byte), metadata: make(map[string]map[string]string)}
+	server := httptest.NewServer(store)
+	DeferCleanup(server.Close)
+
+	client, err := storage.NewMinIOClient(config.StorageConfig{
+		Endpoint:      strings.TrimPrefix(server.URL, "http://"),
+		AccessKey:     "access",
+		SecretKey:     "secret",
+		Bucket:        "test-bucket",
+		URLExpiration: 3600,
+	})
+	Expect(err).ToNot(HaveOccurred())
+	return client, store
+}
+
+// newTestConfig returns a config accepting HCCM uploads, extracted into a temp dir removed when the calling spec ends
+// Specs adjust the settings they exercise before passing it to newTestHandler
+func newTestConfig() *config.Config {
+	return &config.Config{
+		Upload: config.UploadConfig{
+			MaxUploadSize:            10 * 1024 * 1024,
+			MaxMemory:                10 * 1024 * 1024,
+			TempDir:                  GinkgoT().TempDir(),
+			AllowedTypes:             []string{"application/vnd.redhat.hccm.upload"},
+			MaxConcurrentExtractions: 1,
+			StatusTTL:                60,
+		},
+	}
+}
+
+// newTestLogger returns a logger that only reports fatal errors, keeping test output quiet
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	return logger
+}
+
+// newTestHandler returns a handler for cfg backed by a fake object store and producer, with logging silenced
+func newTestHandler(cfg *config.Config) (*Handler, *fakeObjectStore, *mocks.FakeProducer) {
+	storageClient, store := newFakeStorage()
+	producer := mocks.NewFakeProducer()
+	return NewHandler(cfg, storageClient, producer, newTestLogger()), store, producer
+}
+
+// newPayloadUploadRequest builds an authenticated upload request carrying payload as an HCCM archive
+func newPayloadUploadRequest(payload []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="file"; filename="payload.tar.gz"`)
+	partHeader.Set("Content-Type", "application/vnd.redhat.hccm.upload")
+	part, err := writer.CreatePart(partHeader)
+	Expect(err).ToNot(HaveOccurred())
+	_, err = part.Write(payload)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(writer.Close()).To(Succeed())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	ctx := context.WithValue(req.Context(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{
+		Username: "test-user",
+		Groups:   []string{"org:12345", "account:67890"},
+	})
+	ctx = context.WithValue(ctx, auth.OauthTokenKey, "test-token")
+	return req.WithContext(ctx)
+}
+
+// serveAsUser sends handler a test upload, a form carrying only the test field, as user
+func serveAsUser(handler *Handler, user authenticationv1.UserInfo) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	Expect(writer.WriteField("test", "test")).To(Succeed())
+	Expect(writer.Close()).To(Succeed())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = req.WithContext(context.WithValue(req.Context(), auth.AuthenticatedUserKey, user))
+
+	recorder := httptest.NewRecorder()
+	handler.HandleUpload(recorder, req)
+	return recorder
+}
@@ -2,44 +2,134 @@ package upload
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/big"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/features"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/outbox"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/retry"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
 	"github.com/sirupsen/logrus"
 	authenticationv1 "k8s.io/api/authentication/v1"
 )
 
+// apiPathPrefix is the path the API routes are mounted under
+const apiPathPrefix = "/api/ingress/v1"
+
+// multipartOverheadAllowance is the extra body size tolerated for the multipart envelope
+const multipartOverheadAllowance = 64 * 1024
+
+// manifestUUIDHeader carries the uuid of the manifest inside the uploaded payload, when clients are required to send it
+const manifestUUIDHeader = "X-Manifest-UUID"
+
+// producerQueueFullRetryAfter is the Retry-After (seconds) sent when the Kafka producer queue is full
+const producerQueueFullRetryAfter = 5
+
+// retryBudgetRetryAfter is the Retry-After (seconds) sent when a storage retry was shed by the retry budget
+const retryBudgetRetryAfter = 5
+
+// Upload acknowledgment modes
+const (
+	// ackModeSync responds once the upload's events have been delivered
+	ackModeSync = "sync"
+	// ackModeAsync responds once the upload's files are stored and publishes in the background
+	ackModeAsync = "async"
+)
+
+// Schema modes for identities without an org ID
+const (
+	// emptyOrgSchemaAccount derives the schema from the account number
+	emptyOrgSchemaAccount = "account"
+	// emptyOrgSchemaReject refuses uploads from identities without an org ID
+	emptyOrgSchemaReject = "reject"
+)
+
+// ErrROSBytesExceeded is returned when an upload's ROS files together exceed the configured maximum size
+var ErrROSBytesExceeded = errors.New("ROS files exceed the maximum total size")
+
+// ErrUncertified is returned for payloads of uncertified operators when only certified ones are accepted
+var ErrUncertified = errors.New("payload is not from a certified operator")
+
+// ErrNoSchema is returned when no storage schema can be derived for an upload's identity
+var ErrNoSchema = errors.New("no storage schema for identity")
+
+// ErrMissingIdentity is returned when an upload reaches processing without an identity while auth is enabled
+var ErrMissingIdentity = errors.New("no identity for upload with auth enabled")
+
 // Handler handles HCCM upload requests
 type Handler struct {
 	config           *config.Config
-	storageClient    *storage.Client
-	messagingClient  *messaging.Producer
+	storageClient    storage.StorageClient
+	messagingClient  messaging.MessageProducer
 	payloadExtractor *PayloadExtractor
+	extractions      *extractionLimiter
+	statuses         *StatusStore
+	identities       *identityCache
+	enricher         *orgEnricher
+	outbox           outbox.Store
+	clusterUploads   *clusterUploads
+	flags            *features.Flags
+	background       sync.WaitGroup
+	partitionTZ      *time.Location
+	now              func() time.Time
 	logger           *logrus.Logger
+	// settingsMu guards the config settings that can be reloaded while serving
+	settingsMu sync.RWMutex
 }
 
 // UploadResponse represents the response returned to clients
 type UploadResponse struct {
 	RequestID string     `json:"request_id"`
 	Upload    UploadData `json:"upload,omitempty"`
+	// Files lists the stored files, only in verbose responses
+	Files []UploadedFile `json:"files,omitempty"`
+}
+
+// CompactUploadResponse is the upload response for clients asking for the compact verbosity
+type CompactUploadResponse struct {
+	RequestID string `json:"request_id"`
+}
+
+// UploadedFile describes a file stored for an upload
+type UploadedFile struct {
+	ObjectKey string `json:"object_key"`
+	// Kind is "ros" or "usage"
+	Kind string `json:"kind"`
 }
 
+// Upload response verbosity levels, the default is the UploadResponse without its files
+const (
+	verbosityCompact = "compact"
+	verbosityVerbose = "verbose"
+)
+
 // UploadData represents upload metadata in response
 type UploadData struct {
 	Account string `json:"account_number,omitempty"`
@@ -48,16 +138,72 @@ type UploadData struct {
 
 // NewHandler creates a new upload handler
 // Authentication is expected to be handled by middleware that stores user info in request context
-func NewHandler(cfg *config.Config, storageClient *storage.Client, messagingClient *messaging.Producer, log *logrus.Logger) *Handler {
+func NewHandler(cfg *config.Config, storageClient storage.StorageClient, messagingClient messaging.MessageProducer, log *logrus.Logger) *Handler {
+	payloadExtractor := NewPayloadExtractor(cfg.Upload.TempDir, log)
+	payloadExtractor.includeUsageFiles = cfg.Upload.ForwardUsageFiles
+	payloadExtractor.validateDateConsistency = cfg.Upload.ValidateDateConsistency
+	payloadExtractor.strictManifestFields = cfg.Upload.StrictManifestFields
+	payloadExtractor.extractionTimeout = time.Duration(cfg.Upload.ExtractionTimeout) * time.Second
+	payloadExtractor.forbiddenFilePatterns = cfg.Upload.ForbiddenFilePatterns
+	payloadExtractor.keepFailedFor = time.Duration(cfg.Upload.KeepFailedPayloads) * time.Second
+	payloadExtractor.maxFailedPayloads = cfg.Upload.MaxFailedPayloads
+	payloadExtractor.rejectEmptyManifestEarly = cfg.Upload.RejectEmptyManifestEarly
+	payloadExtractor.rejectTrailingData = cfg.Upload.RejectTrailingData
+	if cfg.Upload.InferROSFromFiles {
+		payloadExtractor.rosFilePatterns = cfg.Upload.ROSFilePatterns
+	}
+	if cfg.Upload.MinOperatorVersion != "" {
+		minVersion, err := semver.NewVersion(cfg.Upload.MinOperatorVersion)
+		if err != nil {
+			log.WithError(err).Warn("Ignoring invalid minimum operator version")
+		} else {
+			payloadExtractor.minOperatorVersion = minVersion
+		}
+	}
+
+	var partitionTZ *time.Location
+	if cfg.Storage.PartitionTimezone != "" {
+		location, err := time.LoadLocation(cfg.Storage.PartitionTimezone)
+		if err != nil {
+			log.WithError(err).Warn("Ignoring invalid partition timezone")
+		} else {
+			partitionTZ = location
+		}
+	}
+
 	return &Handler{
 		config:           cfg,
 		storageClient:    storageClient,
 		messagingClient:  messagingClient,
-		payloadExtractor: NewPayloadExtractor(cfg.Upload.TempDir, log),
+		payloadExtractor: payloadExtractor,
+		extractions:      newExtractionLimiter(cfg.Upload.MaxConcurrentExtractions, time.Duration(cfg.Upload.ExtractionQueueTimeout)*time.Second),
+		statuses:         NewStatusStore(time.Duration(cfg.Upload.StatusTTL) * time.Second),
+		identities:       newIdentityCache(time.Duration(cfg.Auth.IdentityCacheTTL) * time.Second),
+		enricher:         newOrgEnricher(cfg.Enrichment),
+		clusterUploads:   newClusterUploads(cfg.Upload.ClusterConcurrency == clusterConcurrencySerialize),
+		flags:            defaultFlags(log),
+		partitionTZ:      partitionTZ,
+		now:              time.Now,
 		logger:           log,
 	}
 }
 
+// WaitForBackground waits for uploads still publishing in the background, or until ctx is done
+func (h *Handler) WaitForBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // HandleUpload handles the main upload endpoint
 func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -76,92 +222,307 @@ func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 		"content_length": r.ContentLength,
 	}).Info("Received upload request")
 
-	// Validate request method
-	if r.Method != http.MethodPost {
-		h.respondError(w, http.StatusMethodNotAllowed, "Method not allowed", requestLogger)
+	// Cheap validations run before anything reads the body so that clients using
+	// "Expect: 100-continue" are rejected without transmitting the payload
+
+	// Extract identity from request context
+	derived, err := h.resolveIdentity(r)
+	h.countIdentityDerivation(derived)
+	var identity *identity.Identity
+	if err == nil && derived != nil {
+		identity = derived.identity
+	}
+	if h.config.Auth.Enabled && identity == nil {
+		h.respondError(w, r, http.StatusUnauthorized, "Invalid or missing identity", requestLogger)
 		return
 	}
 
-	// Handle test requests
-	if h.isTestRequest(r) {
-		h.handleTestRequest(w, r, requestID, requestLogger)
-		return
+	// Update logger with identity context
+	if identity != nil {
+		requestLogger = logger.WithUploadContext(h.logger, requestID, identity.AccountNumber, identity.OrgID)
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(h.config.Upload.MaxMemory); err != nil {
-		h.respondError(w, http.StatusBadRequest, "Failed to parse multipart form", requestLogger)
+	// Reject identities that may not upload
+	if identity != nil {
+		if status, message := h.authorizeIdentity(identity); status != 0 {
+			h.respondError(w, r, status, message, requestLogger)
+			return
+		}
+	}
+
+	// Validate declared content length, optionally requiring one so the size limit
+	// can't be bypassed with chunked transfer encoding
+	if h.config.Upload.RequireContentLength && r.ContentLength < 0 {
+		h.respondError(w, r, http.StatusLengthRequired, "Content-Length required", requestLogger)
 		return
 	}
+	if h.exceedsDeclaredSize(r) {
+		h.respondError(w, r, http.StatusRequestEntityTooLarge, "File too large", requestLogger)
+		return
+	}
+	// The declared length is that of the encoded body, bound what is read once it is decoded too,
+	// so a small gzip body can't expand into an unbounded form
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize())
+
+	// The declared manifest UUID catches payloads swapped or mismatched on the client
+	var manifestUUID string
+	if h.config.Upload.RequireManifestUUID {
+		manifestUUID = strings.TrimSpace(r.Header.Get(manifestUUIDHeader))
+		if manifestUUID == "" {
+			h.respondError(w, r, http.StatusBadRequest, manifestUUIDHeader+" header required", requestLogger)
+			return
+		}
+	}
 
-	// Extract identity from header
-	identity, err := h.extractIdentity(r)
-	if err != nil && h.config.Auth.Enabled {
-		h.respondError(w, http.StatusUnauthorized, "Invalid or missing identity", requestLogger)
+	// Bound the time allowed to transfer the body, separately from the server read timeout
+	var body *deadlineReader
+	if h.config.Server.BodyReadTimeout > 0 {
+		deadline := time.Now().Add(time.Duration(h.config.Server.BodyReadTimeout) * time.Second)
+		if err := http.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+			requestLogger.WithError(err).Debug("Connection read deadline not supported, relying on body deadline")
+		}
+		body = newDeadlineReader(r.Body, deadline)
+		r.Body = body
+	}
+
+	// Raw uploads send the payload itself as the body, there is no form to parse
+	raw := h.isRawUpload(r)
+	if raw && r.ContentLength < 0 {
+		h.respondError(w, r, http.StatusLengthRequired, "Content-Length required for raw uploads", requestLogger)
 		return
 	}
 
-	// Update logger with identity context
-	if identity != nil {
-		requestLogger = logger.WithUploadContext(h.logger, requestID, identity.AccountNumber, identity.OrgID)
+	// Parse the multipart form before the test request check, which would otherwise
+	// parse it implicitly with the default memory limit and discard read errors
+	var parseErr error
+	if !raw {
+		parseErr = r.ParseMultipartForm(h.config.Upload.MaxMemory)
+	}
+	if r.MultipartForm != nil {
+		// The server only removes multipart temp files when the handler returns normally
+		defer func() {
+			if err := r.MultipartForm.RemoveAll(); err != nil {
+				requestLogger.WithError(err).Warn("Failed to remove multipart temp files")
+			}
+		}()
+	}
+	if parseErr != nil && !errors.Is(parseErr, http.ErrNotMultipart) {
+		if body != nil && body.expired {
+			h.respondError(w, r, http.StatusRequestTimeout, "Timed out reading request body", requestLogger)
+			return
+		}
+		if errors.As(parseErr, new(*http.MaxBytesError)) {
+			h.respondError(w, r, http.StatusRequestEntityTooLarge, "File too large", requestLogger)
+			return
+		}
+		if isClientDisconnect(r, parseErr) {
+			h.handleClientDisconnect(w, r, parseErr, requestLogger)
+			return
+		}
 	}
 
-	// Get file from multipart form
-	file, fileHeader, err := h.getFileFromRequest(r)
-	if err != nil {
-		h.respondError(w, http.StatusBadRequest, "File not found in request", requestLogger)
+	// Handle test requests
+	if h.isTestRequest(r) {
+		h.handleTestRequest(w, r, requestID, requestLogger)
 		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			requestLogger.WithError(err).Warn("Failed to close uploaded file")
+
+	if parseErr != nil {
+		h.respondError(w, r, http.StatusBadRequest, "Failed to parse multipart form", requestLogger)
+		return
+	}
+
+	// Get the file from the multipart form, or the body of a raw upload
+	var (
+		file        io.ReadCloser
+		contentType string
+		fileSize    int64
+	)
+	if raw {
+		file = r.Body
+		contentType = r.Header.Get("Content-Type")
+		fileSize = r.ContentLength
+	} else {
+		var fileHeader *multipart.FileHeader
+		file, fileHeader, err = h.getFileFromRequest(r)
+		if err != nil {
+			h.respondError(w, r, http.StatusBadRequest, "File not found in request", requestLogger)
+			return
 		}
-	}()
+		defer func() {
+			if err := file.Close(); err != nil {
+				requestLogger.WithError(err).Warn("Failed to close uploaded file")
+			}
+		}()
+		contentType = fileHeader.Header.Get("Content-Type")
+		fileSize = fileHeader.Size
+	}
 
 	// Validate content type
-	contentType := fileHeader.Header.Get("Content-Type")
 	if !h.isValidContentType(contentType) {
-		h.respondError(w, http.StatusUnsupportedMediaType, "Invalid content type", requestLogger)
+		h.respondError(w, r, http.StatusUnsupportedMediaType, "Invalid content type", requestLogger)
 		return
 	}
 
-	// Validate file size
-	if fileHeader.Size > h.config.Upload.MaxUploadSize {
-		h.respondError(w, http.StatusRequestEntityTooLarge, "File too large", requestLogger)
+	// Validate file size against the limit for its content type
+	if fileSize > h.maxUploadSize(contentType) {
+		h.respondError(w, r, http.StatusRequestEntityTooLarge, "File too large", requestLogger)
 		return
 	}
 
+	// Receive a raw body in full first, like multipart files, so a slow client can't hold an
+	// extraction slot or run down the extraction timeout
+	if raw {
+		spool, err := spoolBody(r.Body, h.config.Upload.TempDir, h.maxUploadSize(contentType))
+		if err != nil {
+			switch {
+			case body != nil && body.expired:
+				h.respondError(w, r, http.StatusRequestTimeout, "Timed out reading request body", requestLogger)
+			case errors.Is(err, errBodyTooLarge):
+				h.respondError(w, r, http.StatusRequestEntityTooLarge, "File too large", requestLogger)
+			case isClientDisconnect(r, err):
+				h.handleClientDisconnect(w, r, err, requestLogger)
+			case errors.As(err, new(*fs.PathError)):
+				// Only the temp file, not the body, fails with a path error
+				h.respondError(w, r, http.StatusInternalServerError, "Failed to process upload", requestLogger)
+				requestLogger.WithError(err).Error("Failed to spool raw upload body")
+			default:
+				h.respondError(w, r, http.StatusBadRequest, "Failed to read request body", requestLogger)
+				requestLogger.WithError(err).Warn("Failed to spool raw upload body")
+			}
+			return
+		}
+		defer func() {
+			if err := spool.Close(); err != nil {
+				requestLogger.WithError(err).Warn("Failed to close spooled upload body")
+			}
+			if err := os.Remove(spool.Name()); err != nil {
+				requestLogger.WithError(err).Warn("Failed to remove spooled upload body")
+			}
+		}()
+		file = spool
+	}
+
 	requestLogger.WithFields(logrus.Fields{
 		"content_type": contentType,
-		"file_size":    fileHeader.Size,
+		"file_size":    fileSize,
+		"raw":          raw,
 	}).Info("Processing upload")
 
 	// Record upload metrics
 	health.UploadsTotal.WithLabelValues("received", contentType).Inc()
-	health.UploadSizeBytes.WithLabelValues(contentType).Observe(float64(fileHeader.Size))
+	health.UploadSizeBytes.WithLabelValues(contentType).Observe(float64(fileSize))
 
 	// Process the upload
-	if err := h.processUpload(r.Context(), file, requestID, identity, requestLogger); err != nil {
+	orgID := h.getOrgID(identity)
+	health.OrgUploadsTotal.WithLabelValues(orgID, "received").Inc()
+	health.OrgUploadBytesTotal.WithLabelValues(orgID).Add(float64(fileSize))
+	h.statuses.Set(requestID, orgID, StatusProcessing, "")
+	async := h.config.Upload.AckMode == ackModeAsync
+	var events *uploadEvents
+	if async {
+		events, err = h.processUploadAsync(r.Context(), file, requestID, manifestUUID, orgID, identity, requestLogger)
+	} else {
+		events, err = h.processUpload(r.Context(), file, requestID, manifestUUID, identity, requestLogger)
+	}
+	if err != nil {
+		h.statuses.Set(requestID, orgID, StatusFailed, err.Error())
+		// Only a cancelled request means the client left
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			h.handleClientDisconnect(w, r, err, requestLogger)
+			return
+		}
 		health.UploadsTotal.WithLabelValues("error", contentType).Inc()
-		h.respondError(w, http.StatusInternalServerError, "Failed to process upload", requestLogger)
+		health.OrgUploadsTotal.WithLabelValues(orgID, "error").Inc()
+		if errors.Is(err, ErrExtractionSaturated) {
+			w.Header().Set("Retry-After", strconv.Itoa(h.config.Upload.ExtractionQueueTimeout+1))
+			h.respondError(w, r, http.StatusServiceUnavailable, "Too many uploads in progress, retry later", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected due to extraction saturation")
+			return
+		}
+		var invalidErr *InvalidPayloadError
+		if errors.As(err, &invalidErr) {
+			h.respondError(w, r, http.StatusUnprocessableEntity, "Invalid payload: "+invalidErr.Reason, requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected due to invalid payload")
+			return
+		}
+		if errors.Is(err, messaging.ErrQueueFull) {
+			w.Header().Set("Retry-After", strconv.Itoa(producerQueueFullRetryAfter))
+			h.respondError(w, r, http.StatusServiceUnavailable, "Event queue is full, retry later", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected due to Kafka producer backpressure")
+			return
+		}
+		if errors.Is(err, retry.ErrBudgetExhausted) {
+			w.Header().Set("Retry-After", strconv.Itoa(retryBudgetRetryAfter))
+			h.respondError(w, r, http.StatusServiceUnavailable, "Storage is unavailable, retry later", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected because the retry budget is exhausted")
+			return
+		}
+		if errors.Is(err, messaging.ErrMessageTooLarge) {
+			h.respondError(w, r, http.StatusRequestEntityTooLarge, "Payload references too many or too large ROS files to announce in a single event", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected because its event exceeds the Kafka message size limit")
+			return
+		}
+		if errors.Is(err, ErrROSBytesExceeded) {
+			h.respondError(w, r, http.StatusRequestEntityTooLarge, "ROS files exceed the maximum total size", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected due to total ROS file size")
+			return
+		}
+		if errors.Is(err, ErrUncertified) {
+			h.respondError(w, r, http.StatusForbidden, "Only payloads of certified operators are accepted", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected because the operator is not certified")
+			return
+		}
+		if errors.Is(err, ErrNoSchema) {
+			h.respondError(w, r, http.StatusUnprocessableEntity, "Identity must carry an org_id", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected because no storage schema can be derived")
+			return
+		}
+		if errors.Is(err, storage.ErrObjectExists) {
+			h.respondError(w, r, http.StatusConflict, "Upload conflicts with an existing object", requestLogger)
+			requestLogger.WithError(err).Warn("Upload rejected due to object key collision")
+			return
+		}
+		h.respondError(w, r, http.StatusInternalServerError, "Failed to process upload", requestLogger)
 		requestLogger.WithError(err).Error("Upload processing failed")
 		return
 	}
 
+	// In async mode the background publisher records the final status
+	if !async {
+		status := StatusSucceeded
+		if events.queued {
+			status = StatusQueued
+		}
+		h.statuses.Set(requestID, orgID, status, "")
+	}
 	health.UploadsTotal.WithLabelValues("success", contentType).Inc()
+	health.OrgUploadsTotal.WithLabelValues(orgID, "success").Inc()
 
 	// Send success response
-	response := UploadResponse{
+	fullResponse := UploadResponse{
 		RequestID: requestID,
 	}
 
 	if identity != nil {
-		response.Upload = UploadData{
+		fullResponse.Upload = UploadData{
 			Account: identity.AccountNumber,
 			OrgID:   identity.OrgID,
 		}
 	}
 
+	var response any = fullResponse
+	switch responseVerbosity(r) {
+	case verbosityCompact:
+		response = CompactUploadResponse{RequestID: requestID}
+	case verbosityVerbose:
+		// With verbose responses switched off the client gets the default shape
+		if h.flags.Enabled(features.VerboseResponses) {
+			fullResponse.Files = events.files()
+		}
+		response = fullResponse
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -171,123 +532,493 @@ func (h *Handler) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	requestLogger.Info("Upload processed successfully")
 }
 
+// HandleStatus returns the processing status of an upload by request ID
+// Statuses are only visible to callers from the same organization as the upload
+func (h *Handler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	requestID := chi.URLParam(r, "requestID")
+	requestLogger := logger.WithRequestID(h.logger, requestID)
+
+	// Authenticate before the lookup, so unauthenticated callers can't probe which request IDs exist
+	orgID := ""
+	if h.config.Auth.Enabled {
+		identity, err := h.extractIdentity(r)
+		if err != nil {
+			h.respondError(w, r, http.StatusUnauthorized, "Invalid or missing identity", requestLogger)
+			return
+		}
+		orgID = h.getOrgID(identity)
+	}
+
+	// Statuses of other organizations are reported as missing
+	status, ok := h.statuses.Get(requestID)
+	if !ok || (h.config.Auth.Enabled && status.OrgID != orgID) {
+		h.respondError(w, r, http.StatusNotFound, "Upload status not found", requestLogger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		requestLogger.WithError(err).Error("Failed to encode status response")
+	}
+}
+
 // processUpload handles the core upload processing logic
-func (h *Handler) processUpload(ctx context.Context, file io.Reader, requestID string, identity *identity.Identity, logger *logrus.Entry) error {
+// It stores the payload's files and then publishes its events before returning
+func (h *Handler) processUpload(ctx context.Context, file io.Reader, requestID, manifestUUID string, identity *identity.Identity, logger *logrus.Entry) (*uploadEvents, error) {
+	events, err := h.storeUpload(ctx, file, requestID, manifestUUID, identity, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.publishEvents(ctx, events, logger); err != nil {
+		if !h.queueForRelay(events, err, logger) {
+			return nil, err
+		}
+		events.queued = true
+	}
+	return events, nil
+}
+
+// processUploadAsync stores the payload's files and publishes its events in the background
+// The request status is updated once publishing finishes
+func (h *Handler) processUploadAsync(ctx context.Context, file io.Reader, requestID, manifestUUID, orgID string, identity *identity.Identity, logger *logrus.Entry) (*uploadEvents, error) {
+	events, err := h.storeUpload(ctx, file, requestID, manifestUUID, identity, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Publishing outlives the request, so it must not be cancelled with it
+	publishCtx := context.WithoutCancel(ctx)
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		if err := h.publishEvents(publishCtx, events, logger); err != nil {
+			if h.queueForRelay(events, err, logger) {
+				h.statuses.Set(requestID, orgID, StatusQueued, "")
+				return
+			}
+			h.statuses.Set(requestID, orgID, StatusFailed, err.Error())
+			logger.WithError(err).Error("Background event publishing failed")
+			return
+		}
+		h.statuses.Set(requestID, orgID, StatusSucceeded, "")
+	}()
+
+	return events, nil
+}
+
+// queueForRelay reports whether events that failed to publish with err are left to the outbox relay
+// The upload is then accepted, since its events will be published. Events too large for Kafka can
+// never be published, so their entry is removed and the upload fails
+func (h *Handler) queueForRelay(events *uploadEvents, err error, logger *logrus.Entry) bool {
+	if h.outbox == nil {
+		return false
+	}
+	if errors.Is(err, messaging.ErrMessageTooLarge) {
+		if err := h.outbox.Done(events.requestID); err != nil {
+			logger.WithError(err).Warn("Failed to remove the outbox entry of unpublishable events")
+		}
+		return false
+	}
+	logger.WithError(err).Warn("Failed to publish events, leaving them to the outbox relay")
+	return true
+}
+
+// uploadEvents are the messages to publish for a stored upload
+type uploadEvents struct {
+	requestID string
+	ros       *messaging.ROSMessage
+	// usage is only set when usage files were forwarded
+	usage *messaging.ROSMessage
+	// queued is set when publishing failed and the outbox relay publishes the events
+	queued bool
+}
+
+// files lists the files the events announce
+func (e *uploadEvents) files() []UploadedFile {
+	var files []UploadedFile
+	for _, key := range e.ros.ObjectKeys {
+		files = append(files, UploadedFile{ObjectKey: key, Kind: "ros"})
+	}
+	if e.usage != nil {
+		for _, key := range e.usage.ObjectKeys {
+			files = append(files, UploadedFile{ObjectKey: key, Kind: "usage"})
+		}
+	}
+	return files
+}
+
+// storeUpload extracts the payload and uploads its files to storage
+// It returns the events announcing the stored files, ready to publish. A non-empty manifestUUID
+// must match the uuid of the payload's manifest
+func (h *Handler) storeUpload(ctx context.Context, file io.Reader, requestID, manifestUUID string, identity *identity.Identity, logger *logrus.Entry) (*uploadEvents, error) {
+	// Without an identity the files would be stored and announced under the "unknown" org
+	if identity == nil && h.config.Auth.Enabled {
+		return nil, ErrMissingIdentity
+	}
+
+	// Record when the ingress took the upload in, so downstream can tell it apart from the report date
+	ingestedAt := h.now().UTC()
+
+	// Wait for an extraction slot so concurrent extractions can't saturate CPU/disk
+	// The slot goes back to the limiter it came from even if the limit is reloaded meanwhile
+	extractions := h.extractionLimiter()
+	if err := extractions.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("failed to acquire extraction slot: %w", err)
+	}
+
 	// Extract payload
-	extractedPayload, err := h.payloadExtractor.ExtractPayload(file, requestID)
+	extractedPayload, err := h.payloadExtractor.ExtractPayload(ctx, file, requestID)
+	extractions.release()
 	if err != nil {
-		return fmt.Errorf("failed to extract payload: %w", err)
+		return nil, fmt.Errorf("failed to extract payload: %w", err)
 	}
+	// The extracted files of a failed upload may be kept for debugging
+	failed := true
 	defer func() {
+		if failed {
+			h.payloadExtractor.discardFailed(extractedPayload.TempDir)
+			return
+		}
 		if err := extractedPayload.Cleanup(); err != nil {
 			logger.WithError(err).Warn("Failed to cleanup extracted payload")
 		}
 	}()
 
+	if manifestUUID != "" && !strings.EqualFold(manifestUUID, extractedPayload.Manifest.UUID) {
+		return nil, invalidPayload("manifest uuid %q does not match the %s header %q", extractedPayload.Manifest.UUID, manifestUUIDHeader, manifestUUID)
+	}
+
 	// Validate that we have ROS files to process
 	if len(extractedPayload.ROSFiles) == 0 {
-		return fmt.Errorf("no ROS files found in payload")
+		return nil, fmt.Errorf("no ROS files found in payload")
 	}
 
 	logger.WithField("ros_files_count", len(extractedPayload.ROSFiles)).Info("Found ROS files in payload")
 
+	// Refuse uncertified payloads before anything is stored
+	if h.config.Upload.RequireCertified && !extractedPayload.Manifest.Certified {
+		return nil, ErrUncertified
+	}
+
+	// Bound the storage and downstream processing cost of a single upload
+	if err := h.checkROSBytes(extractedPayload.ROSFiles); err != nil {
+		return nil, err
+	}
+
+	// Uploads of the same cluster and date write the same object keys
+	release, err := h.acquireClusterPartition(ctx, extractedPayload, identity, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	certified := extractedPayload.Manifest.Certified
+	health.UploadsByCertificationTotal.WithLabelValues(strconv.FormatBool(certified)).Inc()
+
 	// Upload ROS files to storage and collect URLs
+	var checksums map[string]string
+	if h.config.Storage.WriteChecksumManifest {
+		checksums = make(map[string]string, len(extractedPayload.ROSFiles))
+	}
+	uploadedFiles, objectKeys, err := h.uploadFiles(ctx, extractedPayload.ROSFiles, h.rosPathPrefix(certified), extractedPayload, requestID, ingestedAt, identity, checksums, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	b64Identity, err := h.eventIdentity(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+	events := &uploadEvents{
+		requestID: requestID,
+		ros:       h.buildROSMessage(requestID, b64Identity, extractedPayload.Manifest, identity, ingestedAt, uploadedFiles, objectKeys),
+	}
+	events.ros.Metadata.OrgMetadata = h.enricher.lookup(ctx, events.ros.Metadata.OrgID, logger)
+
+	// Write the checksum sidecar once every ROS file is stored, so it only lists complete objects
+	if checksums != nil {
+		if err := h.writeChecksumManifest(ctx, events.ros, checksums, extractedPayload, identity, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// Forward usage files when enabled
+	if h.config.Upload.ForwardUsageFiles && len(extractedPayload.UsageFiles) > 0 {
+		events.usage, err = h.storeUsageFiles(ctx, extractedPayload, events.ros, identity, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the events durably before publishing them, so stored files are announced even if publishing never happens
+	if h.outbox != nil {
+		entry := outbox.NewRecord(requestID, events.ros, events.usage, identity, h.now().UTC())
+		if err := h.outbox.Add(entry); err != nil {
+			return nil, fmt.Errorf("failed to write outbox entry: %w", err)
+		}
+	}
+
+	failed = false
+	return events, nil
+}
+
+// checkROSBytes returns an error wrapping ErrROSBytesExceeded when the ROS files together exceed the configured maximum
+func (h *Handler) checkROSBytes(rosFiles map[string]string) error {
+	limit := h.config.Upload.MaxTotalROSBytes
+	if limit <= 0 {
+		return nil
+	}
+
+	var total int64
+	for fileName, filePath := range rosFiles {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to stat file %s: %w", fileName, err)
+		}
+		total += info.Size()
+	}
+	if total > limit {
+		return fmt.Errorf("%w: %d bytes in %d files, maximum is %d", ErrROSBytesExceeded, total, len(rosFiles), limit)
+	}
+	return nil
+}
+
+// acquireClusterPartition registers the upload with the other uploads in flight for its cluster and date
+// Depending on the configured cluster concurrency it waits for them, or logs that the last writer wins
+func (h *Handler) acquireClusterPartition(ctx context.Context, extractedPayload *ExtractedPayload, identity *identity.Identity, logger *logrus.Entry) (func(), error) {
+	schema, err := h.getSchemaName(identity)
+	if err != nil {
+		return nil, err
+	}
+	clusterID := extractedPayload.Manifest.ClusterID
+	date := h.partitionDate(extractedPayload.Manifest.Date)
+	key := path.Join(schema, clusterID, date)
+
+	partitionLogger := logger.WithFields(logrus.Fields{
+		"cluster_id": clusterID,
+		"date":       date,
+	})
+	release, contended, err := h.clusterUploads.acquire(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for concurrent upload of cluster %s: %w", clusterID, err)
+	}
+	if contended {
+		if h.clusterUploads.serialize {
+			partitionLogger.Info("Waited for a concurrent upload of the same cluster and date")
+		} else {
+			partitionLogger.Warn("Concurrent upload of the same cluster and date, the last writer wins")
+		}
+	}
+	return release, nil
+}
+
+// publishEvents sends the ROS event, the usage event if any, and the validation confirmation
+func (h *Handler) publishEvents(ctx context.Context, events *uploadEvents, logger *logrus.Entry) error {
+	if err := h.messagingClient.SendROSEvent(ctx, events.ros); err != nil {
+		return fmt.Errorf("failed to send ROS event: %w", err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"topic":          h.config.Kafka.Topic,
+		"uploaded_files": len(events.ros.Files),
+		"certified":      events.ros.Metadata.Certified,
+	}).Info("Successfully sent ROS event message")
+
+	if events.usage != nil {
+		if err := h.messagingClient.SendUsageEvent(ctx, events.usage); err != nil {
+			return fmt.Errorf("failed to send usage event: %w", err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"topic":          h.config.Kafka.UsageTopic,
+			"uploaded_files": len(events.usage.Files),
+		}).Info("Successfully sent usage event message")
+	}
+
+	// Send validation confirmation
+	if err := h.messagingClient.SendValidationMessage(ctx, events.requestID, "success"); err != nil {
+		// Log error but don't fail the request
+		logger.WithError(err).Warn("Failed to send validation message")
+	}
+
+	// The relay publishes the entry again if this fails, events are delivered at least once
+	if h.outbox != nil {
+		if err := h.outbox.Done(events.requestID); err != nil {
+			logger.WithError(err).Warn("Failed to mark outbox entry done")
+		}
+	}
+
+	return nil
+}
+
+// uploadFiles uploads the given extracted files to storage and returns their presigned URLs and object keys
+// An empty pathPrefix uses the storage client's configured prefix. When checksums is not nil, the
+// hex SHA-256 of each uploaded file is recorded in it under the file's object key
+func (h *Handler) uploadFiles(ctx context.Context, files map[string]string, pathPrefix string, extractedPayload *ExtractedPayload, requestID string, ingestedAt time.Time, identity *identity.Identity, checksums map[string]string, logger *logrus.Entry) ([]string, []string, error) {
 	var uploadedFiles []string
 	var objectKeys []string
 
-	for fileName, filePath := range extractedPayload.ROSFiles {
-		// Open ROS file
-		rosFile, err := os.Open(filePath)
+	schema, err := h.getSchemaName(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for fileName, filePath := range files {
+		// Open file
+		file, err := os.Open(filePath)
 		if err != nil {
-			return fmt.Errorf("failed to open ROS file %s: %w", fileName, err)
+			return nil, nil, fmt.Errorf("failed to open file %s: %w", fileName, err)
 		}
 
 		// Get file info
-		fileInfo, err := rosFile.Stat()
+		fileInfo, err := file.Stat()
 		if err != nil {
-			if closeErr := rosFile.Close(); closeErr != nil {
-				logger.WithError(closeErr).Warn("Failed to close ROS file after stat error")
+			if closeErr := file.Close(); closeErr != nil {
+				logger.WithError(closeErr).Warn("Failed to close file after stat error")
 			}
-			return fmt.Errorf("failed to stat ROS file %s: %w", fileName, err)
+			return nil, nil, fmt.Errorf("failed to stat file %s: %w", fileName, err)
 		}
 
 		// Generate storage path
-		schema := h.getSchemaName(identity)
 		sourceID := extractedPayload.Manifest.ClusterID
-		date := extractedPayload.Manifest.Date.Format("2006-01-02")
+		date := h.partitionDate(extractedPayload.Manifest.Date)
 		uploadKey := h.storageClient.GenerateUploadPath(schema, sourceID, date, fileName)
 
+		// Skipping identical objects needs the checksum before anything is sent, otherwise
+		// hash the file as it streams to storage when checksums are requested
+		var data io.Reader = file
+		var digest string
+		hasher := sha256.New()
+		if h.config.Storage.OnConflict == storage.OnConflictSkipIdentical {
+			digest, err = fileSHA256(file)
+			if err != nil {
+				if closeErr := file.Close(); closeErr != nil {
+					logger.WithError(closeErr).Warn("Failed to close file after hash error")
+				}
+				return nil, nil, fmt.Errorf("failed to hash file %s: %w", fileName, err)
+			}
+		} else if checksums != nil {
+			data = io.TeeReader(file, hasher)
+		}
+
 		// Prepare upload request
 		uploadReq := &storage.UploadRequest{
 			Key:         uploadKey,
-			Data:        rosFile,
+			Data:        data,
 			Size:        fileInfo.Size(),
 			ContentType: "text/csv",
-			Metadata: map[string]string{
-				"ManifestId":      extractedPayload.Manifest.UUID,
-				"RequestId":       requestID,
-				"ClusterUuid":     extractedPayload.Manifest.ClusterID,
-				"OperatorVersion": extractedPayload.Manifest.OperatorVersion,
-			},
+			Metadata:    objectMetadata(extractedPayload.Manifest, requestID, ingestedAt),
+			PathPrefix:  pathPrefix,
+			SHA256:      digest,
 		}
 
 		// Upload to storage
 		uploadResult, err := h.storageClient.Upload(ctx, uploadReq)
-		if closeErr := rosFile.Close(); closeErr != nil {
-			logger.WithError(closeErr).Warn("Failed to close ROS file after upload")
+		if closeErr := file.Close(); closeErr != nil {
+			logger.WithError(closeErr).Warn("Failed to close file after upload")
 		}
 
 		if err != nil {
-			return fmt.Errorf("failed to upload ROS file %s: %w", fileName, err)
+			return nil, nil, fmt.Errorf("failed to upload file %s: %w", fileName, err)
 		}
 
 		uploadedFiles = append(uploadedFiles, uploadResult.PresignedURL)
 		objectKeys = append(objectKeys, uploadResult.Key)
+		if checksums != nil {
+			if digest == "" {
+				digest = hex.EncodeToString(hasher.Sum(nil))
+			}
+			checksums[uploadResult.Key] = digest
+		}
 
 		logger.WithFields(logrus.Fields{
 			"file_name": fileName,
 			"key":       uploadResult.Key,
 			"size":      uploadResult.Size,
-		}).Info("Successfully uploaded ROS file")
+			"reused":    uploadResult.Reused,
+		}).Info("Successfully uploaded file")
 	}
 
-	token, err := h.getOAuthTokenFromContext(ctx)
+	return uploadedFiles, objectKeys, nil
+}
+
+// storeUsageFiles uploads usage files under the usage prefix and returns the usage event announcing them
+// The event reuses the ROS message metadata so consumers can correlate both events
+func (h *Handler) storeUsageFiles(ctx context.Context, extractedPayload *ExtractedPayload, rosMessage *messaging.ROSMessage, identity *identity.Identity, logger *logrus.Entry) (*messaging.ROSMessage, error) {
+	usageFiles, usageKeys, err := h.uploadFiles(ctx, extractedPayload.UsageFiles, h.config.Storage.UsagePathPrefix, extractedPayload, rosMessage.RequestID, rosMessage.Metadata.IngestedAt, identity, nil, logger)
 	if err != nil {
-		return fmt.Errorf("failed to get OAuth token from context: %w", err)
+		return nil, fmt.Errorf("failed to upload usage files: %w", err)
+	}
+
+	return &messaging.ROSMessage{
+		RequestID:   rosMessage.RequestID,
+		B64Identity: rosMessage.B64Identity,
+		Metadata:    rosMessage.Metadata,
+		Files:       usageFiles,
+		ObjectKeys:  usageKeys,
+	}, nil
+}
+
+// objectMetadata builds the storage object metadata for an uploaded file
+func objectMetadata(manifest *Manifest, requestID string, ingestedAt time.Time) map[string]string {
+	return map[string]string{
+		"ManifestId":      manifest.UUID,
+		"RequestId":       requestID,
+		"ClusterUuid":     manifest.ClusterID,
+		"OperatorVersion": manifest.OperatorVersion,
+		"IngestedAt":      ingestedAt.Format(time.RFC3339),
 	}
-	// Send ROS event message
-	rosMessage := &messaging.ROSMessage{
+}
+
+// buildROSMessage builds the ROS event message for the uploaded files
+func (h *Handler) buildROSMessage(requestID, b64Identity string, manifest *Manifest, identity *identity.Identity, ingestedAt time.Time, files, objectKeys []string) *messaging.ROSMessage {
+	return &messaging.ROSMessage{
 		RequestID:   requestID,
-		B64Identity: token,
+		B64Identity: b64Identity,
 		Metadata: messaging.ROSMetadata{
 			Account:         h.getAccountID(identity),
 			OrgID:           h.getOrgID(identity),
-			SourceID:        extractedPayload.Manifest.ClusterID, // Using cluster ID as source ID
-			ProviderUUID:    extractedPayload.Manifest.ClusterID, // Using cluster ID as provider UUID
-			ClusterUUID:     extractedPayload.Manifest.ClusterID,
-			ClusterAlias:    h.getClusterAlias(extractedPayload.Manifest),
-			OperatorVersion: extractedPayload.Manifest.OperatorVersion,
+			SourceID:        h.getSourceID(manifest),
+			ProviderUUID:    h.getProviderUUID(manifest),
+			ClusterUUID:     manifest.ClusterID,
+			ClusterAlias:    h.getClusterAlias(manifest),
+			OperatorVersion: manifest.OperatorVersion,
+			Certified:       manifest.Certified,
+			IngestedAt:      ingestedAt,
 		},
-		Files:      uploadedFiles,
+		Files:      files,
 		ObjectKeys: objectKeys,
 	}
+}
 
-	if err := h.messagingClient.SendROSEvent(ctx, rosMessage); err != nil {
-		return fmt.Errorf("failed to send ROS event: %w", err)
-	}
-
-	logger.WithFields(logrus.Fields{
-		"topic":          h.config.Kafka.Topic,
-		"uploaded_files": len(uploadedFiles),
-	}).Info("Successfully sent ROS event message")
+// partitionLayouts are the date partition formats by configured granularity
+var partitionLayouts = map[string]string{
+	"hour":  "2006-01-02T15",
+	"day":   "2006-01-02",
+	"month": "2006-01",
+}
 
-	// Send validation confirmation
-	if err := h.messagingClient.SendValidationMessage(ctx, requestID, "success"); err != nil {
-		// Log error but don't fail the request
-		logger.WithError(err).Warn("Failed to send validation message")
+// partitionDate formats a manifest date for the storage date partition, at the configured granularity
+// Converting to the configured timezone keeps payloads from different offsets in consistent partitions
+func (h *Handler) partitionDate(date time.Time) string {
+	if h.partitionTZ != nil {
+		date = date.In(h.partitionTZ)
+	}
+	layout, ok := partitionLayouts[h.config.Storage.DateGranularity]
+	if !ok {
+		layout = partitionLayouts["day"]
 	}
+	return date.Format(layout)
+}
 
-	return nil
+// rosPathPrefix returns the storage prefix override for ROS files
+// An empty result keeps the storage client's configured prefix
+func (h *Handler) rosPathPrefix(certified bool) string {
+	if !certified {
+		return h.config.Storage.UncertifiedPathPrefix
+	}
+	return ""
 }
 
 // Helper methods
@@ -307,6 +1038,76 @@ func (h *Handler) getClusterAlias(manifest *Manifest) string {
 	return manifest.ClusterID
 }
 
+// getSourceID returns the manifest's source ID, falling back to the cluster ID for
+// operators that don't report one
+func (h *Handler) getSourceID(manifest *Manifest) string {
+	if manifest.SourceID != "" {
+		return manifest.SourceID
+	}
+	return manifest.ClusterID
+}
+
+// getProviderUUID returns the manifest's provider UUID, falling back to the cluster ID for
+// operators that don't report one
+func (h *Handler) getProviderUUID(manifest *Manifest) string {
+	if manifest.ProviderUUID != "" {
+		return manifest.ProviderUUID
+	}
+	return manifest.ClusterID
+}
+
+// exceedsDeclaredSize reports whether the declared Content-Length is larger than any accepted upload
+// The multipart envelope adds boundaries and part headers, so a small allowance is made on top of the file limit
+func (h *Handler) exceedsDeclaredSize(r *http.Request) bool {
+	return r.ContentLength > 0 && r.ContentLength > h.maxBodySize()
+}
+
+// maxBodySize returns the largest body any accepted upload can have once decoded
+func (h *Handler) maxBodySize() int64 {
+	maxSize := h.config.Upload.MaxUploadSize
+	for _, typeMaxSize := range h.config.Upload.MaxSizeByType {
+		maxSize = max(maxSize, typeMaxSize)
+	}
+	return maxSize + multipartOverheadAllowance
+}
+
+// responseVerbosity returns the upload response verbosity the client asked for, empty for the default
+// The verbosity query parameter takes precedence over a verbosity parameter on an Accept media type
+func responseVerbosity(r *http.Request) string {
+	if verbosity := r.URL.Query().Get("verbosity"); verbosity != "" {
+		return strings.ToLower(verbosity)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && params["verbosity"] != "" {
+			return strings.ToLower(params["verbosity"])
+		}
+	}
+	return ""
+}
+
+// isRawUpload reports whether the request body is the payload itself rather than a multipart form
+// Only requests that aren't multipart are raw, and only when raw bodies are accepted
+func (h *Handler) isRawUpload(r *http.Request) bool {
+	if !h.config.Upload.AcceptRawBody {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err != nil || !strings.HasPrefix(mediaType, "multipart/")
+}
+
+// maxUploadSize returns the size limit for a file of the given content type
+// Types without their own limit use the global one, parameters such as charset are ignored
+func (h *Handler) maxUploadSize(contentType string) int64 {
+	mediaType := mediaType(contentType)
+	for limitType, maxSize := range h.config.Upload.MaxSizeByType {
+		if strings.EqualFold(limitType, mediaType) {
+			return maxSize
+		}
+	}
+	return h.config.Upload.MaxUploadSize
+}
+
 func (h *Handler) isTestRequest(r *http.Request) bool {
 	// Check form data for test request
 	if r.FormValue("test") == "test" {
@@ -341,10 +1142,36 @@ func (h *Handler) handleTestRequest(w http.ResponseWriter, _ *http.Request, requ
 }
 
 func (h *Handler) extractIdentity(r *http.Request) (*identity.Identity, error) {
+	derived, err := h.resolveIdentity(r)
+	if err != nil || derived == nil {
+		return nil, err
+	}
+	return derived.identity, nil
+}
+
+// resolveIdentity returns the request's identity along with how it was derived
+// A user rejected for lacking an org ID still returns its derivation with the error, so the failure can be counted
+func (h *Handler) resolveIdentity(r *http.Request) (*derivedIdentity, error) {
 	if !h.config.Auth.Enabled {
 		return nil, nil
 	}
 
+	// A trusted proxy has already authenticated the request and resolved its identity
+	if h.config.Auth.TrustRHIdentity {
+		if header := r.Header.Get(auth.RHIdentityHeader); header != "" {
+			id, err := h.decodeRHIdentity(header)
+			if err != nil {
+				return nil, err
+			}
+			return &derivedIdentity{
+				identity:          id,
+				source:            auth.SourceRHIdentity,
+				orgDerivation:     derivedFromHeader,
+				accountDerivation: derivedFromHeader,
+			}, nil
+		}
+	}
+
 	// Get authenticated user from request context (set by auth middleware)
 	user, err := h.getAuthenticatedUserFromContext(r.Context())
 	if err != nil {
@@ -356,8 +1183,86 @@ func (h *Handler) extractIdentity(r *http.Request) (*identity.Identity, error) {
 		"uid":  user.UID,
 	}).Debug("Retrieved authenticated user from context")
 
-	// Create identity from OAuth2 user information
-	return h.createIdentityFromOAuth2User(user), nil
+	// Create identity from OAuth2 user information, reusing the identity derived for the same token
+	// The middleware has already validated the token for this request, without one there's nothing to key the cache by
+	derive := func() *derivedIdentity {
+		return h.deriveIdentity(user)
+	}
+	var derived *derivedIdentity
+	if token, err := h.getOAuthTokenFromContext(r.Context()); err == nil && token != "" {
+		derived = h.identities.getOrDerive(token, derive)
+	} else {
+		derived = derive()
+	}
+	derived.source = auth.IdentitySource(r.Context())
+
+	// In strict mode users without an org get no fallback and aren't authenticated
+	if h.config.Auth.RequireOrgID && derived.identity.OrgID == "" {
+		return derived, fmt.Errorf("no org ID found for user %s", user.Username)
+	}
+	return derived, nil
+}
+
+// decodeRHIdentity decodes a base64 encoded x-rh-identity header
+func (h *Handler) decodeRHIdentity(header string) (*identity.Identity, error) {
+	decoded, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s header: %w", auth.RHIdentityHeader, err)
+	}
+
+	var xrhid identity.XRHID
+	if err := json.Unmarshal(decoded, &xrhid); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s header: %w", auth.RHIdentityHeader, err)
+	}
+	if xrhid.Identity.OrgID == "" {
+		return nil, fmt.Errorf("%s header carries no org ID", auth.RHIdentityHeader)
+	}
+	return &xrhid.Identity, nil
+}
+
+// countIdentityDerivation counts how the org ID and account number of an upload's identity were derived
+// It runs once per upload rather than where identities are derived, so identities reused from the identity
+// cache still count and the lookups of status, preflight and internal requests don't
+func (h *Handler) countIdentityDerivation(derived *derivedIdentity) {
+	if derived == nil {
+		return
+	}
+	// Frequent default derivations point at clients missing their org or account claims
+	health.IdentityDerivationsTotal.WithLabelValues(derived.source, "org", derived.orgDerivation).Inc()
+	health.IdentityDerivationsTotal.WithLabelValues(derived.source, "account", derived.accountDerivation).Inc()
+}
+
+// eventIdentity returns the uploader's identity carried by upload events, the caller's OAuth token, or
+// with the rh-identity format the resolved identity encoded as an x-rh-identity header
+func (h *Handler) eventIdentity(ctx context.Context, id *identity.Identity) (string, error) {
+	if h.config.Kafka.IdentityFormat == config.IdentityFormatRHIdentity && id != nil {
+		return encodeRHIdentity(id)
+	}
+
+	token, err := h.getOAuthTokenFromContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get OAuth token from context: %w", err)
+	}
+	return token, nil
+}
+
+// RelayedEventIdentity returns the identity carried by events relayed from the outbox
+// Tokens are never written to the outbox, so only the rh-identity format can be rebuilt,
+// events in the token format are relayed without an identity
+func (h *Handler) RelayedEventIdentity(id *identity.Identity) (string, error) {
+	if h.config.Kafka.IdentityFormat == config.IdentityFormatRHIdentity && id != nil {
+		return encodeRHIdentity(id)
+	}
+	return "", nil
+}
+
+// encodeRHIdentity encodes an identity as a base64 encoded x-rh-identity header
+func encodeRHIdentity(id *identity.Identity) (string, error) {
+	encoded, err := json.Marshal(identity.XRHID{Identity: *id})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s header: %w", auth.RHIdentityHeader, err)
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
 }
 
 // getAuthenticatedUserFromContext retrieves the authenticated user from request context
@@ -393,11 +1298,22 @@ func (h *Handler) getOAuthTokenFromContext(ctx context.Context) (string, error)
 // createIdentityFromOAuth2User creates an identity from OAuth2/Kubernetes user information
 // This supports tokens issued by Keycloak or Kubernetes API server
 func (h *Handler) createIdentityFromOAuth2User(user *authenticationv1.UserInfo) *identity.Identity {
+	return h.deriveIdentity(user).identity
+}
+
+// deriveIdentity creates an identity from OAuth2 user information along with how its IDs were derived
+func (h *Handler) deriveIdentity(user *authenticationv1.UserInfo) *derivedIdentity {
 	// Extract organization ID and account number from user information
 	// Adjust these extraction methods based on your OAuth2 provider (Keycloak/K8s API)
 
-	orgID := h.extractOrgIDFromUser(user)
-	accountNumber := h.extractAccountNumberFromUser(user)
+	orgID, orgDerivation := h.extractOrgIDFromUser(user)
+	accountNumber, accountDerivation := h.extractAccountNumberFromUser(user)
+
+	// Downstream consumers may need an email even when the provider has no such claim
+	email := h.extractEmailFromUser(user)
+	if email == "" && h.config.Auth.SynthesizeEmail {
+		email = synthesizeEmail(user.Username, orgID)
+	}
 
 	// Determine token type based on username pattern
 	tokenType := "User"
@@ -405,80 +1321,189 @@ func (h *Handler) createIdentityFromOAuth2User(user *authenticationv1.UserInfo)
 		tokenType = "ServiceAccount"
 	}
 
-	return &identity.Identity{
-		AccountNumber: accountNumber,
-		OrgID:         orgID,
-		Type:          tokenType,
-		AuthType:      "oauth2",
-		User: &identity.User{
-			Username:  user.Username,
-			Email:     h.extractEmailFromUser(user),
-			FirstName: h.extractFirstNameFromUser(user),
-			LastName:  h.extractLastNameFromUser(user),
-			Active:    true,
-			OrgAdmin:  h.isOrgAdminUser(user),
-			Internal:  h.isInternalUser(user),
-			Locale:    "en_US",
-		},
-		Internal: identity.Internal{
-			OrgID: orgID,
+	return &derivedIdentity{
+		identity: &identity.Identity{
+			AccountNumber: accountNumber,
+			OrgID:         orgID,
+			Type:          tokenType,
+			AuthType:      "oauth2",
+			User: &identity.User{
+				Username:  user.Username,
+				Email:     email,
+				FirstName: h.extractFirstNameFromUser(user),
+				LastName:  h.extractLastNameFromUser(user),
+				Active:    true,
+				OrgAdmin:  h.isOrgAdminUser(user),
+				Internal:  h.isInternalUser(user),
+				Locale:    "en_US",
+			},
+			Internal: identity.Internal{
+				OrgID: orgID,
+			},
 		},
+		orgDerivation:     orgDerivation,
+		accountDerivation: accountDerivation,
 	}
 }
 
+// How an org ID or account number was derived from a user
+const (
+	derivedFromGroup   = "group"
+	derivedFromExtra   = "extra"
+	derivedFromDefault = "default"
+	derivedFromHeader  = "header"
+	// derivedNone is an org ID that wasn't found and has no fallback in strict mode
+	derivedNone = "none"
+)
+
 // Helper methods to extract information from OAuth2 user
 // Customize these based on your OAuth2 provider (Keycloak, Kubernetes API, etc.)
 
-func (h *Handler) extractOrgIDFromUser(user *authenticationv1.UserInfo) string {
+// extractOrgIDFromUser returns the user's org ID and how it was derived
+func (h *Handler) extractOrgIDFromUser(user *authenticationv1.UserInfo) (string, string) {
 	// Look for org ID in user groups (common in Keycloak/K8s RBAC)
+	prefix := h.config.Auth.OrgGroupPrefix
+	if prefix == "" {
+		prefix = config.DefaultOrgGroupPrefix
+	}
 	for _, group := range user.Groups {
-		if strings.HasPrefix(group, "org:") {
-			orgID := strings.TrimPrefix(group, "org:")
+		if strings.HasPrefix(group, prefix) {
+			orgID := strings.TrimPrefix(group, prefix)
 			if orgID != "" { // Skip empty org IDs
-				return orgID
+				return orgID, derivedFromGroup
 			}
 		}
 	}
 
 	// Check extra fields (Keycloak custom claims, K8s annotations)
-	if orgIDExtra, exists := user.Extra["org_id"]; exists && len(orgIDExtra) > 0 {
-		return orgIDExtra[0]
+	keys := h.config.Auth.OrgClaimKeys
+	if len(keys) == 0 {
+		keys = config.DefaultOrgClaimKeys()
+	}
+	if orgID, ok := firstClaim(user.Extra, keys); ok {
+		return normalizeID(orgID), derivedFromExtra
 	}
 
 	// For Keycloak, you might also check:
 	// - user.Extra["organization"]
 	// - user.Extra["tenant_id"]
 
-	// Default fallback - consider making this configurable
-	return "1"
+	// Strict mode leaves the org empty so the user is rejected
+	if h.config.Auth.RequireOrgID {
+		return "", derivedNone
+	}
+	return h.config.Auth.DefaultOrgID, derivedFromDefault
 }
 
-func (h *Handler) extractAccountNumberFromUser(user *authenticationv1.UserInfo) string {
-	// Check extra fields (Keycloak custom claims, K8s annotations)
-	if accountExtra, exists := user.Extra["account_number"]; exists && len(accountExtra) > 0 {
-		return accountExtra[0]
+// extractAccountNumberFromUser returns the user's account number and how it was derived
+func (h *Handler) extractAccountNumberFromUser(user *authenticationv1.UserInfo) (string, string) {
+	// A configured claim path wins over the built-in fields
+	if path := h.config.Auth.AccountClaimPath; path != "" {
+		if account, ok := claimAtPath(user.Extra, path); ok {
+			return normalizeID(account), derivedFromExtra
+		}
 	}
 
-	// Check for Keycloak alternative fields
-	if customerIDExtra, exists := user.Extra["customer_id"]; exists && len(customerIDExtra) > 0 {
-		return customerIDExtra[0]
+	// Check extra fields (Keycloak custom claims, K8s annotations)
+	keys := h.config.Auth.AccountClaimKeys
+	if len(keys) == 0 {
+		keys = config.DefaultAccountClaimKeys()
 	}
-
-	if clientIDExtra, exists := user.Extra["client_id"]; exists && len(clientIDExtra) > 0 {
-		return clientIDExtra[0]
+	if account, ok := firstClaim(user.Extra, keys); ok {
+		return normalizeID(account), derivedFromExtra
 	}
 
 	// Look for account in user groups (RBAC mapping)
+	prefix := h.config.Auth.AccountGroupPrefix
+	if prefix == "" {
+		prefix = config.DefaultAccountGroupPrefix
+	}
 	for _, group := range user.Groups {
-		if strings.HasPrefix(group, "account:") {
-			return strings.TrimPrefix(group, "account:")
+		if strings.HasPrefix(group, prefix) {
+			return strings.TrimPrefix(group, prefix), derivedFromGroup
 		}
 	}
 
 	// Could also parse from username (e.g., "user@account123") if needed
 
-	// Default fallback - consider making this configurable
-	return "1"
+	return h.config.Auth.DefaultAccount, derivedFromDefault
+}
+
+// firstClaim returns the value of the first of keys present in the identity's extra fields
+func firstClaim(extra map[string]authenticationv1.ExtraValue, keys []string) (string, bool) {
+	for _, key := range keys {
+		if value, exists := extra[key]; exists && len(value) > 0 {
+			return value[0], true
+		}
+	}
+	return "", false
+}
+
+// claimAtPath resolves a dotted claim path against the identity's extra fields
+// Authenticators either flatten nested claims into a single key ("realm_access.account") or pass the
+// top-level claim through as a JSON document ("realm_access" -> {"account": ...}), both forms are accepted
+func claimAtPath(extra map[string]authenticationv1.ExtraValue, path string) (string, bool) {
+	if value, exists := extra[path]; exists && len(value) > 0 {
+		return value[0], value[0] != ""
+	}
+
+	// Try the longest extra key first, so partially flattened claims win over their parent document
+	for i := strings.LastIndex(path, "."); i > 0; i = strings.LastIndex(path[:i], ".") {
+		value, exists := extra[path[:i]]
+		if !exists || len(value) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(value[0]))
+		decoder.UseNumber()
+		var claim interface{}
+		if err := decoder.Decode(&claim); err != nil {
+			continue
+		}
+		if account, ok := walkClaim(claim, strings.Split(path[i+1:], ".")); ok {
+			return account, true
+		}
+	}
+	return "", false
+}
+
+// walkClaim follows segments through a decoded JSON claim down to a string or number leaf
+func walkClaim(claim interface{}, segments []string) (string, bool) {
+	for _, segment := range segments {
+		object, ok := claim.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if claim, ok = object[segment]; !ok {
+			return "", false
+		}
+	}
+
+	switch leaf := claim.(type) {
+	case string:
+		return leaf, leaf != ""
+	case json.Number:
+		return leaf.String(), true
+	default:
+		return "", false
+	}
+}
+
+// normalizeID keeps org/account IDs as exact strings
+// Providers that serialize numeric claims as JSON numbers may hand us values such as
+// "1.2345e+06" or "12345.0", these are expanded to their integer digits without going through float64
+func normalizeID(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.ContainsAny(value, ".eE") {
+		return value
+	}
+
+	number, ok := new(big.Float).SetPrec(256).SetString(value)
+	if !ok || !number.IsInt() {
+		return value
+	}
+	integer, _ := number.Int(nil)
+	return integer.String()
 }
 
 func (h *Handler) extractEmailFromUser(user *authenticationv1.UserInfo) string {
@@ -488,6 +1513,22 @@ func (h *Handler) extractEmailFromUser(user *authenticationv1.UserInfo) string {
 	return ""
 }
 
+// synthesizeEmail returns a placeholder email for users without an email claim
+// It is stable for a username and org, and uses the reserved .invalid domain so it can never be delivered.
+// Characters not allowed in an unquoted local part (e.g. the colons of service account names) become dashes
+func synthesizeEmail(username, orgID string) string {
+	if username == "" {
+		return ""
+	}
+	localPart := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || strings.ContainsRune(".-_+", r) {
+			return r
+		}
+		return '-'
+	}, username)
+	return fmt.Sprintf("%s@org-%s.invalid", localPart, orgID)
+}
+
 func (h *Handler) extractFirstNameFromUser(user *authenticationv1.UserInfo) string {
 	if firstNameExtra, exists := user.Extra["first_name"]; exists && len(firstNameExtra) > 0 {
 		return firstNameExtra[0]
@@ -502,7 +1543,16 @@ func (h *Handler) extractLastNameFromUser(user *authenticationv1.UserInfo) strin
 	return ""
 }
 
+// IsInternalRequest reports whether the request was made by an internal user
+func (h *Handler) IsInternalRequest(r *http.Request) bool {
+	identity, err := h.extractIdentity(r)
+	return err == nil && identity != nil && identity.User != nil && identity.User.Internal
+}
+
 func (h *Handler) isOrgAdminUser(user *authenticationv1.UserInfo) bool {
+	if len(h.config.Auth.AdminGroups) > 0 {
+		return hasMatchingGroup(user.Groups, h.config.Auth.AdminGroups)
+	}
 	for _, group := range user.Groups {
 		if group == "org-admin" || strings.Contains(group, "admin") {
 			return true
@@ -512,6 +1562,9 @@ func (h *Handler) isOrgAdminUser(user *authenticationv1.UserInfo) bool {
 }
 
 func (h *Handler) isInternalUser(user *authenticationv1.UserInfo) bool {
+	if len(h.config.Auth.InternalGroups) > 0 {
+		return hasMatchingGroup(user.Groups, h.config.Auth.InternalGroups)
+	}
 	for _, group := range user.Groups {
 		if group == "internal" || strings.Contains(group, "redhat") {
 			return true
@@ -520,6 +1573,18 @@ func (h *Handler) isInternalUser(user *authenticationv1.UserInfo) bool {
 	return false
 }
 
+// hasMatchingGroup reports whether any of the groups matches one of the path.Match patterns
+func hasMatchingGroup(groups, patterns []string) bool {
+	for _, group := range groups {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, group); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (h *Handler) getFileFromRequest(r *http.Request) (io.ReadCloser, *multipart.FileHeader, error) {
 	// Try "file" field first, then "upload" field
 	file, fileHeader, err := r.FormFile("file")
@@ -536,8 +1601,10 @@ func (h *Handler) getFileFromRequest(r *http.Request) (io.ReadCloser, *multipart
 }
 
 func (h *Handler) isValidContentType(contentType string) bool {
+	// Parameters such as a charset don't change the type of the payload
+	mediaType := mediaType(contentType)
 	for _, allowedType := range h.config.Upload.AllowedTypes {
-		if contentType == allowedType {
+		if strings.EqualFold(mediaType, allowedType) {
 			return true
 		}
 	}
@@ -553,11 +1620,170 @@ func (h *Handler) isValidContentType(contentType string) bool {
 	return vndPattern.MatchString(contentType)
 }
 
-func (h *Handler) getSchemaName(identity *identity.Identity) string {
-	if identity != nil && identity.OrgID != "" {
-		return fmt.Sprintf("org_%s", identity.OrgID)
+// mediaType returns contentType without its parameters, or contentType itself if it doesn't parse
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
+
+// authorizeIdentity checks that an identity may upload
+// It returns the status and message to reject the request with, or a zero status if the identity is accepted
+func (h *Handler) authorizeIdentity(identity *identity.Identity) (int, string) {
+	// Reject identities whose IDs downstream schemas can't handle
+	if h.config.Auth.RequireNumericIDs {
+		if field := nonNumericIDField(identity); field != "" {
+			return http.StatusUnprocessableEntity, fmt.Sprintf("Identity %s must be numeric", field)
+		}
+	}
+
+	// Uploads attributed to the fallback org would be mixed with every other misconfigured client's
+	if h.config.Auth.RejectDefaultOrg && h.usesDefaultOrg(identity) {
+		health.UploadsRejectedTotal.WithLabelValues("default_org").Inc()
+		h.logger.WithField("org_id", identity.OrgID).Warn("Rejecting identity resolved to the default org or account")
+		return http.StatusUnprocessableEntity, "Token lacks org_id or account_number claims, uploads can't be attributed to an organization"
+	}
+
+	// Downstream flows that need an email can't take identities without one
+	if h.config.Auth.RequireEmail && (identity.User == nil || identity.User.Email == "") {
+		return http.StatusUnprocessableEntity, "Identity must carry an email"
+	}
+
+	// Identities without an org must map to a schema, or be refused before their payload is sent
+	if _, err := h.getSchemaName(identity); err != nil {
+		return http.StatusUnprocessableEntity, "Identity must carry an org_id"
+	}
+
+	// Denied organizations are refused whatever the allow list says
+	if slices.Contains(h.config.Auth.DeniedOrgs, identity.OrgID) {
+		health.UploadsRejectedTotal.WithLabelValues("org_denied").Inc()
+		h.logger.WithField("org_id", identity.OrgID).Warn("Rejecting organization on the deny list")
+		return http.StatusForbidden, "Organization is not allowed to upload"
+	}
+
+	// An empty allow list accepts every organization
+	if allowedOrgs := h.allowedOrgs(); len(allowedOrgs) > 0 && !slices.Contains(allowedOrgs, identity.OrgID) {
+		health.UploadsRejectedTotal.WithLabelValues("org_not_allowed").Inc()
+		h.logger.WithField("org_id", identity.OrgID).Warn("Rejecting organization missing from the allow list")
+		return http.StatusForbidden, "Organization is not allowed to upload"
+	}
+
+	return 0, ""
+}
+
+// usesDefaultOrg reports whether identity's org ID or account number is the configured fallback
+// Empty fallbacks are left to the empty org schema handling
+func (h *Handler) usesDefaultOrg(identity *identity.Identity) bool {
+	if defaultOrgID := h.config.Auth.DefaultOrgID; defaultOrgID != "" && identity.OrgID == defaultOrgID {
+		return true
 	}
-	return "default"
+	defaultAccount := h.config.Auth.DefaultAccount
+	return defaultAccount != "" && identity.AccountNumber == defaultAccount
+}
+
+// ExtractionDirs returns the number of payload extraction directories currently on disk
+// Directories left behind once uploads are idle have leaked
+func (h *Handler) ExtractionDirs() int {
+	return h.payloadExtractor.countExtractionDirs()
+}
+
+// SetOutbox makes uploads keep their events in store until they are published
+// It must be called before requests are served
+func (h *Handler) SetOutbox(store outbox.Store) {
+	h.outbox = store
+}
+
+// SetFeatureFlags makes the handler consult flags, until then it uses the default of every flag
+// It must be called before requests are served
+func (h *Handler) SetFeatureFlags(flags *features.Flags) {
+	h.flags = flags
+}
+
+// defaultFlags returns the flags at their defaults, for handlers never given the environment's flags
+// features.New only fails on environment values, and none are given
+func defaultFlags(log *logrus.Logger) *features.Flags {
+	flags, _ := features.New(features.Defaults, nil, log)
+	return flags
+}
+
+// SetAllowedOrgs replaces the organizations allowed to upload, an empty list accepts every organization
+// It is safe to call while requests are being served
+func (h *Handler) SetAllowedOrgs(orgs []string) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	h.config.Auth.AllowedOrgs = orgs
+}
+
+func (h *Handler) allowedOrgs() []string {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	return h.config.Auth.AllowedOrgs
+}
+
+// SetMaxConcurrentExtractions replaces the limit on concurrent extractions, 0 removes the limit
+// It is safe to call while requests are being served. Extractions already running finish under the
+// previous limit, so until they do the total can briefly exceed a lowered one
+func (h *Handler) SetMaxConcurrentExtractions(maxConcurrent int) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	h.config.Upload.MaxConcurrentExtractions = maxConcurrent
+	h.extractions = newExtractionLimiter(maxConcurrent, time.Duration(h.config.Upload.ExtractionQueueTimeout)*time.Second)
+}
+
+func (h *Handler) extractionLimiter() *extractionLimiter {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	return h.extractions
+}
+
+// nonNumericIDField returns the name of the first identity ID that isn't numeric, or "" if all are
+// An empty account number is allowed since not every identity carries one
+func nonNumericIDField(identity *identity.Identity) string {
+	if !isNumeric(identity.OrgID) {
+		return "org_id"
+	}
+	if identity.AccountNumber != "" && !isNumeric(identity.AccountNumber) {
+		return "account_number"
+	}
+	return ""
+}
+
+// isNumeric reports whether value is a non-empty string of ASCII digits
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// getSchemaName returns the storage schema for an identity
+// Identities without an org ID are handled according to the configured empty org schema mode,
+// and an error wrapping ErrNoSchema is returned when no schema may be derived
+func (h *Handler) getSchemaName(identity *identity.Identity) (string, error) {
+	if orgID := identityOrgID(identity); orgID != "" {
+		return fmt.Sprintf("org_%s", orgID), nil
+	}
+
+	switch h.config.Upload.EmptyOrgSchema {
+	case emptyOrgSchemaReject:
+		return "", fmt.Errorf("%w: identity has no org ID", ErrNoSchema)
+	case emptyOrgSchemaAccount:
+		if identity == nil || identity.AccountNumber == "" {
+			return "", fmt.Errorf("%w: identity has neither an org ID nor an account number", ErrNoSchema)
+		}
+		return fmt.Sprintf("acct_%s", identity.AccountNumber), nil
+	}
+	if h.config.Upload.DefaultSchema != "" {
+		return h.config.Upload.DefaultSchema, nil
+	}
+	return "default", nil
 }
 
 func (h *Handler) getAccountID(identity *identity.Identity) string {
@@ -569,16 +1795,53 @@ func (h *Handler) getAccountID(identity *identity.Identity) string {
 
 func (h *Handler) getOrgID(identity *identity.Identity) string {
 	if identity != nil {
-		if identity.OrgID == "" {
-			return identity.Internal.OrgID
-		}
-		return identity.OrgID
+		return identityOrgID(identity)
 	}
 	return "unknown"
 }
 
-func (h *Handler) respondError(w http.ResponseWriter, statusCode int, message string, logger *logrus.Entry) {
-	health.HTTPRequestsTotal.WithLabelValues("POST", "/upload", strconv.Itoa(statusCode)).Inc()
+// identityOrgID returns the org ID of an identity, falling back to its internal org ID
+// The storage schema and the event metadata both derive from it so they never disagree
+func identityOrgID(identity *identity.Identity) string {
+	if identity == nil {
+		return ""
+	}
+	if identity.OrgID == "" {
+		return identity.Internal.OrgID
+	}
+	return identity.OrgID
+}
+
+// isClientDisconnect reports whether err stems from the client going away mid-request,
+// either by closing the connection before the body was complete or by cancelling the request
+func isClientDisconnect(r *http.Request, err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// handleClientDisconnect records an abandoned upload without the error logging of a failed one
+// The client is usually gone, so the response is only a best effort
+func (h *Handler) handleClientDisconnect(w http.ResponseWriter, r *http.Request, err error, logger *logrus.Entry) {
+	health.ClientDisconnectsTotal.Inc()
+	health.HTTPRequestsTotal.WithLabelValues(r.Method, requestEndpoint(r), strconv.Itoa(http.StatusBadRequest)).Inc()
+	logger.WithError(err).Debug("Client disconnected before the upload completed")
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+// requestEndpoint returns the endpoint label of r's metrics: its route pattern without the API
+// prefix, so requests for different IDs share a label, or its path when it wasn't routed
+func requestEndpoint(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return strings.TrimPrefix(pattern, apiPathPrefix)
+		}
+	}
+	return r.URL.Path
+}
+
+func (h *Handler) respondError(w http.ResponseWriter, r *http.Request, statusCode int, message string, logger *logrus.Entry) {
+	health.HTTPRequestsTotal.WithLabelValues(r.Method, requestEndpoint(r), strconv.Itoa(statusCode)).Inc()
 
 	logger.WithFields(logrus.Fields{
 		"status_code": statusCode,
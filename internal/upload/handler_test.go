@@ -1,14 +1,43 @@
 package upload
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
 	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/features"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/middleware"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/outbox"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/retry"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	storagemocks "github.com/RedHatInsights/insights-ros-ingress/internal/storage/mocks"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	authenticationv1 "k8s.io/api/authentication/v1"
 )
 
@@ -53,7 +82,9 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 			BeforeEach(func() {
 				cfg := &config.Config{
 					Auth: config.AuthConfig{
-						Enabled: true,
+						Enabled:        true,
+						DefaultOrgID:   "1",
+						DefaultAccount: "1",
 					},
 				}
 				handler = NewHandler(cfg, nil, nil, logger)
@@ -109,6 +140,200 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 				})
 			})
 
+			Context("with identity derivation metrics", func() {
+				derivations := func(source, field, derivation string) float64 {
+					return testutil.ToFloat64(health.IdentityDerivationsTotal.WithLabelValues(source, field, derivation))
+				}
+
+				// extract sends an upload authenticated as user under source, only its identity matters here
+				extract := func(source string, user authenticationv1.UserInfo) {
+					ctx := context.WithValue(context.Background(), auth.AuthenticatedUserKey, user)
+					ctx = context.WithValue(ctx, auth.IdentitySourceKey, source)
+					ctx = context.WithValue(ctx, auth.OauthTokenKey, "test-token")
+					req := httptest.NewRequest(http.MethodPost, "/upload", nil).WithContext(ctx)
+					handler.HandleUpload(httptest.NewRecorder(), req)
+				}
+
+				It("should count an org from groups and an account from extra claims under the token source", func() {
+					orgBefore := derivations(auth.SourceJWT, "org", "group")
+					accountBefore := derivations(auth.SourceJWT, "account", "extra")
+
+					extract(auth.SourceJWT, authenticationv1.UserInfo{
+						Username: "test-user",
+						Groups:   []string{"org:123"},
+						Extra:    map[string]authenticationv1.ExtraValue{"account_number": {"456"}},
+					})
+
+					Expect(derivations(auth.SourceJWT, "org", "group")).To(Equal(orgBefore + 1))
+					Expect(derivations(auth.SourceJWT, "account", "extra")).To(Equal(accountBefore + 1))
+				})
+
+				It("should count fallbacks to the default org and account", func() {
+					orgBefore := derivations(auth.SourceTokenReview, "org", "default")
+					accountBefore := derivations(auth.SourceTokenReview, "account", "default")
+					groupBefore := derivations(auth.SourceTokenReview, "org", "group")
+
+					extract(auth.SourceTokenReview, authenticationv1.UserInfo{Username: "test-user"})
+
+					Expect(derivations(auth.SourceTokenReview, "org", "default")).To(Equal(orgBefore + 1))
+					Expect(derivations(auth.SourceTokenReview, "account", "default")).To(Equal(accountBefore + 1))
+					Expect(derivations(auth.SourceTokenReview, "org", "group")).To(Equal(groupBefore))
+				})
+
+				It("should count an org from extra claims and an account from groups", func() {
+					orgBefore := derivations(auth.SourceTokenReview, "org", "extra")
+					accountBefore := derivations(auth.SourceTokenReview, "account", "group")
+
+					extract(auth.SourceTokenReview, authenticationv1.UserInfo{
+						Username: "test-user",
+						Groups:   []string{"account:456"},
+						Extra:    map[string]authenticationv1.ExtraValue{"org_id": {"123"}},
+					})
+
+					Expect(derivations(auth.SourceTokenReview, "org", "extra")).To(Equal(orgBefore + 1))
+					Expect(derivations(auth.SourceTokenReview, "account", "group")).To(Equal(accountBefore + 1))
+				})
+
+				It("should count users authenticated without a recorded source as unknown", func() {
+					before := derivations(auth.SourceUnknown, "org", "group")
+
+					ctx := context.WithValue(context.Background(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{Groups: []string{"org:123"}})
+					handler.HandleUpload(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil).WithContext(ctx))
+
+					Expect(derivations(auth.SourceUnknown, "org", "group")).To(Equal(before + 1))
+				})
+
+				It("should count every upload of a user whose identity is cached", func() {
+					handler.config.Auth.IdentityCacheTTL = 60
+					handler = NewHandler(handler.config, nil, nil, logger)
+					before := derivations(auth.SourceJWT, "org", "group")
+
+					user := authenticationv1.UserInfo{Username: "test-user", Groups: []string{"org:123"}}
+					extract(auth.SourceJWT, user)
+					extract(auth.SourceJWT, user)
+
+					Expect(derivations(auth.SourceJWT, "org", "group")).To(Equal(before + 2))
+				})
+
+				It("should count cached uploads without deriving their identity again", func() {
+					handler.config.Auth.IdentityCacheTTL = 60
+					handler = NewHandler(handler.config, nil, nil, logger)
+					groupBefore := derivations(auth.SourceJWT, "org", "group")
+					defaultBefore := derivations(auth.SourceJWT, "org", "default")
+
+					// Within the TTL the claims of the same token aren't looked at again, not even for the metric
+					extract(auth.SourceJWT, authenticationv1.UserInfo{Username: "test-user", Groups: []string{"org:123"}})
+					extract(auth.SourceJWT, authenticationv1.UserInfo{Username: "test-user"})
+					extract(auth.SourceJWT, authenticationv1.UserInfo{Username: "test-user"})
+
+					Expect(derivations(auth.SourceJWT, "org", "group")).To(Equal(groupBefore + 3))
+					Expect(derivations(auth.SourceJWT, "org", "default")).To(Equal(defaultBefore))
+					Expect(handler.identities.entries).To(HaveLen(1))
+				})
+
+				It("should not count identities looked up outside of uploads", func() {
+					before := derivations(auth.SourceJWT, "org", "group")
+
+					ctx := context.WithValue(context.Background(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{Groups: []string{"org:123"}})
+					ctx = context.WithValue(ctx, auth.IdentitySourceKey, auth.SourceJWT)
+					_, err := handler.extractIdentity((&http.Request{}).WithContext(ctx))
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(derivations(auth.SourceJWT, "org", "group")).To(Equal(before))
+				})
+			})
+
+			Context("when an org ID is required", func() {
+				It("should reject a user carrying no org", func() {
+					handler.config.Auth.RequireOrgID = true
+					ctx := context.WithValue(context.Background(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{
+						Username: "no-org-user",
+						Groups:   []string{"account:456"},
+					})
+					req := httptest.NewRequest(http.MethodPost, "/upload", nil).WithContext(ctx)
+
+					result, err := handler.extractIdentity(req)
+
+					Expect(err).To(MatchError(ContainSubstring("no org ID found for user no-org-user")))
+					Expect(result).To(BeNil())
+
+					before := testutil.ToFloat64(health.IdentityDerivationsTotal.WithLabelValues(auth.SourceUnknown, "org", "none"))
+					recorder := httptest.NewRecorder()
+					handler.HandleUpload(recorder, req)
+					Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+					Expect(testutil.ToFloat64(health.IdentityDerivationsTotal.WithLabelValues(auth.SourceUnknown, "org", "none"))).To(Equal(before + 1))
+				})
+			})
+
+			Context("with a trusted x-rh-identity header", func() {
+				encode := func(xrhid string) string {
+					return base64.StdEncoding.EncodeToString([]byte(xrhid))
+				}
+
+				request := func(header string, user *authenticationv1.UserInfo) *http.Request {
+					req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+					req.Header.Set(auth.RHIdentityHeader, header)
+					if user != nil {
+						req = req.WithContext(context.WithValue(req.Context(), auth.AuthenticatedUserKey, *user))
+					}
+					return req
+				}
+
+				BeforeEach(func() {
+					handler.config.Auth.TrustRHIdentity = true
+				})
+
+				It("should decode the identity from the header", func() {
+					header := encode(`{"identity":{"org_id":"12345","account_number":"67890","type":"User","auth_type":"jwt-auth","internal":{"org_id":"12345"},"user":{"username":"proxied-user","is_internal":true}}}`)
+					result, err := handler.extractIdentity(request(header, nil))
+
+					Expect(err).ToNot(HaveOccurred())
+					Expect(result.OrgID).To(Equal("12345"))
+					Expect(result.AccountNumber).To(Equal("67890"))
+					Expect(result.AuthType).To(Equal("jwt-auth"))
+					Expect(result.User.Username).To(Equal("proxied-user"))
+					Expect(result.User.Internal).To(BeTrue())
+
+					before := testutil.ToFloat64(health.IdentityDerivationsTotal.WithLabelValues(auth.SourceRHIdentity, "org", "header"))
+					handler.HandleUpload(httptest.NewRecorder(), request(header, nil))
+					Expect(testutil.ToFloat64(health.IdentityDerivationsTotal.WithLabelValues(auth.SourceRHIdentity, "org", "header"))).To(Equal(before + 1))
+				})
+
+				It("should prefer the header over the authenticated user", func() {
+					user := &authenticationv1.UserInfo{Username: "test-user", Groups: []string{"org:999"}}
+
+					result, err := handler.extractIdentity(request(encode(`{"identity":{"org_id":"12345"}}`), user))
+
+					Expect(err).ToNot(HaveOccurred())
+					Expect(result.OrgID).To(Equal("12345"))
+				})
+
+				It("should ignore the header when it isn't trusted", func() {
+					handler.config.Auth.TrustRHIdentity = false
+					user := &authenticationv1.UserInfo{Username: "test-user", Groups: []string{"org:999"}}
+
+					result, err := handler.extractIdentity(request(encode(`{"identity":{"org_id":"12345"}}`), user))
+
+					Expect(err).ToNot(HaveOccurred())
+					Expect(result.OrgID).To(Equal("999"))
+				})
+
+				It("should reject a header that isn't base64", func() {
+					_, err := handler.extractIdentity(request("not base64!", nil))
+					Expect(err).To(MatchError(ContainSubstring("failed to decode x-rh-identity header")))
+				})
+
+				It("should reject a header that isn't an identity document", func() {
+					_, err := handler.extractIdentity(request(encode(`["identity"]`), nil))
+					Expect(err).To(MatchError(ContainSubstring("failed to unmarshal x-rh-identity header")))
+				})
+
+				It("should reject an identity without an org ID", func() {
+					_, err := handler.extractIdentity(request(encode(`{"identity":{"account_number":"67890"}}`), nil))
+					Expect(err).To(MatchError(ContainSubstring("x-rh-identity header carries no org ID")))
+				})
+			})
+
 			Context("with missing user in context", func() {
 				It("should return error", func() {
 					req := &http.Request{}
@@ -208,7 +433,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 
 	Describe("createIdentityFromOAuth2User", func() {
 		BeforeEach(func() {
-			handler = NewHandler(&config.Config{}, nil, nil, logger)
+			handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultOrgID: "1", DefaultAccount: "1"}}, nil, nil, logger)
 		})
 
 		Context("with regular user with complete info", func() {
@@ -279,6 +504,31 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 			})
 		})
 
+		Context("with email synthesis enabled", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{SynthesizeEmail: true}}, nil, nil, logger)
+			})
+
+			It("should keep an email claim", func() {
+				user := &authenticationv1.UserInfo{
+					Username: "john.doe",
+					Groups:   []string{"org:456"},
+					Extra:    map[string]authenticationv1.ExtraValue{"email": {"john.doe@example.com"}},
+				}
+
+				Expect(handler.createIdentityFromOAuth2User(user).User.Email).To(Equal("john.doe@example.com"))
+			})
+
+			It("should synthesize a placeholder from the username and org when the claim is absent", func() {
+				user := &authenticationv1.UserInfo{
+					Username: "system:serviceaccount:kube-system:my-service",
+					Groups:   []string{"org:456"},
+				}
+
+				Expect(handler.createIdentityFromOAuth2User(user).User.Email).To(Equal("system-serviceaccount-kube-system-my-service@org-456.invalid"))
+			})
+		})
+
 		Context("with minimal user with defaults", func() {
 			It("should use default values", func() {
 				user := &authenticationv1.UserInfo{
@@ -300,7 +550,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 
 	Describe("extractOrgIDFromUser", func() {
 		BeforeEach(func() {
-			handler = NewHandler(&config.Config{}, nil, nil, logger)
+			handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultOrgID: "1", DefaultAccount: "1"}}, nil, nil, logger)
 		})
 
 		Context("when org is in groups", func() {
@@ -309,7 +559,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					Groups: []string{"team-lead", "org:123", "other-group"},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("123"))
 			})
@@ -323,7 +573,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("456"))
 			})
@@ -338,7 +588,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("789"))
 			})
@@ -350,7 +600,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					Groups: []string{"org:111", "org:222", "org:333"},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("111"))
 			})
@@ -365,7 +615,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("1"))
 			})
@@ -375,7 +625,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 			It("should return default", func() {
 				user := &authenticationv1.UserInfo{}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("1"))
 			})
@@ -387,16 +637,101 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					Groups: []string{"org:", "org:valid-123", "not-org-group"},
 				}
 
-				result := handler.extractOrgIDFromUser(user)
+				result, _ := handler.extractOrgIDFromUser(user)
 
 				Expect(result).To(Equal("valid-123"))
 			})
 		})
+
+		Context("with a configured default org", func() {
+			It("should fall back to it", func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultOrgID: "org-fallback"}}, nil, nil, logger)
+
+				orgID, _ := handler.extractOrgIDFromUser(&authenticationv1.UserInfo{})
+				Expect(orgID).To(Equal("org-fallback"))
+			})
+		})
+
+		Context("when an org ID is required", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultOrgID: "1", RequireOrgID: true}}, nil, nil, logger)
+			})
+
+			It("should not fall back to the default org", func() {
+				orgID, _ := handler.extractOrgIDFromUser(&authenticationv1.UserInfo{})
+				Expect(orgID).To(BeEmpty())
+			})
+
+			It("should still extract an org the user carries", func() {
+				user := &authenticationv1.UserInfo{Groups: []string{"org:123"}}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("123"))
+			})
+		})
+
+		Context("with configured mappings", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{
+					DefaultOrgID:   "1",
+					OrgGroupPrefix: "tenant/",
+					OrgClaimKeys:   []string{"tenant_id", "organization"},
+				}}, nil, nil, logger)
+			})
+
+			It("should extract from groups with the configured prefix", func() {
+				user := &authenticationv1.UserInfo{Groups: []string{"org:123", "tenant/456"}}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("456"))
+			})
+
+			It("should check the configured claims in order", func() {
+				user := &authenticationv1.UserInfo{Extra: map[string]authenticationv1.ExtraValue{
+					"org_id":       {"123"},
+					"organization": {"789"},
+					"tenant_id":    {"456"},
+				}}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("456"))
+			})
+
+			It("should fall through to the next configured claim", func() {
+				user := &authenticationv1.UserInfo{Extra: map[string]authenticationv1.ExtraValue{
+					"org_id":       {"123"},
+					"organization": {"789"},
+				}}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("789"))
+			})
+
+			It("should prioritize groups over the configured claims", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"tenant/456"},
+					Extra:  map[string]authenticationv1.ExtraValue{"tenant_id": {"789"}},
+				}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("456"))
+			})
+
+			It("should ignore the built-in mappings", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"org:123"},
+					Extra:  map[string]authenticationv1.ExtraValue{"org_id": {"456"}},
+				}
+
+				orgID, _ := handler.extractOrgIDFromUser(user)
+				Expect(orgID).To(Equal("1"))
+			})
+		})
 	})
 
 	Describe("extractAccountNumberFromUser", func() {
 		BeforeEach(func() {
-			handler = NewHandler(&config.Config{}, nil, nil, logger)
+			handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultOrgID: "1", DefaultAccount: "1"}}, nil, nil, logger)
 		})
 
 		Context("when account is in extra fields", func() {
@@ -407,7 +742,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("123456"))
 			})
@@ -419,7 +754,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					Groups: []string{"team-lead", "account:789", "other-group"},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("789"))
 			})
@@ -434,7 +769,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("111"))
 			})
@@ -448,7 +783,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("555"))
 			})
@@ -462,7 +797,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("777"))
 			})
@@ -477,7 +812,7 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 					},
 				}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("1"))
 			})
@@ -487,11 +822,137 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 			It("should return default", func() {
 				user := &authenticationv1.UserInfo{}
 
-				result := handler.extractAccountNumberFromUser(user)
+				result, _ := handler.extractAccountNumberFromUser(user)
 
 				Expect(result).To(Equal("1"))
 			})
 		})
+
+		Context("with configured mappings", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{
+					DefaultAccount:     "1",
+					AccountGroupPrefix: "ebs=",
+					AccountClaimKeys:   []string{"ebs_number", "account_number"},
+				}}, nil, nil, logger)
+			})
+
+			It("should check the configured claims in order", func() {
+				user := &authenticationv1.UserInfo{Extra: map[string]authenticationv1.ExtraValue{
+					"account_number": {"111"},
+					"ebs_number":     {"222"},
+					"customer_id":    {"333"},
+				}}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("222"))
+			})
+
+			It("should prioritize the configured claims over groups", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"ebs=444"},
+					Extra:  map[string]authenticationv1.ExtraValue{"account_number": {"111"}},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("111"))
+			})
+
+			It("should extract from groups with the configured prefix", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"account:555", "ebs=444"},
+					Extra:  map[string]authenticationv1.ExtraValue{"customer_id": {"333"}},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("444"))
+			})
+
+			It("should still prefer the account claim path", func() {
+				handler.config.Auth.AccountClaimPath = "realm_access.account"
+				user := &authenticationv1.UserInfo{Extra: map[string]authenticationv1.ExtraValue{
+					"realm_access.account": {"666"},
+					"ebs_number":           {"222"},
+				}}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("666"))
+			})
+		})
+
+		Context("with a configured default account", func() {
+			It("should fall back to it", func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{DefaultAccount: "acct-fallback"}}, nil, nil, logger)
+
+				account, _ := handler.extractAccountNumberFromUser(&authenticationv1.UserInfo{})
+				Expect(account).To(Equal("acct-fallback"))
+			})
+		})
+
+		Context("with an account claim path", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{AccountClaimPath: "realm_access.account"}}, nil, nil, logger)
+			})
+
+			It("should read a flattened claim key", func() {
+				user := &authenticationv1.UserInfo{
+					Extra: map[string]authenticationv1.ExtraValue{
+						"realm_access.account": {"4242"},
+						"account_number":       {"111"},
+					},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("4242"))
+			})
+
+			It("should navigate a nested JSON claim", func() {
+				user := &authenticationv1.UserInfo{
+					Extra: map[string]authenticationv1.ExtraValue{
+						"realm_access": {`{"roles":["user"],"account":"4242"}`},
+					},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("4242"))
+			})
+
+			It("should keep large numeric claims exact", func() {
+				user := &authenticationv1.UserInfo{
+					Extra: map[string]authenticationv1.ExtraValue{
+						"realm_access": {`{"account":9007199254740993}`},
+					},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("9007199254740993"))
+			})
+
+			It("should navigate from a partially flattened claim key", func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{AccountClaimPath: "resource_access.ros-client.account"}}, nil, nil, logger)
+				user := &authenticationv1.UserInfo{
+					Extra: map[string]authenticationv1.ExtraValue{
+						"resource_access":            {`{"ros-client":{"account":"1"}}`},
+						"resource_access.ros-client": {`{"account":"5150"}`},
+					},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("5150"))
+			})
+
+			It("should fall back to the built-in fields when the path does not resolve", func() {
+				user := &authenticationv1.UserInfo{
+					Extra: map[string]authenticationv1.ExtraValue{
+						"realm_access":   {`{"account":{"id":"1"}}`},
+						"account_number": {"111"},
+					},
+				}
+
+				account, _ := handler.extractAccountNumberFromUser(user)
+				Expect(account).To(Equal("111"))
+			})
+		})
 	})
 
 	Describe("extractEmailFromUser", func() {
@@ -600,6 +1061,35 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 				Expect(result).To(BeFalse())
 			})
 		})
+
+		Context("with the default heuristics", func() {
+			It("should keep flagging any group containing admin for compatibility", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"non-admin-viewers"},
+				}
+
+				Expect(handler.isOrgAdminUser(user)).To(BeTrue())
+			})
+		})
+
+		Context("with configured admin groups", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{AdminGroups: []string{"org-admin", "tenant-*-admins"}}}, nil, nil, logger)
+			})
+
+			It("should not flag groups that merely contain admin", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"non-admin-viewers", "cluster-admin"},
+				}
+
+				Expect(handler.isOrgAdminUser(user)).To(BeFalse())
+			})
+
+			It("should flag groups matching a configured name or pattern", func() {
+				Expect(handler.isOrgAdminUser(&authenticationv1.UserInfo{Groups: []string{"users", "org-admin"}})).To(BeTrue())
+				Expect(handler.isOrgAdminUser(&authenticationv1.UserInfo{Groups: []string{"tenant-acme-admins"}})).To(BeTrue())
+			})
+		})
 	})
 
 	Describe("isInternalUser", func() {
@@ -664,6 +1154,49 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 				Expect(result).To(BeFalse())
 			})
 		})
+
+		Context("with configured internal groups", func() {
+			BeforeEach(func() {
+				handler = NewHandler(&config.Config{Auth: config.AuthConfig{InternalGroups: []string{"internal", "redhat-employees"}}}, nil, nil, logger)
+			})
+
+			It("should not flag groups that merely contain redhat", func() {
+				user := &authenticationv1.UserInfo{
+					Groups: []string{"not-redhat-partners"},
+				}
+
+				Expect(handler.isInternalUser(user)).To(BeFalse())
+			})
+
+			It("should flag the configured groups", func() {
+				Expect(handler.isInternalUser(&authenticationv1.UserInfo{Groups: []string{"redhat-employees"}})).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("IsInternalRequest", func() {
+		BeforeEach(func() {
+			handler = NewHandler(&config.Config{Auth: config.AuthConfig{Enabled: true}}, nil, nil, logger)
+		})
+
+		requestAs := func(user authenticationv1.UserInfo) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/metrics?org=12345", nil)
+			ctx := context.WithValue(req.Context(), auth.AuthenticatedUserKey, user)
+			ctx = context.WithValue(ctx, auth.OauthTokenKey, "token-"+user.Username)
+			return req.WithContext(ctx)
+		}
+
+		It("should accept internal users", func() {
+			Expect(handler.IsInternalRequest(requestAs(authenticationv1.UserInfo{Username: "operator", Groups: []string{"internal"}}))).To(BeTrue())
+		})
+
+		It("should reject other users", func() {
+			Expect(handler.IsInternalRequest(requestAs(authenticationv1.UserInfo{Username: "customer", Groups: []string{"org:12345"}}))).To(BeFalse())
+		})
+
+		It("should reject unauthenticated requests", func() {
+			Expect(handler.IsInternalRequest(httptest.NewRequest(http.MethodGet, "/metrics?org=12345", nil))).To(BeFalse())
+		})
 	})
 
 	Context("Cluster Alias Logic", func() {
@@ -707,3 +1240,1808 @@ var _ = Describe("Handler OAuth2 Authentication", func() {
 		})
 	})
 })
+
+var _ = Describe("HandleUpload Expect: 100-continue", func() {
+	var (
+		server *httptest.Server
+		cfg    *config.Config
+		logger *logrus.Logger
+	)
+
+	// sendHeaders writes the request headers announcing a body of contentLength bytes
+	// and returns the first response status line the server sends back
+	sendHeaders := func(conn net.Conn, contentType string, contentLength int64) (*bufio.Reader, string) {
+		_, err := fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", contentType, contentLength)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		reader := bufio.NewReader(conn)
+		statusLine, err := reader.ReadString('\n')
+		Expect(err).ToNot(HaveOccurred())
+		return reader, strings.TrimSpace(statusLine)
+	}
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetLevel(logrus.ErrorLevel)
+		cfg = newTestConfig()
+		cfg.Upload.MaxUploadSize = 1024
+		cfg.Upload.MaxMemory = 1024
+	})
+
+	JustBeforeEach(func() {
+		handler := NewHandler(cfg, nil, nil, logger)
+		server = httptest.NewServer(http.HandlerFunc(handler.HandleUpload))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	Context("when the identity is missing", func() {
+		BeforeEach(func() {
+			cfg.Auth.Enabled = true
+		})
+
+		It("should reject with 401 without asking for the body", func() {
+			conn := dial()
+			defer func() { _ = conn.Close() }()
+
+			_, statusLine := sendHeaders(conn, "multipart/form-data; boundary=xyz", 512)
+			Expect(statusLine).To(HavePrefix("HTTP/1.1 401"))
+		})
+	})
+
+	Context("when the declared content length is too large", func() {
+		It("should reject with 413 without asking for the body", func() {
+			conn := dial()
+			defer func() { _ = conn.Close() }()
+
+			_, statusLine := sendHeaders(conn, "multipart/form-data; boundary=xyz", 10*1024*1024)
+			Expect(statusLine).To(HavePrefix("HTTP/1.1 413"))
+		})
+	})
+
+	Context("when the cheap validations pass", func() {
+		It("should send 100 Continue and then process the body", func() {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			Expect(writer.WriteField("test", "test")).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+
+			conn := dial()
+			defer func() { _ = conn.Close() }()
+
+			reader, statusLine := sendHeaders(conn, writer.FormDataContentType(), int64(body.Len()))
+			Expect(statusLine).To(HavePrefix("HTTP/1.1 100"))
+
+			// Consume the blank line terminating the interim response
+			_, err := reader.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = conn.Write(body.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+})
+
+var _ = Describe("HandleUpload temp dir cleanup", func() {
+	var (
+		handler *Handler
+		tempDir string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+
+		cfg := newTestConfig()
+		cfg.Upload.TempDir = tempDir
+		// No storage client is configured, so processing panics right after extraction
+		handler = NewHandler(cfg, nil, nil, logger)
+	})
+
+	It("should remove the extraction directory when processing panics", func() {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Disposition", `form-data; name="file"; filename="payload.tar.gz"`)
+		partHeader.Set("Content-Type", "application/vnd.redhat.hccm.upload")
+		part, err := writer.CreatePart(partHeader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = part.Write(payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+
+		Expect(func() { handler.HandleUpload(recorder, req) }).To(Panic())
+
+		entries, err := os.ReadDir(tempDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
+
+var _ = Describe("HandleUpload failed payload retention", func() {
+	var (
+		handler *Handler
+		store   *storagemocks.FakeClient
+		tempDir string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+
+		store = storagemocks.NewFakeClient()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.TempDir = tempDir
+		cfg.Upload.KeepFailedPayloads = 3600
+		handler = NewHandler(cfg, store, mocks.NewFakeProducer(), logger)
+	})
+
+	upload := func() *httptest.ResponseRecorder {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		return recorder
+	}
+
+	It("should keep the extracted files of an upload that fails after extraction", func() {
+		store.UploadErr = errors.New("connection refused")
+
+		Expect(upload().Code).To(Equal(http.StatusInternalServerError))
+
+		kept, err := os.ReadDir(filepath.Join(tempDir, failedPayloadsDir))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kept).To(HaveLen(1))
+		Expect(filepath.Join(tempDir, failedPayloadsDir, kept[0].Name(), "manifest.json")).To(BeAnExistingFile())
+		Expect(handler.payloadExtractor.countExtractionDirs()).To(Equal(0))
+	})
+
+	It("should remove the extracted files of a successful upload", func() {
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+
+		entries, err := os.ReadDir(tempDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
+
+var _ = Describe("HandleUpload content length requirement", func() {
+	newHandler := func(requireContentLength bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Upload.RequireContentLength = requireContentLength
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	newRequest := func(declareLength bool) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		Expect(writer.WriteField("test", "test")).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if !declareLength {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		return req
+	}
+
+	serve := func(handler *Handler, req *http.Request) int {
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		return recorder.Code
+	}
+
+	Context("when a content length is required", func() {
+		It("should reject requests without a declared content length with 411", func() {
+			Expect(serve(newHandler(true), newRequest(false))).To(Equal(http.StatusLengthRequired))
+		})
+
+		It("should accept requests with a declared content length", func() {
+			Expect(serve(newHandler(true), newRequest(true))).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when a content length is not required", func() {
+		It("should accept requests without a declared content length", func() {
+			Expect(serve(newHandler(false), newRequest(false))).To(Equal(http.StatusOK))
+		})
+
+		It("should accept requests with a declared content length", func() {
+			Expect(serve(newHandler(false), newRequest(true))).To(Equal(http.StatusOK))
+		})
+	})
+})
+
+var _ = Describe("HandleUpload numeric ID validation", func() {
+	newHandler := func(requireNumericIDs bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Auth.RequireNumericIDs = requireNumericIDs
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	serve := func(handler *Handler, groups ...string) *httptest.ResponseRecorder {
+		return serveAsUser(handler, authenticationv1.UserInfo{Username: "test-user", Groups: groups})
+	}
+
+	Context("when numeric IDs are required", func() {
+		It("should accept numeric org and account IDs", func() {
+			Expect(serve(newHandler(true), "org:12345", "account:67890").Code).To(Equal(http.StatusOK))
+		})
+
+		It("should reject a non-numeric org ID with 422", func() {
+			recorder := serve(newHandler(true), "org:acme", "account:67890")
+			Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(recorder.Body.String()).To(ContainSubstring("org_id must be numeric"))
+		})
+
+		It("should reject a non-numeric account number with 422", func() {
+			recorder := serve(newHandler(true), "org:12345", "account:acct-1")
+			Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(recorder.Body.String()).To(ContainSubstring("account_number must be numeric"))
+		})
+	})
+
+	Context("by default", func() {
+		It("should accept non-numeric org and account IDs", func() {
+			Expect(serve(newHandler(false), "org:acme", "account:acct-1").Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when an org allow list is configured", func() {
+		rejected := func() float64 {
+			return testutil.ToFloat64(health.UploadsRejectedTotal.WithLabelValues("org_not_allowed"))
+		}
+
+		It("should reject uploads from other orgs with 403 and count them", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"99999"}
+			before := rejected()
+
+			recorder := serve(handler, "org:12345", "account:67890")
+			Expect(recorder.Code).To(Equal(http.StatusForbidden))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"error":"Organization is not allowed to upload"`))
+			Expect(rejected() - before).To(Equal(1.0))
+		})
+
+		It("should log the rejected org at warn level", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"99999"}
+			hookLogger, hook := logtest.NewNullLogger()
+			handler.logger = hookLogger
+
+			serve(handler, "org:12345", "account:67890")
+
+			Expect(hook.AllEntries()).To(ContainElement(And(
+				HaveField("Message", "Rejecting organization missing from the allow list"),
+				HaveField("Level", logrus.WarnLevel),
+				HaveField("Data", HaveKeyWithValue("org_id", "12345")),
+			)))
+		})
+
+		It("should accept uploads from allowed orgs", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"12345"}
+			before := rejected()
+
+			Expect(serve(handler, "org:12345", "account:67890").Code).To(Equal(http.StatusOK))
+			Expect(rejected()).To(Equal(before))
+		})
+
+		It("should match org IDs exactly", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"1234", "123456", " 12345"}
+
+			Expect(serve(handler, "org:12345", "account:67890").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should apply an allow list replaced while serving", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"12345"}
+
+			handler.SetAllowedOrgs([]string{"99999"})
+			Expect(serve(handler, "org:12345", "account:67890").Code).To(Equal(http.StatusForbidden))
+
+			handler.SetAllowedOrgs([]string{})
+			Expect(serve(handler, "org:12345", "account:67890").Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when an org deny list is configured", func() {
+		denied := func() float64 {
+			return testutil.ToFloat64(health.UploadsRejectedTotal.WithLabelValues("org_denied"))
+		}
+
+		It("should reject uploads from denied orgs with 403 and count them", func() {
+			handler := newHandler(false)
+			handler.config.Auth.DeniedOrgs = []string{"12345"}
+			before := denied()
+
+			recorder := serve(handler, "org:12345", "account:67890")
+			Expect(recorder.Code).To(Equal(http.StatusForbidden))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"error":"Organization is not allowed to upload"`))
+			Expect(denied() - before).To(Equal(1.0))
+
+			Expect(serve(handler, "org:54321", "account:67890").Code).To(Equal(http.StatusOK))
+			Expect(denied() - before).To(Equal(1.0))
+		})
+
+		It("should log the denied org at warn level", func() {
+			handler := newHandler(false)
+			handler.config.Auth.DeniedOrgs = []string{"12345"}
+			hookLogger, hook := logtest.NewNullLogger()
+			handler.logger = hookLogger
+
+			serve(handler, "org:12345", "account:67890")
+
+			Expect(hook.AllEntries()).To(ContainElement(And(
+				HaveField("Message", "Rejecting organization on the deny list"),
+				HaveField("Level", logrus.WarnLevel),
+				HaveField("Data", HaveKeyWithValue("org_id", "12345")),
+			)))
+		})
+
+		It("should reject orgs that are both allowed and denied", func() {
+			handler := newHandler(false)
+			handler.config.Auth.AllowedOrgs = []string{"12345", "54321"}
+			handler.config.Auth.DeniedOrgs = []string{"12345"}
+
+			Expect(serve(handler, "org:12345", "account:67890").Code).To(Equal(http.StatusForbidden))
+			Expect(serve(handler, "org:54321", "account:67890").Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("nonNumericIDField", func() {
+		It("should allow an empty account number but not an empty org ID", func() {
+			Expect(nonNumericIDField(&identity.Identity{OrgID: "123"})).To(BeEmpty())
+			Expect(nonNumericIDField(&identity.Identity{OrgID: ""})).To(Equal("org_id"))
+			Expect(nonNumericIDField(&identity.Identity{OrgID: "-1"})).To(Equal("org_id"))
+		})
+	})
+})
+
+var _ = Describe("HandleUpload email requirement", func() {
+	newHandler := func(synthesizeEmail bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Auth.RequireEmail = true
+		cfg.Auth.SynthesizeEmail = synthesizeEmail
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	serve := func(handler *Handler, extra map[string]authenticationv1.ExtraValue) *httptest.ResponseRecorder {
+		return serveAsUser(handler, authenticationv1.UserInfo{
+			Username: "test-user",
+			Groups:   []string{"org:12345", "account:67890"},
+			Extra:    extra,
+		})
+	}
+
+	It("should accept identities with an email claim", func() {
+		recorder := serve(newHandler(false), map[string]authenticationv1.ExtraValue{"email": {"test-user@example.com"}})
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should reject identities without an email claim with 422", func() {
+		recorder := serve(newHandler(false), nil)
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(recorder.Body.String()).To(ContainSubstring("Identity must carry an email"))
+	})
+
+	It("should accept identities without an email claim when one is synthesized", func() {
+		Expect(serve(newHandler(true), nil).Code).To(Equal(http.StatusOK))
+	})
+})
+
+var _ = Describe("HandleUpload default org rejection", func() {
+	newHandler := func(rejectDefaultOrg bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Auth.DefaultOrgID = "1"
+		cfg.Auth.DefaultAccount = "1"
+		cfg.Auth.RejectDefaultOrg = rejectDefaultOrg
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	serve := func(handler *Handler, groups ...string) *httptest.ResponseRecorder {
+		return serveAsUser(handler, authenticationv1.UserInfo{Username: "test-user", Groups: groups})
+	}
+
+	rejected := func() float64 {
+		return testutil.ToFloat64(health.UploadsRejectedTotal.WithLabelValues("default_org"))
+	}
+
+	It("should reject identities falling back to the default org with 422", func() {
+		before := rejected()
+
+		recorder := serve(newHandler(true), "account:67890")
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(recorder.Body.String()).To(ContainSubstring("Token lacks org_id or account_number claims"))
+		Expect(rejected()).To(Equal(before + 1))
+	})
+
+	It("should reject identities falling back to the default account", func() {
+		Expect(serve(newHandler(true), "org:12345").Code).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("should accept identities carrying their org and account", func() {
+		before := rejected()
+
+		Expect(serve(newHandler(true), "org:12345", "account:67890").Code).To(Equal(http.StatusOK))
+		Expect(rejected()).To(Equal(before))
+	})
+
+	It("should accept fallbacks when the option is off", func() {
+		Expect(serve(newHandler(false)).Code).To(Equal(http.StatusOK))
+	})
+
+	It("should leave empty fallbacks to the empty org handling", func() {
+		handler := newHandler(true)
+		handler.config.Auth.DefaultAccount = ""
+
+		Expect(serve(handler, "org:12345").Code).To(Equal(http.StatusOK))
+	})
+})
+
+var _ = Describe("HandleUpload body read timeout", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		cfg := newTestConfig()
+		cfg.Server.BodyReadTimeout = 1
+		handler := NewHandler(cfg, nil, nil, logger)
+		server = httptest.NewServer(http.HandlerFunc(handler.HandleUpload))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should respond 408 when the body is trickled slower than the body read timeout", func() {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		Expect(writer.WriteField("test", "test")).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer func() { _ = conn.Close() }()
+
+		_, err = fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n", writer.FormDataContentType(), body.Len())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Send only part of the body, then stall past the deadline
+		_, err = conn.Write(body.Bytes()[:10])
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestTimeout))
+	})
+
+	It("should process the body when it arrives within the body read timeout", func() {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		Expect(writer.WriteField("test", "test")).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+
+		resp, err := http.Post(server.URL, writer.FormDataContentType(), body)
+		Expect(err).ToNot(HaveOccurred())
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+})
+
+var _ = Describe("HandleUpload client disconnect", func() {
+	var (
+		handler *Handler
+		tmpDir  string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		cfg := newTestConfig()
+		cfg.Upload.MaxMemory = 1024
+		handler = NewHandler(cfg, nil, nil, logger)
+
+		// Multipart parts over MaxMemory spill to os.TempDir
+		tmpDir = GinkgoT().TempDir()
+		GinkgoT().Setenv("TMPDIR", tmpDir)
+	})
+
+	truncatedRequest := func() *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "payload.tar.gz")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = part.Write(bytes.Repeat([]byte("x"), 64*1024))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+
+		// The body ends partway through the file part, as if the client hung up
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body.Bytes()[:body.Len()/2]))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+
+	It("should count a body that ends prematurely as a client disconnect", func() {
+		before := testutil.ToFloat64(health.ClientDisconnectsTotal)
+
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, truncatedRequest())
+
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.Len()).To(BeZero())
+		Expect(testutil.ToFloat64(health.ClientDisconnectsTotal)).To(Equal(before + 1))
+	})
+
+	It("should remove temp files from the partial upload", func() {
+		handler.HandleUpload(httptest.NewRecorder(), truncatedRequest())
+
+		entries, err := os.ReadDir(tmpDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should treat a cancelled request as a client disconnect", func() {
+		before := testutil.ToFloat64(health.ClientDisconnectsTotal)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		handler.HandleUpload(httptest.NewRecorder(), truncatedRequest().WithContext(ctx))
+
+		Expect(testutil.ToFloat64(health.ClientDisconnectsTotal)).To(Equal(before + 1))
+	})
+
+	It("should still report malformed bodies as bad requests", func() {
+		before := testutil.ToFloat64(health.ClientDisconnectsTotal)
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("not multipart"))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=missing")
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(ContainSubstring("Failed to parse multipart form"))
+		Expect(testutil.ToFloat64(health.ClientDisconnectsTotal)).To(Equal(before))
+	})
+})
+
+var _ = Describe("Certified payload handling", func() {
+	var (
+		handler  *Handler
+		manifest *Manifest
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.ErrorLevel)
+		cfg := &config.Config{
+			Storage: config.StorageConfig{
+				PathPrefix:            "ros",
+				UncertifiedPathPrefix: "ros-uncertified",
+			},
+		}
+		handler = NewHandler(cfg, nil, nil, logger)
+		manifest = &Manifest{
+			UUID:            "manifest-uuid",
+			ClusterID:       "cluster-123",
+			OperatorVersion: "1.0.0",
+		}
+	})
+
+	Context("with a certified payload", func() {
+		BeforeEach(func() {
+			manifest.Certified = true
+		})
+
+		It("should surface the certified flag in the ROS metadata", func() {
+			msg := handler.buildROSMessage("request-1", "token", manifest, nil, time.Time{}, []string{"url"}, []string{"key"})
+
+			Expect(msg.Metadata.Certified).To(BeTrue())
+			Expect(msg.Metadata.ClusterUUID).To(Equal("cluster-123"))
+		})
+
+		It("should keep the configured storage prefix", func() {
+			Expect(handler.rosPathPrefix(manifest.Certified)).To(BeEmpty())
+		})
+	})
+
+	Context("with a non-certified payload", func() {
+		It("should surface the certified flag in the ROS metadata", func() {
+			msg := handler.buildROSMessage("request-1", "token", manifest, nil, time.Time{}, []string{"url"}, []string{"key"})
+
+			Expect(msg.Metadata.Certified).To(BeFalse())
+		})
+
+		It("should use the uncertified storage prefix", func() {
+			Expect(handler.rosPathPrefix(manifest.Certified)).To(Equal("ros-uncertified"))
+		})
+
+		It("should keep the configured storage prefix when no uncertified prefix is set", func() {
+			handler.config.Storage.UncertifiedPathPrefix = ""
+
+			Expect(handler.rosPathPrefix(manifest.Certified)).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Source and provider IDs", func() {
+	var handler *Handler
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		handler = NewHandler(&config.Config{}, nil, nil, logger)
+	})
+
+	It("should parse distinct source and provider IDs from the manifest", func() {
+		var manifest Manifest
+		Expect(json.Unmarshal([]byte(`{"cluster_id":"cluster-123","source_id":"source-1","provider_uuid":"provider-1"}`), &manifest)).To(Succeed())
+
+		Expect(manifest.SourceID).To(Equal("source-1"))
+		Expect(manifest.ProviderUUID).To(Equal("provider-1"))
+	})
+
+	It("should publish distinct source and provider IDs when the manifest specifies them", func() {
+		manifest := &Manifest{ClusterID: "cluster-123", SourceID: "source-1", ProviderUUID: "provider-1"}
+
+		msg := handler.buildROSMessage("request-1", "token", manifest, nil, time.Time{}, []string{"url"}, []string{"key"})
+
+		Expect(msg.Metadata.SourceID).To(Equal("source-1"))
+		Expect(msg.Metadata.ProviderUUID).To(Equal("provider-1"))
+		Expect(msg.Metadata.ClusterUUID).To(Equal("cluster-123"))
+	})
+
+	It("should fall back to the cluster ID when the manifest doesn't specify them", func() {
+		manifest := &Manifest{ClusterID: "cluster-123"}
+
+		msg := handler.buildROSMessage("request-1", "token", manifest, nil, time.Time{}, []string{"url"}, []string{"key"})
+
+		Expect(msg.Metadata.SourceID).To(Equal("cluster-123"))
+		Expect(msg.Metadata.ProviderUUID).To(Equal("cluster-123"))
+		Expect(msg.Metadata.ClusterUUID).To(Equal("cluster-123"))
+	})
+})
+
+var _ = Describe("Ingest timestamp", func() {
+	var (
+		handler    *Handler
+		manifest   *Manifest
+		ingestedAt time.Time
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.ErrorLevel)
+		handler = NewHandler(&config.Config{}, nil, nil, logger)
+		ingestedAt = time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+		handler.now = func() time.Time { return ingestedAt }
+		manifest = &Manifest{
+			UUID:            "manifest-uuid",
+			ClusterID:       "cluster-123",
+			OperatorVersion: "1.0.0",
+			Date:            time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		}
+	})
+
+	It("should record the ingest time in the object metadata", func() {
+		metadata := objectMetadata(manifest, "request-1", handler.now())
+
+		Expect(metadata).To(HaveKeyWithValue("IngestedAt", "2024-03-05T10:30:00Z"))
+		Expect(metadata).To(HaveKeyWithValue("ManifestId", "manifest-uuid"))
+	})
+
+	It("should record the ingest time separately from the report date in the ROS message", func() {
+		msg := handler.buildROSMessage("request-1", "token", manifest, nil, handler.now(), []string{"url"}, []string{"key"})
+		Expect(msg.Metadata.IngestedAt).To(Equal(ingestedAt))
+
+		data, err := json.Marshal(msg)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"ingested_at":"2024-03-05T10:30:00Z"`))
+	})
+})
+
+var _ = Describe("Numeric ID handling", func() {
+	var handler *Handler
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.ErrorLevel)
+		handler = NewHandler(&config.Config{}, nil, nil, logger)
+	})
+
+	Describe("normalizeID", func() {
+		It("should keep plain digit strings unchanged", func() {
+			Expect(normalizeID("12345678901234567890")).To(Equal("12345678901234567890"))
+		})
+
+		It("should expand exponent notation without precision loss", func() {
+			Expect(normalizeID("1.2345678901234567891e+19")).To(Equal("12345678901234567891"))
+		})
+
+		It("should drop an integral decimal suffix", func() {
+			Expect(normalizeID("9007199254740993.0")).To(Equal("9007199254740993"))
+		})
+
+		It("should keep non-integral and non-numeric values unchanged", func() {
+			Expect(normalizeID("12.5")).To(Equal("12.5"))
+			Expect(normalizeID("org.example")).To(Equal("org.example"))
+			Expect(normalizeID("acct-123")).To(Equal("acct-123"))
+		})
+	})
+
+	Context("when extra fields carry numeric IDs", func() {
+		It("should extract org and account IDs as exact strings", func() {
+			user := &authenticationv1.UserInfo{
+				Username: "test-user",
+				Extra: map[string]authenticationv1.ExtraValue{
+					"org_id":         {"1.8446744073709551617e+19"},
+					"account_number": {"9007199254740993"},
+				},
+			}
+
+			orgID, _ := handler.extractOrgIDFromUser(user)
+			Expect(orgID).To(Equal("18446744073709551617"))
+			account, _ := handler.extractAccountNumberFromUser(user)
+			Expect(account).To(Equal("9007199254740993"))
+		})
+	})
+})
+
+var _ = Describe("HandleUpload produced events", func() {
+	var (
+		handler  *Handler
+		store    *fakeObjectStore
+		producer *mocks.FakeProducer
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		storageClient, objectStore := newFakeStorage()
+		store = objectStore
+		producer = mocks.NewFakeProducer()
+
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Storage.UsagePathPrefix = "usage"
+		cfg.Upload.ForwardUsageFiles = true
+		handler = NewHandler(cfg, storageClient, producer, logger)
+		handler.now = func() time.Time { return time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC) }
+	})
+
+	upload := func() (*httptest.ResponseRecorder, UploadResponse) {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+
+		var response UploadResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		return recorder, response
+	}
+
+	It("should publish the ROS, usage and validation messages for a stored upload", func() {
+		recorder, response := upload()
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(producer.Calls()).To(Equal([]string{"SendROSEvent", "SendUsageEvent", "SendValidationMessage"}))
+
+		rosEvents := producer.ROSEvents()
+		Expect(rosEvents).To(HaveLen(1))
+		rosEvent := rosEvents[0]
+		Expect(rosEvent.RequestID).To(Equal(response.RequestID))
+		Expect(rosEvent.B64Identity).To(Equal("test-token"))
+		Expect(rosEvent.Metadata).To(Equal(messaging.ROSMetadata{
+			Account:         "67890",
+			OrgID:           "12345",
+			SourceID:        "test-cluster-456",
+			ProviderUUID:    "test-cluster-456",
+			ClusterUUID:     "test-cluster-456",
+			ClusterAlias:    "test-cluster",
+			OperatorVersion: "1.0.0",
+			Certified:       true,
+			IngestedAt:      time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC),
+		}))
+		Expect(rosEvent.Files).To(HaveLen(1))
+		Expect(rosEvent.ObjectKeys).To(HaveLen(1))
+		Expect(rosEvent.ObjectKeys[0]).To(HaveSuffix("/ros-data.csv"))
+
+		usageEvents := producer.UsageEvents()
+		Expect(usageEvents).To(HaveLen(1))
+		Expect(usageEvents[0].RequestID).To(Equal(response.RequestID))
+		Expect(usageEvents[0].Metadata).To(Equal(rosEvent.Metadata))
+		Expect(usageEvents[0].ObjectKeys).To(HaveLen(1))
+		Expect(usageEvents[0].ObjectKeys[0]).To(HavePrefix("usage/"))
+		Expect(usageEvents[0].ObjectKeys[0]).To(HaveSuffix("/usage.csv"))
+
+		Expect(producer.ValidationMessages()).To(Equal([]messaging.ValidationMessage{
+			{RequestID: response.RequestID, Validation: "success"},
+		}))
+
+		// Every announced object was stored before the events were sent
+		Expect(store.Keys()).To(ConsistOf(
+			"test-bucket/"+rosEvent.ObjectKeys[0],
+			"test-bucket/"+usageEvents[0].ObjectKeys[0],
+		))
+	})
+
+	It("should carry the resolved identity as an x-rh-identity header with the rh-identity format", func() {
+		handler.config.Kafka.IdentityFormat = config.IdentityFormatRHIdentity
+
+		recorder, _ := upload()
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		rosEvents := producer.ROSEvents()
+		Expect(rosEvents).To(HaveLen(1))
+		decoded, err := base64.StdEncoding.DecodeString(rosEvents[0].B64Identity)
+		Expect(err).ToNot(HaveOccurred())
+
+		var xrhid identity.XRHID
+		Expect(json.Unmarshal(decoded, &xrhid)).To(Succeed())
+		Expect(xrhid.Identity.OrgID).To(Equal("12345"))
+		Expect(xrhid.Identity.AccountNumber).To(Equal("67890"))
+		Expect(xrhid.Identity.Internal.OrgID).To(Equal("12345"))
+
+		// Usage events carry the same identity
+		Expect(producer.UsageEvents()[0].B64Identity).To(Equal(rosEvents[0].B64Identity))
+	})
+
+	It("should fail the upload without a validation message when the ROS event is not delivered", func() {
+		producer.SendROSEventErr = errors.New("broker unavailable")
+
+		recorder, _ := upload()
+		Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(producer.Calls()).To(Equal([]string{"SendROSEvent"}))
+		Expect(producer.ValidationMessages()).To(BeEmpty())
+	})
+
+	It("should ask the client to retry when the producer queue is full", func() {
+		producer.SendROSEventErr = fmt.Errorf("failed to produce message: %w", messaging.ErrQueueFull)
+
+		recorder, _ := upload()
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal(strconv.Itoa(producerQueueFullRetryAfter)))
+	})
+
+	It("should reject the upload when the ROS event exceeds the Kafka message size limit", func() {
+		producer.SendROSEventErr = fmt.Errorf("failed to produce message: %w", messaging.ErrMessageTooLarge)
+
+		recorder, _ := upload()
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(recorder.Body.String()).To(ContainSubstring("too many or too large ROS files"))
+		Expect(producer.ValidationMessages()).To(BeEmpty())
+	})
+
+	It("should still accept the upload when the validation message fails", func() {
+		producer.SendValidationMessageErr = errors.New("broker unavailable")
+
+		recorder, _ := upload()
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(producer.ROSEvents()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("HandleUpload storage", func() {
+	var (
+		handler  *Handler
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Storage.UsagePathPrefix = "usage"
+		cfg.Upload.ForwardUsageFiles = true
+		handler = NewHandler(cfg, store, producer, logger)
+	})
+
+	DescribeTable("upload outcomes",
+		func(configure func(), expectedCode int, expectedCalls []string) {
+			configure()
+
+			payload, err := DefaultTestPayloadFactory().Build()
+			Expect(err).ToNot(HaveOccurred())
+			recorder := httptest.NewRecorder()
+			handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+
+			Expect(recorder.Code).To(Equal(expectedCode))
+			Expect(producer.Calls()).To(Equal(expectedCalls))
+		},
+		Entry("stores the files and publishes their events",
+			func() {},
+			http.StatusAccepted, []string{"SendROSEvent", "SendUsageEvent", "SendValidationMessage"}),
+		Entry("fails without publishing when the store is unavailable",
+			func() { store.UploadErr = errors.New("connection refused") },
+			http.StatusInternalServerError, nil),
+		Entry("reports a conflict when an object already exists",
+			func() { store.UploadErr = fmt.Errorf("%w: org_12345/ros-data.csv", storage.ErrObjectExists) },
+			http.StatusConflict, nil),
+		Entry("fails without publishing when a usage file can't be stored",
+			func() {
+				store.UploadErr = errors.New("connection reset")
+				store.FailUploadsAfter(1)
+			},
+			http.StatusInternalServerError, nil),
+		Entry("sheds the upload when the retry budget is exhausted",
+			func() { store.UploadErr = fmt.Errorf("failed to upload to MinIO: %w", retry.ErrBudgetExhausted) },
+			http.StatusServiceUnavailable, nil),
+	)
+
+	It("should ask the client to retry later when the retry budget is exhausted", func() {
+		store.UploadErr = fmt.Errorf("failed to upload to MinIO: %w", retry.ErrBudgetExhausted)
+
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal(strconv.Itoa(retryBudgetRetryAfter)))
+	})
+
+	It("should store a file listed as both usage and ROS only once, as a ROS file", func() {
+		payload, err := DefaultTestPayloadFactory().WithUsageFiles("usage.csv", "ros-data.csv").Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		Expect(store.Uploads()).To(HaveLen(2))
+		Expect(producer.ROSEvents()[0].ObjectKeys).To(ConsistOf(HaveSuffix("/ros-data.csv")))
+		Expect(producer.UsageEvents()[0].ObjectKeys).To(ConsistOf(HaveSuffix("/usage.csv")))
+	})
+
+	It("should partition a manifest date with a non-UTC offset by its UTC date when configured", func() {
+		handler.partitionTZ = time.UTC
+		date := time.Date(2024, 3, 5, 22, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+		payload, err := DefaultTestPayloadFactory().WithDate(date).Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		Expect(store.Keys()).To(ContainElement("org_12345/source=test-cluster-456/date=2024-03-06/ros-data.csv"))
+	})
+
+	It("should upload each file under the tenant schema with its manifest metadata", func() {
+		payload, err := DefaultTestPayloadFactory().WithDate(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)).Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		Expect(store.Keys()).To(Equal([]string{
+			"org_12345/source=test-cluster-456/date=2024-03-05/ros-data.csv",
+			"usage/org_12345/source=test-cluster-456/date=2024-03-05/usage.csv",
+		}))
+
+		uploads := store.Uploads()
+		Expect(uploads).To(HaveLen(2))
+		Expect(uploads[0].ContentType).To(Equal("text/csv"))
+		Expect(uploads[0].Metadata).To(HaveKeyWithValue("ManifestId", "test-uuid-123"))
+
+		rosEvents := producer.ROSEvents()
+		Expect(rosEvents).To(HaveLen(1))
+		Expect(rosEvents[0].Files).To(Equal([]string{
+			"https://storage.example.com/org_12345/source=test-cluster-456/date=2024-03-05/ros-data.csv?signed=true",
+		}))
+	})
+})
+
+var _ = Describe("HandleUpload total ROS bytes", func() {
+	var (
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	// upload sends a payload whose two ROS files hold 22 bytes each
+	upload := func(maxTotalROSBytes int64) *httptest.ResponseRecorder {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.MaxTotalROSBytes = maxTotalROSBytes
+		handler := NewHandler(cfg, store, producer, logger)
+
+		payload, err := DefaultTestPayloadFactory().WithROSFiles("ros-a.csv", "ros-b.csv").Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		return recorder
+	}
+
+	It("should reject with 413 when the ROS files together exceed the cap", func() {
+		recorder := upload(30)
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(recorder.Body.String()).To(ContainSubstring("ROS files exceed the maximum total size"))
+		Expect(store.Uploads()).To(BeEmpty())
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+
+	It("should accept ROS files totalling exactly the cap", func() {
+		Expect(upload(44).Code).To(Equal(http.StatusAccepted))
+		Expect(store.Uploads()).To(HaveLen(2))
+	})
+
+	It("should not cap the ROS files by default", func() {
+		Expect(upload(0).Code).To(Equal(http.StatusAccepted))
+	})
+})
+
+var _ = Describe("HandleUpload certified operator requirement", func() {
+	var (
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	upload := func(requireCertified, certified bool) *httptest.ResponseRecorder {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.RequireCertified = requireCertified
+		handler := NewHandler(cfg, store, producer, logger)
+
+		factory := DefaultTestPayloadFactory()
+		factory.Certified = certified
+		payload, err := factory.Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		return recorder
+	}
+
+	It("should reject uncertified payloads with 403 when certification is required", func() {
+		recorder := upload(true, false)
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(recorder.Body.String()).To(ContainSubstring("Only payloads of certified operators are accepted"))
+		Expect(store.Uploads()).To(BeEmpty())
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+
+	It("should accept certified payloads when certification is required", func() {
+		Expect(upload(true, true).Code).To(Equal(http.StatusAccepted))
+		Expect(store.Uploads()).To(HaveLen(1))
+	})
+
+	It("should accept uncertified payloads by default", func() {
+		Expect(upload(false, false).Code).To(Equal(http.StatusAccepted))
+		Expect(store.Uploads()).To(HaveLen(1))
+	})
+
+	It("should accept certified payloads by default", func() {
+		Expect(upload(false, true).Code).To(Equal(http.StatusAccepted))
+	})
+})
+
+var _ = Describe("HandleUpload size limit by content type", func() {
+	upload := func(maxUploadSize int64, maxSizeByType map[string]int64, contentType string) *httptest.ResponseRecorder {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.MaxUploadSize = maxUploadSize
+		cfg.Upload.MaxSizeByType = maxSizeByType
+		handler := NewHandler(cfg, storagemocks.NewFakeClient(), mocks.NewFakeProducer(), logger)
+
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		Expect(req.ParseMultipartForm(10 * 1024 * 1024)).To(Succeed())
+		req.MultipartForm.File["file"][0].Header.Set("Content-Type", contentType)
+
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		return recorder
+	}
+
+	Context("with a smaller limit for gzip", func() {
+		limits := map[string]int64{"application/gzip": 64}
+
+		It("should reject gzip files over the type's limit with 413", func() {
+			recorder := upload(10*1024*1024, limits, "application/gzip")
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(recorder.Body.String()).To(ContainSubstring("File too large"))
+		})
+
+		It("should match the type without its parameters", func() {
+			Expect(upload(10*1024*1024, limits, "application/gzip; charset=binary").Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("should apply the global limit to other types", func() {
+			Expect(upload(10*1024*1024, limits, "application/vnd.redhat.hccm.upload").Code).To(Equal(http.StatusAccepted))
+		})
+	})
+
+	Context("with a larger limit than the global one", func() {
+		limits := map[string]int64{"application/vnd.redhat.hccm.upload": 10 * 1024 * 1024}
+
+		It("should accept files of that type over the global limit", func() {
+			Expect(upload(64, limits, "application/vnd.redhat.hccm.upload").Code).To(Equal(http.StatusAccepted))
+		})
+
+		It("should still apply the global limit to other types", func() {
+			Expect(upload(64, limits, "application/gzip").Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+})
+
+var _ = Describe("HandleUpload gzip request body", func() {
+	var (
+		store *storagemocks.FakeClient
+		// decoded counts the bytes the handler read from the decoded body
+		decoded int64
+	)
+
+	// upload sends the multipart request of payload gzipped, decoded by the encodings middleware
+	upload := func(payload []byte) *httptest.ResponseRecorder {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.MaxUploadSize = 1024 * 1024
+		handler := NewHandler(cfg, store, mocks.NewFakeProducer(), logger)
+
+		req := newPayloadUploadRequest(payload)
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		_, err := io.Copy(gz, req.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gz.Close()).To(Succeed())
+		req.Body = io.NopCloser(&compressed)
+		req.ContentLength = int64(compressed.Len())
+		req.Header.Set("Content-Encoding", "gzip")
+
+		decoded = 0
+		countDecoded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, writerFunc(func(p []byte) (int, error) {
+				decoded += int64(len(p))
+				return len(p), nil
+			})), r.Body}
+			handler.HandleUpload(w, r)
+		})
+
+		recorder := httptest.NewRecorder()
+		middleware.AllowEncodings(middleware.EncodingIdentity, middleware.EncodingGzip)(countDecoded).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should accept a gzipped upload within the limit", func() {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(upload(payload).Code).To(Equal(http.StatusAccepted))
+		Expect(store.Uploads()).To(HaveLen(1))
+	})
+
+	It("should reject a small gzip body that decodes beyond the limit with 413", func() {
+		// 64MB of zeros compress to about 64KB, well within the declared size limit
+		recorder := upload(make([]byte, 64*1024*1024))
+
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(recorder.Body.String()).To(ContainSubstring("File too large"))
+		Expect(store.Uploads()).To(BeEmpty())
+		// Decoding stops at the limit instead of expanding the whole body to disk
+		Expect(decoded).To(BeNumerically("<=", 1024*1024+multipartOverheadAllowance+1))
+	})
+})
+
+// writerFunc adapts a function to an io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+var _ = Describe("HandleUpload manifest UUID header", func() {
+	var (
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	// upload sends a payload whose manifest uuid is "test-uuid-123"
+	upload := func(required bool, header string) *httptest.ResponseRecorder {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.RequireManifestUUID = required
+		handler := NewHandler(cfg, store, producer, logger)
+
+		payload, err := DefaultTestPayloadFactory().WithUUID("test-uuid-123").Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		if header != "" {
+			req.Header.Set("X-Manifest-UUID", header)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		return recorder
+	}
+
+	Context("when the header is required", func() {
+		It("should accept a header matching the manifest uuid", func() {
+			Expect(upload(true, "TEST-UUID-123").Code).To(Equal(http.StatusAccepted))
+			Expect(store.Uploads()).ToNot(BeEmpty())
+		})
+
+		It("should reject a mismatching header with 422 before storing anything", func() {
+			recorder := upload(true, "other-uuid")
+			Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(recorder.Body.String()).To(ContainSubstring("does not match the X-Manifest-UUID header"))
+			Expect(store.Uploads()).To(BeEmpty())
+			Expect(producer.Calls()).To(BeEmpty())
+		})
+
+		It("should reject a missing header with 400", func() {
+			recorder := upload(true, "")
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring("X-Manifest-UUID header required"))
+			Expect(store.Uploads()).To(BeEmpty())
+		})
+	})
+
+	It("should ignore the header by default", func() {
+		Expect(upload(false, "other-uuid").Code).To(Equal(http.StatusAccepted))
+		Expect(upload(false, "").Code).To(Equal(http.StatusAccepted))
+	})
+})
+
+var _ = Describe("HandleUpload empty org schema", func() {
+	var (
+		handler  *Handler
+		store    *storagemocks.FakeClient
+		producer *mocks.FakeProducer
+	)
+
+	newHandler := func(mode, defaultSchema string) {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.EmptyOrgSchema = mode
+		cfg.Upload.DefaultSchema = defaultSchema
+
+		store = storagemocks.NewFakeClient()
+		producer = mocks.NewFakeProducer()
+		handler = NewHandler(cfg, store, producer, newTestLogger())
+	}
+
+	// upload sends a payload from a user whose org_id claim is blank
+	upload := func() *httptest.ResponseRecorder {
+		payload, err := DefaultTestPayloadFactory().WithDate(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)).Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		req = req.WithContext(context.WithValue(req.Context(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{
+			Username: "test-user",
+			Extra: map[string]authenticationv1.ExtraValue{
+				"org_id":         {""},
+				"account_number": {"67890"},
+			},
+		}))
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		return recorder
+	}
+
+	It("should store the files under the configured default schema", func() {
+		newHandler("default", "shared")
+
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+		Expect(store.Keys()).To(Equal([]string{"shared/source=test-cluster-456/date=2024-03-05/ros-data.csv"}))
+		Expect(producer.ROSEvents()[0].Metadata.OrgID).To(BeEmpty())
+	})
+
+	It("should store the files under the account schema", func() {
+		newHandler("account", "")
+
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+		Expect(store.Keys()).To(Equal([]string{"acct_67890/source=test-cluster-456/date=2024-03-05/ros-data.csv"}))
+		Expect(producer.ROSEvents()[0].Metadata.Account).To(Equal("67890"))
+	})
+
+	It("should reject the upload without storing or publishing anything", func() {
+		newHandler("reject", "")
+
+		recorder := upload()
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(recorder.Body.String()).To(ContainSubstring("Identity must carry an org_id"))
+		Expect(store.Keys()).To(BeEmpty())
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+
+	It("should still store uploads with an org ID under the org schema", func() {
+		newHandler("reject", "")
+
+		payload, err := DefaultTestPayloadFactory().WithDate(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)).Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(store.Keys()).To(Equal([]string{"org_12345/source=test-cluster-456/date=2024-03-05/ros-data.csv"}))
+	})
+})
+
+var _ = Describe("getSchemaName", func() {
+	newHandler := func(mode, defaultSchema string) *Handler {
+		cfg := newTestConfig()
+		cfg.Upload.EmptyOrgSchema = mode
+		cfg.Upload.DefaultSchema = defaultSchema
+		return NewHandler(cfg, nil, nil, newTestLogger())
+	}
+
+	withOrg := &identity.Identity{OrgID: "12345", AccountNumber: "67890"}
+	internalOrg := &identity.Identity{Internal: identity.Internal{OrgID: "12345"}}
+	withoutOrg := &identity.Identity{AccountNumber: "67890"}
+	withoutIDs := &identity.Identity{}
+
+	DescribeTable("should derive the schema",
+		func(mode, defaultSchema string, id *identity.Identity, expected string) {
+			schema, err := newHandler(mode, defaultSchema).getSchemaName(id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schema).To(Equal(expected))
+		},
+		Entry("from the org ID", "reject", "", withOrg, "org_12345"),
+		Entry("from the internal org ID the events also carry", "reject", "", internalOrg, "org_12345"),
+		Entry("as default when unconfigured", "", "", withoutOrg, "default"),
+		Entry("as the configured default schema", "default", "shared", withoutOrg, "shared"),
+		Entry("as the default schema without an identity", "default", "shared", nil, "shared"),
+		Entry("from the account number", "account", "", withoutOrg, "acct_67890"),
+	)
+
+	DescribeTable("should refuse to derive a schema",
+		func(mode string, id *identity.Identity) {
+			_, err := newHandler(mode, "").getSchemaName(id)
+			Expect(err).To(MatchError(ErrNoSchema))
+		},
+		Entry("in reject mode", "reject", withoutOrg),
+		Entry("in reject mode without an identity", "reject", nil),
+		Entry("in account mode without an account number", "account", withoutIDs),
+		Entry("in account mode without an identity", "account", nil),
+	)
+})
+
+var _ = Describe("partitionDate", func() {
+	newHandler := func(timezone string) *Handler {
+		cfg := newTestConfig()
+		cfg.Storage.PartitionTimezone = timezone
+		return NewHandler(cfg, nil, nil, newTestLogger())
+	}
+
+	lateEvening := time.Date(2024, 3, 5, 22, 30, 0, 0, time.FixedZone("", -5*60*60))
+	earlyMorning := time.Date(2024, 3, 6, 1, 0, 0, 0, time.FixedZone("", 9*60*60))
+
+	DescribeTable("should format the date in the configured timezone",
+		func(timezone string, date time.Time, expected string) {
+			Expect(newHandler(timezone).partitionDate(date)).To(Equal(expected))
+		},
+		Entry("keeps a negative offset by default", "", lateEvening, "2024-03-05"),
+		Entry("keeps a positive offset by default", "", earlyMorning, "2024-03-06"),
+		Entry("moves a negative offset forward in UTC", "UTC", lateEvening, "2024-03-06"),
+		Entry("moves a positive offset back in UTC", "UTC", earlyMorning, "2024-03-05"),
+		Entry("converts to a named timezone", "America/New_York", time.Date(2024, 3, 6, 2, 0, 0, 0, time.UTC), "2024-03-05"),
+	)
+
+	It("should put the same instant in the same partition whatever its offset", func() {
+		handler := newHandler("UTC")
+		Expect(handler.partitionDate(lateEvening)).To(Equal(handler.partitionDate(lateEvening.In(time.FixedZone("", 9*60*60)))))
+	})
+
+	It("should keep the manifest offset when the timezone is invalid", func() {
+		Expect(newHandler("Mars/Olympus_Mons").partitionDate(lateEvening)).To(Equal("2024-03-05"))
+	})
+
+	DescribeTable("should format the date at the configured granularity",
+		func(granularity, expected string) {
+			handler := newHandler("UTC")
+			handler.config.Storage.DateGranularity = granularity
+			Expect(handler.partitionDate(lateEvening)).To(Equal(expected))
+		},
+		Entry("by hour", "hour", "2024-03-06T03"),
+		Entry("by day", "day", "2024-03-06"),
+		Entry("by month", "month", "2024-03"),
+		Entry("by day by default", "", "2024-03-06"),
+	)
+})
+
+var _ = Describe("HandleUpload date partition granularity", func() {
+	DescribeTable("should store every object under the partition of the configured granularity",
+		func(granularity, partition string) {
+			logger := logrus.New()
+			logger.SetLevel(logrus.FatalLevel)
+
+			store := storagemocks.NewFakeClient()
+			producer := mocks.NewFakeProducer()
+			cfg := newTestConfig()
+			cfg.Auth.Enabled = true
+			cfg.Storage.UsagePathPrefix = "usage"
+			cfg.Storage.PartitionTimezone = "UTC"
+			cfg.Storage.DateGranularity = granularity
+			cfg.Storage.WriteChecksumManifest = true
+			cfg.Upload.ForwardUsageFiles = true
+			handler := NewHandler(cfg, store, producer, logger)
+
+			payload, err := DefaultTestPayloadFactory().WithDate(time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)).Build()
+			Expect(err).ToNot(HaveOccurred())
+			recorder := httptest.NewRecorder()
+			handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+			Expect(store.Keys()).To(ConsistOf(
+				"org_12345/source=test-cluster-456/date="+partition+"/ros-data.csv",
+				"usage/org_12345/source=test-cluster-456/date="+partition+"/usage.csv",
+				MatchRegexp(`^org_12345/source=test-cluster-456/date=`+partition+`/checksums-.+\.json$`),
+			))
+		},
+		Entry("by hour", "hour", "2024-03-05T14"),
+		Entry("by day", "day", "2024-03-05"),
+		Entry("by month", "month", "2024-03"),
+	)
+})
+
+var _ = Describe("HandleUpload response verbosity", func() {
+	var handler *Handler
+
+	BeforeEach(func() {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Storage.UsagePathPrefix = "usage"
+		cfg.Upload.ForwardUsageFiles = true
+		handler, _, _ = newTestHandler(cfg)
+	})
+
+	// upload sends a payload with the given query and Accept header and returns the decoded response fields
+	upload := func(query, accept string) map[string]json.RawMessage {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		req := newPayloadUploadRequest(payload)
+		req.URL.RawQuery = query
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		var fields map[string]json.RawMessage
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &fields)).To(Succeed())
+		return fields
+	}
+
+	files := func(fields map[string]json.RawMessage) []UploadedFile {
+		var uploaded []UploadedFile
+		Expect(json.Unmarshal(fields["files"], &uploaded)).To(Succeed())
+		return uploaded
+	}
+
+	It("should keep the current shape by default", func() {
+		fields := upload("", "")
+		Expect(fields).To(HaveKey("request_id"))
+		Expect(fields).To(HaveKey("upload"))
+		Expect(fields).ToNot(HaveKey("files"))
+	})
+
+	It("should return only the request ID when compact", func() {
+		fields := upload("verbosity=compact", "")
+		Expect(fields).To(HaveLen(1))
+		Expect(fields).To(HaveKey("request_id"))
+	})
+
+	It("should list the stored files when verbose", func() {
+		fields := upload("verbosity=verbose", "")
+		Expect(fields).To(HaveKey("upload"))
+
+		uploaded := files(fields)
+		Expect(uploaded).To(HaveLen(2))
+		Expect(uploaded[0].Kind).To(Equal("ros"))
+		Expect(uploaded[0].ObjectKey).To(HaveSuffix("/ros-data.csv"))
+		Expect(uploaded[1].Kind).To(Equal("usage"))
+		Expect(uploaded[1].ObjectKey).To(HaveSuffix("/usage.csv"))
+	})
+
+	It("should take the verbosity from the Accept header", func() {
+		fields := upload("", "text/plain, application/json; verbosity=compact")
+		Expect(fields).To(HaveLen(1))
+		Expect(fields).To(HaveKey("request_id"))
+	})
+
+	It("should prefer the query parameter over the Accept header", func() {
+		fields := upload("verbosity=verbose", "application/json; verbosity=compact")
+		Expect(files(fields)).To(HaveLen(2))
+	})
+
+	It("should not list the stored files when verbose responses are switched off", func() {
+		flags, err := features.New(features.Defaults, []string{"FEATURE_VERBOSE_RESPONSES=false"}, newTestLogger())
+		Expect(err).ToNot(HaveOccurred())
+		handler.SetFeatureFlags(flags)
+
+		fields := upload("verbosity=verbose", "")
+		Expect(fields).To(HaveKey("upload"))
+		Expect(fields).ToNot(HaveKey("files"))
+
+		Expect(flags.Set(features.VerboseResponses, "true")).To(Succeed())
+		Expect(files(upload("verbosity=verbose", ""))).To(HaveLen(2))
+	})
+
+	It("should fall back to the default shape for an unknown verbosity", func() {
+		fields := upload("verbosity=loud", "")
+		Expect(fields).To(HaveKey("upload"))
+		Expect(fields).ToNot(HaveKey("files"))
+	})
+})
+
+var _ = Describe("Upload processing without an identity", func() {
+	var (
+		store    *fakeObjectStore
+		producer *mocks.FakeProducer
+	)
+
+	newHandler := func(authEnabled bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = authEnabled
+
+		var handler *Handler
+		handler, store, producer = newTestHandler(cfg)
+		return handler
+	}
+
+	process := func(handler *Handler) error {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// The OAuth token is read from the context when building the ROS event
+		ctx := context.WithValue(context.Background(), auth.OauthTokenKey, "test-token")
+		_, err = handler.processUpload(ctx, bytes.NewReader(payload), "request-1", "", nil, logrus.NewEntry(handler.logger))
+		return err
+	}
+
+	It("should refuse to store anything when auth is enabled", func() {
+		Expect(process(newHandler(true))).To(MatchError(ErrMissingIdentity))
+		Expect(store.Keys()).To(BeEmpty())
+		Expect(producer.Calls()).To(BeEmpty())
+	})
+
+	It("should reject the upload request before reading the body when auth is enabled", func() {
+		handler := newHandler(true)
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("payload"))
+		recorder := httptest.NewRecorder()
+
+		handler.HandleUpload(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(store.Keys()).To(BeEmpty())
+	})
+
+	It("should process the upload under the unknown org when auth is disabled", func() {
+		Expect(process(newHandler(false))).To(Succeed())
+		Expect(producer.ROSEvents()).To(HaveLen(1))
+		Expect(producer.ROSEvents()[0].Metadata.OrgID).To(Equal("unknown"))
+	})
+})
+
+var _ = Describe("HandleUpload outbox", func() {
+	var (
+		dir      string
+		store    *outbox.FileStore
+		producer *mocks.FakeProducer
+		handler  *Handler
+		logger   *logrus.Logger
+	)
+
+	BeforeEach(func() {
+		logger = logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+
+		var err error
+		dir = GinkgoT().TempDir()
+		store, err = outbox.NewFileStore(dir)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(store.Close)
+		producer = mocks.NewFakeProducer()
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		handler = NewHandler(cfg, storagemocks.NewFakeClient(), producer, logger)
+		handler.SetOutbox(store)
+	})
+
+	upload := func() *httptest.ResponseRecorder {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, newPayloadUploadRequest(payload))
+		return recorder
+	}
+
+	It("should mark the outbox entry done once the events are published", func() {
+		Expect(upload().Code).To(Equal(http.StatusAccepted))
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should leave the events of a failed publish for the relay to publish", func() {
+		producer.SendROSEventErr = errors.New("broker unavailable")
+		recorder := upload()
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		// The upload is reported queued, so the client doesn't retry it into a duplicate
+		var response UploadResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		status, found := handler.statuses.Get(response.RequestID)
+		Expect(found).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusQueued))
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].ROS.ObjectKeys).To(ConsistOf(MatchRegexp(`^org_12345/source=test-cluster-456/date=.+/ros-data.csv$`)))
+
+		// The relay of a restarted process publishes the stored upload's events
+		restarted := mocks.NewFakeProducer()
+		relay := outbox.NewRelay(store, restarted, time.Minute, 0, 0, logger)
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+		Expect(restarted.ROSEvents()).To(HaveLen(1))
+		Expect(restarted.ROSEvents()[0].RequestID).To(Equal(pending[0].RequestID))
+
+		pending, err = store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should report a background publish left to the relay as queued", func() {
+		handler.config.Upload.AckMode = ackModeAsync
+		producer.SendROSEventErr = errors.New("broker unavailable")
+		recorder := upload()
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(handler.WaitForBackground(context.Background())).To(Succeed())
+
+		var response UploadResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		status, found := handler.statuses.Get(response.RequestID)
+		Expect(found).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusQueued))
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+	})
+
+	It("should drop the outbox entry of events too large to ever publish", func() {
+		producer.SendROSEventErr = fmt.Errorf("ros event: %w", messaging.ErrMessageTooLarge)
+		Expect(upload().Code).To(Equal(http.StatusRequestEntityTooLarge))
+
+		pending, err := store.Pending()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should not write the uploader's token to the outbox", func() {
+		producer.SendROSEventErr = errors.New("broker unavailable")
+		upload()
+
+		files, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).ToNot(BeEmpty())
+		for _, file := range files {
+			data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).ToNot(ContainSubstring("test-token"))
+		}
+
+		// Relayed events in the token format carry no identity, since the token isn't kept
+		restarted := mocks.NewFakeProducer()
+		relay := outbox.NewRelay(store, restarted, time.Minute, 0, 0, logger)
+		relay.SetIdentityEncoder(handler.RelayedEventIdentity)
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+		Expect(restarted.ROSEvents()[0].B64Identity).To(BeEmpty())
+	})
+
+	It("should rebuild the rh-identity of relayed events from the kept identity", func() {
+		handler.config.Kafka.IdentityFormat = config.IdentityFormatRHIdentity
+		producer.SendROSEventErr = errors.New("broker unavailable")
+		upload()
+
+		restarted := mocks.NewFakeProducer()
+		relay := outbox.NewRelay(store, restarted, time.Minute, 0, 0, logger)
+		relay.SetIdentityEncoder(handler.RelayedEventIdentity)
+		Expect(relay.RelayPending(context.Background())).To(Equal(1))
+
+		decoded, err := base64.StdEncoding.DecodeString(restarted.ROSEvents()[0].B64Identity)
+		Expect(err).ToNot(HaveOccurred())
+		var xrhid identity.XRHID
+		Expect(json.Unmarshal(decoded, &xrhid)).To(Succeed())
+		Expect(xrhid.Identity.OrgID).To(Equal("12345"))
+		Expect(xrhid.Identity.AccountNumber).To(Equal("67890"))
+	})
+})
+
+var _ = Describe("isValidContentType", func() {
+	var handler *Handler
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		handler = NewHandler(&config.Config{
+			Upload: config.UploadConfig{
+				AllowedTypes: []string{"application/x-tar", "application/vnd.redhat.hccm.upload"},
+			},
+		}, nil, nil, logger)
+	})
+
+	DescribeTable("should match allowed types whatever parameters are appended",
+		func(contentType string, valid bool) {
+			Expect(handler.isValidContentType(contentType)).To(Equal(valid))
+		},
+		Entry("exact type", "application/x-tar", true),
+		Entry("charset", "application/x-tar; charset=utf-8", true),
+		Entry("charset without space", "application/x-tar;charset=binary", true),
+		Entry("boundary", `application/x-tar; boundary="----abc123"`, true),
+		Entry("several parameters", "application/x-tar; charset=UTF-8; boundary=xyz", true),
+		Entry("different case", "Application/X-Tar; charset=utf-8", true),
+		Entry("upload type with charset", "application/vnd.redhat.hccm.upload; charset=utf-8", true),
+		Entry("gzip with charset", "application/gzip; charset=binary", true),
+		Entry("other type with charset", "text/plain; charset=utf-8", false),
+		Entry("allowed type as a prefix", "application/x-tarball", false),
+	)
+})
@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+)
+
+// identityCache caches identities derived from OAuth2 users, keyed by a hash of the bearer token
+// A nil cache is valid and derives the identity on every call
+type identityCache struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	entries      map[string]identityCacheEntry
+	lastEviction time.Time
+	now          func() time.Time
+}
+
+type identityCacheEntry struct {
+	derived   derivedIdentity
+	expiresAt time.Time
+}
+
+// derivedIdentity is an identity along with how its org ID and account number were derived
+// The derivations are kept with cached identities so uploads can be counted without deriving again
+type derivedIdentity struct {
+	identity          *identity.Identity
+	source            string
+	orgDerivation     string
+	accountDerivation string
+}
+
+// newIdentityCache creates an identity cache, returning nil when ttl is not positive
+func newIdentityCache(ttl time.Duration) *identityCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &identityCache{
+		ttl:     ttl,
+		entries: make(map[string]identityCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// getOrDerive returns the cached derivation for token, calling derive on a miss or after expiry
+// Callers get their own deep copy, so modifying it, including its user, can't change the cached identity
+func (c *identityCache) getOrDerive(token string, derive func() *derivedIdentity) *derivedIdentity {
+	if c == nil || token == "" {
+		return derive()
+	}
+
+	key := tokenKey(token)
+
+	c.mu.Lock()
+	now := c.now()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.derived.clone()
+	}
+
+	derived := derive()
+	if derived == nil || derived.identity == nil {
+		return derived
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictExpired(now)
+	c.entries[key] = identityCacheEntry{derived: *derived.clone(), expiresAt: now.Add(c.ttl)}
+	return derived
+}
+
+// clone copies a derivation along with its identity
+func (d *derivedIdentity) clone() *derivedIdentity {
+	clone := *d
+	clone.identity = cloneIdentity(d.identity)
+	return &clone
+}
+
+// cloneIdentity copies an identity along with its user, the only pointer derived identities set
+// Internal is a plain struct and is copied with the identity
+func cloneIdentity(id *identity.Identity) *identity.Identity {
+	clone := *id
+	if id.User != nil {
+		user := *id.User
+		clone.User = &user
+	}
+	return &clone
+}
+
+// evictExpired removes expired entries, callers must hold the lock
+func (c *identityCache) evictExpired(now time.Time) {
+	if now.Sub(c.lastEviction) < statusEvictionInterval {
+		return
+	}
+	c.lastEviction = now
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// tokenKey hashes a bearer token so raw tokens aren't kept in memory longer than the request
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
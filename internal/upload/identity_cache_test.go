@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+var _ = Describe("identityCache", func() {
+	var (
+		cache       *identityCache
+		now         time.Time
+		derivations int
+	)
+
+	derive := func(orgID string) func() *derivedIdentity {
+		return func() *derivedIdentity {
+			derivations++
+			return &derivedIdentity{identity: &identity.Identity{OrgID: orgID}, orgDerivation: derivedFromGroup}
+		}
+	}
+
+	BeforeEach(func() {
+		derivations = 0
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		cache = newIdentityCache(time.Minute)
+		cache.now = func() time.Time { return now }
+	})
+
+	It("should derive the identity once per token within the TTL", func() {
+		for i := 0; i < 3; i++ {
+			derived := cache.getOrDerive("token-a", derive("org-a"))
+			Expect(derived.identity.OrgID).To(Equal("org-a"))
+			Expect(derived.orgDerivation).To(Equal(derivedFromGroup))
+		}
+		Expect(derivations).To(Equal(1))
+	})
+
+	It("should derive separately for each unique token", func() {
+		Expect(cache.getOrDerive("token-a", derive("org-a")).identity.OrgID).To(Equal("org-a"))
+		Expect(cache.getOrDerive("token-b", derive("org-b")).identity.OrgID).To(Equal("org-b"))
+		Expect(cache.getOrDerive("token-a", derive("org-b")).identity.OrgID).To(Equal("org-a"))
+		Expect(derivations).To(Equal(2))
+	})
+
+	It("should derive again once the TTL expires", func() {
+		cache.getOrDerive("token-a", derive("org-a"))
+		now = now.Add(time.Minute)
+		Expect(cache.getOrDerive("token-a", derive("org-new")).identity.OrgID).To(Equal("org-new"))
+		Expect(derivations).To(Equal(2))
+	})
+
+	It("should hand out copies that can't modify the cached identity", func() {
+		cache.getOrDerive("token-a", derive("org-a")).identity.OrgID = "tampered"
+		Expect(cache.getOrDerive("token-a", derive("org-a")).identity.OrgID).To(Equal("org-a"))
+	})
+
+	It("should hand out copies whose user can't modify the cached identity", func() {
+		withUser := func() *derivedIdentity {
+			return &derivedIdentity{identity: &identity.Identity{OrgID: "org-a", User: &identity.User{Email: "user@example.com"}}}
+		}
+		cache.getOrDerive("token-a", withUser).identity.User.Email = "derived@example.com"
+		cache.getOrDerive("token-a", withUser).identity.User.Email = "cached@example.com"
+		Expect(cache.getOrDerive("token-a", withUser).identity.User.Email).To(Equal("user@example.com"))
+	})
+
+	It("should not keep raw tokens as keys", func() {
+		cache.getOrDerive("token-a", derive("org-a"))
+		Expect(cache.entries).ToNot(HaveKey("token-a"))
+		Expect(cache.entries).To(HaveKey(tokenKey("token-a")))
+	})
+
+	It("should derive every time when caching is disabled", func() {
+		disabled := newIdentityCache(0)
+		Expect(disabled).To(BeNil())
+
+		disabled.getOrDerive("token-a", derive("org-a"))
+		disabled.getOrDerive("token-a", derive("org-a"))
+		Expect(derivations).To(Equal(2))
+	})
+})
+
+var _ = Describe("extractIdentity with identity caching", func() {
+	newRequest := func(token string, groups ...string) *http.Request {
+		ctx := context.WithValue(context.Background(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{
+			Username: "test-user",
+			Groups:   groups,
+		})
+		ctx = context.WithValue(ctx, auth.OauthTokenKey, token)
+		req := &http.Request{}
+		return req.WithContext(ctx)
+	}
+
+	newHandler := func(ttl int) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Auth.IdentityCacheTTL = ttl
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	It("should reuse the identity derived for the same token", func() {
+		handler := newHandler(60)
+
+		first, err := handler.extractIdentity(newRequest("token-a", "org:123"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.OrgID).To(Equal("123"))
+
+		// Claims aren't re-parsed for a cached token
+		second, err := handler.extractIdentity(newRequest("token-a", "org:456"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second.OrgID).To(Equal("123"))
+
+		other, err := handler.extractIdentity(newRequest("token-b", "org:456"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(other.OrgID).To(Equal("456"))
+	})
+
+	It("should derive the identity on every request without a token", func() {
+		handler := newHandler(60)
+		newTokenlessRequest := func(groups ...string) *http.Request {
+			req := newRequest("", groups...)
+			user := req.Context().Value(auth.AuthenticatedUserKey)
+			return req.WithContext(context.WithValue(context.Background(), auth.AuthenticatedUserKey, user))
+		}
+
+		_, err := handler.extractIdentity(newTokenlessRequest("org:123"))
+		Expect(err).ToNot(HaveOccurred())
+		second, err := handler.extractIdentity(newTokenlessRequest("org:456"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second.OrgID).To(Equal("456"))
+		Expect(handler.identities.entries).To(BeEmpty())
+	})
+
+	It("should derive the identity on every request by default", func() {
+		handler := newHandler(0)
+
+		_, err := handler.extractIdentity(newRequest("token-a", "org:123"))
+		Expect(err).ToNot(HaveOccurred())
+		second, err := handler.extractIdentity(newRequest("token-a", "org:456"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(second.OrgID).To(Equal("456"))
+	})
+})
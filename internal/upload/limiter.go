@@ -0,0 +1,75 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+)
+
+// ErrExtractionSaturated is returned when no extraction slot becomes available in time
+var ErrExtractionSaturated = errors.New("too many concurrent extractions")
+
+// extractionLimiter bounds the number of payload extractions running at once
+// A nil limiter allows unlimited concurrency
+type extractionLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// newExtractionLimiter creates a limiter allowing maxConcurrent extractions
+// Returns nil when maxConcurrent is not positive so that extraction stays unbounded
+func newExtractionLimiter(maxConcurrent int, queueTimeout time.Duration) *extractionLimiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &extractionLimiter{
+		slots:        make(chan struct{}, maxConcurrent),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire waits up to the queue timeout for an extraction slot
+// A zero queue timeout rejects immediately when the limiter is saturated
+func (l *extractionLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		health.ActiveExtractions.Inc()
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		health.ActiveExtractions.Inc()
+		return nil
+	default:
+	}
+
+	if l.queueTimeout <= 0 {
+		health.ExtractionsRejectedTotal.Inc()
+		return ErrExtractionSaturated
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		health.ActiveExtractions.Inc()
+		return nil
+	case <-timer.C:
+		health.ExtractionsRejectedTotal.Inc()
+		return ErrExtractionSaturated
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot previously obtained with acquire
+func (l *extractionLimiter) release() {
+	health.ActiveExtractions.Dec()
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,101 @@
+package upload
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("extractionLimiter", func() {
+	Context("when the limit is disabled", func() {
+		It("should return a nil limiter that never blocks", func() {
+			limiter := newExtractionLimiter(0, 0)
+			Expect(limiter).To(BeNil())
+
+			for i := 0; i < 10; i++ {
+				Expect(limiter.acquire(context.Background())).To(Succeed())
+			}
+			for i := 0; i < 10; i++ {
+				limiter.release()
+			}
+		})
+	})
+
+	Context("when the limiter is saturated", func() {
+		It("should reject immediately without a queue timeout", func() {
+			limiter := newExtractionLimiter(2, 0)
+			Expect(limiter.acquire(context.Background())).To(Succeed())
+			Expect(limiter.acquire(context.Background())).To(Succeed())
+
+			err := limiter.acquire(context.Background())
+			Expect(err).To(MatchError(ErrExtractionSaturated))
+
+			limiter.release()
+			limiter.release()
+		})
+
+		It("should reject after the queue timeout elapses", func() {
+			limiter := newExtractionLimiter(1, 50*time.Millisecond)
+			Expect(limiter.acquire(context.Background())).To(Succeed())
+			defer limiter.release()
+
+			start := time.Now()
+			err := limiter.acquire(context.Background())
+			Expect(err).To(MatchError(ErrExtractionSaturated))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+
+		It("should admit a queued extraction once a slot is released", func() {
+			limiter := newExtractionLimiter(1, 2*time.Second)
+			Expect(limiter.acquire(context.Background())).To(Succeed())
+
+			acquired := make(chan error, 1)
+			go func() {
+				acquired <- limiter.acquire(context.Background())
+			}()
+
+			Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+			limiter.release()
+			Eventually(acquired).Should(Receive(BeNil()))
+			limiter.release()
+		})
+
+		It("should stop waiting when the request context is cancelled", func() {
+			limiter := newExtractionLimiter(1, time.Minute)
+			Expect(limiter.acquire(context.Background())).To(Succeed())
+			defer limiter.release()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err := limiter.acquire(ctx)
+			Expect(err).To(MatchError(context.Canceled))
+		})
+	})
+
+	Context("when the limit is reloaded", func() {
+		It("should apply the new limit to later extractions", func() {
+			handler, _, _ := newTestHandler(newTestConfig())
+			held := handler.extractionLimiter()
+			Expect(held.acquire(context.Background())).To(Succeed())
+			Expect(handler.extractionLimiter().acquire(context.Background())).To(MatchError(ErrExtractionSaturated))
+
+			handler.SetMaxConcurrentExtractions(2)
+			reloaded := handler.extractionLimiter()
+			Expect(reloaded.acquire(context.Background())).To(Succeed())
+			Expect(reloaded.acquire(context.Background())).To(Succeed())
+			Expect(reloaded.acquire(context.Background())).To(MatchError(ErrExtractionSaturated))
+
+			// The slot taken before the reload goes back to the limiter it came from
+			held.release()
+			Expect(held.slots).To(BeEmpty())
+			reloaded.release()
+			reloaded.release()
+
+			handler.SetMaxConcurrentExtractions(0)
+			Expect(handler.extractionLimiter()).To(BeNil())
+		})
+	})
+})
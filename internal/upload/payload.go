@@ -2,15 +2,27 @@ package upload
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,6 +32,8 @@ type Manifest struct {
 	UUID                      string                 `json:"uuid"`
 	ClusterID                 string                 `json:"cluster_id"`
 	ClusterAlias              string                 `json:"cluster_alias,omitempty"`
+	SourceID                  string                 `json:"source_id,omitempty"`
+	ProviderUUID              string                 `json:"provider_uuid,omitempty"`
 	Date                      time.Time              `json:"date"`
 	Start                     *time.Time             `json:"start,omitempty"`
 	End                       *time.Time             `json:"end,omitempty"`
@@ -29,20 +43,76 @@ type Manifest struct {
 	OperatorVersion           string                 `json:"operator_version,omitempty"`
 	DailyReports              bool                   `json:"daily_reports,omitempty"`
 	CRStatus                  map[string]interface{} `json:"cr_status,omitempty"`
+
+	// dir is the manifest's directory within the archive, file references are relative to it
+	dir string
 }
 
-// PayloadExtractor handles extraction and processing of tar.gz payloads
+// Manifest parse failure reasons recorded in the manifest_parse_failures_total metric
+const (
+	manifestFailureNotFound         = "not_found"
+	manifestFailureReadError        = "read_error"
+	manifestFailureInvalidJSON      = "invalid_json"
+	manifestFailureMissingUUID      = "missing_uuid"
+	manifestFailureMissingClusterID = "missing_cluster_id"
+	manifestFailureUnknownField     = "unknown_field"
+)
+
+// ErrInvalidPayload marks payloads that were received intact but failed validation
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// InvalidPayloadError describes why a payload failed validation
+// It matches ErrInvalidPayload with errors.Is
+type InvalidPayloadError struct {
+	Reason string
+}
+
+func (e *InvalidPayloadError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidPayload, e.Reason)
+}
+
+// Is reports whether target is ErrInvalidPayload
+func (e *InvalidPayloadError) Is(target error) bool {
+	return target == ErrInvalidPayload
+}
+
+// invalidPayload creates an InvalidPayloadError with a formatted reason
+func invalidPayload(format string, args ...interface{}) error {
+	return &InvalidPayloadError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// PayloadExtractor handles extraction and processing of tar.gz and zip payloads
 type PayloadExtractor struct {
-	tempDir string
-	logger  *logrus.Logger
+	tempDir                 string
+	includeUsageFiles       bool
+	validateDateConsistency bool
+	strictManifestFields    bool
+	minOperatorVersion      *semver.Version
+	extractionTimeout       time.Duration
+	forbiddenFilePatterns   []string
+	rosFilePatterns         []string
+	keepFailedFor           time.Duration
+	maxFailedPayloads       int
+	// rejectEmptyManifestEarly stops extraction at a manifest listing no ROS files
+	rejectEmptyManifestEarly bool
+	// rejectTrailingData rejects archives followed by anything but zero padding
+	rejectTrailingData bool
+	logger             *logrus.Logger
 }
 
+// failedPayloadsDir is the temp dir subdirectory keeping the extracted files of failed uploads
+const failedPayloadsDir = "failed"
+
+// defaultMaxFailedPayloads caps the failed payloads kept when no cap is configured
+const defaultMaxFailedPayloads = 20
+
 // ExtractedPayload represents the extracted payload contents
 type ExtractedPayload struct {
-	Manifest  *Manifest
-	ROSFiles  map[string]string // filename -> file path
-	TempDir   string
-	RequestID string
+	Manifest   *Manifest
+	ROSFiles   map[string]string // filename -> file path
+	UsageFiles map[string]string // filename -> file path, only populated when usage files are included
+	TempDir    string
+	RequestID  string
 }
 
 // NewPayloadExtractor creates a new payload extractor
@@ -53,59 +123,185 @@ func NewPayloadExtractor(tempDir string, logger *logrus.Logger) *PayloadExtracto
 	}
 }
 
-// ExtractPayload extracts and validates a tar.gz payload
-func (pe *PayloadExtractor) ExtractPayload(payloadData io.Reader, requestID string) (*ExtractedPayload, error) {
+// zipMagic starts zip archives, payloads starting with anything else are read as tar.gz
+var zipMagic = []byte{0x50, 0x4b}
+
+// errExtractionTimeout is the cancellation cause when extraction exceeds the extraction timeout
+var errExtractionTimeout = errors.New("payload extraction timed out")
+
+// ExtractPayload extracts and validates a tar.gz or zip payload
+// Extraction is aborted when ctx is done or the extraction timeout elapses
+func (pe *PayloadExtractor) ExtractPayload(ctx context.Context, payloadData io.Reader, requestID string) (*ExtractedPayload, error) {
+	if pe.extractionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, pe.extractionTimeout, errExtractionTimeout)
+		defer cancel()
+	}
+
+	// Failed payloads are also reaped here, so they expire even when no further upload fails
+	if pe.keepFailedFor > 0 {
+		pe.reapFailed(time.Now())
+	}
+
 	// Create temporary directory for extraction
-	extractDir := filepath.Join(pe.tempDir, requestID)
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
+	extractDir, err := pe.createExtractionDir(requestID)
+	if err != nil {
 		return nil, fmt.Errorf("failed to create extraction directory: %w", err)
 	}
 
+	// Discard the directory on every failure path, including panics during extraction
+	extracted := false
+	defer func() {
+		if !extracted {
+			pe.discardFailed(extractDir)
+		}
+	}()
+
 	pe.logger.WithFields(logrus.Fields{
 		"request_id":  requestID,
 		"extract_dir": extractDir,
 	}).Debug("Starting payload extraction")
 
-	// Extract tar.gz content
-	extractedFiles, err := pe.extractTarGz(payloadData, extractDir)
+	// Detect the archive format by its magic bytes, gzip's 0x1f8b or zip's 0x504b
+	payload := bufio.NewReader(payloadData)
+	extract, format := pe.extractTarGz, "tar.gz"
+	if magic, _ := payload.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		extract, format = pe.extractZip, "zip"
+	}
+
+	extractedFiles, err := extract(ctx, payload, extractDir)
 	if err != nil {
-		pe.cleanup(extractDir)
-		return nil, fmt.Errorf("failed to extract tar.gz: %w", err)
+		if errors.Is(err, errExtractionTimeout) {
+			return nil, invalidPayload("payload extraction exceeded %s", pe.extractionTimeout)
+		}
+		return nil, fmt.Errorf("failed to extract %s: %w", format, err)
 	}
 
 	// Find and parse manifest.json
 	manifest, err := pe.findAndParseManifest(extractedFiles, extractDir)
 	if err != nil {
-		pe.cleanup(extractDir)
 		return nil, fmt.Errorf("failed to parse manifest: %w", err)
 	}
 
 	// Identify ROS files
 	rosFiles, err := pe.identifyROSFiles(manifest, extractedFiles, extractDir)
 	if err != nil {
-		pe.cleanup(extractDir)
 		return nil, fmt.Errorf("failed to identify ROS files: %w", err)
 	}
 
+	// Identify usage files when forwarding is enabled
+	var usageFiles map[string]string
+	if pe.includeUsageFiles {
+		usageFiles = pe.identifyUsageFiles(manifest, extractedFiles, extractDir, rosFiles)
+	}
+
 	pe.logger.WithFields(logrus.Fields{
-		"request_id":      requestID,
-		"manifest_uuid":   manifest.UUID,
-		"cluster_id":      manifest.ClusterID,
-		"ros_files_count": len(rosFiles),
+		"request_id":        requestID,
+		"manifest_uuid":     manifest.UUID,
+		"cluster_id":        manifest.ClusterID,
+		"ros_files_count":   len(rosFiles),
+		"usage_files_count": len(usageFiles),
 	}).Info("Successfully extracted payload")
 
+	extracted = true
 	return &ExtractedPayload{
-		Manifest:  manifest,
-		ROSFiles:  rosFiles,
-		TempDir:   extractDir,
-		RequestID: requestID,
+		Manifest:   manifest,
+		ROSFiles:   rosFiles,
+		UsageFiles: usageFiles,
+		TempDir:    extractDir,
+		RequestID:  requestID,
 	}, nil
 }
 
+// contextReader stops reading once its context is done, returning the cancellation cause
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.reader.Read(p)
+}
+
+// CheckTempDir verifies that dir exists and payloads can be extracted into it
+// A missing directory usually means a volume isn't mounted, so it is reported rather than created
+func CheckTempDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("upload temp dir %s is not accessible: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("upload temp dir %s is not a directory", dir)
+	}
+
+	probe, err := os.CreateTemp(dir, ".write-check-")
+	if err != nil {
+		return fmt.Errorf("upload temp dir %s is not writable: %w", dir, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// extractionDir returns the temporary directory used to extract the given request's payload
+func (pe *PayloadExtractor) extractionDir(requestID string) string {
+	return filepath.Join(pe.tempDir, requestID)
+}
+
+// createExtractionDir creates a fresh directory to extract the given request's payload into
+// If the request's directory already exists, e.g. left over from an earlier attempt with the same
+// request ID, a uniquely suffixed directory is used so files from both attempts never mix
+func (pe *PayloadExtractor) createExtractionDir(requestID string) (string, error) {
+	if err := os.MkdirAll(pe.tempDir, 0755); err != nil {
+		return "", err
+	}
+
+	dir := pe.extractionDir(requestID)
+	err := os.Mkdir(dir, 0755)
+	if err == nil {
+		return dir, nil
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+
+	pe.logger.WithFields(logrus.Fields{
+		"request_id":  requestID,
+		"extract_dir": dir,
+	}).Warn("Extraction directory already exists, using a unique directory")
+	return os.MkdirTemp(pe.tempDir, requestID+"-")
+}
+
+// countExtractionDirs returns the number of extraction directories in the temp dir
+// Only directories named after a request ID, optionally uniquely suffixed, are counted, so
+// a temp dir shared with other processes doesn't skew the count
+func (pe *PayloadExtractor) countExtractionDirs() int {
+	const uuidLength = len("00000000-0000-0000-0000-000000000000")
+
+	entries, err := os.ReadDir(pe.tempDir)
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || len(name) < uuidLength {
+			continue
+		}
+		if _, err := uuid.Parse(name[:uuidLength]); err == nil {
+			count++
+		}
+	}
+	return count
+}
+
 // extractTarGz extracts a tar.gz archive to the specified directory
-func (pe *PayloadExtractor) extractTarGz(data io.Reader, destDir string) ([]string, error) {
+func (pe *PayloadExtractor) extractTarGz(ctx context.Context, data io.Reader, destDir string) ([]string, error) {
 	// Create gzip reader
-	gzReader, err := gzip.NewReader(data)
+	gzReader, err := gzip.NewReader(&contextReader{ctx: ctx, reader: data})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 	}
@@ -119,22 +315,31 @@ func (pe *PayloadExtractor) extractTarGz(data io.Reader, destDir string) ([]stri
 	tarReader := tar.NewReader(gzReader)
 
 	var extractedFiles []string
+	entries := 0
 
 	// Extract files
 	for {
 		header, err := tarReader.Next()
+		if entries == 0 && (err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, tar.ErrHeader)) {
+			// The gzip layer was valid but didn't wrap any tar entries
+			return nil, invalidPayload("archive contains no files")
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to read tar header: %w", err)
 		}
+		entries++
 
-		// Construct file path
-		filePath := filepath.Join(destDir, header.Name)
+		// Reject the whole payload when any entry matches a forbidden pattern
+		if err := pe.checkForbiddenFile(header.Name); err != nil {
+			return nil, err
+		}
 
 		// Security check: prevent path traversal
-		if !strings.HasPrefix(filePath, destDir) {
+		filePath, ok := entryPath(destDir, header.Name)
+		if !ok {
 			pe.logger.WithField("file_path", header.Name).Warn("Skipping file with suspicious path")
 			continue
 		}
@@ -148,31 +353,107 @@ func (pe *PayloadExtractor) extractTarGz(data io.Reader, destDir string) ([]stri
 
 		case tar.TypeReg:
 			// Create regular file
-			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-				return nil, fmt.Errorf("failed to create parent directory for %s: %w", filePath, err)
+			if err := pe.writeEntry(ctx, tarReader, filePath, header.FileInfo().Mode()); err != nil {
+				return nil, err
 			}
 
-			file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode())
-			if err != nil {
-				return nil, fmt.Errorf("failed to create file %s: %w", filePath, err)
+			extractedFiles = append(extractedFiles, header.Name)
+
+			// Skip extracting the rest of a payload that can't have any ROS files
+			if filepath.Base(header.Name) == "manifest.json" && pe.rejectsEarly(filePath) {
+				return nil, invalidPayload("no ROS files specified in manifest")
 			}
 
-			if _, err := io.Copy(file, tarReader); err != nil {
-				if err := file.Close(); err != nil {
-					pe.logger.WithError(err).WithField("file_path", filePath).Warn("Failed to close file after copy error")
-				}
-				return nil, fmt.Errorf("failed to write file %s: %w", filePath, err)
+		default:
+			pe.logger.WithFields(logrus.Fields{
+				"file_path": header.Name,
+				"type_flag": header.Typeflag,
+			}).Debug("Skipping unsupported file type")
+		}
+	}
+
+	if pe.rejectTrailingData {
+		if err := checkTrailingData(&contextReader{ctx: ctx, reader: gzReader}); err != nil {
+			return nil, err
+		}
+	}
+
+	pe.logger.WithFields(logrus.Fields{
+		"dest_dir":        destDir,
+		"extracted_count": len(extractedFiles),
+	}).Debug("Extraction completed")
+
+	return extractedFiles, nil
+}
+
+// extractZip extracts a zip archive to the specified directory
+// zip archives are indexed by a central directory at their end, so the payload is first spooled to a
+// temporary file that can be read at random
+func (pe *PayloadExtractor) extractZip(ctx context.Context, data io.Reader, destDir string) ([]string, error) {
+	spool, err := os.CreateTemp(pe.tempDir, ".zip-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zip spool file: %w", err)
+	}
+	defer func() {
+		if err := spool.Close(); err != nil {
+			pe.logger.WithError(err).Warn("Failed to close zip spool file")
+		}
+		if err := os.Remove(spool.Name()); err != nil {
+			pe.logger.WithError(err).Warn("Failed to remove zip spool file")
+		}
+	}()
+
+	size, err := io.Copy(spool, &contextReader{ctx: ctx, reader: data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool zip archive: %w", err)
+	}
+
+	// Entries escaping destDir are skipped below, like those of tar archives
+	zipReader, err := zip.NewReader(spool, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return nil, fmt.Errorf("failed to read zip archive: %w", err)
+	}
+	if len(zipReader.File) == 0 {
+		return nil, invalidPayload("archive contains no files")
+	}
+
+	var extractedFiles []string
+	for _, entry := range zipReader.File {
+		// Reject the whole payload when any entry matches a forbidden pattern
+		if err := pe.checkForbiddenFile(entry.Name); err != nil {
+			return nil, err
+		}
+
+		// Security check: prevent path traversal
+		filePath, ok := entryPath(destDir, entry.Name)
+		if !ok {
+			pe.logger.WithField("file_path", entry.Name).Warn("Skipping file with suspicious path")
+			continue
+		}
+
+		// zip writers often leave permissions unset, so entries get fixed ones
+		switch mode := entry.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(filePath, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create directory %s: %w", filePath, err)
 			}
-			if err := file.Close(); err != nil {
-				pe.logger.WithError(err).WithField("file_path", filePath).Warn("Failed to close file after write")
+
+		case mode.IsRegular():
+			if err := pe.writeZipEntry(ctx, entry, filePath); err != nil {
+				return nil, err
 			}
 
-			extractedFiles = append(extractedFiles, header.Name)
+			extractedFiles = append(extractedFiles, entry.Name)
+
+			// Skip extracting the rest of a payload that can't have any ROS files
+			if filepath.Base(entry.Name) == "manifest.json" && pe.rejectsEarly(filePath) {
+				return nil, invalidPayload("no ROS files specified in manifest")
+			}
 
 		default:
 			pe.logger.WithFields(logrus.Fields{
-				"file_path": header.Name,
-				"type_flag": header.Typeflag,
+				"file_path": entry.Name,
+				"mode":      mode.String(),
 			}).Debug("Skipping unsupported file type")
 		}
 	}
@@ -185,18 +466,128 @@ func (pe *PayloadExtractor) extractTarGz(data io.Reader, destDir string) ([]stri
 	return extractedFiles, nil
 }
 
+// writeZipEntry decompresses a zip entry to filePath, its checksum is verified once fully read
+func (pe *PayloadExtractor) writeZipEntry(ctx context.Context, entry *zip.File, filePath string) error {
+	reader, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open zip entry %s: %w", entry.Name, err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			pe.logger.WithError(err).WithField("file_path", entry.Name).Warn("Failed to close zip entry")
+		}
+	}()
+
+	return pe.writeEntry(ctx, reader, filePath, 0644)
+}
+
+// checkForbiddenFile returns an invalid payload error when the archive entry name matches a forbidden pattern
+func (pe *PayloadExtractor) checkForbiddenFile(name string) error {
+	pattern, ok := pe.forbiddenFilePattern(name)
+	if !ok {
+		return nil
+	}
+
+	health.SuspiciousPayloadsTotal.Inc()
+	pe.logger.WithFields(logrus.Fields{
+		"file_path": name,
+		"pattern":   pattern,
+	}).Warn("Rejecting payload with forbidden file")
+	return invalidPayload("payload contains forbidden file %s", cleanEntryPath(name))
+}
+
+// entryPath returns where the archive entry name is extracted under destDir
+// It reports false for entries escaping destDir, including into a sibling directory sharing destDir's prefix
+func entryPath(destDir, name string) (string, bool) {
+	filePath := filepath.Join(destDir, name)
+	if rel, err := filepath.Rel(destDir, filePath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filePath, true
+}
+
+// writeEntry writes the content of an archive entry to filePath, creating its parent directories
+func (pe *PayloadExtractor) writeEntry(ctx context.Context, content io.Reader, filePath string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory for %s: %w", filePath, err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", filePath, err)
+	}
+
+	// Check the context while writing too, highly compressed entries can expand without reading much input
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, reader: content}); err != nil {
+		if err := file.Close(); err != nil {
+			pe.logger.WithError(err).WithField("file_path", filePath).Warn("Failed to close file after copy error")
+		}
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+	if err := file.Close(); err != nil {
+		pe.logger.WithError(err).WithField("file_path", filePath).Warn("Failed to close file after write")
+	}
+	return nil
+}
+
+// rejectsEarly reports whether the manifest at manifestPath lists no ROS files and the payload
+// can be rejected before the rest of the archive is extracted
+// Manifests that can't be read or decoded aren't rejected here, full parsing reports why they are invalid
+func (pe *PayloadExtractor) rejectsEarly(manifestPath string) bool {
+	// ROS files inferred from file names don't need to be listed
+	if !pe.rejectEmptyManifestEarly || len(pe.rosFilePatterns) > 0 {
+		return false
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return false
+	}
+	var manifest struct {
+		ResourceOptimizationFiles []string `json:"resource_optimization_files"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return false
+	}
+	return len(manifest.ResourceOptimizationFiles) == 0
+}
+
+// checkTrailingData reads what follows the end of the tar archive, which tar writers only fill with
+// zero padding, and returns an invalid payload error if anything else follows, in or after the gzip stream
+func checkTrailingData(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if slices.ContainsFunc(buf[:n], func(b byte) bool { return b != 0 }) {
+			return invalidPayload("payload has data after the end of the tar archive")
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, gzip.ErrHeader) {
+			// Bytes after the gzip stream that don't start another gzip member
+			return invalidPayload("payload has data after the end of the gzip stream")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read data after the tar archive: %w", err)
+		}
+	}
+}
+
 // findAndParseManifest finds and parses the manifest.json file
 func (pe *PayloadExtractor) findAndParseManifest(extractedFiles []string, extractDir string) (*Manifest, error) {
 	// Find manifest.json (exact match, not substring)
-	var manifestPath string
+	var manifestPath, manifestDir string
 	for _, file := range extractedFiles {
 		if filepath.Base(file) == "manifest.json" {
 			manifestPath = filepath.Join(extractDir, file)
+			manifestDir = path.Dir(cleanEntryPath(file))
 			break
 		}
 	}
 
 	if manifestPath == "" {
+		health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureNotFound).Inc()
 		return nil, fmt.Errorf("manifest.json not found in payload")
 	}
 
@@ -205,21 +596,47 @@ func (pe *PayloadExtractor) findAndParseManifest(extractedFiles []string, extrac
 	// Read and parse manifest
 	manifestData, err := os.ReadFile(manifestPath)
 	if err != nil {
+		health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureReadError).Inc()
 		return nil, fmt.Errorf("failed to read manifest file: %w", err)
 	}
 
+	// Decode numbers as json.Number so large numeric IDs in free-form fields
+	// such as cr_status are not rounded through float64
 	var manifest Manifest
-	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(manifestData))
+	decoder.UseNumber()
+	if pe.strictManifestFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&manifest); err != nil {
+		if field, ok := unknownManifestField(err); ok {
+			health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureUnknownField).Inc()
+			return nil, invalidPayload("manifest has unknown field %s", field)
+		}
+		health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureInvalidJSON).Inc()
 		return nil, fmt.Errorf("failed to parse manifest JSON: %w", err)
 	}
+	manifest.dir = manifestDir
 
 	// Validate required fields
 	if manifest.UUID == "" {
+		health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureMissingUUID).Inc()
 		return nil, fmt.Errorf("manifest UUID is missing")
 	}
 	if manifest.ClusterID == "" {
+		health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureMissingClusterID).Inc()
 		return nil, fmt.Errorf("manifest cluster_id is missing")
 	}
+	if pe.validateDateConsistency {
+		if err := validateDateConsistency(&manifest); err != nil {
+			return nil, err
+		}
+	}
+	if pe.minOperatorVersion != nil {
+		if err := pe.checkOperatorVersion(&manifest); err != nil {
+			return nil, err
+		}
+	}
 
 	pe.logger.WithFields(logrus.Fields{
 		"manifest_uuid":   manifest.UUID,
@@ -231,21 +648,138 @@ func (pe *PayloadExtractor) findAndParseManifest(extractedFiles []string, extrac
 	return &manifest, nil
 }
 
+// unknownManifestField returns the quoted field name from a DisallowUnknownFields decoding error
+// encoding/json doesn't export a type for it, so the message is matched
+func unknownManifestField(err error) (string, bool) {
+	return strings.CutPrefix(err.Error(), "json: unknown field ")
+}
+
+// validateDateConsistency checks that the manifest start/end range is ordered and contains the manifest date
+// Dates are compared by UTC calendar day since operators stamp the date at generation time
+func validateDateConsistency(manifest *Manifest) error {
+	day := func(t time.Time) time.Time {
+		return t.UTC().Truncate(24 * time.Hour)
+	}
+
+	if manifest.Start != nil && manifest.End != nil && manifest.Start.After(*manifest.End) {
+		return invalidPayload("manifest start %s is after end %s",
+			manifest.Start.Format(time.RFC3339), manifest.End.Format(time.RFC3339))
+	}
+	if manifest.Date.IsZero() {
+		return nil
+	}
+	if manifest.Start != nil && day(manifest.Date).Before(day(*manifest.Start)) {
+		return invalidPayload("manifest date %s is before start %s",
+			manifest.Date.Format(time.RFC3339), manifest.Start.Format(time.RFC3339))
+	}
+	if manifest.End != nil && day(manifest.Date).After(day(*manifest.End)) {
+		return invalidPayload("manifest date %s is after end %s",
+			manifest.Date.Format(time.RFC3339), manifest.End.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkOperatorVersion rejects manifests produced by operators older than the configured minimum
+// Pre-release builds are compared by their release version, so 2.1.0-rc1 satisfies a 2.1.0 minimum.
+// Missing or malformed versions (e.g. commit SHAs from development builds) are let through with a warning.
+func (pe *PayloadExtractor) checkOperatorVersion(manifest *Manifest) error {
+	version, err := semver.NewVersion(manifest.OperatorVersion)
+	if err != nil {
+		pe.logger.WithFields(logrus.Fields{
+			"manifest_uuid":    manifest.UUID,
+			"operator_version": manifest.OperatorVersion,
+		}).Warn("Unable to parse operator version, skipping minimum version check")
+		return nil
+	}
+
+	release := semver.New(version.Major(), version.Minor(), version.Patch(), "", "")
+	if release.LessThan(pe.minOperatorVersion) {
+		return invalidPayload("operator version %s is no longer supported, upgrade the cost management metrics operator to %s or later",
+			manifest.OperatorVersion, pe.minOperatorVersion.Original())
+	}
+	return nil
+}
+
+// resolveManifestFiles maps manifest file references to extracted archive entries
+// A reference is first resolved relative to the manifest directory, honoring subpaths such as
+// data/ros-data.csv. Otherwise it falls back to the single entry whose path ends with the reference.
+// References matching several entries (e.g. the same basename in different directories) are left
+// unresolved rather than picking one arbitrarily.
+func (pe *PayloadExtractor) resolveManifestFiles(references []string, manifestDir string, extractedFiles []string) map[string]string {
+	entries := make(map[string]string, len(extractedFiles))
+	for _, file := range extractedFiles {
+		entries[cleanEntryPath(file)] = file
+	}
+
+	resolved := make(map[string]string)
+	for _, reference := range references {
+		cleaned := cleanEntryPath(reference)
+		if file, ok := entries[path.Join(manifestDir, cleaned)]; ok {
+			resolved[reference] = file
+			continue
+		}
+
+		var matches []string
+		for entry, file := range entries {
+			if entry == cleaned || strings.HasSuffix(entry, "/"+cleaned) {
+				matches = append(matches, file)
+			}
+		}
+		switch len(matches) {
+		case 0:
+		case 1:
+			resolved[reference] = matches[0]
+		default:
+			sort.Strings(matches)
+			pe.logger.WithFields(logrus.Fields{
+				"file":    reference,
+				"matches": matches,
+			}).Warn("Manifest file reference matches multiple extracted files")
+		}
+	}
+	return resolved
+}
+
+// forbiddenFilePattern returns the first forbidden pattern matching the archive entry name
+// Patterns are matched against the whole path and every trailing part of it, so
+// ".ssh/authorized_keys" also catches "home/user/.ssh/authorized_keys"
+func (pe *PayloadExtractor) forbiddenFilePattern(name string) (string, bool) {
+	if len(pe.forbiddenFilePatterns) == 0 {
+		return "", false
+	}
+
+	parts := strings.Split(cleanEntryPath(name), "/")
+	for i := range parts {
+		suffix := strings.Join(parts[i:], "/")
+		for _, pattern := range pe.forbiddenFilePatterns {
+			if matched, _ := path.Match(pattern, suffix); matched {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// cleanEntryPath normalizes an archive entry or manifest reference to a slash separated relative path
+func cleanEntryPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
 // identifyROSFiles identifies ROS CSV files from the manifest
 func (pe *PayloadExtractor) identifyROSFiles(manifest *Manifest, extractedFiles []string, extractDir string) (map[string]string, error) {
 	rosFiles := make(map[string]string)
 
 	// Check if there are any ROS files specified in manifest
 	if len(manifest.ResourceOptimizationFiles) == 0 {
+		if len(pe.rosFilePatterns) > 0 {
+			return pe.inferROSFiles(extractedFiles, extractDir)
+		}
 		pe.logger.Debug("No ROS files specified in manifest")
 		return nil, fmt.Errorf("no ROS files specified in manifest")
 	}
 
-	// Map extracted files for easy lookup
-	extractedFileSet := make(map[string]string)
-	for _, file := range extractedFiles {
-		extractedFileSet[filepath.Base(file)] = file
-	}
+	// Resolve manifest references to the extracted entries
+	extractedFileSet := pe.resolveManifestFiles(manifest.ResourceOptimizationFiles, manifest.dir, extractedFiles)
 
 	// Find ROS files that were actually extracted
 	for _, rosFileName := range manifest.ResourceOptimizationFiles {
@@ -276,6 +810,70 @@ func (pe *PayloadExtractor) identifyROSFiles(manifest *Manifest, extractedFiles
 	return rosFiles, nil
 }
 
+// inferROSFiles picks the ROS files among the extracted entries by matching their base names
+// against the ROS file patterns, for manifests that don't list their ROS files
+func (pe *PayloadExtractor) inferROSFiles(extractedFiles []string, extractDir string) (map[string]string, error) {
+	rosFiles := make(map[string]string)
+	for _, file := range extractedFiles {
+		name := cleanEntryPath(file)
+		for _, pattern := range pe.rosFilePatterns {
+			if matched, _ := path.Match(pattern, path.Base(name)); matched {
+				rosFiles[name] = filepath.Join(extractDir, file)
+				break
+			}
+		}
+	}
+
+	if len(rosFiles) == 0 {
+		pe.logger.Debug("No ROS files specified in manifest or matching the ROS file patterns")
+		return nil, fmt.Errorf("no ROS files specified in manifest")
+	}
+
+	pe.logger.WithField("ros_files_found", len(rosFiles)).Info("Inferred ROS files from archive entries")
+	return rosFiles, nil
+}
+
+// identifyUsageFiles identifies usage CSV files listed in the manifest "files" field
+// Missing usage files are logged and skipped, they never fail the ROS upload
+// Files also listed as ROS files are left to the ROS upload so they're only stored once
+func (pe *PayloadExtractor) identifyUsageFiles(manifest *Manifest, extractedFiles []string, extractDir string, rosFiles map[string]string) map[string]string {
+	usageFiles := make(map[string]string)
+
+	// Compare resolved paths, the two lists may spell the same entry differently
+	rosPaths := make(map[string]bool, len(rosFiles))
+	for _, rosPath := range rosFiles {
+		rosPaths[rosPath] = true
+	}
+
+	extractedFileSet := pe.resolveManifestFiles(manifest.Files, manifest.dir, extractedFiles)
+
+	for _, usageFileName := range manifest.Files {
+		extractedFile, exists := extractedFileSet[usageFileName]
+		if !exists {
+			pe.logger.WithField("usage_file", usageFileName).Warn("Usage file specified in manifest but not extracted")
+			continue
+		}
+
+		fullPath := filepath.Join(extractDir, extractedFile)
+		if rosPaths[fullPath] {
+			pe.logger.WithField("usage_file", usageFileName).Debug("Usage file is also a ROS file, uploading it as ROS only")
+			continue
+		}
+		if _, err := os.Stat(fullPath); err != nil {
+			pe.logger.WithFields(logrus.Fields{
+				"usage_file": usageFileName,
+				"error":      err,
+			}).Warn("Usage file specified in manifest but not found")
+			continue
+		}
+
+		usageFiles[usageFileName] = fullPath
+	}
+
+	pe.logger.WithField("usage_files_found", len(usageFiles)).Debug("Identified usage files")
+	return usageFiles
+}
+
 // Cleanup removes temporary files
 func (ep *ExtractedPayload) Cleanup() error {
 	if ep.TempDir != "" {
@@ -290,3 +888,79 @@ func (pe *PayloadExtractor) cleanup(dir string) {
 		pe.logger.WithError(err).WithField("dir", dir).Error("Failed to cleanup extraction directory")
 	}
 }
+
+// discardFailed disposes of the extraction directory of a failed upload
+// When failed payloads are retained it is moved under the failed payloads dir, otherwise it is removed
+func (pe *PayloadExtractor) discardFailed(dir string) {
+	if pe.keepFailedFor <= 0 {
+		pe.cleanup(dir)
+		return
+	}
+
+	failedDir := filepath.Join(pe.tempDir, failedPayloadsDir)
+	kept := filepath.Join(failedDir, filepath.Base(dir))
+	if err := os.MkdirAll(failedDir, 0755); err != nil {
+		pe.logger.WithError(err).WithField("dir", failedDir).Warn("Failed to create failed payloads directory")
+		pe.cleanup(dir)
+		return
+	}
+	if err := os.Rename(dir, kept); err != nil {
+		pe.logger.WithError(err).WithField("dir", dir).Warn("Failed to keep extracted files of failed upload")
+		pe.cleanup(dir)
+		return
+	}
+
+	// Retention counts from the failure rather than from when the directory was created
+	now := time.Now()
+	if err := os.Chtimes(kept, now, now); err != nil {
+		pe.logger.WithError(err).WithField("dir", kept).Warn("Failed to timestamp failed payload")
+	}
+	pe.logger.WithFields(logrus.Fields{
+		"dir":       kept,
+		"retention": pe.keepFailedFor,
+	}).Info("Kept extracted files of failed upload for debugging")
+
+	pe.reapFailed(now)
+}
+
+// reapFailed removes the failed payloads kept longer than the retention, then the oldest ones
+// beyond the configured cap
+func (pe *PayloadExtractor) reapFailed(now time.Time) {
+	failedDir := filepath.Join(pe.tempDir, failedPayloadsDir)
+	entries, err := os.ReadDir(failedDir)
+	if err != nil {
+		return
+	}
+
+	type keptPayload struct {
+		dir     string
+		modTime time.Time
+	}
+	var kept []keptPayload
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(failedDir, entry.Name())
+		if now.Sub(info.ModTime()) >= pe.keepFailedFor {
+			pe.cleanup(dir)
+			continue
+		}
+		kept = append(kept, keptPayload{dir: dir, modTime: info.ModTime()})
+	}
+
+	limit := pe.maxFailedPayloads
+	if limit <= 0 {
+		limit = defaultMaxFailedPayloads
+	}
+	if len(kept) <= limit {
+		return
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].modTime.Before(kept[j].modTime)
+	})
+	for _, payload := range kept[:len(kept)-limit] {
+		pe.cleanup(payload.dir)
+	}
+}
@@ -2,14 +2,25 @@ package upload
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/google/uuid"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,10 +30,14 @@ type TestPayloadFactory struct {
 	ClusterID                 string
 	ClusterAlias              string
 	Date                      time.Time
+	Start                     *time.Time
+	End                       *time.Time
 	Files                     []string
 	ResourceOptimizationFiles []string
 	Certified                 bool
 	OperatorVersion           string
+	CRStatus                  map[string]interface{}
+	ExtraFiles                map[string]string
 	IncludeManifest           bool
 	IncludeROSFiles           bool
 }
@@ -55,6 +70,53 @@ func (f *TestPayloadFactory) WithClusterID(clusterID string) *TestPayloadFactory
 	return f
 }
 
+// WithPeriod sets the manifest start and end of the reporting period
+func (f *TestPayloadFactory) WithPeriod(start, end time.Time) *TestPayloadFactory {
+	f.Start = &start
+	f.End = &end
+	return f
+}
+
+// WithDate sets the manifest date
+func (f *TestPayloadFactory) WithDate(date time.Time) *TestPayloadFactory {
+	f.Date = date
+	return f
+}
+
+// WithOperatorVersion sets the manifest operator version
+func (f *TestPayloadFactory) WithOperatorVersion(version string) *TestPayloadFactory {
+	f.OperatorVersion = version
+	return f
+}
+
+// WithCRStatus sets the manifest cr_status
+func (f *TestPayloadFactory) WithCRStatus(crStatus map[string]interface{}) *TestPayloadFactory {
+	f.CRStatus = crStatus
+	return f
+}
+
+// WithROSFiles sets the ROS files referenced by the manifest and added to the payload
+func (f *TestPayloadFactory) WithROSFiles(files ...string) *TestPayloadFactory {
+	f.ResourceOptimizationFiles = files
+	f.IncludeROSFiles = true
+	return f
+}
+
+// WithUsageFiles sets the usage files listed in the manifest "files" field
+func (f *TestPayloadFactory) WithUsageFiles(files ...string) *TestPayloadFactory {
+	f.Files = files
+	return f
+}
+
+// WithExtraFile adds an archive entry that is not derived from the manifest
+func (f *TestPayloadFactory) WithExtraFile(name, data string) *TestPayloadFactory {
+	if f.ExtraFiles == nil {
+		f.ExtraFiles = make(map[string]string)
+	}
+	f.ExtraFiles[name] = data
+	return f
+}
+
 // WithoutManifest excludes the manifest from the payload
 func (f *TestPayloadFactory) WithoutManifest() *TestPayloadFactory {
 	f.IncludeManifest = false
@@ -95,10 +157,13 @@ func (f *TestPayloadFactory) Build() ([]byte, error) {
 			ClusterID:                 f.ClusterID,
 			ClusterAlias:              f.ClusterAlias,
 			Date:                      f.Date,
+			Start:                     f.Start,
+			End:                       f.End,
 			Files:                     f.Files,
 			ResourceOptimizationFiles: f.ResourceOptimizationFiles,
 			Certified:                 f.Certified,
 			OperatorVersion:           f.OperatorVersion,
+			CRStatus:                  f.CRStatus,
 		}
 
 		manifestJSON, err := json.Marshal(manifest)
@@ -122,8 +187,11 @@ func (f *TestPayloadFactory) Build() ([]byte, error) {
 		}
 	}
 
-	// Add regular files
+	// Add regular files, those also listed as ROS files are written once below
 	for _, fileName := range f.Files {
+		if f.IncludeROSFiles && slices.Contains(f.ResourceOptimizationFiles, fileName) {
+			continue
+		}
 		var fileData []byte
 		switch fileName {
 		case "usage.csv":
@@ -176,6 +244,24 @@ func (f *TestPayloadFactory) Build() ([]byte, error) {
 		}
 	}
 
+	// Add extra entries
+	for name, data := range f.ExtraFiles {
+		header := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+
+		if _, err := tarWriter.Write([]byte(data)); err != nil {
+			return nil, err
+		}
+	}
+
 	// Add other files for edge cases
 	if !f.IncludeManifest {
 		// Add a dummy file when no manifest
@@ -207,6 +293,69 @@ func (f *TestPayloadFactory) Build() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// TestZipPayloadFactory builds the payload of a TestPayloadFactory as a zip archive
+type TestZipPayloadFactory struct {
+	*TestPayloadFactory
+}
+
+// DefaultTestZipPayloadFactory returns a zip factory with the defaults of DefaultTestPayloadFactory
+func DefaultTestZipPayloadFactory() *TestZipPayloadFactory {
+	return &TestZipPayloadFactory{TestPayloadFactory: DefaultTestPayloadFactory()}
+}
+
+// Build creates the zip payload bytes, with the same entries as the tar.gz payload
+func (f *TestZipPayloadFactory) Build() ([]byte, error) {
+	tarGz, err := f.TestPayloadFactory.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(tarGz))
+	if err != nil {
+		return nil, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := zipWriter.Create(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(entry, tarReader); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close zip writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// slowReader returns a few bytes per read with a delay, simulating a slow to decompress archive
+type slowReader struct {
+	reader *bytes.Reader
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(p) > 8 {
+		p = p[:8]
+	}
+	return r.reader.Read(p)
+}
+
 var _ = Describe("PayloadExtractor", func() {
 	var (
 		extractor *PayloadExtractor
@@ -229,7 +378,7 @@ var _ = Describe("PayloadExtractor", func() {
 				Expect(err).ToNot(HaveOccurred())
 
 				// Extract payload
-				result, err := extractor.ExtractPayload(bytes.NewReader(payload), "test-request-123")
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
 				Expect(err).ToNot(HaveOccurred())
 				defer func() {
 					if err := result.Cleanup(); err != nil {
@@ -257,7 +406,7 @@ var _ = Describe("PayloadExtractor", func() {
 				Expect(err).ToNot(HaveOccurred())
 
 				// Extract payload should fail
-				_, err = extractor.ExtractPayload(bytes.NewReader(payload), "test-request-123")
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("manifest.json not found"))
 			})
@@ -270,10 +419,1016 @@ var _ = Describe("PayloadExtractor", func() {
 				Expect(err).ToNot(HaveOccurred())
 
 				// Extract payload should fail
-				_, err = extractor.ExtractPayload(bytes.NewReader(payload), "test-request-123")
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("no ROS files"))
 			})
 		})
+
+		Context("with ROS files missing from the manifest list", func() {
+			factory := func() *TestPayloadFactory {
+				return DefaultTestPayloadFactory().
+					WithoutROSFiles().
+					WithExtraFile("reports/0f1e_ros-openshift-202403.csv", "ros data").
+					WithExtraFile("reports/0f1e_cm-openshift-usage-202403.csv", "usage data")
+			}
+
+			It("should reject the payload when inference is disabled", func() {
+				payload, err := factory().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("no ROS files specified in manifest"))
+			})
+
+			It("should infer the ROS files from entries matching the patterns when enabled", func() {
+				extractor.rosFilePatterns = []string{"*ros-openshift*.csv"}
+				payload, err := factory().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() { Expect(result.Cleanup()).To(Succeed()) }()
+
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.ROSFiles).To(HaveKey("reports/0f1e_ros-openshift-202403.csv"))
+				data, err := os.ReadFile(result.ROSFiles["reports/0f1e_ros-openshift-202403.csv"])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("ros data"))
+			})
+
+			It("should not forward inferred ROS files as usage files", func() {
+				extractor.rosFilePatterns = []string{"*ros-openshift*.csv"}
+				extractor.includeUsageFiles = true
+				payload, err := factory().WithUsageFiles("reports/0f1e_ros-openshift-202403.csv").Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() { Expect(result.Cleanup()).To(Succeed()) }()
+
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.UsageFiles).To(BeEmpty())
+			})
+
+			It("should reject the payload when no entry matches the patterns", func() {
+				extractor.rosFilePatterns = []string{"*ros-openshift*.csv"}
+				payload, err := DefaultTestPayloadFactory().WithoutROSFiles().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("no ROS files specified in manifest"))
+			})
+
+			It("should keep using the manifest list when it names ROS files", func() {
+				extractor.rosFilePatterns = []string{"*ros-openshift*.csv"}
+				payload, err := DefaultTestPayloadFactory().
+					WithExtraFile("reports/0f1e_ros-openshift-202403.csv", "ros data").
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() { Expect(result.Cleanup()).To(Succeed()) }()
+
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.ROSFiles).To(HaveKey("ros-data.csv"))
+			})
+		})
+
+		Context("with both usage and ROS files", func() {
+			It("should not identify usage files when forwarding is disabled", func() {
+				payload, err := DefaultTestPayloadFactory().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() {
+					if err := result.Cleanup(); err != nil {
+						GinkgoT().Logf("Failed to cleanup test payload: %v", err)
+					}
+				}()
+
+				Expect(result.ROSFiles).To(HaveKey("ros-data.csv"))
+				Expect(result.UsageFiles).To(BeEmpty())
+			})
+
+			It("should identify usage files separately when forwarding is enabled", func() {
+				extractor.includeUsageFiles = true
+
+				payload, err := DefaultTestPayloadFactory().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() {
+					if err := result.Cleanup(); err != nil {
+						GinkgoT().Logf("Failed to cleanup test payload: %v", err)
+					}
+				}()
+
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.ROSFiles).To(HaveKey("ros-data.csv"))
+				Expect(result.UsageFiles).To(HaveLen(1))
+				Expect(result.UsageFiles).To(HaveKey("usage.csv"))
+				Expect(result.UsageFiles).ToNot(HaveKey("ros-data.csv"))
+			})
+
+			It("should skip usage files listed in the manifest but missing from the archive", func() {
+				extractDir := GinkgoT().TempDir()
+				Expect(os.WriteFile(filepath.Join(extractDir, "usage.csv"), []byte("usage"), 0644)).To(Succeed())
+
+				manifest := &Manifest{Files: []string{"usage.csv", "missing.csv"}}
+				usageFiles := extractor.identifyUsageFiles(manifest, []string{"usage.csv"}, extractDir, nil)
+
+				Expect(usageFiles).To(HaveLen(1))
+				Expect(usageFiles).To(HaveKeyWithValue("usage.csv", filepath.Join(extractDir, "usage.csv")))
+				Expect(usageFiles).ToNot(HaveKey("missing.csv"))
+			})
+
+			It("should give ROS precedence to a file listed as both usage and ROS", func() {
+				extractor.includeUsageFiles = true
+				payload, err := DefaultTestPayloadFactory().WithUsageFiles("usage.csv", "ros-data.csv").Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() {
+					if err := result.Cleanup(); err != nil {
+						GinkgoT().Logf("Failed to cleanup test payload: %v", err)
+					}
+				}()
+
+				Expect(result.ROSFiles).To(HaveKey("ros-data.csv"))
+				Expect(result.UsageFiles).To(HaveLen(1))
+				Expect(result.UsageFiles).To(HaveKey("usage.csv"))
+			})
+
+			It("should match overlapping files by path rather than by manifest spelling", func() {
+				extractDir := GinkgoT().TempDir()
+				for _, name := range []string{"usage.csv", "ros.csv"} {
+					Expect(os.WriteFile(filepath.Join(extractDir, name), []byte(name), 0644)).To(Succeed())
+				}
+
+				manifest := &Manifest{Files: []string{"usage.csv", "./ros.csv"}}
+				rosFiles := map[string]string{"ros.csv": filepath.Join(extractDir, "ros.csv")}
+				usageFiles := extractor.identifyUsageFiles(manifest, []string{"usage.csv", "ros.csv"}, extractDir, rosFiles)
+
+				Expect(usageFiles).To(Equal(map[string]string{"usage.csv": filepath.Join(extractDir, "usage.csv")}))
+			})
+		})
+
+		Context("with date consistency validation", func() {
+			var (
+				start time.Time
+				end   time.Time
+			)
+
+			BeforeEach(func() {
+				start = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+				end = time.Date(2024, 3, 31, 23, 59, 59, 0, time.UTC)
+			})
+
+			extract := func(factory *TestPayloadFactory) error {
+				payload, err := factory.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				if err == nil {
+					Expect(result.Cleanup()).To(Succeed())
+				}
+				return err
+			}
+
+			It("should accept a date within the start/end range", func() {
+				extractor.validateDateConsistency = true
+
+				factory := DefaultTestPayloadFactory().WithPeriod(start, end).WithDate(start.Add(48 * time.Hour))
+				Expect(extract(factory)).To(Succeed())
+			})
+
+			It("should accept a date on the last day of the range", func() {
+				extractor.validateDateConsistency = true
+
+				factory := DefaultTestPayloadFactory().WithPeriod(start, end.Add(-12*time.Hour)).WithDate(end)
+				Expect(extract(factory)).To(Succeed())
+			})
+
+			It("should reject a date after the end of the range", func() {
+				extractor.validateDateConsistency = true
+
+				factory := DefaultTestPayloadFactory().WithPeriod(start, end).WithDate(end.Add(72 * time.Hour))
+				err := extract(factory)
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("is after end"))
+			})
+
+			It("should reject a date before the start of the range", func() {
+				extractor.validateDateConsistency = true
+
+				factory := DefaultTestPayloadFactory().WithPeriod(start, end).WithDate(start.Add(-72 * time.Hour))
+				err := extract(factory)
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("is before start"))
+			})
+
+			It("should reject a start after the end", func() {
+				extractor.validateDateConsistency = true
+
+				factory := DefaultTestPayloadFactory().WithPeriod(end, start).WithDate(start)
+				err := extract(factory)
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("is after end"))
+			})
+
+			It("should accept inconsistent dates when validation is disabled", func() {
+				factory := DefaultTestPayloadFactory().WithPeriod(start, end).WithDate(end.Add(72 * time.Hour))
+				Expect(extract(factory)).To(Succeed())
+			})
+		})
+
+		Context("with a minimum operator version", func() {
+			BeforeEach(func() {
+				extractor.minOperatorVersion = semver.MustParse("2.1.0")
+			})
+
+			extract := func(version string) error {
+				payload, err := DefaultTestPayloadFactory().WithOperatorVersion(version).Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				if err == nil {
+					Expect(result.Cleanup()).To(Succeed())
+				}
+				return err
+			}
+
+			It("should reject an operator older than the minimum with an upgrade hint", func() {
+				err := extract("2.0.9")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("upgrade the cost management metrics operator to 2.1.0 or later"))
+			})
+
+			It("should accept an operator at the minimum", func() {
+				Expect(extract("2.1.0")).To(Succeed())
+				Expect(extract("v2.1.0")).To(Succeed())
+			})
+
+			It("should accept an operator above the minimum", func() {
+				Expect(extract("2.1.1")).To(Succeed())
+				Expect(extract("3.0.0")).To(Succeed())
+			})
+
+			It("should compare pre-release builds by their release version", func() {
+				Expect(extract("2.1.0-rc1")).To(Succeed())
+				Expect(extract("2.0.9-rc1")).To(MatchError(ErrInvalidPayload))
+			})
+
+			It("should let malformed or missing versions through", func() {
+				Expect(extract("e3450f7e3f1f4ba3a9a1d0fbd1e84e1b3dea0b64")).To(Succeed())
+				Expect(extract("")).To(Succeed())
+			})
+		})
+
+		Context("with ROS files referenced by relative subpaths", func() {
+			extract := func(factory *TestPayloadFactory) (*ExtractedPayload, error) {
+				payload, err := factory.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				if err == nil {
+					DeferCleanup(result.Cleanup)
+				}
+				return result, err
+			}
+
+			readFile := func(path string) string {
+				data, err := os.ReadFile(path)
+				Expect(err).ToNot(HaveOccurred())
+				return string(data)
+			}
+
+			It("should match a subdirectory-qualified reference by its full path", func() {
+				result, err := extract(DefaultTestPayloadFactory().WithROSFiles("data/ros-data.csv"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.ROSFiles).To(HaveKey("data/ros-data.csv"))
+				Expect(result.ROSFiles["data/ros-data.csv"]).To(HaveSuffix(filepath.Join("data", "ros-data.csv")))
+			})
+
+			It("should keep files with the same basename in different directories apart", func() {
+				result, err := extract(DefaultTestPayloadFactory().WithROSFiles("a/ros.csv", "b/ros.csv"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(result.ROSFiles).To(HaveLen(2))
+				Expect(readFile(result.ROSFiles["a/ros.csv"])).To(Equal("ros data for a/ros.csv"))
+				Expect(readFile(result.ROSFiles["b/ros.csv"])).To(Equal("ros data for b/ros.csv"))
+			})
+
+			It("should prefer the file next to the manifest for a basename reference", func() {
+				factory := DefaultTestPayloadFactory().
+					WithROSFiles("ros.csv").
+					WithExtraFile("old/ros.csv", "stale data")
+				result, err := extract(factory)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readFile(result.ROSFiles["ros.csv"])).To(Equal("ros data for ros.csv"))
+			})
+
+			It("should match a basename reference to a single nested file", func() {
+				factory := DefaultTestPayloadFactory().WithExtraFile("nested/ros.csv", "nested data")
+				factory.ResourceOptimizationFiles = []string{"ros.csv"}
+				factory.IncludeROSFiles = false
+
+				result, err := extract(factory)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readFile(result.ROSFiles["ros.csv"])).To(Equal("nested data"))
+			})
+
+			It("should not guess when a basename reference matches several nested files", func() {
+				factory := DefaultTestPayloadFactory().
+					WithExtraFile("a/ros.csv", "a data").
+					WithExtraFile("b/ros.csv", "b data")
+				factory.ResourceOptimizationFiles = []string{"ros.csv"}
+				factory.IncludeROSFiles = false
+
+				_, err := extract(factory)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("no ROS files found in payload"))
+			})
+		})
+
+		Context("with an extraction timeout", func() {
+			var payload []byte
+
+			BeforeEach(func() {
+				var err error
+				payload, err = DefaultTestPayloadFactory().Build()
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("should abort a slow extraction once the extraction timeout elapses", func() {
+				extractor.extractionTimeout = 50 * time.Millisecond
+
+				// The overall deadline is far away, only the extraction timeout should trip
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+
+				start := time.Now()
+				_, err := extractor.ExtractPayload(ctx, &slowReader{reader: bytes.NewReader(payload), delay: 5 * time.Millisecond}, "test-request-123")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("payload extraction exceeded 50ms"))
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+				Expect(ctx.Err()).ToNot(HaveOccurred())
+
+				_, statErr := os.Stat(filepath.Join(tempDir, "test-request-123"))
+				Expect(os.IsNotExist(statErr)).To(BeTrue())
+			})
+
+			It("should extract normally within the extraction timeout", func() {
+				extractor.extractionTimeout = time.Minute
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Cleanup()).To(Succeed())
+			})
+
+			It("should not report a cancelled request as an invalid payload", func() {
+				extractor.extractionTimeout = time.Minute
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := extractor.ExtractPayload(ctx, bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(MatchError(context.Canceled))
+				Expect(err).ToNot(MatchError(ErrInvalidPayload))
+			})
+		})
+
+		Context("with a stale extraction directory for the same request ID", func() {
+			var staleDir string
+
+			BeforeEach(func() {
+				staleDir = filepath.Join(tempDir, "test-request-123")
+				Expect(os.MkdirAll(staleDir, 0755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(staleDir, "stale-ros-data.csv"), []byte("stale"), 0644)).To(Succeed())
+			})
+
+			It("should extract into a separate directory without mixing in stale files", func() {
+				payload, err := DefaultTestPayloadFactory().Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(result.TempDir).ToNot(Equal(staleDir))
+				Expect(filepath.Dir(result.TempDir)).To(Equal(tempDir))
+				Expect(result.ROSFiles).To(HaveLen(1))
+				for _, filePath := range result.ROSFiles {
+					Expect(filePath).To(HavePrefix(result.TempDir + string(filepath.Separator)))
+				}
+
+				Expect(result.Cleanup()).To(Succeed())
+				Expect(filepath.Join(staleDir, "stale-ros-data.csv")).To(BeAnExistingFile())
+			})
+
+			It("should not let entries escape into a sibling directory sharing the extraction directory's prefix", func() {
+				destDir := filepath.Join(tempDir, "test-request-123-abc")
+				Expect(os.Mkdir(destDir, 0755)).To(Succeed())
+				payload, err := DefaultTestPayloadFactory().
+					WithExtraFile("../test-request-123-abc2/escaped.csv", "escaped").
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.extractTarGz(context.Background(), bytes.NewReader(payload), destDir)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(filepath.Join(tempDir, "test-request-123-abc2")).ToNot(BeADirectory())
+				Expect(filepath.Join(tempDir, "test-request-123-abc2", "escaped.csv")).ToNot(BeAnExistingFile())
+			})
+
+			It("should leave the stale directory alone when extraction fails", func() {
+				_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader([]byte("not a tarball")), "test-request-123")
+				Expect(err).To(HaveOccurred())
+
+				Expect(filepath.Join(staleDir, "stale-ros-data.csv")).To(BeAnExistingFile())
+				entries, err := os.ReadDir(tempDir)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+			})
+		})
+
+		Context("with forbidden file patterns", func() {
+			BeforeEach(func() {
+				extractor.forbiddenFilePatterns = []string{".ssh/authorized_keys", "*.sh"}
+			})
+
+			It("should reject a payload containing a forbidden file", func() {
+				before := testutil.ToFloat64(health.SuspiciousPayloadsTotal)
+				payload, err := DefaultTestPayloadFactory().
+					WithExtraFile("home/core/.ssh/authorized_keys", "ssh-rsa AAAA").
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("payload contains forbidden file home/core/.ssh/authorized_keys"))
+				Expect(testutil.ToFloat64(health.SuspiciousPayloadsTotal)).To(Equal(before + 1))
+
+				_, statErr := os.Stat(filepath.Join(tempDir, "test-request-123"))
+				Expect(os.IsNotExist(statErr)).To(BeTrue())
+			})
+
+			It("should match base name patterns anywhere in the archive", func() {
+				payload, err := DefaultTestPayloadFactory().WithExtraFile("scripts/install.sh", "#!/bin/sh").Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+			})
+
+			It("should accept a payload without forbidden files", func() {
+				payload, err := DefaultTestPayloadFactory().WithExtraFile("notes/authorized_keys.txt", "x").Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Cleanup()).To(Succeed())
+			})
+		})
+
+		Context("with a gzip stream that contains no tar data", func() {
+			gzipped := func(content []byte) []byte {
+				var buf bytes.Buffer
+				gzWriter := gzip.NewWriter(&buf)
+				_, err := gzWriter.Write(content)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gzWriter.Close()).To(Succeed())
+				return buf.Bytes()
+			}
+
+			DescribeTable("should reject the payload as an archive with no files",
+				func(content []byte) {
+					_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(gzipped(content)), "test-request-123")
+					Expect(err).To(MatchError(ErrInvalidPayload))
+					Expect(err.Error()).To(ContainSubstring("archive contains no files"))
+					Expect(err.Error()).ToNot(ContainSubstring("manifest"))
+				},
+				Entry("empty stream", []byte{}),
+				Entry("short non-tar content", []byte("manifest.json is not here")),
+				Entry("block-sized non-tar content", bytes.Repeat([]byte("not a tar header "), 64)),
+			)
+		})
+
+		Context("with a zip payload", func() {
+			It("should extract the manifest and ROS files", func() {
+				zipFactory := DefaultTestZipPayloadFactory()
+				zipFactory.WithROSFiles("data/ros-data.csv")
+				payload, err := zipFactory.Build()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(payload[:2]).To(Equal([]byte{0x50, 0x4b}))
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() {
+					if err := result.Cleanup(); err != nil {
+						GinkgoT().Logf("Failed to cleanup test payload: %v", err)
+					}
+				}()
+
+				Expect(result.Manifest.UUID).To(Equal(zipFactory.UUID))
+				Expect(result.Manifest.ClusterID).To(Equal(zipFactory.ClusterID))
+				Expect(result.ROSFiles).To(HaveLen(1))
+				Expect(result.ROSFiles).To(HaveKeyWithValue("data/ros-data.csv", filepath.Join(result.TempDir, "data", "ros-data.csv")))
+				Expect(os.ReadFile(result.ROSFiles["data/ros-data.csv"])).To(Equal([]byte("ros data for data/ros-data.csv")))
+
+				// Only the extraction directory is left in the temp dir
+				entries, err := os.ReadDir(tempDir)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+			})
+
+			It("should skip entries escaping the extraction directory", func() {
+				zipFactory := DefaultTestZipPayloadFactory()
+				zipFactory.WithExtraFile("../escaped.csv", "escaped")
+				payload, err := zipFactory.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.ROSFiles).To(HaveKey("ros-data.csv"))
+				Expect(filepath.Join(tempDir, "escaped.csv")).ToNot(BeAnExistingFile())
+				Expect(result.Cleanup()).To(Succeed())
+			})
+
+			It("should reject a payload containing a forbidden file", func() {
+				extractor.forbiddenFilePatterns = []string{"*.sh"}
+				zipFactory := DefaultTestZipPayloadFactory()
+				zipFactory.WithExtraFile("scripts/install.sh", "#!/bin/sh")
+				payload, err := zipFactory.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("payload contains forbidden file scripts/install.sh"))
+			})
+
+			It("should reject an archive with no files", func() {
+				var buf bytes.Buffer
+				Expect(zip.NewWriter(&buf).Close()).To(Succeed())
+
+				_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(buf.Bytes()), "test-request-123")
+				Expect(err).To(MatchError(ErrInvalidPayload))
+				Expect(err.Error()).To(ContainSubstring("archive contains no files"))
+			})
+
+			It("should report a corrupt archive", func() {
+				_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader([]byte("PK not really a zip")), "test-request-123")
+				Expect(err).To(MatchError(ContainSubstring("failed to extract zip")))
+				Expect(err).ToNot(MatchError(ErrInvalidPayload))
+			})
+		})
+
+		Context("with large numeric IDs in cr_status", func() {
+			It("should preserve the exact digits", func() {
+				factory := DefaultTestPayloadFactory().WithCRStatus(map[string]interface{}{
+					"org_id":         json.Number("12345678901234567890"),
+					"account_number": json.Number("9007199254740993"),
+				})
+				payload, err := factory.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), "test-request-123")
+				Expect(err).ToNot(HaveOccurred())
+				defer func() {
+					if err := result.Cleanup(); err != nil {
+						GinkgoT().Logf("Failed to cleanup test payload: %v", err)
+					}
+				}()
+
+				Expect(result.Manifest.CRStatus["org_id"]).To(Equal(json.Number("12345678901234567890")))
+				Expect(result.Manifest.CRStatus["account_number"]).To(Equal(json.Number("9007199254740993")))
+			})
+		})
+	})
+})
+
+var _ = Describe("Manifest parse failure metrics", func() {
+	var (
+		extractor *PayloadExtractor
+		tempDir   string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+		extractor = NewPayloadExtractor(tempDir, logger)
+	})
+
+	writeManifest := func(content string) []string {
+		Expect(os.WriteFile(filepath.Join(tempDir, "manifest.json"), []byte(content), 0644)).To(Succeed())
+		return []string{"manifest.json"}
+	}
+
+	DescribeTable("should count each failure under its reason",
+		func(reason string, files func() []string, message string) {
+			before := testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(reason))
+
+			_, err := extractor.findAndParseManifest(files(), tempDir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(message))
+
+			Expect(testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(reason))).To(Equal(before + 1))
+		},
+		Entry("manifest not found", manifestFailureNotFound,
+			func() []string { return []string{"ros-data.csv"} }, "manifest.json not found"),
+		Entry("manifest not readable", manifestFailureReadError,
+			func() []string { return []string{"missing/manifest.json"} }, "failed to read manifest file"),
+		Entry("malformed JSON", manifestFailureInvalidJSON,
+			func() []string { return writeManifest(`{"uuid":`) }, "failed to parse manifest JSON"),
+		Entry("missing UUID", manifestFailureMissingUUID,
+			func() []string { return writeManifest(`{"cluster_id":"cluster-1"}`) }, "manifest UUID is missing"),
+		Entry("missing cluster ID", manifestFailureMissingClusterID,
+			func() []string { return writeManifest(`{"uuid":"uuid-1"}`) }, "manifest cluster_id is missing"),
+	)
+
+	It("should not count a manifest that parses", func() {
+		totals := map[string]float64{}
+		for _, reason := range []string{manifestFailureNotFound, manifestFailureReadError, manifestFailureInvalidJSON, manifestFailureMissingUUID, manifestFailureMissingClusterID} {
+			totals[reason] = testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(reason))
+		}
+
+		_, err := extractor.findAndParseManifest(writeManifest(`{"uuid":"uuid-1","cluster_id":"cluster-1"}`), tempDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		for reason, total := range totals {
+			Expect(testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(reason))).To(Equal(total), "reason %s", reason)
+		}
+	})
+})
+
+var _ = Describe("Unknown manifest fields", func() {
+	var (
+		extractor *PayloadExtractor
+		tempDir   string
+	)
+
+	// The ROS file list under its camelCase name, a typo the lenient decoder silently drops
+	misspelled := `{"uuid":"uuid-1","cluster_id":"cluster-1","resourceOptimizationFiles":["ros.csv"]}`
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+		extractor = NewPayloadExtractor(tempDir, logger)
+	})
+
+	writeManifest := func(content string) []string {
+		Expect(os.WriteFile(filepath.Join(tempDir, "manifest.json"), []byte(content), 0644)).To(Succeed())
+		return []string{"manifest.json"}
+	}
+
+	It("should ignore unknown fields by default", func() {
+		manifest, err := extractor.findAndParseManifest(writeManifest(misspelled), tempDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.ResourceOptimizationFiles).To(BeEmpty())
+	})
+
+	Context("when strict", func() {
+		BeforeEach(func() {
+			extractor.strictManifestFields = true
+		})
+
+		It("should reject the manifest naming the unknown field", func() {
+			before := testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureUnknownField))
+
+			_, err := extractor.findAndParseManifest(writeManifest(misspelled), tempDir)
+			var invalidErr *InvalidPayloadError
+			Expect(errors.As(err, &invalidErr)).To(BeTrue())
+			Expect(invalidErr.Reason).To(Equal(`manifest has unknown field "resourceOptimizationFiles"`))
+
+			Expect(testutil.ToFloat64(health.ManifestParseFailuresTotal.WithLabelValues(manifestFailureUnknownField))).To(Equal(before + 1))
+		})
+
+		It("should accept fields nested in cr_status", func() {
+			_, err := extractor.findAndParseManifest(writeManifest(`{"uuid":"uuid-1","cluster_id":"cluster-1","cr_status":{"anything":{"goes":true}}}`), tempDir)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should accept a payload from the current operator", func() {
+			payload, err := DefaultTestPayloadFactory().Build()
+			Expect(err).ToNot(HaveOccurred())
+
+			result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), uuid.New().String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Cleanup()).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Extraction directory count", func() {
+	var (
+		extractor *PayloadExtractor
+		tempDir   string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+		extractor = NewPayloadExtractor(tempDir, logger)
+	})
+
+	It("should reflect extraction directories as they are created and cleaned up", func() {
+		requestID := uuid.New().String()
+		first, err := extractor.createExtractionDir(requestID)
+		Expect(err).ToNot(HaveOccurred())
+		// A retry of the same request gets a uniquely suffixed directory
+		second, err := extractor.createExtractionDir(requestID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extractor.countExtractionDirs()).To(Equal(2))
+
+		extractor.cleanup(first)
+		Expect(extractor.countExtractionDirs()).To(Equal(1))
+		extractor.cleanup(second)
+		Expect(extractor.countExtractionDirs()).To(Equal(0))
+	})
+
+	It("should not count a directory left by a successful extraction once it is cleaned up", func() {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), uuid.New().String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(extractor.countExtractionDirs()).To(Equal(1))
+
+		Expect(result.Cleanup()).To(Succeed())
+		Expect(extractor.countExtractionDirs()).To(Equal(0))
+	})
+
+	It("should ignore entries that aren't extraction directories", func() {
+		Expect(os.Mkdir(filepath.Join(tempDir, "other-process"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tempDir, uuid.New().String()), []byte("file"), 0644)).To(Succeed())
+
+		Expect(extractor.countExtractionDirs()).To(Equal(0))
+	})
+
+	It("should report no directories when the temp dir doesn't exist yet", func() {
+		extractor.tempDir = filepath.Join(tempDir, "missing")
+		Expect(extractor.countExtractionDirs()).To(Equal(0))
+	})
+})
+
+var _ = Describe("Failed payload retention", func() {
+	var (
+		extractor *PayloadExtractor
+		tempDir   string
+		failedDir string
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir = GinkgoT().TempDir()
+		failedDir = filepath.Join(tempDir, failedPayloadsDir)
+		extractor = NewPayloadExtractor(tempDir, logger)
+		extractor.keepFailedFor = time.Hour
+	})
+
+	// keepAged keeps a failed extraction directory and backdates it by age
+	keepAged := func(age time.Duration) string {
+		dir, err := extractor.createExtractionDir(uuid.New().String())
+		Expect(err).ToNot(HaveOccurred())
+		extractor.discardFailed(dir)
+
+		kept := filepath.Join(failedDir, filepath.Base(dir))
+		modTime := time.Now().Add(-age)
+		Expect(os.Chtimes(kept, modTime, modTime)).To(Succeed())
+		return kept
+	}
+
+	It("should keep the extracted files of a payload that fails extraction", func() {
+		payload, err := DefaultTestPayloadFactory().WithoutROSFiles().Build()
+		Expect(err).ToNot(HaveOccurred())
+		requestID := uuid.New().String()
+
+		_, err = extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), requestID)
+		Expect(err).To(HaveOccurred())
+
+		Expect(filepath.Join(failedDir, requestID, "manifest.json")).To(BeAnExistingFile())
+		Expect(extractor.countExtractionDirs()).To(Equal(0))
+	})
+
+	It("should remove the extracted files of a successful extraction", func() {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), uuid.New().String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.Cleanup()).To(Succeed())
+
+		Expect(failedDir).ToNot(BeADirectory())
+	})
+
+	It("should remove failed payloads immediately when retention is disabled", func() {
+		extractor.keepFailedFor = 0
+		dir, err := extractor.createExtractionDir(uuid.New().String())
+		Expect(err).ToNot(HaveOccurred())
+
+		extractor.discardFailed(dir)
+
+		Expect(dir).ToNot(BeADirectory())
+		Expect(failedDir).ToNot(BeADirectory())
+	})
+
+	It("should reap failed payloads once their retention has passed", func() {
+		expired := keepAged(2 * time.Hour)
+		recent := keepAged(time.Minute)
+
+		extractor.reapFailed(time.Now())
+
+		Expect(expired).ToNot(BeADirectory())
+		Expect(recent).To(BeADirectory())
+	})
+
+	It("should remove the oldest failed payloads beyond the cap", func() {
+		extractor.maxFailedPayloads = 2
+		oldest := keepAged(3 * time.Minute)
+		older := keepAged(2 * time.Minute)
+		newest := keepAged(time.Minute)
+
+		extractor.reapFailed(time.Now())
+
+		Expect(oldest).ToNot(BeADirectory())
+		Expect(older).To(BeADirectory())
+		Expect(newest).To(BeADirectory())
+	})
+})
+
+var _ = Describe("CheckTempDir", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		tempDir = GinkgoT().TempDir()
+	})
+
+	It("should accept a writable directory without leaving anything behind", func() {
+		Expect(CheckTempDir(tempDir)).To(Succeed())
+
+		entries, err := os.ReadDir(tempDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should reject a missing directory rather than create it", func() {
+		missing := filepath.Join(tempDir, "missing")
+
+		err := CheckTempDir(missing)
+		Expect(err).To(MatchError(ContainSubstring("is not accessible")))
+		Expect(missing).ToNot(BeAnExistingFile())
+	})
+
+	It("should reject a path that isn't a directory", func() {
+		file := filepath.Join(tempDir, "file")
+		Expect(os.WriteFile(file, []byte("file"), 0644)).To(Succeed())
+
+		Expect(CheckTempDir(file)).To(MatchError(ContainSubstring("is not a directory")))
+	})
+
+	It("should reject a directory that can't be written to", func() {
+		if os.Geteuid() == 0 {
+			Skip("permissions are not enforced for root")
+		}
+		readOnly := filepath.Join(tempDir, "read-only")
+		Expect(os.Mkdir(readOnly, 0555)).To(Succeed())
+
+		Expect(CheckTempDir(readOnly)).To(MatchError(ContainSubstring("is not writable")))
+	})
+})
+
+var _ = Describe("Early rejection of manifests without ROS files", func() {
+	var (
+		extractor *PayloadExtractor
+		failedDir string
+		payload   []byte
+	)
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		tempDir := GinkgoT().TempDir()
+		failedDir = filepath.Join(tempDir, failedPayloadsDir)
+		extractor = NewPayloadExtractor(tempDir, logger)
+		extractor.rejectEmptyManifestEarly = true
+		// Keep the failed extraction so the files written before the rejection can be inspected
+		extractor.keepFailedFor = time.Hour
+
+		var err error
+		payload, err = DefaultTestPayloadFactory().
+			WithoutROSFiles().
+			WithExtraFile("cost-mgmt-ros-openshift-1.csv", "node,cpu_request\nnode1,100m\n").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject the payload before extracting the entries after the manifest", func() {
+		requestID := uuid.New().String()
+		_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), requestID)
+		Expect(err).To(MatchError(ErrInvalidPayload))
+		Expect(err.Error()).To(ContainSubstring("no ROS files specified in manifest"))
+
+		Expect(filepath.Join(failedDir, requestID, "manifest.json")).To(BeAnExistingFile())
+		Expect(filepath.Join(failedDir, requestID, "cost-mgmt-ros-openshift-1.csv")).ToNot(BeAnExistingFile())
+	})
+
+	It("should extract the whole archive when early rejection is disabled", func() {
+		extractor.rejectEmptyManifestEarly = false
+		requestID := uuid.New().String()
+		_, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), requestID)
+		Expect(err).To(MatchError(ContainSubstring("no ROS files specified in manifest")))
+		Expect(err).ToNot(MatchError(ErrInvalidPayload))
+
+		Expect(filepath.Join(failedDir, requestID, "cost-mgmt-ros-openshift-1.csv")).To(BeAnExistingFile())
+	})
+
+	It("should not reject early when ROS files are inferred from file names", func() {
+		extractor.rosFilePatterns = []string{"*ros-openshift*.csv"}
+		extracted, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), uuid.New().String())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(extracted.Cleanup)
+		Expect(extracted.ROSFiles).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Trailing data after the tar archive", func() {
+	var extractor *PayloadExtractor
+
+	BeforeEach(func() {
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		extractor = NewPayloadExtractor(GinkgoT().TempDir(), logger)
+		extractor.rejectTrailingData = true
+	})
+
+	// tarWithTrailingData re-compresses the tar archive of a valid payload followed by trailing
+	tarWithTrailingData := func(trailing []byte) []byte {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		gzReader, err := gzip.NewReader(bytes.NewReader(payload))
+		Expect(err).ToNot(HaveOccurred())
+		archive, err := io.ReadAll(gzReader)
+		Expect(err).ToNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		gzWriter := gzip.NewWriter(&buf)
+		_, err = gzWriter.Write(append(archive, trailing...))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gzWriter.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	extract := func(payload []byte) error {
+		extracted, err := extractor.ExtractPayload(context.Background(), bytes.NewReader(payload), uuid.New().String())
+		if err == nil {
+			DeferCleanup(extracted.Cleanup)
+		}
+		return err
+	}
+
+	It("should accept an archive without trailing data", func() {
+		Expect(extract(tarWithTrailingData(nil))).To(Succeed())
+	})
+
+	It("should accept extra zero padding", func() {
+		Expect(extract(tarWithTrailingData(make([]byte, 64*1024)))).To(Succeed())
+	})
+
+	It("should reject garbage after the tar archive", func() {
+		err := extract(tarWithTrailingData([]byte("garbage")))
+		Expect(err).To(MatchError(ErrInvalidPayload))
+		Expect(err.Error()).To(ContainSubstring("data after the end of the tar archive"))
+	})
+
+	It("should reject garbage after zero padding", func() {
+		trailing := append(make([]byte, 40*1024), 0x01)
+		Expect(extract(tarWithTrailingData(trailing))).To(MatchError(ErrInvalidPayload))
+	})
+
+	It("should reject garbage after the gzip stream", func() {
+		payload := append(tarWithTrailingData(nil), []byte("garbage after gzip")...)
+		err := extract(payload)
+		Expect(err).To(MatchError(ErrInvalidPayload))
+		Expect(err.Error()).To(ContainSubstring("data after the end of the gzip stream"))
+	})
+
+	It("should ignore trailing data by default", func() {
+		extractor.rejectTrailingData = false
+		Expect(extract(tarWithTrailingData([]byte("garbage")))).To(Succeed())
+		Expect(extract(append(tarWithTrailingData(nil), []byte("garbage after gzip")...))).To(Succeed())
 	})
 })
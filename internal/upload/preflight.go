@@ -0,0 +1,41 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
+)
+
+// HandlePreflight checks whether the caller would be allowed to upload, without a payload
+// It runs the same identity and authorization checks as HandleUpload and returns the
+// derived org and account so clients can fail fast before sending a large archive
+func (h *Handler) HandlePreflight(w http.ResponseWriter, r *http.Request) {
+	requestID := h.generateRequestID()
+	requestLogger := logger.WithRequestID(h.logger, requestID)
+
+	identity, err := h.extractIdentity(r)
+	if err != nil {
+		h.respondError(w, r, http.StatusUnauthorized, "Invalid or missing identity", requestLogger)
+		return
+	}
+
+	var response UploadData
+	if identity != nil {
+		requestLogger = logger.WithUploadContext(h.logger, requestID, identity.AccountNumber, identity.OrgID)
+		if status, message := h.authorizeIdentity(identity); status != 0 {
+			h.respondError(w, r, status, message, requestLogger)
+			return
+		}
+		response = UploadData{
+			Account: identity.AccountNumber,
+			OrgID:   identity.OrgID,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		requestLogger.WithError(err).Error("Failed to encode response")
+	}
+}
@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+var _ = Describe("HandlePreflight", func() {
+	newHandler := func(authConfig config.AuthConfig) *Handler {
+		cfg := newTestConfig()
+		cfg.Auth = authConfig
+		handler, _, _ := newTestHandler(cfg)
+		return handler
+	}
+
+	preflight := func(handler *Handler, user *authenticationv1.UserInfo) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/preflight", nil)
+		if user != nil {
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthenticatedUserKey, *user))
+		}
+		recorder := httptest.NewRecorder()
+		handler.HandlePreflight(recorder, req)
+		return recorder
+	}
+
+	user := &authenticationv1.UserInfo{
+		Username: "test-user",
+		Groups:   []string{"org:12345", "account:67890"},
+	}
+
+	It("should return the derived identity for an accepted caller", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, AllowedOrgs: []string{"12345"}})
+
+		recorder := preflight(handler, user)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var response UploadData
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response).To(Equal(UploadData{Account: "67890", OrgID: "12345"}))
+	})
+
+	It("should count refused preflight checks under their own method and route", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, AllowedOrgs: []string{"99999"}})
+		forbidden := health.HTTPRequestsTotal.WithLabelValues(http.MethodPost, "/preflight", "403")
+		before := testutil.ToFloat64(forbidden)
+
+		Expect(preflight(handler, user).Code).To(Equal(http.StatusForbidden))
+		Expect(testutil.ToFloat64(forbidden)).To(Equal(before + 1))
+	})
+
+	It("should accept any org when no allow list is configured", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true})
+		Expect(preflight(handler, user).Code).To(Equal(http.StatusOK))
+	})
+
+	It("should reject an org that is not allowed to upload", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, AllowedOrgs: []string{"99999"}})
+
+		recorder := preflight(handler, user)
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(recorder.Body.String()).To(ContainSubstring("Organization is not allowed to upload"))
+	})
+
+	It("should reject non-numeric IDs when numeric IDs are required", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, RequireNumericIDs: true})
+
+		recorder := preflight(handler, &authenticationv1.UserInfo{Username: "test-user", Groups: []string{"org:acme"}})
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("should reject a caller carrying no org when an org ID is required", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, DefaultOrgID: "1", RequireOrgID: true})
+
+		recorder := preflight(handler, &authenticationv1.UserInfo{Username: "test-user", Groups: []string{"account:67890"}})
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should report the default org for a caller carrying none", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, DefaultOrgID: "fallback-org", DefaultAccount: "fallback-account"})
+
+		recorder := preflight(handler, &authenticationv1.UserInfo{Username: "test-user"})
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var response UploadData
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response).To(Equal(UploadData{Account: "fallback-account", OrgID: "fallback-org"}))
+	})
+
+	It("should return the identity from a trusted x-rh-identity header", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true, TrustRHIdentity: true})
+
+		req := httptest.NewRequest(http.MethodPost, "/preflight", nil)
+		req.Header.Set(auth.RHIdentityHeader, base64.StdEncoding.EncodeToString([]byte(`{"identity":{"org_id":"54321","account_number":"9876"}}`)))
+		recorder := httptest.NewRecorder()
+		handler.HandlePreflight(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var response UploadData
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response).To(Equal(UploadData{Account: "9876", OrgID: "54321"}))
+	})
+
+	It("should reject a request without an authenticated user", func() {
+		handler := newHandler(config.AuthConfig{Enabled: true})
+		Expect(preflight(handler, nil).Code).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,152 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+var _ = Describe("HandleUpload raw bodies", func() {
+	var (
+		producer *mocks.FakeProducer
+		payload  []byte
+	)
+
+	newHandler := func(acceptRawBody bool) *Handler {
+		cfg := newTestConfig()
+		cfg.Upload.AcceptRawBody = acceptRawBody
+
+		var handler *Handler
+		handler, _, producer = newTestHandler(cfg)
+		return handler
+	}
+
+	// newRawUploadRequest builds an authenticated upload request whose body is the archive itself
+	newRawUploadRequest := func(contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", contentType)
+		ctx := context.WithValue(req.Context(), auth.AuthenticatedUserKey, authenticationv1.UserInfo{
+			Username: "test-user",
+			Groups:   []string{"org:12345", "account:67890"},
+		})
+		ctx = context.WithValue(ctx, auth.OauthTokenKey, "test-token")
+		return req.WithContext(ctx)
+	}
+
+	upload := func(handler *Handler, req *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.HandleUpload(recorder, req)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		var err error
+		payload, err = DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("when raw bodies are accepted", func() {
+		var handler *Handler
+
+		BeforeEach(func() {
+			handler = newHandler(true)
+		})
+
+		It("should process a raw HCCM archive body", func() {
+			recorder := upload(handler, newRawUploadRequest("application/vnd.redhat.hccm.upload"))
+
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(producer.ROSEvents()).To(HaveLen(1))
+		})
+
+		It("should still process multipart uploads", func() {
+			recorder := upload(handler, newPayloadUploadRequest(payload))
+
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(producer.ROSEvents()).To(HaveLen(1))
+		})
+
+		It("should reject a raw body of an unsupported type", func() {
+			recorder := upload(handler, newRawUploadRequest("text/plain"))
+			Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+		})
+
+		It("should reject a raw body over the size limit", func() {
+			handler.config.Upload.MaxUploadSize = int64(len(payload)) - 1
+
+			recorder := upload(handler, newRawUploadRequest("application/vnd.redhat.hccm.upload"))
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(producer.ROSEvents()).To(BeEmpty())
+		})
+
+		It("should reject a raw body decoding to more than the size limit", func() {
+			handler.config.Upload.MaxUploadSize = int64(len(payload)) - 1
+			req := newRawUploadRequest("application/vnd.redhat.hccm.upload")
+			// A gzip encoded body is decoded past its declared length
+			req.ContentLength = int64(len(payload)) - 1
+
+			recorder := upload(handler, req)
+			Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(producer.ROSEvents()).To(BeEmpty())
+		})
+
+		It("should not hold an extraction slot while the raw body is received", func() {
+			bodyReader, bodyWriter := io.Pipe()
+			req := newRawUploadRequest("application/vnd.redhat.hccm.upload")
+			req.Body = bodyReader
+			req.ContentLength = int64(len(payload))
+
+			slow := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				slow <- upload(handler, req).Code
+			}()
+			// The write returns once the handler has read it, so the body is being received
+			_, err := bodyWriter.Write(payload[:len(payload)/2])
+			Expect(err).ToNot(HaveOccurred())
+
+			// The only extraction slot is still free for another upload
+			Expect(upload(handler, newPayloadUploadRequest(payload)).Code).To(Equal(http.StatusAccepted))
+
+			_, err = bodyWriter.Write(payload[len(payload)/2:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bodyWriter.Close()).To(Succeed())
+			Eventually(slow).Should(Receive(Equal(http.StatusAccepted)))
+		})
+
+		It("should remove the spooled raw body", func() {
+			Expect(upload(handler, newRawUploadRequest("application/vnd.redhat.hccm.upload")).Code).To(Equal(http.StatusAccepted))
+
+			spooled, err := filepath.Glob(filepath.Join(handler.config.Upload.TempDir, ".raw-*"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spooled).To(BeEmpty())
+		})
+
+		It("should require a Content-Length for raw bodies", func() {
+			req := newRawUploadRequest("application/vnd.redhat.hccm.upload")
+			req.ContentLength = -1
+
+			recorder := upload(handler, req)
+			Expect(recorder.Code).To(Equal(http.StatusLengthRequired))
+		})
+	})
+
+	Context("by default", func() {
+		It("should reject a raw body as a malformed multipart form", func() {
+			handler := newHandler(false)
+
+			recorder := upload(handler, newRawUploadRequest("application/vnd.redhat.hccm.upload"))
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(producer.ROSEvents()).To(BeEmpty())
+		})
+	})
+})
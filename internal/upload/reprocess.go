@@ -0,0 +1,190 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/storage"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	"github.com/sirupsen/logrus"
+)
+
+// reprocessNamespace seeds the deterministic request IDs of reprocessed payloads
+var reprocessNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("insights-ros-ingress/reprocess"))
+
+// rawArchivePrefix is the object key prefix of raw payload archives, the only objects that can be reprocessed
+const rawArchivePrefix = "raw/"
+
+// Metadata of stored payload archives identifying their original upload, lowercased as storage returns it
+const (
+	archiveMetadataOrgID         = "orgid"
+	archiveMetadataAccountNumber = "accountnumber"
+)
+
+// ReprocessRequest identifies a stored payload archive to run through the pipeline again
+// The org and account come from the archive's metadata, and must match it when set
+type ReprocessRequest struct {
+	ObjectKey     string `json:"object_key"`
+	OrgID         string `json:"org_id"`
+	AccountNumber string `json:"account_number,omitempty"`
+}
+
+// HandleReprocess downloads a stored payload archive and reruns extraction, upload and publishing
+// It is restricted to internal users, and reprocessing the same object always uses the same request ID
+func (h *Handler) HandleReprocess(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	requestLogger := logger.WithRequestID(h.logger, "")
+
+	defer func() {
+		health.HTTPRequestDuration.WithLabelValues(r.Method, "/internal/reprocess").Observe(time.Since(start).Seconds())
+	}()
+
+	caller, err := h.extractIdentity(r)
+	if err != nil || caller == nil || caller.User == nil || !caller.User.Internal {
+		h.respondError(w, r, http.StatusForbidden, "Reprocessing is restricted to internal users", requestLogger)
+		return
+	}
+
+	var req ReprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, r, http.StatusBadRequest, "Invalid reprocess request", requestLogger)
+		return
+	}
+	if req.ObjectKey == "" {
+		h.respondError(w, r, http.StatusBadRequest, "object_key is required", requestLogger)
+		return
+	}
+	if !isRawArchiveKey(req.ObjectKey) {
+		h.respondError(w, r, http.StatusBadRequest, "object_key must name a raw payload archive", requestLogger)
+		return
+	}
+
+	metadata, err := h.storageClient.Metadata(r.Context(), req.ObjectKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			h.respondError(w, r, http.StatusNotFound, "Payload object not found", requestLogger)
+			return
+		}
+		h.respondError(w, r, http.StatusInternalServerError, "Failed to read payload metadata", requestLogger)
+		requestLogger.WithError(err).Error("Payload metadata lookup failed")
+		return
+	}
+	// The org can't be taken from the request, an archive without one isn't known to belong to it
+	orgID, accountNumber := metadata[archiveMetadataOrgID], metadata[archiveMetadataAccountNumber]
+	if orgID == "" {
+		h.respondError(w, r, http.StatusUnprocessableEntity, "Payload archive carries no upload metadata", requestLogger)
+		return
+	}
+	if req.OrgID != "" && req.OrgID != orgID {
+		h.respondError(w, r, http.StatusBadRequest, "org_id does not match the payload's org", requestLogger)
+		return
+	}
+	if req.AccountNumber != "" && req.AccountNumber != accountNumber {
+		h.respondError(w, r, http.StatusBadRequest, "account_number does not match the payload's account", requestLogger)
+		return
+	}
+
+	payloadIdentity := &identity.Identity{
+		AccountNumber: accountNumber,
+		OrgID:         orgID,
+		Type:          "System",
+		AuthType:      "oauth2",
+		Internal: identity.Internal{
+			OrgID: orgID,
+		},
+	}
+
+	requestID := reprocessRequestID(req.ObjectKey)
+	requestLogger = logger.WithUploadContext(h.logger, requestID, accountNumber, orgID).
+		WithFields(logrus.Fields{
+			"object_key":   req.ObjectKey,
+			"requested_by": caller.User.Username,
+		})
+	requestLogger.Info("Received reprocess request")
+
+	// Reprocessing must not get around the checks the payload's org is subject to on upload
+	if status, message := h.authorizeIdentity(payloadIdentity); status != 0 {
+		h.respondError(w, r, status, message, requestLogger)
+		return
+	}
+
+	payload, err := h.storageClient.Download(r.Context(), req.ObjectKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			h.respondError(w, r, http.StatusNotFound, "Payload object not found", requestLogger)
+			return
+		}
+		h.respondError(w, r, http.StatusInternalServerError, "Failed to download payload", requestLogger)
+		requestLogger.WithError(err).Error("Payload download failed")
+		return
+	}
+	defer func() {
+		if err := payload.Close(); err != nil {
+			requestLogger.WithError(err).Warn("Failed to close downloaded payload")
+		}
+	}()
+
+	// Events carry the payload's identity, never the internal caller's token. No token is archived,
+	// so in the token format they carry none
+	ctx := context.WithValue(r.Context(), auth.OauthTokenKey, "")
+
+	h.statuses.Set(requestID, orgID, StatusProcessing, "")
+	if _, err := h.processUpload(ctx, payload, requestID, "", payloadIdentity, requestLogger); err != nil {
+		h.statuses.Set(requestID, orgID, StatusFailed, err.Error())
+		var invalidErr *InvalidPayloadError
+		if errors.As(err, &invalidErr) {
+			h.respondError(w, r, http.StatusUnprocessableEntity, "Invalid payload: "+invalidErr.Reason, requestLogger)
+			return
+		}
+		if errors.Is(err, ErrROSBytesExceeded) {
+			h.respondError(w, r, http.StatusRequestEntityTooLarge, "ROS files exceed the maximum total size", requestLogger)
+			return
+		}
+		if errors.Is(err, storage.ErrObjectExists) {
+			h.respondError(w, r, http.StatusConflict, "Reprocessed files conflict with existing objects", requestLogger)
+			return
+		}
+		h.respondError(w, r, http.StatusInternalServerError, "Failed to reprocess payload", requestLogger)
+		requestLogger.WithError(err).Error("Payload reprocessing failed")
+		return
+	}
+	h.statuses.Set(requestID, orgID, StatusSucceeded, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	response := UploadResponse{
+		RequestID: requestID,
+		Upload: UploadData{
+			Account: accountNumber,
+			OrgID:   orgID,
+		},
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		requestLogger.WithError(err).Error("Failed to encode response")
+	}
+
+	requestLogger.Info("Payload reprocessed successfully")
+}
+
+// isRawArchiveKey reports whether objectKey names an object under the raw archive prefix,
+// without path elements that could point elsewhere
+func isRawArchiveKey(objectKey string) bool {
+	return strings.HasPrefix(objectKey, rawArchivePrefix) &&
+		len(objectKey) > len(rawArchivePrefix) &&
+		path.Clean(objectKey) == objectKey
+}
+
+// reprocessRequestID derives a stable request ID from the object key so repeated
+// reprocessing of the same payload is correlated downstream instead of fanning out
+func reprocessRequestID(objectKey string) string {
+	return uuid.NewSHA1(reprocessNamespace, []byte(objectKey)).String()
+}
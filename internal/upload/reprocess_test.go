@@ -0,0 +1,183 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/config"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/messaging/mocks"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+var _ = Describe("HandleReprocess", func() {
+	var (
+		handler  *Handler
+		store    *fakeObjectStore
+		producer *mocks.FakeProducer
+	)
+
+	BeforeEach(func() {
+		storageClient, objectStore := newFakeStorage()
+		store = objectStore
+		producer = mocks.NewFakeProducer()
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.FatalLevel)
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = true
+		cfg.Upload.StatusTTL = 3600
+		cfg.Upload.ReprocessEnabled = true
+		handler = NewHandler(cfg, storageClient, producer, logger)
+	})
+
+	reprocess := func(user authenticationv1.UserInfo, body ReprocessRequest) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(body)
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest(http.MethodPost, "/internal/reprocess", bytes.NewReader(payload))
+		ctx := context.WithValue(req.Context(), auth.AuthenticatedUserKey, user)
+		ctx = context.WithValue(ctx, auth.OauthTokenKey, "token-"+user.Username)
+		recorder := httptest.NewRecorder()
+		handler.HandleReprocess(recorder, req.WithContext(ctx))
+		return recorder
+	}
+
+	internalUser := authenticationv1.UserInfo{Username: "operator", Groups: []string{"internal"}}
+
+	// archiveMetadata is the upload metadata a raw payload archive is stored with
+	archiveMetadata := map[string]string{"OrgId": "12345", "AccountNumber": "67890"}
+
+	It("should reject callers that are not internal users", func() {
+		external := authenticationv1.UserInfo{Username: "customer", Groups: []string{"org:12345"}}
+
+		recorder := reprocess(external, ReprocessRequest{ObjectKey: "raw/payload.tar.gz", OrgID: "12345"})
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should require an object key", func() {
+		recorder := reprocess(internalUser, ReprocessRequest{OrgID: "12345"})
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	DescribeTable("should only reprocess raw payload archives",
+		func(objectKey string) {
+			store.PutWithMetadata("test-bucket/"+objectKey, []byte("payload"), archiveMetadata)
+
+			recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: objectKey})
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring("object_key must name a raw payload archive"))
+			Expect(producer.ROSEvents()).To(BeEmpty())
+		},
+		Entry("stored ROS file", "ros/org_12345/ros-data.csv"),
+		Entry("parent path element", "raw/../ros/org_12345/ros-data.csv"),
+		Entry("prefix alone", "raw/"),
+		Entry("absolute key", "/raw/payload.tar.gz"),
+	)
+
+	It("should refuse an archive without its upload metadata, whatever org the request names", func() {
+		store.Put("test-bucket/raw/payload.tar.gz", []byte("payload"))
+
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/payload.tar.gz", OrgID: "12345"})
+		Expect(recorder.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(recorder.Body.String()).To(ContainSubstring("Payload archive carries no upload metadata"))
+		Expect(producer.ROSEvents()).To(BeEmpty())
+	})
+
+	It("should count refused requests as POST /internal/reprocess", func() {
+		refused := health.HTTPRequestsTotal.WithLabelValues(http.MethodPost, "/internal/reprocess", "400")
+		before := testutil.ToFloat64(refused)
+
+		Expect(reprocess(internalUser, ReprocessRequest{}).Code).To(Equal(http.StatusBadRequest))
+		Expect(testutil.ToFloat64(refused)).To(Equal(before + 1))
+	})
+
+	It("should return 404 when the raw payload object is missing", func() {
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/missing.tar.gz", OrgID: "12345"})
+		Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		Expect(handler.statuses.statuses).To(BeEmpty())
+	})
+
+	It("should process a stored payload and publish its events", func() {
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		store.PutWithMetadata("test-bucket/raw/payload.tar.gz", payload, archiveMetadata)
+
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/payload.tar.gz", OrgID: "12345", AccountNumber: "67890"})
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		var response UploadResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.RequestID).To(Equal(reprocessRequestID("raw/payload.tar.gz")))
+
+		rosEvents := producer.ROSEvents()
+		Expect(rosEvents).To(HaveLen(1))
+		Expect(rosEvents[0].RequestID).To(Equal(response.RequestID))
+		Expect(rosEvents[0].Metadata.OrgID).To(Equal("12345"))
+		Expect(rosEvents[0].Metadata.Account).To(Equal("67890"))
+		Expect(rosEvents[0].B64Identity).To(BeEmpty())
+		Expect(producer.ValidationMessages()).To(HaveLen(1))
+
+		status, found := handler.statuses.Get(response.RequestID)
+		Expect(found).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusSucceeded))
+	})
+
+	It("should reprocess under the identity stored with the archive", func() {
+		handler.config.Kafka.IdentityFormat = config.IdentityFormatRHIdentity
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		store.PutWithMetadata("test-bucket/raw/payload.tar.gz", payload, archiveMetadata)
+
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/payload.tar.gz"})
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		rosEvents := producer.ROSEvents()
+		Expect(rosEvents).To(HaveLen(1))
+		Expect(rosEvents[0].Metadata.OrgID).To(Equal("12345"))
+		Expect(rosEvents[0].Metadata.Account).To(Equal("67890"))
+
+		decoded, err := base64.StdEncoding.DecodeString(rosEvents[0].B64Identity)
+		Expect(err).ToNot(HaveOccurred())
+		var xrhid identity.XRHID
+		Expect(json.Unmarshal(decoded, &xrhid)).To(Succeed())
+		Expect(xrhid.Identity.OrgID).To(Equal("12345"))
+		Expect(xrhid.Identity.AccountNumber).To(Equal("67890"))
+	})
+
+	It("should reject an org that doesn't match the archive's", func() {
+		store.PutWithMetadata("test-bucket/raw/payload.tar.gz", []byte("payload"), map[string]string{"OrgId": "12345"})
+
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/payload.tar.gz", OrgID: "99999"})
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(producer.ROSEvents()).To(BeEmpty())
+	})
+
+	It("should reject orgs that may not upload", func() {
+		handler.config.Auth.DeniedOrgs = []string{"12345"}
+		payload, err := DefaultTestPayloadFactory().Build()
+		Expect(err).ToNot(HaveOccurred())
+		store.PutWithMetadata("test-bucket/raw/payload.tar.gz", payload, archiveMetadata)
+
+		recorder := reprocess(internalUser, ReprocessRequest{ObjectKey: "raw/payload.tar.gz", OrgID: "12345"})
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(producer.ROSEvents()).To(BeEmpty())
+		Expect(handler.statuses.statuses).To(BeEmpty())
+	})
+
+	It("should derive the same request ID for the same object", func() {
+		first := reprocessRequestID("raw/payload.tar.gz")
+		Expect(reprocessRequestID("raw/payload.tar.gz")).To(Equal(first))
+		Expect(reprocessRequestID("raw/other.tar.gz")).ToNot(Equal(first))
+	})
+})
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/logger"
+)
+
+// Processing states recorded in the status store
+const (
+	StatusProcessing = "processing"
+	StatusSucceeded  = "succeeded"
+	StatusFailed     = "failed"
+	// StatusQueued is a stored upload whose events failed to publish and are left to the outbox relay
+	StatusQueued = "queued"
+)
+
+// UploadStatus represents the processing state of an upload
+type UploadStatus struct {
+	RequestID string    `json:"request_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	OrgID     string    `json:"-"`
+}
+
+// MarshalJSON encodes UpdatedAt in the configured timestamp format
+func (s UploadStatus) MarshalJSON() ([]byte, error) {
+	type plain UploadStatus
+	return json.Marshal(struct {
+		plain
+		UpdatedAt logger.Timestamp `json:"updated_at"`
+	}{plain(s), logger.Timestamp(s.UpdatedAt)})
+}
+
+// StatusStore keeps upload statuses in memory for a limited time
+type StatusStore struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	statuses     map[string]UploadStatus
+	lastEviction time.Time
+	now          func() time.Time
+}
+
+// statusEvictionInterval bounds how often Set sweeps expired entries
+const statusEvictionInterval = time.Minute
+
+// NewStatusStore creates a status store that forgets entries after ttl
+func NewStatusStore(ttl time.Duration) *StatusStore {
+	return &StatusStore{
+		ttl:      ttl,
+		statuses: make(map[string]UploadStatus),
+		now:      time.Now,
+	}
+}
+
+// Set records the status of a request, replacing any previous state
+func (s *StatusStore) Set(requestID, orgID, status, errMessage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.evictExpired(now)
+	s.statuses[requestID] = UploadStatus{
+		RequestID: requestID,
+		Status:    status,
+		Error:     errMessage,
+		UpdatedAt: now,
+		OrgID:     orgID,
+	}
+}
+
+// Get returns the status of a request if it is known and not expired
+func (s *StatusStore) Get(requestID string) (UploadStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.statuses[requestID]
+	if !ok {
+		return UploadStatus{}, false
+	}
+	if s.now().Sub(status.UpdatedAt) > s.ttl {
+		delete(s.statuses, requestID)
+		return UploadStatus{}, false
+	}
+	return status, true
+}
+
+// evictExpired removes entries older than the TTL, callers must hold the lock
+func (s *StatusStore) evictExpired(now time.Time) {
+	if now.Sub(s.lastEviction) < statusEvictionInterval {
+		return
+	}
+	s.lastEviction = now
+
+	for requestID, status := range s.statuses {
+		if now.Sub(status.UpdatedAt) > s.ttl {
+			delete(s.statuses, requestID)
+		}
+	}
+}
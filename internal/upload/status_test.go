@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"time"
+
+	"github.com/RedHatInsights/insights-ros-ingress/internal/auth"
+	"github.com/RedHatInsights/insights-ros-ingress/internal/health"
+	"github.com/go-chi/chi/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+var _ = Describe("StatusStore", func() {
+	var (
+		store *StatusStore
+		now   time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		store = NewStatusStore(time.Hour)
+		store.now = func() time.Time { return now }
+	})
+
+	It("should report unknown request IDs as not found", func() {
+		_, ok := store.Get("missing")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should track a request through processing to succeeded", func() {
+		store.Set("req-1", "org-1", StatusProcessing, "")
+		status, ok := store.Get("req-1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusProcessing))
+		Expect(status.OrgID).To(Equal("org-1"))
+
+		now = now.Add(time.Second)
+		store.Set("req-1", "org-1", StatusSucceeded, "")
+		status, ok = store.Get("req-1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusSucceeded))
+		Expect(status.Error).To(BeEmpty())
+		Expect(status.UpdatedAt).To(Equal(now))
+	})
+
+	It("should record the error detail for failed requests", func() {
+		store.Set("req-1", "org-1", StatusProcessing, "")
+		store.Set("req-1", "org-1", StatusFailed, "failed to extract payload")
+
+		status, ok := store.Get("req-1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Status).To(Equal(StatusFailed))
+		Expect(status.Error).To(Equal("failed to extract payload"))
+	})
+
+	It("should expire statuses after the TTL", func() {
+		store.Set("req-1", "org-1", StatusSucceeded, "")
+
+		now = now.Add(59 * time.Minute)
+		_, ok := store.Get("req-1")
+		Expect(ok).To(BeTrue())
+
+		now = now.Add(2 * time.Minute)
+		_, ok = store.Get("req-1")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should sweep expired statuses when new ones are recorded", func() {
+		store.Set("req-1", "org-1", StatusSucceeded, "")
+
+		now = now.Add(2 * time.Hour)
+		store.Set("req-2", "org-1", StatusProcessing, "")
+
+		Expect(store.statuses).ToNot(HaveKey("req-1"))
+		Expect(store.statuses).To(HaveKey("req-2"))
+	})
+})
+
+var _ = Describe("HandleStatus", func() {
+	var (
+		handler *Handler
+		router  *chi.Mux
+	)
+
+	newHandler := func(authEnabled bool) {
+		cfg := newTestConfig()
+		cfg.Auth.Enabled = authEnabled
+		handler, _, _ = newTestHandler(cfg)
+		router = chi.NewRouter()
+		router.Post("/upload", handler.HandleUpload)
+		router.Get("/status/{requestID}", handler.HandleStatus)
+	}
+
+	getStatus := func(requestID string, user *authenticationv1.UserInfo) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/status/"+requestID, nil)
+		if user != nil {
+			req = req.WithContext(context.WithValue(req.Context(), auth.AuthenticatedUserKey, *user))
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should return 404 for unknown request IDs", func() {
+		newHandler(false)
+
+		recorder := getStatus("unknown", nil)
+		Expect(recorder.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should return the recorded status as JSON", func() {
+		newHandler(false)
+		handler.statuses.Set("req-1", "", StatusSucceeded, "")
+
+		recorder := getStatus("req-1", nil)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var status map[string]interface{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+		Expect(status).To(HaveKeyWithValue("request_id", "req-1"))
+		Expect(status).To(HaveKeyWithValue("status", StatusSucceeded))
+		Expect(status).ToNot(HaveKey("org_id"))
+	})
+
+	It("should hide statuses belonging to another organization", func() {
+		newHandler(true)
+		handler.statuses.Set("req-1", "org-1", StatusSucceeded, "")
+
+		owner := &authenticationv1.UserInfo{Username: "owner", Groups: []string{"org:org-1"}}
+		Expect(getStatus("req-1", owner).Code).To(Equal(http.StatusOK))
+
+		other := &authenticationv1.UserInfo{Username: "other", Groups: []string{"org:org-2"}}
+		Expect(getStatus("req-1", other).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should answer unauthenticated callers alike for known and unknown request IDs", func() {
+		newHandler(true)
+		handler.statuses.Set("req-1", "org-1", StatusSucceeded, "")
+
+		Expect(getStatus("req-1", nil).Code).To(Equal(http.StatusUnauthorized))
+		Expect(getStatus("unknown", nil).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should count refused status requests under their own method and route", func() {
+		newHandler(true)
+		unauthorized := health.HTTPRequestsTotal.WithLabelValues(http.MethodGet, "/status/{requestID}", "401")
+		before := testutil.ToFloat64(unauthorized)
+		uploads := testutil.ToFloat64(health.HTTPRequestsTotal.WithLabelValues(http.MethodPost, "/upload", "401"))
+
+		Expect(getStatus("req-1", nil).Code).To(Equal(http.StatusUnauthorized))
+		Expect(testutil.ToFloat64(unauthorized)).To(Equal(before + 1))
+		Expect(testutil.ToFloat64(health.HTTPRequestsTotal.WithLabelValues(http.MethodPost, "/upload", "401"))).To(Equal(uploads))
+	})
+
+	It("should record a failed status when the upload cannot be processed", func() {
+		newHandler(false)
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Disposition", `form-data; name="file"; filename="payload.tar.gz"`)
+		partHeader.Set("Content-Type", "application/vnd.redhat.hccm.upload")
+		part, err := writer.CreatePart(partHeader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = part.Write([]byte("not a tarball"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		Expect(recorder.Code).ToNot(Equal(http.StatusAccepted))
+
+		Expect(handler.statuses.statuses).To(HaveLen(1))
+		for _, status := range handler.statuses.statuses {
+			Expect(status.Status).To(Equal(StatusFailed))
+			Expect(status.Error).ToNot(BeEmpty())
+		}
+	})
+})